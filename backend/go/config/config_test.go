@@ -0,0 +1,150 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// env is a fake environment for Load.
+type env map[string]string
+
+func (e env) get(k string) string { return e[k] }
+
+func writeFile(t *testing.T, name, body string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(body), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	path := writeFile(t, "turbo.yaml", `
+addr: ":1000"
+log:
+  level: debug
+bus:
+  nsq:
+    max_attempts: 3
+    concurrency: 2
+`)
+	e := env{"ADDR": ":2000", "NSQ_MAX_ATTEMPTS": "4"}
+	c, rest, err := Load("server", []string{"-config", path, "-addr", ":3000", "extra"}, e.get)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Addr != ":3000" {
+		t.Errorf("addr = %q, want the flag's :3000", c.Addr)
+	}
+	if c.Bus.NSQ.MaxAttempts != 4 {
+		t.Errorf("max_attempts = %d, want the environment's 4", c.Bus.NSQ.MaxAttempts)
+	}
+	if c.Bus.NSQ.Concurrency != 2 || c.Log.Level != "debug" {
+		t.Errorf("concurrency, level = %d, %q, want the file's 2, debug", c.Bus.NSQ.Concurrency, c.Log.Level)
+	}
+	if c.ShutdownTimeout != Default().ShutdownTimeout {
+		t.Errorf("shutdown_timeout = %s, want the default", c.ShutdownTimeout)
+	}
+	if len(rest) != 1 || rest[0] != "extra" {
+		t.Errorf("remaining args = %q", rest)
+	}
+}
+
+func TestLoadSources(t *testing.T) {
+	path := writeFile(t, "turbo.toml", "addr = \":1000\"\n[notify]\nidle_after = \"1m\"\n")
+	e := env{
+		"TURBO_CONFIG": path,
+		// the first variable listed for a setting wins
+		"DATABASE_URL": "postgres://db/first",
+		"POSTGRES_URL": "postgres://db/second",
+		"ADMIN_EMAILS": "a@example.com, b@example.com",
+	}
+	c, _, err := Load("server", nil, e.get)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Addr != ":1000" || c.Notify.IdleAfter != time.Minute {
+		t.Errorf("TOML from TURBO_CONFIG not applied: addr %q, idle_after %s", c.Addr, c.Notify.IdleAfter)
+	}
+	if string(c.Store.URL) != "postgres://db/first" {
+		t.Errorf("store.url = %q, want DATABASE_URL's", string(c.Store.URL))
+	}
+	if fmt.Sprint(c.AdminEmails) != "[a@example.com b@example.com]" {
+		t.Errorf("admin_emails = %q", c.AdminEmails)
+	}
+
+	if _, _, err := Load("server", nil, env{"TURBO_CONFIG": writeFile(t, "typo.yaml", "adr: \":1\"\n")}.get); err == nil {
+		t.Error("unknown file key accepted")
+	}
+	if _, _, err := Load("server", nil, env{"NSQ_MAX_ATTEMPTS": "lots"}.get); err == nil || !strings.Contains(err.Error(), "NSQ_MAX_ATTEMPTS") {
+		t.Errorf("bad environment value: %v", err)
+	}
+}
+
+func TestBusDefault(t *testing.T) {
+	c, _, err := Load("server", []string{"-store.kind", "memory"}, env{}.get)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Bus.Kind != "memory" {
+		t.Errorf("memory store picked bus %q", c.Bus.Kind)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	c, _, err := Load("server", nil, env{}.get)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Validate(); err != nil {
+		t.Errorf("defaults: %v", err)
+	}
+
+	c.Env = "production"
+	err = c.Validate()
+	if err == nil || !strings.Contains(err.Error(), "jwt_secret") || !strings.Contains(err.Error(), "store.url") {
+		t.Errorf("production with development secrets: %v", err)
+	}
+
+	c, _, _ = Load("server", []string{"-bus.nsq.concurrency", "0", "-log.level", "loud"}, env{}.get)
+	err = c.Validate()
+	for _, key := range []string{"bus.nsq.concurrency", "log.level"} {
+		if err == nil || !strings.Contains(err.Error(), key) {
+			t.Errorf("Validate() = %v, want it to report %s", err, key)
+		}
+	}
+}
+
+func TestRedaction(t *testing.T) {
+	e := env{"JWT_SECRET": "jwt-hunter2", "DATABASE_URL": "postgres://u:db-hunter2@db/turbo", "SMTP_PASSWORD": "smtp-hunter2"}
+	c, _, err := Load("server", nil, e.get)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	if err := c.Print(&b); err != nil {
+		t.Fatal(err)
+	}
+	out := b.String()
+	if strings.Contains(out, "hunter2") {
+		t.Errorf("Print leaked a secret:\n%s", out)
+	}
+	if !strings.Contains(out, "jwt_secret: '[redacted]'") && !strings.Contains(out, `jwt_secret: "[redacted]"`) {
+		t.Errorf("Print didn't redact jwt_secret:\n%s", out)
+	}
+	if got := fmt.Sprintf("%v %s", c.JWTSecret, c.Store.URL); strings.Contains(got, "hunter2") {
+		t.Errorf("formatting leaked a secret: %s", got)
+	}
+	if string(c.JWTSecret) != "jwt-hunter2" {
+		t.Error("the secret itself was changed")
+	}
+	if Secret("").String() != "" {
+		t.Error("an unset secret prints as set")
+	}
+}
@@ -0,0 +1,67 @@
+package turbo
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// viewer resolves the caller to a users row; tokens carry only one of id
+// and email in some setups.
+func (s *Server) viewer(ctx context.Context, u *user) (*user, error) {
+	rec, err := s.store.Users().Resolve(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+	return &user{ID: rec.ID, Email: rec.Email}, nil
+}
+
+// lookupRef finds a user by id, email or @handle.
+func (s *Server) lookupRef(ctx context.Context, ref string) (*user, error) {
+	rec, err := s.store.Users().Lookup(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+	return &user{ID: rec.ID, Email: rec.Email}, nil
+}
+
+// parseConversation turns a conversation filter into the conversation id
+// history and search filter by: nil for any, 0 for the public room. It
+// accepts "public", a conversation id, the "room:N", "group:N" and "dm:a,b"
+// keys clients see on events, "#name", "@user" and "dm:user". A DM peer the
+// viewer has never talked to matches nothing.
+func (s *Server) parseConversation(ctx context.Context, me *user, in string) (*int64, error) {
+	var id int64
+	switch {
+	case in == "":
+		return nil, nil
+	case in == "public":
+		return &id, nil
+	case strings.HasPrefix(in, "#"):
+		id, err := s.store.Conversations().RoomID(ctx, in[1:])
+		return &id, err
+	}
+	for _, prefix := range []string{"room:", "group:", "conversation:", ""} {
+		if n, err := strconv.ParseInt(strings.TrimPrefix(in, prefix), 10, 64); err == nil && strings.HasPrefix(in, prefix) {
+			return &n, nil
+		}
+	}
+	ref := strings.TrimPrefix(in, "dm:")
+	if a, b, ok := strings.Cut(ref, ","); ok {
+		ref = a
+		if me != nil && (a == strconv.FormatInt(me.ID, 10) || strings.EqualFold(a, me.Email)) {
+			ref = b
+		}
+	}
+	peer, err := s.lookupRef(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+	id, err = s.store.Conversations().DirectID(ctx, directKey(me.ID, peer.ID))
+	if errors.Is(err, errNotFound) {
+		id = -1
+		return &id, nil
+	}
+	return &id, err
+}
@@ -0,0 +1,115 @@
+package turbo
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// topicChat carries chat frames between instances for broadcast.
+const topicChat = "chat"
+
+// BusMessage is one delivery from the bus to a subscriber. Attempts counts
+// deliveries on backends that redeliver (NSQ) and is zero elsewhere.
+type BusMessage struct {
+	Topic    string
+	Body     []byte
+	Attempts int
+}
+
+// BusHandler processes one delivery. Returning an error tells backends that
+// support redelivery to try again later; wrap it with permanent when a retry
+// can't help, e.g. the body doesn't parse.
+type BusHandler func(ctx context.Context, m *BusMessage) error
+
+// permanentError marks a handler failure that must not be retried.
+type permanentError struct{ err error }
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// permanent wraps err so backends dead-letter the message immediately.
+func permanent(err error) error { return &permanentError{err: err} }
+
+func isPermanent(err error) bool {
+	var p *permanentError
+	return errors.As(err, &p)
+}
+
+// Bus moves realtime events between instances. Every instance subscribed to
+// a topic receives every message published to it, including its own.
+type Bus interface {
+	Publish(ctx context.Context, topic string, body []byte) error
+	// Subscribe registers h for topic; call it before serving traffic.
+	Subscribe(topic string, h BusHandler) error
+	// Close stops subscriptions and flushes pending publishes within ctx.
+	Close(ctx context.Context) error
+}
+
+// BusOptions selects and configures the bus built by NewBus. Empty
+// addresses fall back to each backend's local default.
+type BusOptions struct {
+	// Kind is nsq (default), redis, nats, postgres or memory.
+	Kind string
+	// Instance is this replica's id (see InstanceID); NSQ names its channel
+	// after it and dead letters record it.
+	Instance        string
+	NSQDAddrs       []string
+	NSQLookupdAddrs []string
+	NSQ             NSQOptions
+	RedisAddr       string
+	RedisPassword   string
+	NATSURL         string
+	// Logger defaults to the standard logger.
+	Logger *slog.Logger
+	// Metrics, if set, receives the NSQ bus's publish and consume counters.
+	Metrics prometheus.Registerer
+}
+
+// NewBus builds the bus selected by opts.Kind. The in-process bus needs no
+// infrastructure and only reaches clients on this instance, which suits
+// single-node runs and tests. The postgres bus needs the Postgres store;
+// store also receives NSQ's dead letters.
+func NewBus(ctx context.Context, opts BusOptions, store Store) (Bus, error) {
+	logger := opts.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	switch opts.Kind {
+	case "", "nsq":
+		nsqds := opts.NSQDAddrs
+		if len(nsqds) == 0 {
+			nsqds = []string{"localhost:4150"}
+		}
+		nopts := opts.NSQ
+		nopts.deadLetter = func(ctx context.Context, m *BusMessage, cause error) {
+			if err := store.DeadLetters().Record(ctx, opts.Instance, m, cause); err != nil {
+				logger.Error("dead letter", "err", err)
+			}
+		}
+		m, err := newNSQMetrics(opts.Metrics)
+		if err != nil {
+			return nil, err
+		}
+		nopts.metrics = m
+		return newNSQBus(nsqds, opts.NSQLookupdAddrs, opts.Instance, nopts, logger)
+	case "redis":
+		return newRedisBus(ctx, cmp.Or(opts.RedisAddr, "localhost:6379"), opts.RedisPassword, logger)
+	case "nats":
+		return newNATSBus(cmp.Or(opts.NATSURL, "nats://localhost:4222"), opts.Instance, logger)
+	case "postgres", "pg":
+		pg, ok := store.(*pgStore)
+		if !ok {
+			return nil, errors.New("the postgres bus needs the Postgres store")
+		}
+		return newPGBus(pg.pool, logger), nil
+	case "memory":
+		return newMemBus(logger), nil
+	default:
+		return nil, fmt.Errorf("unknown bus %q", opts.Kind)
+	}
+}
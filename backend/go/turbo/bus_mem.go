@@ -0,0 +1,47 @@
+package turbo
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+)
+
+// memBus is an in-process Bus. Publish delivers synchronously to the
+// handlers on this instance only.
+type memBus struct {
+	mu       sync.RWMutex
+	handlers map[string][]BusHandler
+	log      *slog.Logger
+}
+
+func newMemBus(logger *slog.Logger) *memBus {
+	return &memBus{handlers: make(map[string][]BusHandler), log: logger}
+}
+
+func (b *memBus) Publish(ctx context.Context, topic string, body []byte) error {
+	b.mu.RLock()
+	hs := b.handlers[topic]
+	b.mu.RUnlock()
+	for _, h := range hs {
+		// handlers may hold on to the body; give each its own copy
+		m := &BusMessage{Topic: topic, Body: append([]byte(nil), body...)}
+		if err := h(ctx, m); err != nil {
+			b.log.ErrorContext(ctx, "memory bus: handler failed", "topic", topic, "err", err)
+		}
+	}
+	return nil
+}
+
+func (b *memBus) Subscribe(topic string, h BusHandler) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.handlers[topic] = append(b.handlers[topic], h)
+	return nil
+}
+
+func (b *memBus) Close(context.Context) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.handlers = make(map[string][]BusHandler)
+	return nil
+}
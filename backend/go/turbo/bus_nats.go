@@ -0,0 +1,58 @@
+package turbo
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// natsBus is a Bus on core NATS subjects. Plain subscriptions (not queue
+// groups) give every instance its own copy of each message.
+type natsBus struct {
+	nc  *nats.Conn
+	log *slog.Logger
+}
+
+func newNATSBus(url, instance string, logger *slog.Logger) (*natsBus, error) {
+	nc, err := nats.Connect(url,
+		nats.Name("turbo-"+instance),
+		nats.MaxReconnects(-1),
+		nats.ReconnectWait(time.Second),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &natsBus{nc: nc, log: logger}, nil
+}
+
+func (b *natsBus) Publish(_ context.Context, topic string, body []byte) error {
+	return b.nc.Publish(topic, body)
+}
+
+func (b *natsBus) Subscribe(topic string, h BusHandler) error {
+	_, err := b.nc.Subscribe(topic, func(m *nats.Msg) {
+		if err := h(context.Background(), &BusMessage{Topic: m.Subject, Body: m.Data}); err != nil {
+			b.log.Error("nats bus: handler failed", "topic", topic, "err", err)
+		}
+	})
+	return err
+}
+
+// Close drains subscriptions and flushes buffered publishes before closing.
+func (b *natsBus) Close(ctx context.Context) error {
+	closed := make(chan struct{})
+	b.nc.SetClosedHandler(func(*nats.Conn) { close(closed) })
+	if err := b.nc.Drain(); err != nil {
+		b.nc.Close()
+		return err
+	}
+	select {
+	case <-closed:
+		return nil
+	case <-ctx.Done():
+		b.nc.Close()
+		return ctx.Err()
+	}
+}
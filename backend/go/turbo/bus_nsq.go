@@ -0,0 +1,256 @@
+package turbo
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	nsq "github.com/nsqio/go-nsq"
+)
+
+// channelUnsafe matches characters NSQ doesn't allow in channel names.
+var channelUnsafe = regexp.MustCompile(`[^.a-zA-Z0-9_-]`)
+
+// InstanceID returns a unique id for this replica. name (or the pod
+// hostname) keeps it readable in nsqadmin; the random suffix keeps it unique
+// across restarts.
+func InstanceID(name string) string {
+	if name == "" {
+		name, _ = os.Hostname()
+	}
+	if name == "" {
+		name = "turbo"
+	}
+	var b [4]byte
+	_, _ = rand.Read(b[:])
+	return name + "-" + hex.EncodeToString(b[:])
+}
+
+// instanceChannel returns this replica's own ephemeral channel. Every channel
+// on a topic receives a copy of each message, so one channel per instance
+// gives full fan-out; ephemeral channels are deleted by nsqd once the
+// instance disconnects instead of piling up messages for dead pods.
+func instanceChannel(id string) string {
+	const suffix = "#ephemeral"
+	name := channelUnsafe.ReplaceAllString(id, "_")
+	if max := 64 - len(suffix); len(name) > max {
+		name = name[len(name)-max:]
+	}
+	return name + suffix
+}
+
+// producerPool publishes through one of several nsqd nodes, starting at a
+// rotating offset and failing over to the next node on error.
+type producerPool struct {
+	producers []*nsq.Producer
+	next      atomic.Uint32
+	stopOnce  sync.Once
+	log       *slog.Logger
+	metrics   *nsqMetrics
+}
+
+func newProducerPool(addrs []string, cfg *nsq.Config, metrics *nsqMetrics, logger *slog.Logger) (*producerPool, error) {
+	if len(addrs) == 0 {
+		return nil, errors.New("no nsqd addresses")
+	}
+	p := &producerPool{log: logger, metrics: metrics}
+	for _, addr := range addrs {
+		prod, err := nsq.NewProducer(addr, cfg)
+		if err != nil {
+			p.Stop()
+			return nil, fmt.Errorf("%s: %w", addr, err)
+		}
+		p.producers = append(p.producers, prod)
+	}
+	return p, nil
+}
+
+// Publish sends body to topic on the first nsqd node that accepts it.
+func (p *producerPool) Publish(topic string, body []byte) error {
+	n := len(p.producers)
+	start := int(p.next.Add(1)) % n
+	var errs []error
+	for i := 0; i < n; i++ {
+		prod := p.producers[(start+i)%n]
+		err := prod.Publish(topic, body)
+		if err == nil {
+			p.metrics.published.WithLabelValues(topic).Inc()
+			return nil
+		}
+		p.log.Warn("nsq: publish failed", "nsqd", prod.String(), "err", err)
+		errs = append(errs, err)
+	}
+	p.metrics.publishErrors.WithLabelValues(topic).Inc()
+	return errors.Join(errs...)
+}
+
+// Stop closes every producer connection.
+func (p *producerPool) Stop() {
+	p.stopOnce.Do(func() {
+		for _, prod := range p.producers {
+			prod.Stop()
+		}
+	})
+}
+
+// nsqBus is the NSQ Bus: publishes go through a producerPool and each
+// subscribed topic gets a consumer on this instance's ephemeral channel.
+type nsqBus struct {
+	prod     *producerPool
+	nsqds    []string
+	lookupds []string
+	channel  string
+	opts     NSQOptions
+	log      *slog.Logger
+
+	mu        sync.Mutex
+	consumers []*nsq.Consumer
+}
+
+// NSQOptions tunes delivery and redelivery for NSQ consumers.
+type NSQOptions struct {
+	// MaxInFlight is how many messages nsqd may push before they are finished.
+	MaxInFlight int
+	// Concurrency is the number of handler goroutines per topic.
+	Concurrency int
+	// MaxAttempts is how many deliveries a message gets before it is
+	// dead-lettered instead of requeued, defaultNSQMaxAttempts if zero.
+	MaxAttempts int
+	// RequeueDelay grows linearly with attempts up to MaxRequeueDelay.
+	RequeueDelay    time.Duration
+	MaxRequeueDelay time.Duration
+	// deadLetter records a message that won't be retried.
+	deadLetter func(ctx context.Context, m *BusMessage, cause error)
+	// metrics counts publishes and deliveries; unregistered if nil
+	metrics *nsqMetrics
+}
+
+// defaultNSQMaxAttempts bounds redelivery when NSQOptions doesn't.
+const defaultNSQMaxAttempts = 5
+
+func newNSQBus(nsqds, lookupds []string, instance string, opts NSQOptions, logger *slog.Logger) (*nsqBus, error) {
+	if opts.metrics == nil {
+		opts.metrics, _ = newNSQMetrics(nil)
+	}
+	prod, err := newProducerPool(nsqds, nsq.NewConfig(), opts.metrics, logger)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Concurrency < 1 {
+		opts.Concurrency = 1
+	}
+	if opts.MaxAttempts < 1 {
+		opts.MaxAttempts = defaultNSQMaxAttempts
+	}
+	return &nsqBus{prod: prod, nsqds: nsqds, lookupds: lookupds, channel: instanceChannel(instance), opts: opts, log: logger}, nil
+}
+
+func (b *nsqBus) Publish(_ context.Context, topic string, body []byte) error {
+	return b.prod.Publish(topic, body)
+}
+
+// Subscribe consumes topic on this instance's own channel so every replica
+// gets a copy of every message. A handler error requeues the message with a
+// delay growing linearly with its attempts; permanent errors and messages
+// at MaxAttempts are dead-lettered instead.
+//
+// Messages are finished and requeued by hand rather than by returning the
+// handler's error, which would also put the whole consumer into go-nsq's
+// backoff: one bad message shouldn't slow delivery of every other event.
+func (b *nsqBus) Subscribe(topic string, h BusHandler) error {
+	cfg := nsq.NewConfig()
+	cfg.MaxInFlight = b.opts.MaxInFlight
+	// MaxAttempts is enforced below, where exhausted messages are
+	// dead-lettered; go-nsq's own limit would finish them silently
+	cfg.MaxAttempts = 0
+	if b.opts.RequeueDelay > 0 {
+		cfg.DefaultRequeueDelay = b.opts.RequeueDelay
+	}
+	if b.opts.MaxRequeueDelay > 0 {
+		cfg.MaxRequeueDelay = b.opts.MaxRequeueDelay
+	}
+	c, err := nsq.NewConsumer(topic, b.channel, cfg)
+	if err != nil {
+		return err
+	}
+	c.AddConcurrentHandlers(nsq.HandlerFunc(func(m *nsq.Message) error {
+		m.DisableAutoResponse()
+		ctx := context.Background()
+		bm := &BusMessage{Topic: topic, Body: m.Body, Attempts: int(m.Attempts)}
+		err := h(ctx, bm)
+		b.opts.metrics.consumed.WithLabelValues(topic).Inc()
+		if err == nil {
+			m.Finish()
+			return nil
+		}
+		b.opts.metrics.consumeErrors.WithLabelValues(topic).Inc()
+		if isPermanent(err) || bm.Attempts >= b.opts.MaxAttempts {
+			b.deadLetter(ctx, bm, err)
+			m.Finish()
+			return nil
+		}
+		b.log.Warn("nsq: requeueing", "topic", topic, "attempt", bm.Attempts, "err", err)
+		// -1 is go-nsq's linear RequeueDelay * attempts, capped at MaxRequeueDelay
+		m.RequeueWithoutBackoff(-1)
+		return nil
+	}), b.opts.Concurrency)
+	if err := connectConsumer(c, b.lookupds, b.nsqds); err != nil {
+		c.Stop()
+		return err
+	}
+	b.log.Info("nsq: consuming", "topic", topic, "channel", b.channel)
+	b.mu.Lock()
+	b.consumers = append(b.consumers, c)
+	b.mu.Unlock()
+	return nil
+}
+
+// deadLetter hands m to the dead-letter hook, which keeps it in the store
+// for inspection and replay. It isn't republished to NSQ: a topic nobody
+// consumes would only pile up in nsqd.
+func (b *nsqBus) deadLetter(ctx context.Context, m *BusMessage, cause error) {
+	b.log.Error("nsq: dead-lettering", "topic", m.Topic, "attempts", m.Attempts, "err", cause)
+	if b.opts.deadLetter != nil {
+		b.opts.deadLetter(ctx, m, cause)
+	}
+}
+
+// Close stops the consumers, waiting for in-flight handlers, then the
+// producers. Publish is synchronous, so there is nothing left to flush once
+// callers have stopped publishing.
+func (b *nsqBus) Close(ctx context.Context) error {
+	b.mu.Lock()
+	consumers := b.consumers
+	b.consumers = nil
+	b.mu.Unlock()
+	for _, c := range consumers {
+		c.Stop()
+	}
+	var err error
+	for _, c := range consumers {
+		select {
+		case <-c.StopChan:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	}
+	b.prod.Stop()
+	return err
+}
+
+// connectConsumer attaches c to the cluster, via nsqlookupd discovery when
+// lookupd addresses are configured and directly to the nsqd nodes otherwise.
+func connectConsumer(c *nsq.Consumer, lookupds, nsqds []string) error {
+	if len(lookupds) > 0 {
+		return c.ConnectToNSQLookupds(lookupds)
+	}
+	return c.ConnectToNSQDs(nsqds)
+}
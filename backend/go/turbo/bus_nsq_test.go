@@ -0,0 +1,43 @@
+package turbo
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/nsqio/go-nsq"
+)
+
+func TestInstanceID(t *testing.T) {
+	a, b := InstanceID("backend-1"), InstanceID("backend-1")
+	if a == b {
+		t.Errorf("two replicas named alike share id %s", a)
+	}
+	if !strings.HasPrefix(a, "backend-1-") {
+		t.Errorf("InstanceID(backend-1) = %s, want the name kept", a)
+	}
+	if InstanceID("") == "" {
+		t.Error("no id without a name")
+	}
+}
+
+func TestInstanceChannel(t *testing.T) {
+	long := strings.Repeat("pod", 30) + "-a1b2c3d4"
+	for _, id := range []string{
+		"backend-1-a1b2c3d4",
+		"turbo.local-00ff00ff",
+		"pod name/with:odd@chars-a1b2c3d4",
+		long,
+	} {
+		ch := instanceChannel(id)
+		if !nsq.IsValidChannelName(ch) || !strings.HasSuffix(ch, "#ephemeral") {
+			t.Errorf("instanceChannel(%q) = %q, not a valid ephemeral channel", id, ch)
+		}
+		// the random suffix is what tells replicas apart, so it survives
+		if !strings.Contains(ch, id[len(id)-8:]) {
+			t.Errorf("instanceChannel(%q) = %q lost the instance suffix", id, ch)
+		}
+	}
+	if a, b := instanceChannel(InstanceID(long)), instanceChannel(InstanceID(long)); a == b {
+		t.Errorf("two replicas share channel %s", a)
+	}
+}
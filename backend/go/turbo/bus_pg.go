@@ -0,0 +1,105 @@
+package turbo
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// pgNotifyLimit is Postgres' maximum NOTIFY payload size in bytes.
+const pgNotifyLimit = 8000
+
+// pgBus is a Bus on Postgres LISTEN/NOTIFY, for deployments that want
+// multi-instance fan-out without running a broker. Each subscribed topic
+// holds one dedicated connection taken out of the pool.
+type pgBus struct {
+	db     *pgxpool.Pool
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	log    *slog.Logger
+}
+
+func newPGBus(db *pgxpool.Pool, logger *slog.Logger) *pgBus {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &pgBus{db: db, ctx: ctx, cancel: cancel, log: logger}
+}
+
+func (b *pgBus) Publish(ctx context.Context, topic string, body []byte) error {
+	if len(body) >= pgNotifyLimit {
+		return fmt.Errorf("pg bus: payload of %d bytes exceeds NOTIFY limit", len(body))
+	}
+	_, err := b.db.Exec(ctx, `SELECT pg_notify($1, $2)`, topic, string(body))
+	return err
+}
+
+func (b *pgBus) Subscribe(topic string, h BusHandler) error {
+	conn, err := b.listen(topic)
+	if err != nil {
+		return err
+	}
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		for {
+			n, err := conn.WaitForNotification(b.ctx)
+			if err == nil {
+				if err := h(b.ctx, &BusMessage{Topic: n.Channel, Body: []byte(n.Payload)}); err != nil {
+					b.log.Error("pg bus: handler failed", "topic", topic, "err", err)
+				}
+				continue
+			}
+			conn.Close(context.Background())
+			if b.ctx.Err() != nil {
+				return
+			}
+			// connection lost: keep retrying until LISTEN is back
+			b.log.Error("pg bus: listen", "topic", topic, "err", err)
+			for conn == nil || conn.IsClosed() {
+				select {
+				case <-b.ctx.Done():
+					return
+				case <-time.After(time.Second):
+				}
+				if conn, err = b.listen(topic); err != nil {
+					b.log.Error("pg bus: relisten", "topic", topic, "err", err)
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// listen takes a connection out of the pool and LISTENs on topic with it.
+func (b *pgBus) listen(topic string) (*pgx.Conn, error) {
+	pc, err := b.db.Acquire(b.ctx)
+	if err != nil {
+		return nil, err
+	}
+	conn := pc.Hijack()
+	if _, err := conn.Exec(b.ctx, "LISTEN "+pgx.Identifier{topic}.Sanitize()); err != nil {
+		conn.Close(context.Background())
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (b *pgBus) Close(ctx context.Context) error {
+	b.cancel()
+	done := make(chan struct{})
+	go func() {
+		b.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
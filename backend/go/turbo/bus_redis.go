@@ -0,0 +1,78 @@
+package turbo
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// redisBus is a Bus on Redis pub/sub. Delivery is at-most-once: messages
+// published while an instance is disconnected are not replayed to it.
+type redisBus struct {
+	rdb *redis.Client
+	log *slog.Logger
+
+	mu   sync.Mutex
+	subs []*redis.PubSub
+	wg   sync.WaitGroup
+}
+
+func newRedisBus(ctx context.Context, addr, password string, logger *slog.Logger) (*redisBus, error) {
+	rdb := redis.NewClient(&redis.Options{Addr: addr, Password: password})
+	if err := rdb.Ping(ctx).Err(); err != nil {
+		_ = rdb.Close()
+		return nil, err
+	}
+	return &redisBus{rdb: rdb, log: logger}, nil
+}
+
+func (b *redisBus) Publish(ctx context.Context, topic string, body []byte) error {
+	return b.rdb.Publish(ctx, topic, body).Err()
+}
+
+func (b *redisBus) Subscribe(topic string, h BusHandler) error {
+	ctx := context.Background()
+	ps := b.rdb.Subscribe(ctx, topic)
+	// wait for the subscription confirmation so nothing published after
+	// Subscribe returns is missed
+	if _, err := ps.Receive(ctx); err != nil {
+		_ = ps.Close()
+		return err
+	}
+	b.mu.Lock()
+	b.subs = append(b.subs, ps)
+	b.mu.Unlock()
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		// the channel is closed by ps.Close; go-redis reconnects underneath
+		for msg := range ps.Channel() {
+			if err := h(ctx, &BusMessage{Topic: msg.Channel, Body: []byte(msg.Payload)}); err != nil {
+				b.log.Error("redis bus: handler failed", "topic", topic, "err", err)
+			}
+		}
+	}()
+	return nil
+}
+
+func (b *redisBus) Close(ctx context.Context) error {
+	b.mu.Lock()
+	subs := b.subs
+	b.subs = nil
+	b.mu.Unlock()
+	for _, ps := range subs {
+		_ = ps.Close()
+	}
+	done := make(chan struct{})
+	go func() {
+		b.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+	return b.rdb.Close()
+}
@@ -0,0 +1,91 @@
+package turbo
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewBus(t *testing.T) {
+	ctx := context.Background()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	if b, err := NewBus(ctx, BusOptions{Kind: "memory", Logger: logger}, nil); err != nil {
+		t.Errorf("memory bus: %v", err)
+	} else {
+		_ = b.Close(ctx)
+	}
+	for _, kind := range []string{"kafka", "postgres"} {
+		if _, err := NewBus(ctx, BusOptions{Kind: kind, Logger: logger}, NewMemoryStore(nil)); err == nil {
+			t.Errorf("%s bus on the memory store: no error", kind)
+		}
+	}
+}
+
+func TestMemBus(t *testing.T) {
+	ctx := context.Background()
+	b := newMemBus(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	var got []string
+	record := func(name string) BusHandler {
+		return func(_ context.Context, m *BusMessage) error {
+			got = append(got, name+":"+m.Topic+":"+string(m.Body))
+			// a handler keeping the body must not see it change
+			m.Body[0] = 'X'
+			return nil
+		}
+	}
+	_ = b.Subscribe("chat", record("a"))
+	_ = b.Subscribe("chat", record("b"))
+	_ = b.Subscribe("other", record("c"))
+	_ = b.Subscribe("chat", func(context.Context, *BusMessage) error { return errors.New("handler failed") })
+
+	body := []byte("hello")
+	if err := b.Publish(ctx, "chat", body); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+	if want := "a:chat:hello b:chat:hello"; strings.Join(got, " ") != want || string(body) != "hello" {
+		t.Errorf("delivered %q, body %q; want %q", got, body, want)
+	}
+
+	got = nil
+	_ = b.Close(ctx)
+	if err := b.Publish(ctx, "chat", body); err != nil || len(got) != 0 {
+		t.Errorf("after close: %v, delivered %q", err, got)
+	}
+}
+
+func TestPGBusNotifyLimit(t *testing.T) {
+	// refused before it reaches the database, so no pool is needed
+	b := newPGBus(nil, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	defer b.Close(context.Background())
+	if err := b.Publish(context.Background(), topicChat, make([]byte, pgNotifyLimit)); err == nil {
+		t.Errorf("published %d bytes, over the NOTIFY limit", pgNotifyLimit)
+	}
+}
+
+func TestPGBus(t *testing.T) {
+	st, _ := testPostgres(t)
+	b := newPGBus(st.(*pgStore).pool, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	defer b.Close(context.Background())
+	got := make(chan string, 1)
+	if err := b.Subscribe("turbo_test", func(_ context.Context, m *BusMessage) error {
+		got <- string(m.Body)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Publish(context.Background(), "turbo_test", []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case body := <-got:
+		if body != "hello" {
+			t.Errorf("got %q", body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no notification")
+	}
+}
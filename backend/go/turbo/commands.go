@@ -0,0 +1,439 @@
+package turbo
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// commandPattern is what bot command names may look like.
+var commandPattern = regexp.MustCompile(`^[a-z][a-z0-9_-]{0,31}$`)
+
+// commandCall is one invocation of a slash command.
+type commandCall struct {
+	user *user
+	// name is the command without its slash, args the rest of the line
+	name, args string
+	// frame is the message frame the command was typed into; it carries the
+	// conversation or DM recipient the command applies to
+	frame map[string]any
+	// conv is that conversation, nil in the public room
+	conv *conversation
+}
+
+// ephemeral is a reply shown only to the connection that ran the command.
+func ephemeral(c *commandCall, text string) map[string]any {
+	return map[string]any{"type": "ephemeral", "command": "/" + c.name, "text": text}
+}
+
+// slashCommand is a built-in command. run returns the ephemeral reply, if
+// any; commands that post do so through storeMessage like any message.
+type slashCommand struct {
+	usage string
+	help  string
+	run   func(s *Server, ctx context.Context, c *commandCall) (map[string]any, error)
+}
+
+// builtinCommands is the registry of commands handled in-process. Bots add
+// more at runtime through /api/commands; built-ins win on a name clash.
+var builtinCommands map[string]*slashCommand
+
+func init() {
+	builtinCommands = map[string]*slashCommand{
+		"me":     {usage: "/me <action>", help: "Post an action, like \"waves\"", run: cmdMe},
+		"shrug":  {usage: "/shrug [message]", help: `Append ¯\_(ツ)_/¯ to your message`, run: cmdShrug},
+		"topic":  {usage: "/topic [new topic]", help: "Show or set the room topic", run: cmdTopic},
+		"invite": {usage: "/invite @user", help: "Add someone to this room", run: cmdInvite},
+		"mute":   {usage: "/mute [off]", help: "Stop or resume notifications for this conversation", run: cmdMute},
+		"remind": {usage: "/remind <me|@user> [in] <duration> <text>", help: "Send a reminder later, e.g. /remind me in 10m stand up", run: cmdRemind},
+		"help":   {usage: "/help", help: "List commands", run: cmdHelp},
+	}
+}
+
+// parseCommand splits "/name args" into its parts. A leading "//" escapes the
+// slash so messages can start with one; ok is false for anything that isn't
+// a command.
+func parseCommand(text string) (name, args string, ok bool) {
+	if !strings.HasPrefix(text, "/") || strings.HasPrefix(text, "//") {
+		return "", "", false
+	}
+	name, args, _ = strings.Cut(text[1:], " ")
+	name = strings.ToLower(name)
+	if name == "" {
+		return "", "", false
+	}
+	return name, strings.TrimSpace(args), true
+}
+
+// runCommand dispatches a "/" message frame. Unknown commands come back as
+// an ephemeral error rather than being posted.
+func (s *Server) runCommand(ctx context.Context, u *user, msg map[string]any, name, args string) (map[string]any, error) {
+	conv, err := resolveConversation(ctx, s.store, u, msg)
+	if err != nil {
+		return nil, err
+	}
+	c := &commandCall{user: u, name: name, args: args, frame: msg, conv: conv}
+	if cmd, ok := builtinCommands[name]; ok {
+		return cmd.run(s, ctx, c)
+	}
+	reply, err := s.runBotCommand(ctx, c)
+	if errors.Is(err, errNotFound) {
+		return ephemeral(c, fmt.Sprintf("Unknown command /%s. Try /help.", name)), nil
+	}
+	return reply, err
+}
+
+// post stores text as a message in the conversation the command came from.
+func (s *Server) post(ctx context.Context, c *commandCall, text string, extra map[string]any, opts *storeOpts) error {
+	msg := map[string]any{"type": "message", "text": text}
+	for _, k := range []string{"conversation", "room", "to", "recipient"} {
+		if v, ok := c.frame[k]; ok {
+			msg[k] = v
+		}
+	}
+	for k, v := range extra {
+		msg[k] = v
+	}
+	return s.storeMessage(ctx, c.user, msg, opts)
+}
+
+func cmdMe(s *Server, ctx context.Context, c *commandCall) (map[string]any, error) {
+	if c.args == "" {
+		return ephemeral(c, "Usage: /me <action>"), nil
+	}
+	return nil, s.post(ctx, c, c.args, nil, &storeOpts{Subtype: "me"})
+}
+
+func cmdShrug(s *Server, ctx context.Context, c *commandCall) (map[string]any, error) {
+	text := `¯\_(ツ)_/¯`
+	if c.args != "" {
+		text = c.args + " " + text
+	}
+	return nil, s.post(ctx, c, text, nil, nil)
+}
+
+func cmdTopic(s *Server, ctx context.Context, c *commandCall) (map[string]any, error) {
+	if c.conv == nil || c.conv.Kind == kindDirect {
+		return ephemeral(c, "Topics are only available in rooms and groups."), nil
+	}
+	if c.args == "" {
+		conv, err := s.store.Conversations().Get(ctx, c.conv.ID)
+		if err != nil {
+			return nil, err
+		}
+		if conv.Topic == nil || *conv.Topic == "" {
+			return ephemeral(c, "No topic is set."), nil
+		}
+		return ephemeral(c, "Topic: "+*conv.Topic), nil
+	}
+	if !s.canManage(ctx, c.conv, c.user) {
+		return ephemeral(c, "Only the room's creator or an admin can set its topic."), nil
+	}
+	if err := s.store.Conversations().SetTopic(ctx, c.conv.ID, c.args); err != nil {
+		return nil, err
+	}
+	return nil, s.publishTo(ctx, "topic", c.conv.key(), c.conv.Members, map[string]any{"type": "topic", "conversation_id": c.conv.ID, "topic": c.args, "by": c.user.ID})
+}
+
+func cmdInvite(s *Server, ctx context.Context, c *commandCall) (map[string]any, error) {
+	if c.conv == nil || c.conv.Kind == kindDirect {
+		return ephemeral(c, "Invites are only available in rooms and groups."), nil
+	}
+	if c.args == "" {
+		return ephemeral(c, "Usage: /invite @user"), nil
+	}
+	if !s.canManage(ctx, c.conv, c.user) {
+		return ephemeral(c, "Only the room's creator or an admin can invite people."), nil
+	}
+	id, name, err := lookupUser(ctx, s.store, strings.Fields(c.args)[0])
+	if errors.Is(err, errNotFound) {
+		return ephemeral(c, "No user "+c.args+"."), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	joined, err := s.store.Conversations().Join(ctx, c.conv.ID, id)
+	if err != nil {
+		return nil, err
+	}
+	if !joined {
+		return ephemeral(c, name+" is already here."), nil
+	}
+	members := append(slices.Clone(c.conv.Members), id)
+	if err := s.publishTo(ctx, "member_joined", c.conv.key(), members, map[string]any{"type": "member_joined", "conversation_id": c.conv.ID, "user_id": id, "name": name, "by": c.user.ID}); err != nil {
+		return nil, err
+	}
+	return ephemeral(c, "Invited "+name+"."), nil
+}
+
+func cmdMute(s *Server, ctx context.Context, c *commandCall) (map[string]any, error) {
+	// the public room only ever notifies about mentions
+	if c.conv == nil {
+		return ephemeral(c, "Only rooms, groups and DMs can be muted."), nil
+	}
+	off := strings.EqualFold(c.args, "off")
+	muted := !off
+	if err := s.store.Conversations().UpdateParticipant(ctx, c.conv.ID, c.user.ID, nil, &muted, nil); err != nil {
+		return nil, err
+	}
+	if off {
+		return ephemeral(c, "Notifications for this conversation are back on."), nil
+	}
+	return ephemeral(c, "Muted. You won't be notified about this conversation; /mute off to undo."), nil
+}
+
+// parseReminderDelay reads durations like 10m, 1h30m or 2d.
+func parseReminderDelay(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(s)
+}
+
+func cmdRemind(s *Server, ctx context.Context, c *commandCall) (map[string]any, error) {
+	usage := ephemeral(c, "Usage: "+builtinCommands["remind"].usage)
+	f := strings.Fields(c.args)
+	if len(f) < 3 {
+		return usage, nil
+	}
+	who, rest := f[0], f[1:]
+	if rest[0] == "in" {
+		rest = rest[1:]
+	}
+	if len(rest) < 2 {
+		return usage, nil
+	}
+	delay, err := parseReminderDelay(rest[0])
+	if err != nil || delay <= 0 || delay > maxScheduleAhead {
+		return ephemeral(c, "Reminders take a duration like 10m, 2h or 3d, up to a year."), nil
+	}
+	text := strings.Join(rest[1:], " ")
+	if text, _ = strings.CutPrefix(text, "to "); text == "" {
+		return usage, nil
+	}
+	me, err := s.ownerID(ctx, c.user)
+	if err != nil {
+		return nil, err
+	}
+	target, name := me, "you"
+	if !strings.EqualFold(who, "me") {
+		target, name, err = lookupUser(ctx, s.store, who)
+		if errors.Is(err, errNotFound) {
+			return ephemeral(c, "No user "+who+"."), nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	switch err := s.checkReminder(ctx, me, target); {
+	case errors.Is(err, errNotReachable):
+		return ephemeral(c, "You can only remind people you share a conversation with."), nil
+	case errors.Is(err, errTooManyReminders):
+		return ephemeral(c, fmt.Sprintf("You already have %d reminders pending; cancel some at /api/scheduled.", maxPendingReminders)), nil
+	case err != nil:
+		return nil, err
+	}
+	frame := map[string]any{"text": text, "conversation": c.conv.key()}
+	if _, err := s.scheduleMessage(ctx, c.user, scheduledReminder, target, frame, s.now().Add(delay)); err != nil {
+		return nil, err
+	}
+	return ephemeral(c, fmt.Sprintf("OK, I'll remind %s in %s. Manage reminders at /api/scheduled.", name, delay)), nil
+}
+
+func cmdHelp(s *Server, ctx context.Context, c *commandCall) (map[string]any, error) {
+	names := make([]string, 0, len(builtinCommands))
+	for name := range builtinCommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&b, "%s — %s\n", builtinCommands[name].usage, builtinCommands[name].help)
+	}
+	bots, err := s.store.Commands().List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, bot := range bots {
+		if bot.Description != nil {
+			fmt.Fprintf(&b, "/%s — %s\n", bot.Name, *bot.Description)
+		} else {
+			fmt.Fprintf(&b, "/%s\n", bot.Name)
+		}
+	}
+	return ephemeral(c, strings.TrimSpace(b.String())), nil
+}
+
+// publishTo sends an unstored event to the given users' connections on every
+// instance.
+func (s *Server) publishTo(ctx context.Context, typ, conversation string, to []int64, payload map[string]any) error {
+	env := s.newEnvelope(ctx, typ, conversation, payload)
+	env.To = to
+	s.deliverLocal(env)
+	return s.bus.Publish(ctx, topicChat, []byte(mustJSON(env)))
+}
+
+// runBotCommand POSTs the invocation to the bot's callback URL, signed like
+// outgoing webhooks and, like them, only to public addresses. The bot answers {"text", "response_type"}; "in_channel"
+// posts the text under the bot's name on behalf of the invoking user,
+// anything else is an ephemeral reply. errNotFound means no such command.
+func (s *Server) runBotCommand(ctx context.Context, c *commandCall) (map[string]any, error) {
+	bot, err := s.store.Commands().Get(ctx, c.name)
+	if err != nil {
+		return nil, err
+	}
+	endpoint, secret, display := bot.URL, bot.Secret, bot.DisplayName
+	body := []byte(mustJSON(map[string]any{
+		"command":      "/" + c.name,
+		"text":         c.args,
+		"user_id":      c.user.ID,
+		"user_email":   c.user.Email,
+		"conversation": c.conv.key(),
+	}))
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	ts := s.now().Unix()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(string(body)))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Turbo-Event", "command")
+	req.Header.Set("X-Turbo-Timestamp", strconv.FormatInt(ts, 10))
+	req.Header.Set("X-Turbo-Signature", signWebhook(secret, ts, body))
+	resp, err := s.bots.Do(req)
+	if err != nil {
+		return ephemeral(c, fmt.Sprintf("/%s didn't respond.", c.name)), nil
+	}
+	defer resp.Body.Close()
+	var out struct {
+		Text         string `json:"text"`
+		ResponseType string `json:"response_type"`
+	}
+	if resp.StatusCode >= 300 || json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&out) != nil {
+		return ephemeral(c, fmt.Sprintf("/%s failed (%s).", c.name, resp.Status)), nil
+	}
+	if out.Text == "" {
+		return nil, nil
+	}
+	if out.ResponseType == "in_channel" {
+		opts := &storeOpts{DisplayName: "/" + c.name}
+		if display != nil && *display != "" {
+			opts.DisplayName = *display
+		}
+		return nil, s.post(ctx, c, out.Text, nil, opts)
+	}
+	return ephemeral(c, out.Text), nil
+}
+
+// handleCommands lists commands for autocompletion (GET, any user) and lets
+// integrators register (POST {"name", "url", "description", "display_name"})
+// or remove (DELETE ?name=) bot commands.
+func (s *Server) handleCommands(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	switch r.Method {
+	case http.MethodGet:
+		if s.authenticate(r, r.Header.Get("Authorization")) == nil {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		out := []map[string]any{}
+		for name, cmd := range builtinCommands {
+			out = append(out, map[string]any{"name": name, "usage": cmd.usage, "description": cmd.help, "builtin": true})
+		}
+		bots, err := s.store.Commands().List(ctx)
+		if err != nil {
+			s.internalError(w, r, "db", err)
+			return
+		}
+		for _, bot := range bots {
+			cmd := map[string]any{"name": bot.Name, "usage": "/" + bot.Name, "builtin": false}
+			if bot.Description != nil {
+				cmd["description"] = *bot.Description
+			}
+			out = append(out, cmd)
+		}
+		sort.Slice(out, func(i, j int) bool { return out[i]["name"].(string) < out[j]["name"].(string) })
+		_ = json.NewEncoder(w).Encode(out)
+
+	case http.MethodPost:
+		u := s.requireRole(w, r, roleIntegrator, roleAdmin)
+		if u == nil {
+			return
+		}
+		owner, err := s.ownerID(ctx, u)
+		if err != nil {
+			http.Error(w, "unknown user", http.StatusForbidden)
+			return
+		}
+		var body struct {
+			Name        string `json:"name"`
+			URL         string `json:"url"`
+			Description string `json:"description"`
+			DisplayName string `json:"display_name"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "bad json", http.StatusBadRequest)
+			return
+		}
+		body.Name = strings.ToLower(strings.TrimPrefix(body.Name, "/"))
+		if !commandPattern.MatchString(body.Name) || builtinCommands[body.Name] != nil {
+			http.Error(w, "bad name", http.StatusBadRequest)
+			return
+		}
+		if err := validUserURL(body.URL); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		secret := newWebhookSecret()
+		err = s.store.Commands().Create(ctx, &botCommand{Name: body.Name, URL: body.URL, Secret: secret, OwnerID: owner, Description: nonEmpty(body.Description), DisplayName: nonEmpty(body.DisplayName)})
+		if errors.Is(err, errConflict) {
+			http.Error(w, "name taken", http.StatusConflict)
+			return
+		}
+		if err != nil {
+			s.internalError(w, r, "db", err)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(w).Encode(map[string]any{"name": body.Name, "url": body.URL, "secret": secret})
+
+	case http.MethodDelete:
+		u := s.requireRole(w, r, roleIntegrator, roleAdmin)
+		if u == nil {
+			return
+		}
+		owner, err := s.ownerID(ctx, u)
+		if err != nil {
+			http.Error(w, "unknown user", http.StatusForbidden)
+			return
+		}
+		admin := s.userRole(ctx, u) == roleAdmin
+		err = s.store.Commands().Delete(ctx, strings.ToLower(r.URL.Query().Get("name")), owner, admin)
+		if errors.Is(err, errNotFound) {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			s.internalError(w, r, "db", err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "method", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,140 @@
+package turbo
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseCommand(t *testing.T) {
+	for _, tc := range []struct {
+		text, name, args string
+		ok               bool
+	}{
+		{"/me waves", "me", "waves", true},
+		{"/ME  waves  ", "me", "waves", true},
+		{"/help", "help", "", true},
+		{"/remind me in 10m stand up", "remind", "me in 10m stand up", true},
+		{"//etc/hosts is a file", "", "", false},
+		{"/", "", "", false},
+		{"/ leading space", "", "", false},
+		{"hello /me", "", "", false},
+		{"", "", "", false},
+	} {
+		name, args, ok := parseCommand(tc.text)
+		if name != tc.name || args != tc.args || ok != tc.ok {
+			t.Errorf("parseCommand(%q) = %q, %q, %t; want %q, %q, %t", tc.text, name, args, ok, tc.name, tc.args, tc.ok)
+		}
+	}
+}
+
+func TestParseReminderDelay(t *testing.T) {
+	for in, want := range map[string]time.Duration{
+		"10m":   10 * time.Minute,
+		"1h30m": 90 * time.Minute,
+		"2d":    48 * time.Hour,
+		"45s":   45 * time.Second,
+	} {
+		if got, err := parseReminderDelay(in); err != nil || got != want {
+			t.Errorf("parseReminderDelay(%q) = %s, %v; want %s", in, got, err, want)
+		}
+	}
+	for _, in := range []string{"", "soon", "d", "1.5d", "10"} {
+		if got, err := parseReminderDelay(in); err == nil {
+			t.Errorf("parseReminderDelay(%q) = %s, want an error", in, got)
+		}
+	}
+}
+
+func TestSlashEscape(t *testing.T) {
+	ts := newTestServer(t, nil)
+	token, _ := ts.signup("alice@example.com")
+	if code := ts.do(http.MethodPost, "/api/send", token, map[string]any{"text": "//etc/hosts is a file"}, nil); code != http.StatusAccepted {
+		t.Fatalf("send: %d", code)
+	}
+	var page historyPage
+	ts.do(http.MethodGet, "/api/messages", token, nil, &page)
+	if got := page.texts(); len(got) != 1 || got[0] != "/etc/hosts is a file" {
+		t.Errorf("stored %q, want the text with one slash", got)
+	}
+}
+
+func TestRemindCommand(t *testing.T) {
+	ts := newTestServer(t, nil)
+	token, _ := ts.signup("alice@example.com")
+	remind := func(text string) string {
+		t.Helper()
+		var reply struct {
+			Type string `json:"type"`
+			Text string `json:"text"`
+		}
+		if code := ts.do(http.MethodPost, "/api/send", token, map[string]any{"text": text}, &reply); code != http.StatusOK || reply.Type != "ephemeral" {
+			t.Fatalf("%s: %d %q", text, code, reply.Type)
+		}
+		return reply.Text
+	}
+
+	for _, text := range []string{"/remind", "/remind me", "/remind me in 10m", "/remind me 10m"} {
+		if got := remind(text); !strings.HasPrefix(got, "Usage:") {
+			t.Errorf("%s: %q, want usage", text, got)
+		}
+	}
+	for _, text := range []string{"/remind me in soon stretch", "/remind me in -5m stretch", "/remind me in 400d stretch"} {
+		if got := remind(text); !strings.Contains(got, "duration") {
+			t.Errorf("%s: %q, want a duration error", text, got)
+		}
+	}
+	if got := remind("/remind nobody@example.com in 1h stretch"); !strings.HasPrefix(got, "No user") {
+		t.Errorf("unknown user: %q", got)
+	}
+
+	before := time.Now()
+	if got := remind("/remind me in 1h30m to stand up"); !strings.HasPrefix(got, "OK") {
+		t.Fatalf("reminder not set: %q", got)
+	}
+	var rows []scheduledOut
+	ts.do(http.MethodGet, "/api/scheduled?status=pending", token, nil, &rows)
+	if len(rows) != 1 || rows[0].Kind != scheduledReminder || rows[0].Frame["text"] != "stand up" {
+		t.Fatalf("scheduled %+v", rows)
+	}
+	if at := rows[0].SendAt.Sub(before); at < 90*time.Minute || at > 91*time.Minute {
+		t.Errorf("reminder due in %s, want 1h30m", at)
+	}
+}
+
+func TestBotCommandEgress(t *testing.T) {
+	bot := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"text": "internal secret"}`))
+	}))
+	defer bot.Close()
+
+	ts := newTestServer(t, nil)
+	token, id := ts.signup("integrator@example.com")
+	if err := ts.store.Users().SetRole(context.Background(), id, roleIntegrator); err != nil {
+		t.Fatal(err)
+	}
+	for _, u := range []string{bot.URL, "http://169.254.169.254/latest/meta-data", "http://192.168.1.1/"} {
+		if code := ts.do(http.MethodPost, "/api/commands", token, map[string]string{"name": "peek", "url": u}, nil); code != http.StatusBadRequest {
+			t.Errorf("command calling %s: %d, want 400", u, code)
+		}
+	}
+	if code := ts.do(http.MethodPost, "/api/commands", token, map[string]string{"name": "deploy", "url": "https://bot.example.com/deploy"}, nil); code != http.StatusCreated {
+		t.Errorf("public command: %d, want 201", code)
+	}
+
+	// a callback that resolves to an internal address isn't called, so
+	// nothing it would answer reaches the chat
+	if err := ts.store.Commands().Create(context.Background(), &botCommand{Name: "peek", URL: bot.URL, Secret: "s", OwnerID: id}); err != nil {
+		t.Fatal(err)
+	}
+	var reply struct {
+		Text string `json:"text"`
+	}
+	ts.do(http.MethodPost, "/api/send", token, map[string]any{"text": "/peek"}, &reply)
+	if reply.Text != "/peek didn't respond." {
+		t.Errorf("/peek = %q", reply.Text)
+	}
+}
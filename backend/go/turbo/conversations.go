@@ -0,0 +1,303 @@
+package turbo
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Conversation kinds. The public room isn't a conversation: its messages
+// have no conversation_id and everyone may read them.
+const (
+	kindDirect = "direct"
+	kindGroup  = "group"
+	kindRoom   = "room"
+)
+
+// maxGroupSize caps how many people a group conversation starts with.
+const maxGroupSize = 50
+
+var (
+	// errNotMember is reported for frames addressed to a conversation the
+	// sender isn't part of.
+	errNotMember = errors.New("not a member")
+	// errUnknownRecipient is reported for DMs to someone who isn't a user.
+	errUnknownRecipient = errors.New("unknown recipient")
+	// errGroupSize is reported for groups started with too few or too many
+	// members.
+	errGroupSize = fmt.Errorf("groups need 1 to %d other members", maxGroupSize-1)
+)
+
+// conversation is a direct, group or room conversation and who is in it.
+type conversation struct {
+	ID        int64
+	Kind      string
+	Name      *string
+	Topic     *string
+	DirectKey string
+	Members   []int64
+	// CreatedBy is nil once its creator's account is gone
+	CreatedBy *int64
+	CreatedAt time.Time
+}
+
+// key is how events, webhooks and notifications name the conversation:
+// "dm:<a>,<b>" with both user ids in order for direct conversations,
+// "room:<id>" or "group:<id>" otherwise, and "" for the public room.
+func (c *conversation) key() string {
+	if c == nil {
+		return ""
+	}
+	return conversationKey(c.Kind, c.ID, c.DirectKey)
+}
+
+func conversationKey(kind string, id int64, direct string) string {
+	if kind == kindDirect {
+		return "dm:" + direct
+	}
+	return fmt.Sprintf("%s:%d", kind, id)
+}
+
+// directKey identifies the direct conversation between two users whoever
+// started it; a user's notes to self have a and b equal.
+func directKey(a, b int64) string {
+	if b < a {
+		a, b = b, a
+	}
+	return fmt.Sprintf("%d,%d", a, b)
+}
+
+// frameID reads an id that clients send as a number or a string.
+func frameID(v any) int64 {
+	switch v := v.(type) {
+	case float64:
+		return int64(v)
+	case int64:
+		return v
+	case string:
+		id, _ := strconv.ParseInt(v, 10, 64)
+		return id
+	}
+	return 0
+}
+
+// frameConversationID returns the conversation a frame names by id, under
+// "conversation" or, as rooms were addressed before, "room"; 0 if neither.
+func frameConversationID(msg map[string]any) int64 {
+	if id := frameID(msg["conversation"]); id != 0 {
+		return id
+	}
+	return frameID(msg["room"])
+}
+
+// memberOf returns conversation id, failing with errNotMember unless u is
+// one of its participants.
+func memberOf(ctx context.Context, st Store, id int64, u *user) (*conversation, error) {
+	c, err := st.Conversations().Get(ctx, id)
+	if errors.Is(err, errNotFound) {
+		return nil, errNotMember
+	}
+	if err != nil {
+		return nil, err
+	}
+	if u == nil || !slices.Contains(c.Members, u.ID) {
+		return nil, errNotMember
+	}
+	return c, nil
+}
+
+// canManage reports whether u may invite people to c and set its topic.
+// Groups are run by all their members; a room only by whoever created it,
+// or an admin.
+func (s *Server) canManage(ctx context.Context, c *conversation, u *user) bool {
+	switch c.Kind {
+	case kindGroup:
+		return true
+	case kindRoom:
+		return c.CreatedBy != nil && *c.CreatedBy == u.ID || s.userRole(ctx, u) == roleAdmin
+	}
+	return false
+}
+
+// resolveConversation finds the conversation msg is addressed to on behalf
+// of u: by id, which u must be part of, or by a DM recipient under "to",
+// whose direct conversation is created on first use. A nil conversation
+// means the public room.
+func resolveConversation(ctx context.Context, st Store, u *user, msg map[string]any) (*conversation, error) {
+	if id := frameConversationID(msg); id != 0 {
+		return memberOf(ctx, st, id, u)
+	}
+	to := frameRecipient(msg)
+	if to == "" {
+		return nil, nil
+	}
+	if u == nil {
+		return nil, errNotMember
+	}
+	peer, err := st.Users().Lookup(ctx, to)
+	if errors.Is(err, errNotFound) {
+		return nil, errUnknownRecipient
+	}
+	if err != nil {
+		return nil, err
+	}
+	return st.Conversations().Direct(ctx, u.ID, peer.ID)
+}
+
+// handleConversations opens direct conversations and starts groups; rooms
+// are created through /api/rooms.
+//
+//	GET  /api/conversations?id=N                    one conversation with its participants
+//	POST /api/conversations {"with": "@bob"}        the direct conversation with bob, created if new
+//	POST /api/conversations {"members": [...], "name"}  a new group including the caller
+//	PATCH /api/conversations?id=N {"pinned", "muted", "read"}  the caller's inbox state
+//
+// read marks the conversation read up to that message id, or all of it
+// when 0.
+func (s *Server) handleConversations(w http.ResponseWriter, r *http.Request) {
+	u := s.authenticate(r, r.Header.Get("Authorization"))
+	if u == nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	ctx := r.Context()
+	me, err := s.ownerID(ctx, u)
+	if err != nil {
+		http.Error(w, "unknown user", http.StatusForbidden)
+		return
+	}
+	u = &user{ID: me, Email: u.Email}
+	switch r.Method {
+	case http.MethodGet:
+		id, _ := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+		c, err := memberOf(ctx, s.store, id, u)
+		if errors.Is(err, errNotMember) {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			s.internalError(w, r, "db", err)
+			return
+		}
+		out, err := s.conversationOut(ctx, c)
+		if err != nil {
+			s.internalError(w, r, "db", err)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(out)
+
+	case http.MethodPost:
+		var body struct {
+			With    string   `json:"with"`
+			Members []string `json:"members"`
+			Name    string   `json:"name"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "bad json", http.StatusBadRequest)
+			return
+		}
+		var c *conversation
+		if body.With != "" {
+			c, err = resolveConversation(ctx, s.store, u, map[string]any{"to": body.With})
+		} else {
+			c, err = s.createGroup(ctx, u, body.Name, body.Members)
+		}
+		if errors.Is(err, errUnknownRecipient) || errors.Is(err, errNotFound) {
+			http.Error(w, "unknown user", http.StatusBadRequest)
+			return
+		}
+		if errors.Is(err, errGroupSize) || clientError(err) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			s.internalError(w, r, "db", err)
+			return
+		}
+		out, err := s.conversationOut(ctx, c)
+		if err != nil {
+			s.internalError(w, r, "db", err)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(out)
+
+	case http.MethodPatch:
+		id, _ := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+		var body struct {
+			Pinned *bool  `json:"pinned"`
+			Muted  *bool  `json:"muted"`
+			Read   *int64 `json:"read"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "bad json", http.StatusBadRequest)
+			return
+		}
+		err := s.store.Conversations().UpdateParticipant(ctx, id, me, body.Pinned, body.Muted, body.Read)
+		if errors.Is(err, errNotFound) {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			s.internalError(w, r, "db", err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "method", http.StatusMethodNotAllowed)
+	}
+}
+
+// createGroup starts a group of u and the users named by refs (ids, emails
+// or @handles).
+func (s *Server) createGroup(ctx context.Context, u *user, name string, refs []string) (*conversation, error) {
+	if len(refs) == 0 || len(refs) >= maxGroupSize {
+		return nil, errGroupSize
+	}
+	members := []int64{u.ID}
+	for _, ref := range refs {
+		m, err := s.lookupRef(ctx, ref)
+		if err != nil {
+			return nil, err
+		}
+		if !slices.Contains(members, m.ID) {
+			members = append(members, m.ID)
+		}
+	}
+	slices.Sort(members)
+	c := &conversation{Kind: kindGroup, Members: members}
+	if name = strings.TrimSpace(name); name != "" {
+		c.Name = &name
+	}
+	err := s.store.Conversations().Create(ctx, c, u.ID)
+	return c, err
+}
+
+// conversationOut describes c for clients, with its participants' profiles.
+func (s *Server) conversationOut(ctx context.Context, c *conversation) (map[string]any, error) {
+	users, err := s.store.Users().ByIDs(ctx, c.Members)
+	if err != nil {
+		return nil, err
+	}
+	participants := []map[string]any{}
+	for _, u := range users {
+		participants = append(participants, map[string]any{"id": u.ID, "email": u.Email, "handle": u.Handle, "display_name": u.DisplayName, "avatar_url": u.AvatarURL})
+	}
+	out := map[string]any{"id": c.ID, "kind": c.Kind, "conversation": c.key(), "participants": participants, "created_at": c.CreatedAt}
+	if c.Name != nil {
+		out["name"] = *c.Name
+	}
+	if c.Topic != nil {
+		out["topic"] = *c.Topic
+	}
+	if c.CreatedBy != nil {
+		out["created_by"] = *c.CreatedBy
+	}
+	return out, nil
+}
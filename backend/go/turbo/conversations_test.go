@@ -0,0 +1,48 @@
+package turbo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+// brokenCreateStore fails to start conversations, as when the database
+// goes away between the member lookups and the insert.
+type brokenCreateStore struct{ Store }
+
+func (s brokenCreateStore) Conversations() ConversationRepo {
+	return brokenCreate{s.Store.Conversations()}
+}
+
+type brokenCreate struct{ ConversationRepo }
+
+func (brokenCreate) Create(context.Context, *conversation, int64) error {
+	return errors.New("connection reset")
+}
+
+func TestCreateConversationStatus(t *testing.T) {
+	crowd := make([]string, maxGroupSize)
+	for i := range crowd {
+		crowd[i] = fmt.Sprintf("u%d@example.com", i)
+	}
+	for _, tc := range []struct {
+		name string
+		body map[string]any
+		want int
+	}{
+		{"no members", map[string]any{"members": []string{}}, http.StatusBadRequest},
+		{"too many members", map[string]any{"members": crowd}, http.StatusBadRequest},
+		{"unknown member", map[string]any{"members": []string{"nobody@example.com"}}, http.StatusBadRequest},
+		{"unknown peer", map[string]any{"with": "nobody@example.com"}, http.StatusBadRequest},
+		{"store failure", map[string]any{"members": []string{"bob@example.com"}}, http.StatusInternalServerError},
+	} {
+		ts := newTestServer(t, brokenCreateStore{NewMemoryStore(nil)})
+		alice, _ := ts.signup("alice@example.com")
+		ts.signup("bob@example.com")
+		if code := ts.do(http.MethodPost, "/api/conversations", alice, tc.body, nil); code != tc.want {
+			t.Errorf("%s: %d, want %d", tc.name, code, tc.want)
+		}
+	}
+}
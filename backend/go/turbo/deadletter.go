@@ -0,0 +1,123 @@
+package turbo
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+)
+
+// requireAdmin returns the caller if they are an admin (by role or
+// ADMIN_EMAILS), writing 401/403 and returning nil otherwise.
+func (s *Server) requireAdmin(w http.ResponseWriter, r *http.Request) *user {
+	return s.requireRole(w, r, roleAdmin)
+}
+
+// handleDeadLetters lists dead-lettered bus messages, newest first.
+// ?all=1 includes ones already replayed.
+func (s *Server) handleDeadLetters(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.requireAdmin(w, r) == nil {
+		return
+	}
+	limit := 100
+	if l, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && l > 0 && l <= 1000 {
+		limit = l
+	}
+	all := r.URL.Query().Get("all") == "1"
+	letters, err := s.store.DeadLetters().List(r.Context(), all, limit)
+	if err != nil {
+		s.internalError(w, r, "db", err)
+		return
+	}
+	out := []map[string]any{}
+	for _, d := range letters {
+		m := map[string]any{"id": d.ID, "topic": d.Topic, "attempts": d.Attempts, "created_at": d.CreatedAt}
+		// show JSON bodies inline and anything else as a string
+		if json.Valid(d.Body) {
+			m["body"] = json.RawMessage(d.Body)
+		} else {
+			m["body"] = string(d.Body)
+		}
+		if d.Error != nil {
+			m["error"] = *d.Error
+		}
+		if d.Instance != nil {
+			m["instance"] = *d.Instance
+		}
+		if d.ReplayedAt != nil {
+			m["replayed_at"] = *d.ReplayedAt
+		}
+		out = append(out, m)
+	}
+	_ = json.NewEncoder(w).Encode(out)
+}
+
+// handleDeadLetterReplay republishes dead-lettered messages to their
+// original topic. Body: {"ids": [1, 2]}.
+//
+// Every instance consumes chat events on its own channel, and only the one
+// that dead-lettered a message missed it, so chat replays are addressed to
+// that instance alone; the rest would deliver it to their clients a second
+// time. If that instance is gone, its clients have reconnected elsewhere and
+// reloaded history, and the replay is dropped. Events the outbox gave up on
+// reached no instance and are republished to all of them.
+func (s *Server) handleDeadLetterReplay(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.requireAdmin(w, r) == nil {
+		return
+	}
+	var body struct {
+		IDs []int64 `json:"ids"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || len(body.IDs) == 0 {
+		http.Error(w, "bad json", http.StatusBadRequest)
+		return
+	}
+	ctx := r.Context()
+	replayed := []int64{}
+	for _, id := range body.IDs {
+		// claim the row first so concurrent replays can't publish it twice
+		d, err := s.store.DeadLetters().Claim(ctx, id)
+		if err != nil {
+			if !errors.Is(err, errNotFound) {
+				s.log.ErrorContext(ctx, "dead letter claim", "id", id, "err", err)
+			}
+			continue
+		}
+		if err := s.bus.Publish(ctx, d.Topic, s.replayBody(d)); err != nil {
+			s.log.ErrorContext(ctx, "dead letter replay", "id", id, "topic", d.Topic, "err", err)
+			if err := s.store.DeadLetters().Unclaim(ctx, id); err != nil {
+				s.log.ErrorContext(ctx, "dead letter unclaim", "id", id, "err", err)
+			}
+			http.Error(w, "publish", http.StatusBadGateway)
+			return
+		}
+		replayed = append(replayed, id)
+	}
+	_ = json.NewEncoder(w).Encode(map[string]any{"replayed": replayed})
+}
+
+// replayBody is what replaying d publishes: chat events wrapped for the
+// instance that dead-lettered them, anything else as it was.
+func (s *Server) replayBody(d *deadLetter) []byte {
+	if d.Topic != topicChat || d.Instance == nil {
+		return d.Body
+	}
+	env := &envelope{
+		ID:        newEventID(),
+		Type:      eventReplay,
+		Version:   envelopeVersion,
+		Origin:    s.instance,
+		Target:    *d.Instance,
+		Timestamp: s.now().UnixMilli(),
+		Payload:   json.RawMessage(mustJSON(replayPayload{Body: d.Body})),
+	}
+	return []byte(mustJSON(env))
+}
@@ -0,0 +1,94 @@
+package turbo
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestDeadLetterReplay(t *testing.T) {
+	ts := newTestServer(t, nil)
+	bus := &pickyBus{Bus: ts.bus}
+	ts.bus = bus
+	member, _ := ts.signup("member@example.com")
+	admin, id := ts.signup("admin@example.com")
+	ctx := context.Background()
+	if err := ts.store.Users().SetRole(ctx, id, roleAdmin); err != nil {
+		t.Fatal(err)
+	}
+	event := func(id string) []byte {
+		return []byte(mustJSON(envelope{ID: id, Type: eventMessageCreated, Version: envelopeVersion, Origin: "other", Payload: json.RawMessage(`{"text":"hi"}`)}))
+	}
+	cause := errors.New("handler failed")
+	for _, d := range []struct {
+		instance string
+		body     []byte
+	}{
+		// failed by this instance's consumer, by another's, by the outbox,
+		// and one the bus refuses again
+		{ts.instance, event("e1")},
+		{"elsewhere", event("e2")},
+		{"", event("e3")},
+		{"", []byte("oversized")},
+	} {
+		if err := ts.store.DeadLetters().Record(ctx, d.instance, &BusMessage{Topic: topicChat, Body: d.body, Attempts: 5}, cause); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// consumed by two replicas, recorded once
+	if err := ts.store.DeadLetters().Record(ctx, "elsewhere", &BusMessage{Topic: topicChat, Body: event("e2")}, cause); err != nil {
+		t.Fatal(err)
+	}
+
+	if code := ts.do(http.MethodGet, "/api/admin/dead-letters", member, nil, nil); code != http.StatusForbidden {
+		t.Errorf("list as a member: %d, want 403", code)
+	}
+	var letters []struct {
+		ID       int64           `json:"id"`
+		Body     json.RawMessage `json:"body"`
+		Instance string          `json:"instance"`
+	}
+	if code := ts.do(http.MethodGet, "/api/admin/dead-letters", admin, nil, &letters); code != http.StatusOK || len(letters) != 4 {
+		t.Fatalf("list: %d, %d letters, want 4", code, len(letters))
+	}
+	// newest first
+	oversized, outbox, elsewhere, here := letters[0], letters[1], letters[2], letters[3]
+	if string(oversized.Body) != `"oversized"` || here.Instance != ts.instance {
+		t.Errorf("listed %s first and %q last", oversized.Body, here.Instance)
+	}
+
+	replay := func(ids ...int64) (int, []int64) {
+		t.Helper()
+		var res struct {
+			Replayed []int64 `json:"replayed"`
+		}
+		code := ts.do(http.MethodPost, "/api/admin/dead-letters/replay", admin, map[string]any{"ids": ids}, &res)
+		return code, res.Replayed
+	}
+	if code, got := replay(here.ID, elsewhere.ID, outbox.ID); code != http.StatusOK || len(got) != 3 {
+		t.Fatalf("replay: %d %v", code, got)
+	}
+	if code, got := replay(here.ID); code != http.StatusOK || len(got) != 0 {
+		t.Errorf("second replay: %d %v, want nothing replayed", code, got)
+	}
+	// each instance only handles what it missed: this one the replay
+	// addressed to it and the outbox's event, not the other's
+	for i, want := range []bool{true, false, true} {
+		before := ts.hub.seq
+		if err := ts.handleChatEvent(ctx, &BusMessage{Topic: topicChat, Body: bus.published[i]}); err != nil {
+			t.Fatal(err)
+		}
+		if delivered := ts.hub.seq != before; delivered != want {
+			t.Errorf("replay %d: delivered %t, want %t", i, delivered, want)
+		}
+	}
+
+	if code, _ := replay(oversized.ID); code != http.StatusBadGateway {
+		t.Errorf("replay the bus refuses: %d, want 502", code)
+	}
+	if code := ts.do(http.MethodGet, "/api/admin/dead-letters", admin, nil, &letters); code != http.StatusOK || len(letters) != 1 || letters[0].ID != oversized.ID {
+		t.Errorf("pending after a failed replay: %+v", letters)
+	}
+}
@@ -0,0 +1,64 @@
+package turbo
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// errPrivateAddress is reported for requests to an address inside the
+// network the server runs in.
+var errPrivateAddress = errors.New("destination is not a public address")
+
+// publicAddr reports whether a may be reached on behalf of a user: not
+// loopback, link-local (which includes cloud metadata services), private,
+// unspecified or multicast.
+func publicAddr(a netip.Addr) bool {
+	a = a.Unmap()
+	return a.IsValid() && !a.IsLoopback() && !a.IsPrivate() && !a.IsLinkLocalUnicast() &&
+		!a.IsLinkLocalMulticast() && !a.IsInterfaceLocalMulticast() && !a.IsMulticast() && !a.IsUnspecified()
+}
+
+// publicClient is an HTTP client for URLs users supply. The check runs on
+// every connection it dials, after DNS resolution and on redirects, so a
+// public name that resolves to an internal address is refused too. It
+// ignores proxy settings, which would hide the real destination.
+func publicClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: 10 * time.Second,
+		Control: func(_, address string, _ syscall.RawConn) error {
+			ap, err := netip.ParseAddrPort(address)
+			if err != nil || !publicAddr(ap.Addr()) {
+				return errPrivateAddress
+			}
+			return nil
+		},
+	}
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: &http.Transport{DialContext: dialer.DialContext, TLSHandshakeTimeout: 10 * time.Second},
+	}
+}
+
+// validUserURL checks a URL a user wants the server to call: http or https,
+// with a host that isn't obviously internal. publicClient enforces the rest
+// when the request is made.
+func validUserURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Hostname() == "" {
+		return errors.New("bad url")
+	}
+	host := strings.ToLower(u.Hostname())
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return errPrivateAddress
+	}
+	if a, err := netip.ParseAddr(host); err == nil && !publicAddr(a) {
+		return errPrivateAddress
+	}
+	return nil
+}
@@ -0,0 +1,208 @@
+package turbo
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// envelopeVersion is the envelope schema this build publishes.
+const envelopeVersion = 1
+
+// Event types carried in envelope.Type.
+const (
+	eventMessageCreated = "message.created"
+	// eventReplay carries a dead-lettered bus message back to the instance
+	// that failed it; see replayPayload.
+	eventReplay = "dead_letter.replay"
+)
+
+// envelope wraps every event published on the bus. Payload is the frame
+// clients receive; the other fields are for instances: ID and Origin drop
+// duplicates and echoes, Version drives upgradeEnvelope, and Trace carries a
+// W3C traceparent from the request that produced the event.
+type envelope struct {
+	ID           string `json:"id"`
+	Type         string `json:"type"`
+	Version      int    `json:"v"`
+	Origin       string `json:"origin"`
+	Conversation string `json:"conversation,omitempty"`
+	Timestamp    int64  `json:"ts"`
+	Trace        string `json:"trace,omitempty"`
+	// To lists the user ids a targeted event is for; empty means everyone
+	To []int64 `json:"to,omitempty"`
+	// Target, if set, is the only instance that handles the event
+	Target  string          `json:"target,omitempty"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// replayPayload is the payload of an eventReplay: the original bus message
+// body, which need not be valid JSON.
+type replayPayload struct {
+	Body []byte `json:"body"`
+}
+
+// newEnvelope wraps payload as an event of type typ originating here.
+func (s *Server) newEnvelope(ctx context.Context, typ, conversation string, payload any) *envelope {
+	return &envelope{
+		ID:           newEventID(),
+		Type:         typ,
+		Version:      envelopeVersion,
+		Origin:       s.instance,
+		Conversation: conversation,
+		Timestamp:    s.now().UnixMilli(),
+		Trace:        traceFrom(ctx),
+		Payload:      json.RawMessage(mustJSON(payload)),
+	}
+}
+
+// frameEventType maps a client frame type to its envelope event type.
+func frameEventType(frameType string) string {
+	switch frameType {
+	case "message":
+		return eventMessageCreated
+	case "":
+		return "frame"
+	default:
+		return frameType
+	}
+}
+
+// frameRecipient returns the DM recipient a frame names under "to" or, from
+// older clients, "recipient".
+func frameRecipient(msg map[string]any) string {
+	to, _ := msg["to"].(string)
+	if to == "" {
+		to, _ = msg["recipient"].(string)
+	}
+	return to
+}
+
+// decodeEnvelope parses a bus message and upgrades it to the current
+// envelope version.
+func decodeEnvelope(body []byte) (*envelope, error) {
+	var probe struct {
+		Version *int            `json:"v"`
+		Payload json.RawMessage `json:"payload"`
+	}
+	if err := json.Unmarshal(body, &probe); err != nil {
+		return nil, err
+	}
+	if probe.Version == nil || probe.Payload == nil {
+		return upgradeV0(body)
+	}
+	var env envelope
+	if err := json.Unmarshal(body, &env); err != nil {
+		return nil, err
+	}
+	return upgradeEnvelope(&env)
+}
+
+// upgradeEnvelope brings env up to envelopeVersion one step at a time. Add a
+// case here when bumping envelopeVersion so old publishers still interoperate
+// during a rolling deploy.
+func upgradeEnvelope(env *envelope) (*envelope, error) {
+	for env.Version < envelopeVersion {
+		switch env.Version {
+		default:
+			return nil, fmt.Errorf("envelope: no upgrade from v%d", env.Version)
+		}
+	}
+	if env.Version > envelopeVersion {
+		return nil, fmt.Errorf("envelope: v%d is newer than supported v%d", env.Version, envelopeVersion)
+	}
+	return env, nil
+}
+
+// upgradeV0 wraps a pre-envelope bus message, which was the raw client
+// frame, possibly stamped with an outbox event_id.
+func upgradeV0(body []byte) (*envelope, error) {
+	var frame map[string]any
+	if err := json.Unmarshal(body, &frame); err != nil {
+		return nil, err
+	}
+	if frame == nil {
+		return nil, errors.New("envelope: empty v0 frame")
+	}
+	id, _ := frame["event_id"].(string)
+	delete(frame, "event_id")
+	typ, _ := frame["type"].(string)
+	return &envelope{
+		ID:        id,
+		Type:      frameEventType(typ),
+		Version:   envelopeVersion,
+		Timestamp: time.Now().UnixMilli(),
+		Payload:   json.RawMessage(mustJSON(frame)),
+	}, nil
+}
+
+// deliverLocal broadcasts env to this instance's clients right away and
+// remembers its id, so the copy coming back over the bus is dropped.
+func (s *Server) deliverLocal(env *envelope) {
+	s.seen.add(env.ID)
+	s.fanout(env)
+}
+
+// fanout hands env to the hub, timing how long the fan-out takes.
+func (s *Server) fanout(env *envelope) {
+	t := prometheus.NewTimer(s.metrics.fanout)
+	s.hub.broadcastTo(env.To, env.Type, env.Payload)
+	t.ObserveDuration()
+}
+
+// handleChatEvent is the bus subscriber for topicChat.
+func (s *Server) handleChatEvent(ctx context.Context, m *BusMessage) error {
+	env, err := decodeEnvelope(m.Body)
+	if err != nil {
+		// no amount of retrying fixes a body that doesn't parse
+		return permanent(fmt.Errorf("decode: %w", err))
+	}
+	if env.Target != "" && env.Target != s.instance {
+		return nil
+	}
+	if env.Type == eventReplay {
+		var p replayPayload
+		if err := json.Unmarshal(env.Payload, &p); err != nil {
+			return permanent(fmt.Errorf("decode replay: %w", err))
+		}
+		return s.handleChatEvent(ctx, &BusMessage{Topic: m.Topic, Body: p.Body, Attempts: m.Attempts})
+	}
+	// our own events were already delivered locally when published
+	if env.Origin == s.instance {
+		return nil
+	}
+	// the relay is at-least-once; drop redeliveries of the same event
+	if env.ID != "" && s.seen.add(env.ID) {
+		s.metrics.outboxDuplicates.Inc()
+		return nil
+	}
+	s.fanout(env)
+	return nil
+}
+
+type traceKey struct{}
+
+// withTrace attaches the request's W3C traceparent to ctx, starting a new
+// trace when the client didn't send one.
+func withTrace(ctx context.Context, r *http.Request) context.Context {
+	tp := r.Header.Get("traceparent")
+	if tp == "" {
+		var b [24]byte
+		_, _ = rand.Read(b[:])
+		tp = "00-" + hex.EncodeToString(b[:16]) + "-" + hex.EncodeToString(b[16:]) + "-01"
+	}
+	return context.WithValue(ctx, traceKey{}, tp)
+}
+
+// traceFrom returns the traceparent stored by withTrace, if any.
+func traceFrom(ctx context.Context) string {
+	tp, _ := ctx.Value(traceKey{}).(string)
+	return tp
+}
@@ -0,0 +1,96 @@
+package turbo
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+)
+
+func TestDecodeEnvelope(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		body    string
+		id, typ string
+		payload string
+	}{
+		{"v1", `{"id":"e1","type":"message.created","v":1,"origin":"a","ts":1,"payload":{"text":"hi"}}`, "e1", eventMessageCreated, `{"text":"hi"}`},
+		{"v0 from the outbox", `{"type":"message","text":"hi","event_id":"e2"}`, "e2", eventMessageCreated, `{"text":"hi","type":"message"}`},
+		{"v0 typing", `{"type":"typing","user":"bob"}`, "", "typing", `{"type":"typing","user":"bob"}`},
+		{"v0 without a type", `{"text":"hi"}`, "", "frame", `{"text":"hi"}`},
+		// a frame that happens to have a v field is still a frame
+		{"v0 with v", `{"type":"message","v":2}`, "", eventMessageCreated, `{"type":"message","v":2}`},
+	} {
+		env, err := decodeEnvelope([]byte(tc.body))
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if env.ID != tc.id || env.Type != tc.typ || env.Version != envelopeVersion {
+			t.Errorf("%s: id %q, type %q, v%d; want %q, %q, v%d", tc.name, env.ID, env.Type, env.Version, tc.id, tc.typ, envelopeVersion)
+		}
+		if !jsonEqual(env.Payload, []byte(tc.payload)) {
+			t.Errorf("%s: payload %s, want %s", tc.name, env.Payload, tc.payload)
+		}
+	}
+
+	for _, body := range []string{
+		`not json`,
+		`null`,
+		`[1, 2]`,
+		`{"id":"e1","v":2,"payload":{}}`,
+		`{"id":"e1","v":0,"payload":{}}`,
+	} {
+		if env, err := decodeEnvelope([]byte(body)); err == nil {
+			t.Errorf("decodeEnvelope(%s) = %+v, want an error", body, env)
+		}
+	}
+}
+
+// jsonEqual reports whether a and b hold the same JSON value.
+func jsonEqual(a, b []byte) bool {
+	var va, vb any
+	if json.Unmarshal(a, &va) != nil || json.Unmarshal(b, &vb) != nil {
+		return false
+	}
+	return mustJSON(va) == mustJSON(vb)
+}
+
+func TestChatEventDedup(t *testing.T) {
+	ts := newTestServer(t, nil)
+	ctx := context.Background()
+	event := func(id, origin, target string) string {
+		return mustJSON(envelope{ID: id, Type: eventMessageCreated, Version: envelopeVersion, Origin: origin, Target: target, Payload: json.RawMessage(`{"text":"hi"}`)})
+	}
+	replay := func(body, target string) string {
+		return mustJSON(envelope{ID: "r-" + target, Type: eventReplay, Version: envelopeVersion, Origin: "other", Target: target, Payload: json.RawMessage(mustJSON(replayPayload{Body: []byte(body)}))})
+	}
+	for _, tc := range []struct {
+		name      string
+		body      string
+		delivered bool
+	}{
+		{"new event", event("e1", "other", ""), true},
+		{"redelivery", event("e1", "other", ""), false},
+		{"redelivery from an old publisher", `{"type":"message","text":"hi","event_id":"e1"}`, false},
+		{"echo", event("e2", ts.instance, ""), false},
+		{"for another instance", event("e3", "other", "elsewhere"), false},
+		{"for this instance", event("e4", "other", ts.instance), true},
+		{"v0 without an id", `{"type":"typing"}`, true},
+		{"the same again", `{"type":"typing"}`, true},
+		{"replay here", replay(event("e5", "other", ""), ts.instance), true},
+		{"replay elsewhere", replay(event("e6", "other", ""), "elsewhere"), false},
+		{"replay of a delivered event", replay(event("e1", "other", ""), ts.instance), false},
+	} {
+		before := ts.hub.seq
+		if err := ts.handleChatEvent(ctx, &BusMessage{Topic: topicChat, Body: []byte(tc.body)}); err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+		}
+		if delivered := ts.hub.seq != before; delivered != tc.delivered {
+			t.Errorf("%s: delivered %t, want %t", tc.name, delivered, tc.delivered)
+		}
+	}
+
+	if err := ts.handleChatEvent(ctx, &BusMessage{Topic: topicChat, Body: []byte("not json")}); !isPermanent(err) {
+		t.Errorf("undecodable body: %v, want a permanent error", err)
+	}
+}
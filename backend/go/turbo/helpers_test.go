@@ -0,0 +1,132 @@
+package turbo
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// testServer is a Server driven through its http.Handler, without Start.
+type testServer struct {
+	*Server
+	tb testing.TB
+}
+
+// newTestServer builds a server on st, a fresh memory store if nil.
+func newTestServer(tb testing.TB, st Store) *testServer {
+	tb.Helper()
+	if st == nil {
+		st = NewMemoryStore(nil)
+	}
+	s, err := New(Options{
+		Store:     st,
+		JWTSecret: []byte("test-secret"),
+		Logger:    slog.New(slog.NewTextHandler(io.Discard, nil)),
+		UploadDir: tb.TempDir(),
+	})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { _ = s.Shutdown(context.Background()) })
+	return &testServer{Server: s, tb: tb}
+}
+
+// do sends a request as token ("" for none) with body encoded as JSON
+// unless nil, decodes a JSON response into out unless nil, and returns the
+// status code.
+func (ts *testServer) do(method, path, token string, body, out any) int {
+	ts.tb.Helper()
+	var rd io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			ts.tb.Fatal(err)
+		}
+		rd = bytes.NewReader(b)
+	}
+	req := httptest.NewRequest(method, path, rd)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	ts.ServeHTTP(rec, req)
+	if out != nil && rec.Code < 300 {
+		if err := json.Unmarshal(rec.Body.Bytes(), out); err != nil {
+			ts.tb.Fatalf("%s %s: decode %q: %v", method, path, rec.Body.String(), err)
+		}
+	}
+	return rec.Code
+}
+
+// signup registers email and logs in, returning the token and user id.
+func (ts *testServer) signup(email string) (string, int64) {
+	ts.tb.Helper()
+	creds := map[string]string{"email": email, "password": "password1"}
+	if code := ts.do(http.MethodPost, "/api/register", "", creds, nil); code != http.StatusCreated {
+		ts.tb.Fatalf("register %s: %d", email, code)
+	}
+	var login struct {
+		Token string `json:"token"`
+		User  struct {
+			ID int64 `json:"id"`
+		} `json:"user"`
+	}
+	if code := ts.do(http.MethodPost, "/api/login", "", creds, &login); code != http.StatusOK {
+		ts.tb.Fatalf("login %s: %d", email, code)
+	}
+	return login.Token, login.User.ID
+}
+
+// queryCounter counts the statements a Postgres pool runs.
+type queryCounter struct{ n atomic.Int64 }
+
+func (c *queryCounter) TraceQueryStart(ctx context.Context, _ *pgx.Conn, _ pgx.TraceQueryStartData) context.Context {
+	c.n.Add(1)
+	return ctx
+}
+
+func (c *queryCounter) TraceQueryEnd(context.Context, *pgx.Conn, pgx.TraceQueryEndData) {}
+
+// testPostgres opens the scratch database named by TURBO_TEST_DATABASE_URL,
+// migrated up, or skips the test if it isn't set.
+func testPostgres(tb testing.TB) (Store, *queryCounter) {
+	tb.Helper()
+	url := os.Getenv("TURBO_TEST_DATABASE_URL")
+	if url == "" {
+		tb.Skip("TURBO_TEST_DATABASE_URL not set")
+	}
+	ctx := context.Background()
+	cfg, err := pgxpool.ParseConfig(url)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	qc := &queryCounter{}
+	cfg.ConnConfig.Tracer = qc
+	pool, err := pgxpool.NewWithConfig(ctx, cfg)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	st := newPGStore(pool)
+	if err := MigrateOnStartup(ctx, st, "up", slog.New(slog.NewTextHandler(io.Discard, nil))); err != nil {
+		pool.Close()
+		tb.Fatal(err)
+	}
+	tb.Cleanup(st.Close)
+	return st, qc
+}
+
+// uniqueEmail returns an address no earlier run has registered, for tests
+// sharing a database.
+func uniqueEmail(name string) string {
+	return name + "-" + newEventID()[:8] + "@example.com"
+}
@@ -0,0 +1,90 @@
+package turbo
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+// seedHistory stores n public messages by uid, each with an image and a
+// mention of its author, so every per-row lookup history used to make has
+// something to find.
+func seedHistory(tb testing.TB, st Store, uid int64, n int) {
+	tb.Helper()
+	ctx := context.Background()
+	for i := 0; i < n; i++ {
+		m := &messageRecord{UserID: uid, Text: fmt.Sprintf("@me message %d", i),
+			Images: []imageRecord{{URL: "https://example.com/a.png", Filename: "a.png", Filesize: 1}}}
+		if err := st.Messages().Insert(ctx, m); err != nil {
+			tb.Fatal(err)
+		}
+		if err := st.Messages().AddMentions(ctx, m.ID, []mentionSpan{{Start: 0, End: 3, Kind: mentionUser, UserID: uid}}); err != nil {
+			tb.Fatal(err)
+		}
+	}
+}
+
+// TestHistoryQueries checks that a page of history costs the same number
+// of queries however many messages it holds.
+func TestHistoryQueries(t *testing.T) {
+	st, qc := testPostgres(t)
+	ts := newTestServer(t, st)
+	token, uid := ts.signup(uniqueEmail("history"))
+	seedHistory(t, st, uid, 60)
+
+	queries := func(limit int) int64 {
+		var page struct {
+			Messages []struct {
+				Images   []imageRecord `json:"images"`
+				Mentions []mentionSpan `json:"mentions"`
+			} `json:"messages"`
+		}
+		before := qc.n.Load()
+		if code := ts.do(http.MethodGet, fmt.Sprintf("/api/messages?limit=%d", limit), token, nil, &page); code != http.StatusOK {
+			t.Fatalf("limit %d: status %d", limit, code)
+		}
+		n := qc.n.Load() - before
+		if len(page.Messages) != limit {
+			t.Fatalf("limit %d: got %d messages", limit, len(page.Messages))
+		}
+		last := page.Messages[len(page.Messages)-1]
+		if len(last.Images) != 1 || len(last.Mentions) != 1 {
+			t.Fatalf("limit %d: images %v, mentions %v", limit, last.Images, last.Mentions)
+		}
+		return n
+	}
+	small, large := queries(5), queries(50)
+	if small != large {
+		t.Errorf("history ran %d queries for 5 messages and %d for 50", small, large)
+	}
+	t.Logf("%d queries per page", large)
+}
+
+// BenchmarkHistory loads 50-message pages of history, reporting the
+// queries each costs on Postgres.
+func BenchmarkHistory(b *testing.B) {
+	run := func(b *testing.B, st Store, qc *queryCounter) {
+		ts := newTestServer(b, st)
+		token, uid := ts.signup(uniqueEmail("bench"))
+		seedHistory(b, st, uid, 50)
+		b.ResetTimer()
+		var start int64
+		if qc != nil {
+			start = qc.n.Load()
+		}
+		for i := 0; i < b.N; i++ {
+			if code := ts.do(http.MethodGet, "/api/messages?limit=50", token, nil, nil); code != http.StatusOK {
+				b.Fatalf("status %d", code)
+			}
+		}
+		if qc != nil {
+			b.ReportMetric(float64(qc.n.Load()-start)/float64(b.N), "queries/op")
+		}
+	}
+	b.Run("memory", func(b *testing.B) { run(b, NewMemoryStore(nil), nil) })
+	b.Run("postgres", func(b *testing.B) {
+		st, qc := testPostgres(b)
+		run(b, st, qc)
+	})
+}
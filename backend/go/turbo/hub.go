@@ -0,0 +1,225 @@
+package turbo
+
+import (
+	"encoding/json"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// hubBacklog is how many recent events the hub keeps so SSE and long-poll
+// clients can resume with Last-Event-ID after a reconnect.
+const hubBacklog = 1024
+
+// hubEvent is a single fan-out event. Seq is a per-instance, monotonically
+// increasing sequence; ID qualifies it with the instance ("<instance>:<seq>")
+// and is the SSE event id and long-poll cursor, so a cursor handed to
+// another replica is recognised as foreign rather than misread. Control
+// events such as the shutdown reconnect frame have no ID and carry the
+// client's reconnect delay in Retry.
+type hubEvent struct {
+	ID    string          `json:"id,omitempty"`
+	Seq   uint64          `json:"-"`
+	Data  json.RawMessage `json:"data"`
+	Retry time.Duration   `json:"-"`
+	// To limits delivery to these user ids; empty means everyone
+	To []int64 `json:"-"`
+	// Type is the event type, for metrics
+	Type string `json:"-"`
+}
+
+// visibleTo reports whether a subscriber authenticated as u gets ev.
+func (ev hubEvent) visibleTo(u *user) bool {
+	if len(ev.To) == 0 {
+		return true
+	}
+	if u == nil || u.ID == 0 {
+		return false
+	}
+	for _, id := range ev.To {
+		if id == u.ID {
+			return true
+		}
+	}
+	return false
+}
+
+// subscriber is one realtime connection (WebSocket, SSE stream or pending
+// long-poll). ch is closed by the hub when the subscriber is dropped.
+type subscriber struct {
+	ch   chan hubEvent
+	user *user
+	// head is the cursor of the last event when it subscribed; everything
+	// after it arrives on ch
+	head string
+}
+
+// hub fans events out to every realtime subscriber on this instance and keeps
+// a bounded backlog for resume.
+type hub struct {
+	instance string
+	mu       sync.Mutex
+	seq      uint64
+	backlog  []hubEvent
+	subs     map[*subscriber]struct{}
+	draining bool
+	jitter   time.Duration
+}
+
+func newHub(instance string) *hub {
+	return &hub{instance: instance, subs: make(map[*subscriber]struct{})}
+}
+
+// cursor is the event id of sequence number seq on this instance.
+func (h *hub) cursor(seq uint64) string {
+	return h.instance + ":" + strconv.FormatUint(seq, 10)
+}
+
+// broadcast assigns the next event id to data and delivers it to every
+// subscriber. Subscribers whose buffer is full are dropped rather than
+// blocking the fan-out; SSE and long-poll clients resume from the backlog.
+func (h *hub) broadcast(typ string, data []byte) {
+	h.broadcastTo(nil, typ, data)
+}
+
+// broadcastTo is broadcast limited to the connections of the given users;
+// an empty list means everyone.
+func (h *hub) broadcastTo(to []int64, typ string, data []byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.seq++
+	ev := hubEvent{ID: h.cursor(h.seq), Seq: h.seq, Data: json.RawMessage(data), To: to, Type: typ}
+	h.backlog = append(h.backlog, ev)
+	if len(h.backlog) > hubBacklog {
+		h.backlog = h.backlog[len(h.backlog)-hubBacklog:]
+	}
+	for sub := range h.subs {
+		if !ev.visibleTo(sub.user) {
+			continue
+		}
+		select {
+		case sub.ch <- ev:
+		default:
+			delete(h.subs, sub)
+			close(sub.ch)
+		}
+	}
+}
+
+// subscribe registers a new subscriber. An empty lastID means "from now on";
+// otherwise events after it that are still in the backlog are queued first.
+// ok is false if lastID is older than the backlog or was issued by another
+// instance, meaning the client may have missed events and should refetch
+// history.
+func (h *hub) subscribe(u *user, lastID string) (sub *subscriber, ok bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.draining {
+		// hand back a subscriber that only says "reconnect elsewhere"
+		sub = &subscriber{ch: make(chan hubEvent, 1), user: u, head: lastID}
+		sub.ch <- h.reconnectEvent()
+		close(sub.ch)
+		return sub, true
+	}
+	var missed []hubEvent
+	ok = true
+	if lastID != "" {
+		seq, err := strconv.ParseUint(strings.TrimPrefix(lastID, h.instance+":"), 10, 64)
+		if err != nil || !strings.HasPrefix(lastID, h.instance+":") {
+			// another replica's sequence says nothing about ours
+			ok = false
+		} else {
+			missed, ok = h.since(seq)
+		}
+	}
+	sub = &subscriber{ch: make(chan hubEvent, len(missed)+64), user: u, head: h.cursor(h.seq)}
+	for _, ev := range missed {
+		if ev.visibleTo(u) {
+			sub.ch <- ev
+		}
+	}
+	h.subs[sub] = struct{}{}
+	return sub, ok
+}
+
+// identify records who sub belongs to once a WebSocket authenticates, so
+// targeted events start reaching it.
+func (h *hub) identify(sub *subscriber, u *user) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	sub.user = u
+}
+
+// onlineUsers returns the ids of users with an authenticated subscriber on
+// this instance.
+func (h *hub) onlineUsers() []int64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	seen := map[int64]bool{}
+	var ids []int64
+	for sub := range h.subs {
+		if sub.user != nil && sub.user.ID != 0 && !seen[sub.user.ID] {
+			seen[sub.user.ID] = true
+			ids = append(ids, sub.user.ID)
+		}
+	}
+	return ids
+}
+
+// unsubscribe removes sub if it is still registered.
+func (h *hub) unsubscribe(sub *subscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.subs[sub]; ok {
+		delete(h.subs, sub)
+		close(sub.ch)
+	}
+}
+
+// since returns backlog events with a sequence number greater than lastSeq.
+// Callers must hold h.mu. A sequence number ahead of ours can't have come
+// from this instance and is reported as a gap.
+func (h *hub) since(lastSeq uint64) ([]hubEvent, bool) {
+	if lastSeq == h.seq {
+		return nil, true
+	}
+	if lastSeq > h.seq {
+		return append([]hubEvent(nil), h.backlog...), false
+	}
+	if len(h.backlog) == 0 || lastSeq+1 < h.backlog[0].Seq {
+		return append([]hubEvent(nil), h.backlog...), false
+	}
+	i := int(lastSeq + 1 - h.backlog[0].Seq)
+	return append([]hubEvent(nil), h.backlog[i:]...), true
+}
+
+// drain stops the hub accepting subscribers and sends every current one a
+// reconnect frame before closing it. Each client gets a random delay up to
+// jitter so a rolling restart doesn't reconnect everyone at once.
+func (h *hub) drain(jitter time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.draining = true
+	h.jitter = jitter
+	for sub := range h.subs {
+		select {
+		case sub.ch <- h.reconnectEvent():
+		default:
+			// buffer full: closing alone still makes the client reconnect
+		}
+		delete(h.subs, sub)
+		close(sub.ch)
+	}
+}
+
+// reconnectEvent builds a jittered reconnect frame. Callers must hold h.mu.
+func (h *hub) reconnectEvent() hubEvent {
+	var delay time.Duration
+	if h.jitter > 0 {
+		delay = time.Duration(rand.Int63n(int64(h.jitter)))
+	}
+	data, _ := json.Marshal(map[string]any{"type": "reconnect", "delay_ms": delay.Milliseconds()})
+	return hubEvent{Data: data, Retry: delay, Type: "reconnect"}
+}
@@ -0,0 +1,135 @@
+package turbo
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	inboxDefaultLimit = 30
+	inboxMaxLimit     = 100
+	// inboxUnreadCap bounds the unread count per conversation, so a room
+	// with a long backlog costs no more than this to count; clients show
+	// the cap as "99+"
+	inboxUnreadCap = 100
+	// inboxParticipants is how many other participants come with each
+	// entry; participant_count has the total
+	inboxParticipants = 5
+	// inboxPreviewLen is the length, in characters, of last message previews
+	inboxPreviewLen = 200
+)
+
+type inboxEntry struct {
+	ID           int64           `json:"id"`
+	Kind         string          `json:"kind"`
+	Conversation string          `json:"conversation"`
+	Name         *string         `json:"name,omitempty"`
+	Topic        *string         `json:"topic,omitempty"`
+	Participants json.RawMessage `json:"participants"`
+	// ParticipantCount includes the caller
+	ParticipantCount int64         `json:"participant_count"`
+	Unread           int64         `json:"unread"`
+	Muted            bool          `json:"muted"`
+	Pinned           bool          `json:"pinned"`
+	LastActivity     time.Time     `json:"last_activity_at"`
+	LastMessage      *inboxPreview `json:"last_message,omitempty"`
+}
+
+type inboxPreview struct {
+	ID       int64   `json:"id"`
+	Text     string  `json:"text"`
+	Ts       int64   `json:"ts"`
+	AuthorID *int64  `json:"author_id,omitempty"`
+	Author   *string `json:"author,omitempty"`
+	HasImage bool    `json:"has_image"`
+}
+
+// encodeInboxCursor makes the opaque position after an inbox entry from
+// what orders the inbox: pinned, last activity and id.
+func encodeInboxCursor(e inboxEntry) string {
+	pinned := "0"
+	if e.Pinned {
+		pinned = "1"
+	}
+	return base64.RawURLEncoding.EncodeToString([]byte(pinned + ":" + strconv.FormatInt(e.LastActivity.UnixMicro(), 10) + ":" + strconv.FormatInt(e.ID, 10)))
+}
+
+func decodeInboxCursor(c string) (pinned bool, at *time.Time, id int64, err error) {
+	if c == "" {
+		return false, nil, 0, nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(c)
+	if err != nil {
+		return false, nil, 0, err
+	}
+	parts := strings.Split(string(b), ":")
+	if len(parts) != 3 {
+		return false, nil, 0, errors.New("bad cursor")
+	}
+	us, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return false, nil, 0, err
+	}
+	if id, err = strconv.ParseInt(parts[2], 10, 64); err != nil {
+		return false, nil, 0, err
+	}
+	t := time.UnixMicro(us)
+	return parts[0] == "1", &t, id, nil
+}
+
+// handleInbox lists the caller's conversations for the conversation list.
+//
+//	GET /api/inbox?limit=&cursor=
+//
+// The response is {"conversations", "next_cursor"}: pinned conversations
+// first, then the most recently active. Pin, mute and mark conversations
+// read with PATCH /api/conversations. The public room isn't listed.
+func (s *Server) handleInbox(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method", http.StatusMethodNotAllowed)
+		return
+	}
+	u := s.authenticate(r, r.Header.Get("Authorization"))
+	if u == nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	ctx := r.Context()
+	me, err := s.ownerID(ctx, u)
+	if err != nil {
+		http.Error(w, "unknown user", http.StatusForbidden)
+		return
+	}
+	pinned, at, after, err := decodeInboxCursor(r.URL.Query().Get("cursor"))
+	if err != nil {
+		http.Error(w, "bad cursor", http.StatusBadRequest)
+		return
+	}
+	limit := inboxDefaultLimit
+	if n, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && n > 0 {
+		limit = min(n, inboxMaxLimit)
+	}
+
+	// one extra row tells us whether there is a next page
+	entries, err := s.store.Conversations().Inbox(ctx, inboxQuery{User: me, Pinned: pinned, At: at, ID: after, Limit: limit + 1,
+		UnreadCap: inboxUnreadCap, Participants: inboxParticipants, PreviewLen: inboxPreviewLen})
+	if err != nil {
+		s.internalError(w, r, "db", err)
+		return
+	}
+	if entries == nil {
+		entries = []inboxEntry{}
+	}
+	out := map[string]any{"conversations": entries}
+	if len(entries) > limit {
+		entries = entries[:limit]
+		out["conversations"] = entries
+		out["next_cursor"] = encodeInboxCursor(entries[limit-1])
+	}
+	_ = json.NewEncoder(w).Encode(out)
+}
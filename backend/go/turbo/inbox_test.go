@@ -0,0 +1,97 @@
+package turbo
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"testing"
+)
+
+func TestInbox(t *testing.T) {
+	w := newChatWorld(t)
+	type page struct {
+		Conversations []inboxEntry `json:"conversations"`
+		Next          string       `json:"next_cursor"`
+	}
+	inbox := func(token, query string) page {
+		t.Helper()
+		var p page
+		if code := w.do(http.MethodGet, "/api/inbox?"+query, token, nil, &p); code != http.StatusOK {
+			t.Fatalf("inbox %s: %d", query, code)
+		}
+		return p
+	}
+	kinds := func(entries []inboxEntry) []string {
+		var out []string
+		for _, e := range entries {
+			out = append(out, e.Kind)
+		}
+		return out
+	}
+
+	// most recently active first; the public room isn't listed
+	p := inbox(w.bob, "")
+	if got := kinds(p.Conversations); !slices.Equal(got, []string{kindRoom, kindGroup, kindDirect}) || p.Next != "" {
+		t.Fatalf("bob's inbox = %v, next %q", got, p.Next)
+	}
+	for _, e := range p.Conversations {
+		if e.Unread == 0 || e.LastMessage == nil || e.ParticipantCount != 2 {
+			t.Errorf("%s: unread %d, participants %d, last message %+v", e.Kind, e.Unread, e.ParticipantCount, e.LastMessage)
+		}
+	}
+	if dm := p.Conversations[2]; dm.LastMessage.Text != "secret dm" {
+		t.Errorf("dm preview %q", dm.LastMessage.Text)
+	}
+	if got := inbox(w.carol, ""); len(got.Conversations) != 0 {
+		t.Errorf("carol's inbox = %v", kinds(got.Conversations))
+	}
+
+	// pinned first; read and muted state is per participant
+	dm, group, room := p.Conversations[2].ID, w.group, w.room
+	patch := func(id int64, body map[string]any) {
+		t.Helper()
+		if code := w.do(http.MethodPatch, fmt.Sprintf("/api/conversations?id=%d", id), w.bob, body, nil); code != http.StatusNoContent {
+			t.Fatalf("patch %d: %d", id, code)
+		}
+	}
+	patch(dm, map[string]any{"pinned": true})
+	patch(group, map[string]any{"read": 0})
+	patch(room, map[string]any{"muted": true})
+	p = inbox(w.bob, "")
+	if got := kinds(p.Conversations); !slices.Equal(got, []string{kindDirect, kindRoom, kindGroup}) {
+		t.Fatalf("after pinning the dm = %v", got)
+	}
+	if e := p.Conversations[0]; !e.Pinned {
+		t.Error("dm not pinned")
+	}
+	if e := p.Conversations[1]; !e.Muted {
+		t.Error("room not muted")
+	}
+	if e := p.Conversations[2]; e.Unread != 0 {
+		t.Errorf("group unread %d after reading it", e.Unread)
+	}
+	if e := inbox(w.alice, "").Conversations; e[0].Pinned || e[0].Muted {
+		t.Errorf("bob's pin and mute leaked to alice: %+v", e[0])
+	}
+	if code := w.do(http.MethodPatch, fmt.Sprintf("/api/conversations?id=%d", group), w.carol, map[string]any{"pinned": true}, nil); code != http.StatusNotFound {
+		t.Errorf("carol pinning the group: %d, want 404", code)
+	}
+
+	// paging one at a time gives the same order without repeats
+	var paged []string
+	cursor := ""
+	for i := 0; i < 5; i++ {
+		p := inbox(w.bob, "limit=1&cursor="+url.QueryEscape(cursor))
+		paged = append(paged, kinds(p.Conversations)...)
+		if cursor = p.Next; cursor == "" {
+			break
+		}
+	}
+	if !slices.Equal(paged, []string{kindDirect, kindRoom, kindGroup}) {
+		t.Errorf("paged inbox = %v", paged)
+	}
+	if code := w.do(http.MethodGet, "/api/inbox?cursor=nonsense", w.bob, nil, nil); code != http.StatusBadRequest {
+		t.Errorf("bad cursor: %d, want 400", code)
+	}
+}
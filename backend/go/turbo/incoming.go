@@ -0,0 +1,256 @@
+package turbo
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// incomingPath is where incoming webhooks post; the token follows it.
+const incomingPath = "/api/hooks/"
+
+// storeOpts carries what an incoming webhook may set on a message that a
+// client frame may not: who it appears to be from, rich attachments and a
+// subtype.
+type storeOpts struct {
+	// Subtype marks special messages, e.g. "me" for /me actions
+	Subtype     string
+	WebhookID   int64
+	DisplayName string
+	AvatarURL   string
+	Attachments json.RawMessage
+}
+
+// incomingPayload is the Slack-compatible body of an incoming webhook post.
+// Slack-only fields like blocks and channel are accepted and ignored.
+type incomingPayload struct {
+	Text        string `json:"text"`
+	Username    string `json:"username"`
+	IconURL     string `json:"icon_url"`
+	Attachments []struct {
+		Fallback string `json:"fallback"`
+		Title    string `json:"title"`
+		Text     string `json:"text"`
+		ImageURL string `json:"image_url"`
+	} `json:"attachments"`
+	// Images is Turbo's native shape, as sent in message frames
+	Images []map[string]any `json:"images"`
+}
+
+// hashIncomingToken is how tokens are stored; the plain token only ever
+// appears in the URL handed to the creator.
+func hashIncomingToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// handleIncomingHook posts a message into the hook's conversation. It
+// accepts JSON or, like Slack, a form field named payload holding JSON.
+// POST /api/hooks/<token>
+func (s *Server) handleIncomingHook(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method", http.StatusMethodNotAllowed)
+		return
+	}
+	token := strings.TrimPrefix(r.URL.Path, incomingPath)
+	if token == "" || strings.Contains(token, "/") {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	ctx := withTrace(r.Context(), r)
+	hook, err := s.store.IncomingHooks().ByToken(ctx, hashIncomingToken(token))
+	if err != nil {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, 1<<20)
+	var p incomingPayload
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		err = json.Unmarshal([]byte(r.PostFormValue("payload")), &p)
+	} else {
+		err = json.NewDecoder(r.Body).Decode(&p)
+	}
+	if err != nil {
+		http.Error(w, "invalid_payload", http.StatusBadRequest)
+		return
+	}
+	if p.Text == "" && len(p.Attachments) > 0 {
+		p.Text = p.Attachments[0].Fallback
+	}
+	if p.Text == "" && len(p.Attachments) == 0 && len(p.Images) == 0 {
+		http.Error(w, "no_text", http.StatusBadRequest)
+		return
+	}
+
+	msg := map[string]any{"type": "message", "text": p.Text}
+	switch {
+	case hook.ConversationID != nil:
+		// storeMessage checks the owner is still a member
+		msg["conversation"] = *hook.ConversationID
+	case hook.Recipient != nil && *hook.Recipient != "":
+		msg["to"] = *hook.Recipient
+	}
+	images := []any{}
+	for _, im := range p.Images {
+		images = append(images, im)
+	}
+	for _, a := range p.Attachments {
+		if a.ImageURL != "" {
+			images = append(images, map[string]any{"url": a.ImageURL, "filename": a.Title})
+		}
+	}
+	if len(images) > 0 {
+		msg["images"] = images
+	}
+	opts := &storeOpts{WebhookID: hook.ID}
+	if hook.Name != nil {
+		opts.DisplayName = *hook.Name
+	}
+	if hook.AvatarURL != nil {
+		opts.AvatarURL = *hook.AvatarURL
+	}
+	// the poster may override the name and icon per message, as in Slack
+	if p.Username != "" {
+		opts.DisplayName = p.Username
+	}
+	if p.IconURL != "" {
+		opts.AvatarURL = p.IconURL
+	}
+	if len(p.Attachments) > 0 {
+		opts.Attachments = json.RawMessage(mustJSON(p.Attachments))
+	}
+	// same persistence and fan-out as a message frame from the owner
+	err = s.storeMessage(ctx, &user{ID: hook.OwnerID, Email: hook.OwnerEmail}, msg, opts)
+	if clientError(err) {
+		// the owner left the conversation, or their DM peer is gone
+		http.Error(w, "channel_not_found", http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		s.internalError(w, r, "store", err)
+		return
+	}
+	if err := s.store.IncomingHooks().Used(ctx, hook.ID); err != nil {
+		s.log.ErrorContext(ctx, "incoming hook last used", "id", hook.ID, "err", err)
+	}
+	_, _ = w.Write([]byte("ok"))
+}
+
+// handleIncomingWebhooks manages the caller's incoming webhooks.
+//
+//	GET    /api/incoming-webhooks
+//	POST   /api/incoming-webhooks   {"conversation", "to", "name", "avatar_url"} -> includes url
+//	DELETE /api/incoming-webhooks?id=N
+//
+// "conversation" is the id of a group or room the caller is in and "to" a
+// DM recipient, as in message frames; omit both for the public room.
+func (s *Server) handleIncomingWebhooks(w http.ResponseWriter, r *http.Request) {
+	u := s.authenticate(r, r.Header.Get("Authorization"))
+	if u == nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	ctx := r.Context()
+	owner, err := s.ownerID(ctx, u)
+	if err != nil {
+		http.Error(w, "unknown user", http.StatusForbidden)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		hooks, err := s.store.IncomingHooks().List(ctx, owner)
+		if err != nil {
+			s.internalError(w, r, "db", err)
+			return
+		}
+		out := []map[string]any{}
+		for _, hook := range hooks {
+			h := map[string]any{"id": hook.ID, "created_at": hook.CreatedAt}
+			if hook.Recipient != nil {
+				h["to"] = *hook.Recipient
+			}
+			if hook.ConversationID != nil {
+				h["conversation"] = *hook.ConversationID
+			}
+			if hook.Name != nil {
+				h["name"] = *hook.Name
+			}
+			if hook.AvatarURL != nil {
+				h["avatar_url"] = *hook.AvatarURL
+			}
+			if hook.LastUsedAt != nil {
+				h["last_used_at"] = *hook.LastUsedAt
+			}
+			out = append(out, h)
+		}
+		_ = json.NewEncoder(w).Encode(out)
+
+	case http.MethodPost:
+		var body struct {
+			Conversation any    `json:"conversation"`
+			To           string `json:"to"`
+			Name         string `json:"name"`
+			AvatarURL    string `json:"avatar_url"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "bad json", http.StatusBadRequest)
+			return
+		}
+		var conv *int64
+		if body.Conversation != nil {
+			if body.To != "" {
+				http.Error(w, "conversation and to are exclusive", http.StatusBadRequest)
+				return
+			}
+			c, err := memberOf(ctx, s.store, frameID(body.Conversation), &user{ID: owner})
+			if errors.Is(err, errNotMember) {
+				http.Error(w, "not a member", http.StatusForbidden)
+				return
+			}
+			if err != nil {
+				s.internalError(w, r, "db", err)
+				return
+			}
+			conv = &c.ID
+		}
+		if body.To != "" {
+			peer, err := s.store.Users().Lookup(ctx, body.To)
+			if err != nil || peer.ID == owner {
+				http.Error(w, "unknown recipient", http.StatusBadRequest)
+				return
+			}
+		}
+		var b [24]byte
+		_, _ = rand.Read(b[:])
+		token := hex.EncodeToString(b[:])
+		hook := &incomingHook{OwnerID: owner, Recipient: nonEmpty(body.To), ConversationID: conv, Name: nonEmpty(body.Name), AvatarURL: nonEmpty(body.AvatarURL)}
+		if err := s.store.IncomingHooks().Create(ctx, hook, hashIncomingToken(token)); err != nil {
+			s.internalError(w, r, "db", err)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(w).Encode(map[string]any{"id": hook.ID, "url": incomingPath + token, "token": token})
+
+	case http.MethodDelete:
+		id, _ := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+		err := s.store.IncomingHooks().Delete(ctx, id, owner)
+		if errors.Is(err, errNotFound) {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			s.internalError(w, r, "db", err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "method", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,59 @@
+package turbo
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"testing"
+)
+
+func TestIncomingHookConversation(t *testing.T) {
+	w := newChatWorld(t)
+	create := func(token string, req map[string]any) (int, string) {
+		t.Helper()
+		var hook struct {
+			Token string `json:"token"`
+		}
+		code := w.do(http.MethodPost, "/api/incoming-webhooks", token, req, &hook)
+		return code, hook.Token
+	}
+
+	if code, _ := create(w.carol, map[string]any{"conversation": w.group}); code != http.StatusForbidden {
+		t.Errorf("carol's hook into the group: %d, want 403", code)
+	}
+	if code, _ := create(w.alice, map[string]any{"conversation": w.group, "to": "bob@example.com"}); code != http.StatusBadRequest {
+		t.Errorf("hook with conversation and to: %d, want 400", code)
+	}
+	code, token := create(w.alice, map[string]any{"conversation": w.group, "name": "ci"})
+	if code != http.StatusCreated {
+		t.Fatalf("alice's hook into the group: %d", code)
+	}
+	if code := w.do(http.MethodPost, incomingPath+token, "", map[string]string{"text": "build passed"}, nil); code != http.StatusOK {
+		t.Fatalf("post: %d", code)
+	}
+	query := fmt.Sprintf("conversation=group:%d", w.group)
+	if got := w.history(w.bob, query); !slices.Contains(got, "build passed") {
+		t.Errorf("bob's group history = %q, want the hook's message", got)
+	}
+	if got := w.search(w.carol, "build"); len(got) != 0 {
+		t.Errorf("carol found %q", got)
+	}
+
+	// a hook whose owner isn't in the conversation, as after they leave it,
+	// posts nothing
+	carol, err := w.store.Users().Lookup(context.Background(), "carol@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hook := &incomingHook{OwnerID: carol.ID, ConversationID: &w.group}
+	if err := w.store.IncomingHooks().Create(context.Background(), hook, hashIncomingToken("stale")); err != nil {
+		t.Fatal(err)
+	}
+	if code := w.do(http.MethodPost, incomingPath+"stale", "", map[string]string{"text": "intruder"}, nil); code != http.StatusForbidden {
+		t.Errorf("post from a non-member's hook: %d, want 403", code)
+	}
+	if got := w.history(w.alice, query); slices.Contains(got, "intruder") {
+		t.Errorf("alice's group history = %q", got)
+	}
+}
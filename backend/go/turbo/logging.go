@@ -0,0 +1,199 @@
+package turbo
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// requestIDHeader carries the request id in and out. A well-formed id sent
+// by a proxy is kept so logs line up across hops.
+const requestIDHeader = "X-Request-ID"
+
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,64}$`)
+
+// NewLogger returns a logger writing to w at level (debug, info, warn or
+// error) in format (text or json).
+func NewLogger(w io.Writer, level, format string) (*slog.Logger, error) {
+	var lv slog.Level
+	if err := lv.UnmarshalText([]byte(level)); err != nil {
+		return nil, err
+	}
+	opts := &slog.HandlerOptions{Level: lv}
+	switch strings.ToLower(format) {
+	case "", "text":
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	}
+	return nil, fmt.Errorf("unknown log format %q (want text or json)", format)
+}
+
+// requestInfo is what the access log learns about a request while it runs.
+type requestInfo struct {
+	id string
+	// route is the pattern that matched, never the raw path, which can
+	// hold secrets such as incoming webhook tokens
+	route string
+	user  atomic.Int64
+}
+
+type requestInfoKey struct{}
+
+func requestFrom(ctx context.Context) *requestInfo {
+	ri, _ := ctx.Value(requestInfoKey{}).(*requestInfo)
+	return ri
+}
+
+// requestID returns the id of the request ctx belongs to, if any.
+func requestID(ctx context.Context) string {
+	if ri := requestFrom(ctx); ri != nil {
+		return ri.id
+	}
+	return ""
+}
+
+// requestIDHandler adds the request id and, once known, the user id to
+// records logged with a request's context.
+type requestIDHandler struct{ slog.Handler }
+
+func (h requestIDHandler) Handle(ctx context.Context, r slog.Record) error {
+	if ri := requestFrom(ctx); ri != nil {
+		r.AddAttrs(slog.String("request_id", ri.id))
+		if uid := ri.user.Load(); uid != 0 {
+			r.AddAttrs(slog.Int64("user_id", uid))
+		}
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h requestIDHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return requestIDHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h requestIDHandler) WithGroup(name string) slog.Handler {
+	return requestIDHandler{h.Handler.WithGroup(name)}
+}
+
+// accessLog assigns every request an id, echoed in X-Request-ID, and logs
+// it once served with its route, status, latency and user. WebSocket
+// sessions are logged when they close, with the session's duration. The
+// same latency feeds the per-route request histogram.
+func (s *Server) accessLog(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := s.now()
+		id := r.Header.Get(requestIDHeader)
+		if !requestIDPattern.MatchString(id) {
+			id = newEventID()[:16]
+		}
+		w.Header().Set(requestIDHeader, id)
+		_, route := mux.Handler(r)
+		if route == "" {
+			route = "unmatched"
+		}
+		ri := &requestInfo{id: id, route: route}
+		ctx := context.WithValue(r.Context(), requestInfoKey{}, ri)
+
+		sw := &statusWriter{ResponseWriter: w}
+		mux.ServeHTTP(sw, r.WithContext(ctx))
+
+		latency := s.now().Sub(start)
+		s.metrics.requests.WithLabelValues(methodLabel(r.Method), route, strconv.Itoa(sw.code())).Observe(latency.Seconds())
+
+		level := slog.LevelInfo
+		if sw.code() >= 500 {
+			level = slog.LevelError
+		}
+		s.log.LogAttrs(ctx, level, "request",
+			slog.String("method", r.Method),
+			slog.String("route", route),
+			slog.Int("status", sw.code()),
+			slog.Duration("latency", latency),
+			slog.Int64("bytes", sw.bytes),
+		)
+	})
+}
+
+// authenticate is validateToken for r, noting the user for r's access log.
+func (s *Server) authenticate(r *http.Request, token string) *user {
+	u := s.validateToken(token)
+	s.noteUser(r.Context(), u)
+	return u
+}
+
+// noteUser records u as the user behind ctx's request.
+func (s *Server) noteUser(ctx context.Context, u *user) {
+	if ri := requestFrom(ctx); ri != nil && u != nil {
+		ri.user.Store(u.ID)
+	}
+}
+
+// internalError logs err against r's route and answers with a bare 500.
+func (s *Server) internalError(w http.ResponseWriter, r *http.Request, msg string, err error) {
+	route := "unmatched"
+	if ri := requestFrom(r.Context()); ri != nil {
+		route = ri.route
+	}
+	s.log.ErrorContext(r.Context(), "handler failed", "route", route, "reason", msg, "err", err)
+	http.Error(w, msg, http.StatusInternalServerError)
+}
+
+// statusWriter records the status and size of a response. It passes
+// through Flush for SSE and Hijack for WebSockets.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	conn, rw, err := h.Hijack()
+	if err == nil {
+		w.status = http.StatusSwitchingProtocols
+	}
+	return conn, rw, err
+}
+
+func (w *statusWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
+
+// code is the status sent, 200 if the handler never wrote.
+func (w *statusWriter) code() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
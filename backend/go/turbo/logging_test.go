@@ -0,0 +1,113 @@
+package turbo
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestErrorLogOmitsHookToken(t *testing.T) {
+	st := &brokenTxStore{Store: NewMemoryStore(nil)}
+	ts := newTestServer(t, st)
+	var logs bytes.Buffer
+	ts.log = slog.New(requestIDHandler{slog.NewTextHandler(&logs, nil)})
+	token, _ := ts.signup("alice@example.com")
+	var hook struct {
+		Token string `json:"token"`
+	}
+	if code := ts.do(http.MethodPost, "/api/incoming-webhooks", token, map[string]string{"name": "ci"}, &hook); code != http.StatusCreated {
+		t.Fatalf("create hook: %d", code)
+	}
+
+	st.broken.Store(true)
+	if code := ts.do(http.MethodPost, incomingPath+hook.Token, "", map[string]string{"text": "build passed"}, nil); code != http.StatusInternalServerError {
+		t.Fatalf("post with the store down: %d, want 500", code)
+	}
+	out := logs.String()
+	if !strings.Contains(out, "handler failed") || !strings.Contains(out, "route="+incomingPath) {
+		t.Errorf("no error logged for the hook route:\n%s", out)
+	}
+	if strings.Contains(out, hook.Token) {
+		t.Errorf("the hook token was logged:\n%s", out)
+	}
+}
+
+func TestNewLogger(t *testing.T) {
+	for _, tc := range []struct {
+		level, format string
+		ok            bool
+	}{
+		{"info", "", true},
+		{"debug", "text", true},
+		{"WARN", "JSON", true},
+		{"error", "json", true},
+		{"loud", "text", false},
+		{"info", "xml", false},
+	} {
+		_, err := NewLogger(io.Discard, tc.level, tc.format)
+		if (err == nil) != tc.ok {
+			t.Errorf("NewLogger(%q, %q): %v", tc.level, tc.format, err)
+		}
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	ts := newTestServer(t, nil)
+	var logs bytes.Buffer
+	ts.log = slog.New(requestIDHandler{slog.NewJSONHandler(&logs, nil)})
+	token, id := ts.signup("alice@example.com")
+
+	for _, tc := range []struct {
+		name, path, token, sentID string
+		keep                      bool
+	}{
+		{"proxy id", "/api/health", "", "edge-1.abc:42", true},
+		{"no id", "/api/health", "", "", false},
+		{"malformed id", "/api/health", "", "two words", false},
+		{"too long", "/api/health", "", strings.Repeat("a", 65), false},
+		{"signed in", "/api/profile", token, "", false},
+		{"unmatched", "/nowhere", "", "", false},
+	} {
+		logs.Reset()
+		req := httptest.NewRequest(http.MethodGet, tc.path, nil)
+		if tc.sentID != "" {
+			req.Header.Set(requestIDHeader, tc.sentID)
+		}
+		if tc.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tc.token)
+		}
+		rec := httptest.NewRecorder()
+		ts.ServeHTTP(rec, req)
+
+		got := rec.Header().Get(requestIDHeader)
+		if tc.keep && got != tc.sentID || !tc.keep && (got == "" || got == tc.sentID) {
+			t.Errorf("%s: sent id %q, answered %q", tc.name, tc.sentID, got)
+		}
+		var entry struct {
+			Msg       string `json:"msg"`
+			RequestID string `json:"request_id"`
+			Route     string `json:"route"`
+			Status    int    `json:"status"`
+			UserID    int64  `json:"user_id"`
+		}
+		if err := json.Unmarshal(logs.Bytes(), &entry); err != nil {
+			t.Errorf("%s: want one access log line, got %q", tc.name, logs.String())
+			continue
+		}
+		route, user := tc.path, int64(0)
+		if tc.path == "/nowhere" {
+			route = "unmatched"
+		}
+		if tc.token != "" {
+			user = id
+		}
+		if entry.Msg != "request" || entry.RequestID != got || entry.Route != route || entry.Status != rec.Code || entry.UserID != user {
+			t.Errorf("%s: logged %+v for %s (%d), want user %d", tc.name, entry, got, rec.Code, user)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package turbo
+
+import (
+	"context"
+	"regexp"
+	"slices"
+	"strings"
+	"unicode/utf16"
+)
+
+// Mention kinds stored in mentions.kind.
+const (
+	mentionUser = "user"
+	mentionHere = "here"
+	mentionRoom = "room"
+)
+
+// eventMention is the envelope type of the targeted notification sent to
+// each mentioned user's connections.
+const eventMention = "mention"
+
+// mentionPattern matches @email or @handle. The leading group keeps
+// addresses like bob@example.com from being read as a mention of "example".
+var mentionPattern = regexp.MustCompile(`(^|[^\w@.])@([A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}|[A-Za-z0-9_][A-Za-z0-9_.-]*)`)
+
+// handlePattern is what users may pick as their @handle.
+var handlePattern = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]{1,31}$`)
+
+// mentionSpan is one resolved mention in a message's text. Start and End are
+// UTF-16 offsets so clients can slice the JavaScript string directly.
+type mentionSpan struct {
+	Start       int    `json:"start"`
+	End         int    `json:"end"`
+	Kind        string `json:"kind"`
+	UserID      int64  `json:"user_id,omitempty"`
+	Handle      string `json:"handle,omitempty"`
+	DisplayName string `json:"display_name,omitempty"`
+
+	// token is the text after "@", used while resolving
+	token string
+}
+
+// parseMentions finds @mentions in text. Spans are unresolved: user mentions
+// carry only their token until resolveMentions fills in the user.
+func parseMentions(text string) []mentionSpan {
+	var spans []mentionSpan
+	for _, m := range mentionPattern.FindAllStringSubmatchIndex(text, -1) {
+		at, end := m[4]-1, m[5]
+		// sentence punctuation isn't part of the handle
+		token := strings.TrimRight(text[m[4]:end], ".-")
+		end = m[4] + len(token)
+		if token == "" {
+			continue
+		}
+		sp := mentionSpan{Start: utf16Len(text[:at]), End: utf16Len(text[:end]), Kind: mentionUser, token: token}
+		switch strings.ToLower(token) {
+		case "here":
+			sp.Kind = mentionHere
+		case "room":
+			sp.Kind = mentionRoom
+		}
+		spans = append(spans, sp)
+	}
+	return spans
+}
+
+// utf16Len is the length of s in UTF-16 code units.
+func utf16Len(s string) int {
+	return len(utf16.Encode([]rune(s)))
+}
+
+// resolveMentions looks up user mentions by handle or email in one query and
+// drops the ones that don't match anybody.
+func resolveMentions(ctx context.Context, tx Store, spans []mentionSpan) ([]mentionSpan, error) {
+	var keys []string
+	for _, sp := range spans {
+		if sp.Kind == mentionUser {
+			keys = append(keys, strings.ToLower(sp.token))
+		}
+	}
+	found := map[string]mentionSpan{}
+	if len(keys) > 0 {
+		users, err := tx.Users().Mentioned(ctx, keys)
+		if err != nil {
+			return nil, err
+		}
+		for _, u := range users {
+			sp := mentionSpan{UserID: u.ID}
+			if u.Handle != nil {
+				sp.Handle = *u.Handle
+			}
+			if u.DisplayName != nil {
+				sp.DisplayName = *u.DisplayName
+			}
+			found[strings.ToLower(u.Email)] = sp
+			if u.Handle != nil {
+				found[strings.ToLower(*u.Handle)] = sp
+			}
+		}
+	}
+	out := spans[:0]
+	for _, sp := range spans {
+		if sp.Kind == mentionUser {
+			u, ok := found[strings.ToLower(sp.token)]
+			if !ok {
+				continue
+			}
+			sp.UserID, sp.Handle, sp.DisplayName = u.UserID, u.Handle, u.DisplayName
+		}
+		out = append(out, sp)
+	}
+	return out, nil
+}
+
+// mentionTargets returns who a message's mention event goes to. User
+// mentions target that user; @here and @room target everyone in the
+// conversation, which outside the public room is its participants (members)
+// and in it every connection (all). Outside the public room only
+// participants are targeted. The author is never notified.
+func mentionTargets(authorID int64, members []int64, spans []mentionSpan) (to []int64, all bool) {
+	seen := map[int64]bool{authorID: true}
+	add := func(id int64) {
+		if members != nil && !slices.Contains(members, id) {
+			return
+		}
+		if id != 0 && !seen[id] {
+			seen[id] = true
+			to = append(to, id)
+		}
+	}
+	for _, sp := range spans {
+		switch sp.Kind {
+		case mentionUser:
+			add(sp.UserID)
+		case mentionHere, mentionRoom:
+			if members == nil {
+				return nil, true
+			}
+			for _, id := range members {
+				add(id)
+			}
+		}
+	}
+	return to, false
+}
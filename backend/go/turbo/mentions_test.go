@@ -0,0 +1,99 @@
+package turbo
+
+import (
+	"context"
+	"slices"
+	"testing"
+)
+
+func TestParseMentions(t *testing.T) {
+	user := func(start, end int, token string) mentionSpan {
+		return mentionSpan{Start: start, End: end, Kind: mentionUser, token: token}
+	}
+	for _, tc := range []struct {
+		text string
+		want []mentionSpan
+	}{
+		{"hi @bob", []mentionSpan{user(3, 7, "bob")}},
+		{"@a and @b_2", []mentionSpan{user(0, 2, "a"), user(7, 11, "b_2")}},
+		// sentence punctuation after a handle isn't part of it
+		{"thanks @bob.", []mentionSpan{user(7, 11, "bob")}},
+		{"ask @bob.. or @carol-", []mentionSpan{user(4, 8, "bob"), user(14, 20, "carol")}},
+		{"(@bob)", []mentionSpan{user(1, 5, "bob")}},
+		// an email address mentions its owner, one inside a word nobody
+		{"cc @bob@example.com, please", []mentionSpan{user(3, 19, "bob@example.com")}},
+		{"mail bob@example.com", nil},
+		{"a@b and x.@y", nil},
+		{"meet @ noon", nil},
+		{"@here lunch", []mentionSpan{{Start: 0, End: 5, Kind: mentionHere, token: "here"}}},
+		{"hey @ROOM!", []mentionSpan{{Start: 4, End: 9, Kind: mentionRoom, token: "ROOM"}}},
+		// offsets count UTF-16 code units, as JavaScript strings do
+		{"é @bob", []mentionSpan{user(2, 6, "bob")}},
+		{"😀 @bob", []mentionSpan{user(3, 7, "bob")}},
+		{"👍🏽@bob", []mentionSpan{user(4, 8, "bob")}},
+	} {
+		if got := parseMentions(tc.text); !slices.Equal(got, tc.want) {
+			t.Errorf("parseMentions(%q) = %+v, want %+v", tc.text, got, tc.want)
+		}
+	}
+}
+
+func TestMentionTargets(t *testing.T) {
+	const author = 1
+	mention := func(id int64) mentionSpan { return mentionSpan{Kind: mentionUser, UserID: id} }
+	here := mentionSpan{Kind: mentionHere}
+	room := mentionSpan{Kind: mentionRoom}
+	group := []int64{1, 2, 3}
+	for _, tc := range []struct {
+		name    string
+		members []int64
+		spans   []mentionSpan
+		want    []int64
+		all     bool
+	}{
+		{"user in the public room", nil, []mentionSpan{mention(2)}, []int64{2}, false},
+		{"same user twice", nil, []mentionSpan{mention(2), mention(2)}, []int64{2}, false},
+		{"the author", nil, []mentionSpan{mention(author)}, nil, false},
+		{"unresolved", nil, []mentionSpan{mention(0)}, nil, false},
+		{"@here in the public room", nil, []mentionSpan{mention(2), here}, nil, true},
+		{"@room in the public room", nil, []mentionSpan{room}, nil, true},
+		{"@here in a group", group, []mentionSpan{here}, []int64{2, 3}, false},
+		{"@room and a member", group, []mentionSpan{mention(3), room}, []int64{3, 2}, false},
+		{"outsider in a group", group, []mentionSpan{mention(4), mention(2)}, []int64{2}, false},
+	} {
+		to, all := mentionTargets(author, tc.members, tc.spans)
+		if !slices.Equal(to, tc.want) || all != tc.all {
+			t.Errorf("%s: %v, %t; want %v, %t", tc.name, to, all, tc.want, tc.all)
+		}
+	}
+}
+
+func TestResolveMentions(t *testing.T) {
+	ctx := context.Background()
+	st := NewMemoryStore(nil)
+	alice, _, err := st.Users().Create(ctx, "alice@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	carol, _, err := st.Users().Create(ctx, "Carol@Example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := st.Users().UpdateProfile(ctx, alice, "Alice A", "", "", "ali"); err != nil {
+		t.Fatal(err)
+	}
+
+	// handles and emails match ignoring case; nobody matches nothing
+	spans, err := resolveMentions(ctx, st, parseMentions("@ALI @carol@example.com @nobody @here"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []mentionSpan{
+		{Start: 0, End: 4, Kind: mentionUser, UserID: alice, Handle: "ali", DisplayName: "Alice A", token: "ALI"},
+		{Start: 5, End: 23, Kind: mentionUser, UserID: carol, DisplayName: "Carol@Example.com", token: "carol@example.com"},
+		{Start: 32, End: 37, Kind: mentionHere, token: "here"},
+	}
+	if !slices.Equal(spans, want) {
+		t.Errorf("resolved %+v, want %+v", spans, want)
+	}
+}
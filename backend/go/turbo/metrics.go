@@ -0,0 +1,190 @@
+package turbo
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+)
+
+// metrics are one server's Prometheus collectors, served on /metrics.
+type metrics struct {
+	requests    *prometheus.HistogramVec
+	wsConns     prometheus.Gauge
+	frames      *prometheus.CounterVec
+	fanout      prometheus.Histogram
+	uploadBytes prometheus.Counter
+
+	outboxPublished  prometheus.Counter
+	outboxFailed     prometheus.Counter
+	outboxDead       prometheus.Counter
+	outboxDuplicates prometheus.Counter
+	outboxLag        prometheus.Gauge
+}
+
+// newMetrics builds a server's metrics and registers them with reg, which
+// fails if another server already registered its own there.
+func newMetrics(reg prometheus.Registerer) (*metrics, error) {
+	m := &metrics{
+		requests: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "turbo_http_request_duration_seconds",
+			Help:    "HTTP request latency by route; WebSocket and SSE requests last the whole session.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"method", "route", "code"}),
+		wsConns: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "turbo_ws_connections",
+			Help: "Open WebSocket connections.",
+		}),
+		frames: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "turbo_ws_frames_total",
+			Help: "WebSocket frames received (in) and sent (out) by type.",
+		}, []string{"direction", "type"}),
+		fanout: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "turbo_broadcast_fanout_seconds",
+			Help:    "Time to hand one event to every local realtime subscriber.",
+			Buckets: prometheus.ExponentialBuckets(1e-6, 4, 10),
+		}),
+		uploadBytes: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "turbo_upload_bytes_total",
+			Help: "Bytes received through /api/upload.",
+		}),
+		outboxPublished: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "turbo_outbox_published_total",
+			Help: "Outbox events published to the bus.",
+		}),
+		outboxFailed: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "turbo_outbox_publish_failures_total",
+			Help: "Outbox publishes that failed and were rescheduled.",
+		}),
+		outboxDead: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "turbo_outbox_dead_lettered_total",
+			Help: "Outbox events given up on after repeated failed publishes and kept as dead letters.",
+		}),
+		outboxDuplicates: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "turbo_outbox_duplicates_dropped_total",
+			Help: "Bus redeliveries of already delivered events that were dropped.",
+		}),
+		outboxLag: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "turbo_outbox_last_lag_seconds",
+			Help: "Time between enqueueing and publishing the last outbox event.",
+		}),
+	}
+	for _, c := range []prometheus.Collector{
+		m.requests, m.wsConns, m.frames, m.fanout, m.uploadBytes,
+		m.outboxPublished, m.outboxFailed, m.outboxDead, m.outboxDuplicates, m.outboxLag,
+	} {
+		if err := reg.Register(c); err != nil {
+			return nil, fmt.Errorf("turbo: metrics: %w", err)
+		}
+	}
+	return m, nil
+}
+
+// frameTypes are the frame and event types counted under their own name;
+// anything else a client sends is counted as "other" so it can't blow up
+// the label set.
+var frameTypes = map[string]bool{
+	"auth": true, "auth_ok": true, "auth_fail": true, "error": true, "reconnect": true,
+	"message": true, eventMessageCreated: true, eventMessageDeleted: true, "message_deleted": true,
+	"typing": true, "reaction": true, "read": true, eventMention: true, "reminder": true,
+	"ephemeral": true, "member_joined": true, "topic": true, "frame": true,
+}
+
+func frameLabel(t string) string {
+	if frameTypes[t] {
+		return t
+	}
+	return "other"
+}
+
+// methodLabel bounds the method label the same way.
+func methodLabel(m string) string {
+	switch m {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete, http.MethodOptions:
+		return m
+	}
+	return "other"
+}
+
+// registerDefaultCollectors adds the Go runtime and process collectors to a
+// registry the server created itself.
+func registerDefaultCollectors(reg prometheus.Registerer) {
+	reg.MustRegister(collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+}
+
+// poolCollector exports pgxpool statistics at scrape time.
+type poolCollector struct {
+	pool *pgxpool.Pool
+
+	acquired, idle, total, max                  *prometheus.Desc
+	acquires, acquireSeconds, waited, cancelled *prometheus.Desc
+}
+
+func newPoolCollector(pool *pgxpool.Pool) *poolCollector {
+	desc := func(name, help string) *prometheus.Desc {
+		return prometheus.NewDesc("turbo_pgxpool_"+name, help, nil, nil)
+	}
+	return &poolCollector{
+		pool:           pool,
+		acquired:       desc("acquired_conns", "Connections currently in use."),
+		idle:           desc("idle_conns", "Idle connections."),
+		total:          desc("total_conns", "Open connections, including ones being established."),
+		max:            desc("max_conns", "Pool size limit."),
+		acquires:       desc("acquires_total", "Successful connection acquires."),
+		acquireSeconds: desc("acquire_duration_seconds_total", "Total time spent acquiring connections."),
+		waited:         desc("empty_acquires_total", "Acquires that had to wait for a connection."),
+		cancelled:      desc("canceled_acquires_total", "Acquires cancelled by their context."),
+	}
+}
+
+func (c *poolCollector) Describe(ch chan<- *prometheus.Desc) {
+	prometheus.DescribeByCollect(c, ch)
+}
+
+func (c *poolCollector) Collect(ch chan<- prometheus.Metric) {
+	st := c.pool.Stat()
+	gauge := func(d *prometheus.Desc, v float64) {
+		ch <- prometheus.MustNewConstMetric(d, prometheus.GaugeValue, v)
+	}
+	counter := func(d *prometheus.Desc, v float64) {
+		ch <- prometheus.MustNewConstMetric(d, prometheus.CounterValue, v)
+	}
+	gauge(c.acquired, float64(st.AcquiredConns()))
+	gauge(c.idle, float64(st.IdleConns()))
+	gauge(c.total, float64(st.TotalConns()))
+	gauge(c.max, float64(st.MaxConns()))
+	counter(c.acquires, float64(st.AcquireCount()))
+	counter(c.acquireSeconds, st.AcquireDuration().Seconds())
+	counter(c.waited, float64(st.EmptyAcquireCount()))
+	counter(c.cancelled, float64(st.CanceledAcquireCount()))
+}
+
+// nsqMetrics count NSQ traffic by topic.
+type nsqMetrics struct {
+	published, publishErrors *prometheus.CounterVec
+	consumed, consumeErrors  *prometheus.CounterVec
+}
+
+// newNSQMetrics registers with reg; a nil reg keeps them unregistered.
+func newNSQMetrics(reg prometheus.Registerer) (*nsqMetrics, error) {
+	counter := func(name, help string) *prometheus.CounterVec {
+		return prometheus.NewCounterVec(prometheus.CounterOpts{Name: "turbo_nsq_" + name, Help: help}, []string{"topic"})
+	}
+	m := &nsqMetrics{
+		published:     counter("published_total", "Messages published to nsqd."),
+		publishErrors: counter("publish_errors_total", "Publishes that failed on every nsqd."),
+		consumed:      counter("consumed_total", "Messages delivered to handlers."),
+		consumeErrors: counter("consume_errors_total", "Deliveries whose handler failed."),
+	}
+	if reg == nil {
+		return m, nil
+	}
+	for _, c := range []prometheus.Collector{m.published, m.publishErrors, m.consumed, m.consumeErrors} {
+		if err := reg.Register(c); err != nil {
+			return nil, fmt.Errorf("nsq metrics: %w", err)
+		}
+	}
+	return m, nil
+}
@@ -0,0 +1,63 @@
+package turbo
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestMetrics(t *testing.T) {
+	ts := newTestServer(t, nil)
+	ts.do(http.MethodGet, "/api/health", "", nil, nil)
+	ts.do("BREW", "/api/health", "", nil, nil)
+	ts.do(http.MethodPost, incomingPath+"secrettoken", "", map[string]string{"text": "hi"}, nil)
+
+	rec := httptest.NewRecorder()
+	ts.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body := rec.Body.String()
+	if rec.Code != http.StatusOK {
+		t.Fatalf("/metrics: %d", rec.Code)
+	}
+	for _, want := range []string{
+		`turbo_http_request_duration_seconds_count{code="200",method="GET",route="/api/health"} 1`,
+		// unknown methods are bucketed and routes are patterns, so clients
+		// can't grow the label set
+		`turbo_http_request_duration_seconds_count{code="200",method="other",route="/api/health"} 1`,
+		`route="/api/hooks/"`,
+		"turbo_outbox_published_total",
+		"go_goroutines",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("/metrics lacks %s", want)
+		}
+	}
+	if strings.Contains(body, "secrettoken") {
+		t.Error("/metrics has a hook token in a route label")
+	}
+	// and so are frame types
+	for in, want := range map[string]string{"typing": "typing", eventMessageCreated: eventMessageCreated, "made-up": "other", "": "other"} {
+		if got := frameLabel(in); got != want {
+			t.Errorf("frameLabel(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestMetricsRegistry(t *testing.T) {
+	// two servers can't share a registry, or their series would mix
+	reg := prometheus.NewRegistry()
+	opts := Options{Store: NewMemoryStore(nil), JWTSecret: []byte("test-secret"), Logger: slog.New(slog.NewTextHandler(io.Discard, nil)), Metrics: reg, UploadDir: t.TempDir()}
+	s, err := New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := New(opts); err == nil {
+		t.Error("second server on the same registry: no error")
+	}
+	_ = s.Shutdown(context.Background())
+}
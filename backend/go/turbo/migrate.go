@@ -0,0 +1,382 @@
+package turbo
+
+import (
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Schema changes are SQL files in migrations/, embedded in the binary:
+// NNNN_name.up.sql applies version NNNN and NNNN_name.down.sql, if there is
+// one, reverts it. Applied versions are recorded in schema_migrations with
+// a checksum of their up file, so an edited migration is caught rather than
+// silently skipped. Never change a migration once it has shipped; add one.
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migrationLockKey is the advisory lock held while migrating, so replicas
+// starting together apply each migration once.
+const migrationLockKey int64 = 0x7475726b6f // "turbo"
+
+type migration struct {
+	version  int64
+	name     string
+	up       string
+	down     string // empty when the migration can't be reverted
+	checksum string
+}
+
+type appliedMigration struct {
+	version   int64
+	name      string
+	checksum  string
+	appliedAt time.Time
+}
+
+var (
+	errSchemaNewer   = errors.New("database schema is newer than this build")
+	errSchemaUnknown = errors.New("database schema has migrations this build doesn't know")
+	errSchemaPending = errors.New("database schema has pending migrations")
+)
+
+// loadMigrations reads the embedded migrations in version order.
+func loadMigrations() ([]migration, error) {
+	entries, err := migrationFiles.ReadDir("migrations")
+	if err != nil {
+		return nil, err
+	}
+	byVersion := map[int64]*migration{}
+	for _, e := range entries {
+		base, dir, ok := strings.Cut(strings.TrimSuffix(e.Name(), ".sql"), ".")
+		num, name, ok2 := strings.Cut(base, "_")
+		version, err := strconv.ParseInt(num, 10, 64)
+		if !ok || !ok2 || err != nil || version <= 0 || (dir != "up" && dir != "down") {
+			return nil, fmt.Errorf("migration %s: name must be NNNN_name.up.sql or NNNN_name.down.sql", e.Name())
+		}
+		b, err := migrationFiles.ReadFile(path.Join("migrations", e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		m := byVersion[version]
+		if m == nil {
+			m = &migration{version: version, name: name}
+			byVersion[version] = m
+		}
+		if m.name != name {
+			return nil, fmt.Errorf("migration %d: up and down files are named differently", version)
+		}
+		if dir == "up" {
+			m.up = string(b)
+			sum := sha256.Sum256(b)
+			m.checksum = hex.EncodeToString(sum[:])
+		} else {
+			m.down = string(b)
+		}
+	}
+	out := make([]migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.up == "" {
+			return nil, fmt.Errorf("migration %d: no up file", m.version)
+		}
+		out = append(out, *m)
+	}
+	slices.SortFunc(out, func(a, b migration) int { return cmp.Compare(a.version, b.version) })
+	return out, nil
+}
+
+// loadApplied returns the versions recorded in schema_migrations, none if
+// the table doesn't exist yet.
+func loadApplied(ctx context.Context, q pgDB) (map[int64]appliedMigration, error) {
+	var exists bool
+	if err := q.QueryRow(ctx, `SELECT to_regclass('schema_migrations') IS NOT NULL`).Scan(&exists); err != nil || !exists {
+		return map[int64]appliedMigration{}, err
+	}
+	rows, err := q.Query(ctx, `SELECT version, name, checksum, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	applied := map[int64]appliedMigration{}
+	for rows.Next() {
+		var a appliedMigration
+		if err := rows.Scan(&a.version, &a.name, &a.checksum, &a.appliedAt); err != nil {
+			return nil, err
+		}
+		applied[a.version] = a
+	}
+	return applied, rows.Err()
+}
+
+// checkApplied fails if the database has a version this build doesn't
+// have, or one whose file has changed since it was applied.
+func checkApplied(migrations []migration, applied map[int64]appliedMigration) error {
+	known := map[int64]migration{}
+	for _, m := range migrations {
+		known[m.version] = m
+	}
+	var latest int64
+	if len(migrations) > 0 {
+		latest = migrations[len(migrations)-1].version
+	}
+	for v, a := range applied {
+		m, ok := known[v]
+		switch {
+		case !ok && v > latest:
+			return fmt.Errorf("%w: version %d (%s) is applied, this build knows up to %d", errSchemaNewer, v, a.name, latest)
+		case !ok:
+			return fmt.Errorf("%w: version %d (%s)", errSchemaUnknown, v, a.name)
+		case m.checksum != a.checksum:
+			return fmt.Errorf("%w: version %d (%s) was changed after it was applied", errSchemaUnknown, v, a.name)
+		}
+	}
+	return nil
+}
+
+// withMigrationLock runs fn on one connection holding the migration lock,
+// with schema_migrations in place.
+func withMigrationLock(ctx context.Context, db *pgxpool.Pool, fn func(conn *pgxpool.Conn) error) error {
+	conn, err := db.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+	if _, err := conn.Exec(ctx, `SELECT pg_advisory_lock($1)`, migrationLockKey); err != nil {
+		return err
+	}
+	defer func() {
+		// ctx may be done; the lock must go regardless or the pooled
+		// connection keeps it
+		_, _ = conn.Exec(context.Background(), `SELECT pg_advisory_unlock($1)`, migrationLockKey)
+	}()
+	if _, err := conn.Exec(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (version BIGINT PRIMARY KEY, name TEXT NOT NULL, checksum TEXT NOT NULL, applied_at TIMESTAMPTZ NOT NULL DEFAULT now())`); err != nil {
+		return err
+	}
+	return fn(conn)
+}
+
+// migrateUp applies up to n pending migrations in order, all of them when
+// n is 0, each in its own transaction. It returns those it applied.
+func migrateUp(ctx context.Context, db *pgxpool.Pool, n int) ([]migration, error) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return nil, err
+	}
+	var done []migration
+	err = withMigrationLock(ctx, db, func(conn *pgxpool.Conn) error {
+		applied, err := loadApplied(ctx, conn)
+		if err != nil {
+			return err
+		}
+		if err := checkApplied(migrations, applied); err != nil {
+			return err
+		}
+		for _, m := range migrations {
+			if _, ok := applied[m.version]; ok {
+				continue
+			}
+			if n > 0 && len(done) == n {
+				break
+			}
+			err := pgx.BeginFunc(ctx, conn, func(tx pgx.Tx) error {
+				if _, err := tx.Exec(ctx, m.up); err != nil {
+					return err
+				}
+				_, err := tx.Exec(ctx, `INSERT INTO schema_migrations (version, name, checksum) VALUES ($1, $2, $3)`, m.version, m.name, m.checksum)
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("migration %d (%s): %w", m.version, m.name, err)
+			}
+			done = append(done, m)
+		}
+		return nil
+	})
+	return done, err
+}
+
+// migrateDown reverts the last n applied migrations, newest first. It stops
+// at one without a down file.
+func migrateDown(ctx context.Context, db *pgxpool.Pool, n int) ([]migration, error) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return nil, err
+	}
+	var done []migration
+	err = withMigrationLock(ctx, db, func(conn *pgxpool.Conn) error {
+		applied, err := loadApplied(ctx, conn)
+		if err != nil {
+			return err
+		}
+		if err := checkApplied(migrations, applied); err != nil {
+			return err
+		}
+		for i := len(migrations) - 1; i >= 0 && len(done) < n; i-- {
+			m := migrations[i]
+			if _, ok := applied[m.version]; !ok {
+				continue
+			}
+			if m.down == "" {
+				return fmt.Errorf("migration %d (%s) can't be reverted", m.version, m.name)
+			}
+			err := pgx.BeginFunc(ctx, conn, func(tx pgx.Tx) error {
+				if _, err := tx.Exec(ctx, m.down); err != nil {
+					return err
+				}
+				_, err := tx.Exec(ctx, `DELETE FROM schema_migrations WHERE version = $1`, m.version)
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("migration %d (%s): %w", m.version, m.name, err)
+			}
+			done = append(done, m)
+		}
+		return nil
+	})
+	return done, err
+}
+
+// errNoSchema is returned by Migrate for stores without a schema.
+var errNoSchema = errors.New("store has no schema to migrate")
+
+// MigrateOnStartup brings the schema up to date before serving. mode "up",
+// the default, applies pending migrations; "check" only verifies, for
+// deployments that run "migrate up" as a separate step. Either way a
+// database migrated by a newer build, or by a different one, is refused
+// rather than served with the wrong schema. Only Postgres has a schema;
+// other stores pass.
+func MigrateOnStartup(ctx context.Context, store Store, mode string, logger *slog.Logger) error {
+	pg, ok := store.(*pgStore)
+	if !ok {
+		return nil
+	}
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return migrateOnStartup(ctx, pg.pool, mode, logger)
+}
+
+func migrateOnStartup(ctx context.Context, db *pgxpool.Pool, mode string, logger *slog.Logger) error {
+	switch mode {
+	case "", "up":
+		done, err := migrateUp(ctx, db, 0)
+		for _, m := range done {
+			logger.Info("schema: applied migration", "version", m.version, "name", m.name)
+		}
+		return err
+	case "check":
+		migrations, err := loadMigrations()
+		if err != nil {
+			return err
+		}
+		applied, err := loadApplied(ctx, db)
+		if err != nil {
+			return err
+		}
+		if err := checkApplied(migrations, applied); err != nil {
+			return err
+		}
+		if pending := len(migrations) - len(applied); pending > 0 {
+			return fmt.Errorf("%w: %d; run migrate up", errSchemaPending, pending)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown migrate mode %q (want up or check)", mode)
+}
+
+// Migrate runs the migrate command against store, writing progress to out:
+//
+//	server migrate up [n]     apply pending migrations, or the next n
+//	server migrate down [n]   revert the last migration, or the last n
+//	server migrate status     list migrations and whether they are applied
+func Migrate(ctx context.Context, store Store, args []string, out io.Writer) error {
+	pg, ok := store.(*pgStore)
+	if !ok {
+		return errNoSchema
+	}
+	return runMigrate(ctx, pg.pool, args, out)
+}
+
+func runMigrate(ctx context.Context, db *pgxpool.Pool, args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return errors.New("usage: migrate up [n] | down [n] | status")
+	}
+	n := 0
+	if args[0] == "down" {
+		n = 1
+	}
+	if len(args) > 1 {
+		v, err := strconv.Atoi(args[1])
+		if err != nil || v <= 0 {
+			return fmt.Errorf("bad count %q", args[1])
+		}
+		n = v
+	}
+	switch args[0] {
+	case "up", "down":
+		migrate := migrateUp
+		verb := "applied"
+		if args[0] == "down" {
+			migrate, verb = migrateDown, "reverted"
+		}
+		done, err := migrate(ctx, db, n)
+		for _, m := range done {
+			fmt.Fprintf(out, "%s %04d_%s\n", verb, m.version, m.name)
+		}
+		if err == nil && len(done) == 0 {
+			fmt.Fprintln(out, "nothing to do")
+		}
+		return err
+	case "status":
+		migrations, err := loadMigrations()
+		if err != nil {
+			return err
+		}
+		applied, err := loadApplied(ctx, db)
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "VERSION\tNAME\tSTATE\tAPPLIED AT")
+		for _, m := range migrations {
+			state, at := "pending", ""
+			if a, ok := applied[m.version]; ok {
+				state, at = "applied", a.appliedAt.Format(time.RFC3339)
+				if a.checksum != m.checksum {
+					state = "changed"
+				}
+				delete(applied, m.version)
+			}
+			if m.down == "" {
+				state += ", irreversible"
+			}
+			fmt.Fprintf(tw, "%04d\t%s\t%s\t%s\n", m.version, m.name, state, at)
+		}
+		// whatever is left was applied by another build
+		unknown := make([]int64, 0, len(applied))
+		for v := range applied {
+			unknown = append(unknown, v)
+		}
+		slices.Sort(unknown)
+		for _, v := range unknown {
+			fmt.Fprintf(tw, "%04d\t%s\t%s\t%s\n", v, applied[v].name, "unknown", applied[v].appliedAt.Format(time.RFC3339))
+		}
+		return tw.Flush()
+	}
+	return fmt.Errorf("unknown migrate command %q", args[0])
+}
@@ -0,0 +1,128 @@
+package turbo
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"testing"
+)
+
+func TestLoadMigrations(t *testing.T) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := map[string]bool{}
+	for i, m := range migrations {
+		if m.version != int64(i+1) {
+			t.Errorf("migration %d (%s) follows %d; versions must be consecutive", m.version, m.name, i)
+		}
+		if m.up == "" {
+			t.Errorf("migration %d (%s) has no up file", m.version, m.name)
+		}
+		if len(m.checksum) != 64 || seen[m.checksum] {
+			t.Errorf("migration %d (%s) checksum %q", m.version, m.name, m.checksum)
+		}
+		seen[m.checksum] = true
+	}
+}
+
+func TestCheckApplied(t *testing.T) {
+	migrations := []migration{
+		{version: 1, name: "baseline", checksum: "a"},
+		{version: 3, name: "inbox", checksum: "c"},
+	}
+	applied := func(rows ...appliedMigration) map[int64]appliedMigration {
+		out := map[int64]appliedMigration{}
+		for _, a := range rows {
+			out[a.version] = a
+		}
+		return out
+	}
+	for _, tc := range []struct {
+		name    string
+		applied map[int64]appliedMigration
+		want    error
+	}{
+		{"fresh database", applied(), nil},
+		{"partly migrated", applied(appliedMigration{version: 1, name: "baseline", checksum: "a"}), nil},
+		{"up to date", applied(appliedMigration{version: 1, checksum: "a"}, appliedMigration{version: 3, checksum: "c"}), nil},
+		{"newer build", applied(appliedMigration{version: 1, checksum: "a"}, appliedMigration{version: 4, name: "later"}), errSchemaNewer},
+		{"other build", applied(appliedMigration{version: 2, name: "branch"}), errSchemaUnknown},
+		{"edited migration", applied(appliedMigration{version: 1, checksum: "edited"}), errSchemaUnknown},
+	} {
+		if err := checkApplied(migrations, tc.applied); !errors.Is(err, tc.want) {
+			t.Errorf("%s: %v, want %v", tc.name, err, tc.want)
+		}
+	}
+}
+
+func TestMigrateWithoutSchema(t *testing.T) {
+	st := NewMemoryStore(nil)
+	if err := MigrateOnStartup(context.Background(), st, "check", nil); err != nil {
+		t.Errorf("check on the memory store: %v", err)
+	}
+	if err := Migrate(context.Background(), st, []string{"status"}, io.Discard); !errors.Is(err, errNoSchema) {
+		t.Errorf("migrate on the memory store: %v, want errNoSchema", err)
+	}
+}
+
+func TestMigrateCheck(t *testing.T) {
+	st, _ := testPostgres(t)
+	pool := st.(*pgStore).pool
+	ctx := context.Background()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	migrations, err := loadMigrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	latest := migrations[len(migrations)-1]
+	exec := func(sql string, args ...any) {
+		t.Helper()
+		if _, err := pool.Exec(ctx, sql, args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := MigrateOnStartup(ctx, st, "check", logger); err != nil {
+		t.Fatalf("check after up: %v", err)
+	}
+	if err := MigrateOnStartup(ctx, st, "sideways", logger); err == nil {
+		t.Error("unknown mode accepted")
+	}
+
+	// each case edits schema_migrations as another build would have left
+	// it and puts it back afterwards
+	v := latest.version
+	for _, tc := range []struct {
+		name         string
+		change, undo func()
+		want         error
+	}{
+		{"pending",
+			func() { exec(`DELETE FROM schema_migrations WHERE version = $1`, v) },
+			func() {
+				exec(`INSERT INTO schema_migrations (version, name, checksum) VALUES ($1, $2, $3)`, v, latest.name, latest.checksum)
+			},
+			errSchemaPending},
+		{"edited",
+			func() { exec(`UPDATE schema_migrations SET checksum = 'edited' WHERE version = $1`, v) },
+			func() { exec(`UPDATE schema_migrations SET checksum = $2 WHERE version = $1`, v, latest.checksum) },
+			errSchemaUnknown},
+		{"newer",
+			func() { exec(`INSERT INTO schema_migrations (version, name, checksum) VALUES ($1, 'later', 'x')`, v+1) },
+			func() { exec(`DELETE FROM schema_migrations WHERE version = $1`, v+1) },
+			errSchemaNewer},
+	} {
+		tc.change()
+		err := MigrateOnStartup(ctx, st, "check", logger)
+		tc.undo()
+		if !errors.Is(err, tc.want) {
+			t.Errorf("%s: %v, want %v", tc.name, err, tc.want)
+		}
+	}
+	if err := MigrateOnStartup(ctx, st, "check", logger); err != nil {
+		t.Errorf("check after restoring: %v", err)
+	}
+}
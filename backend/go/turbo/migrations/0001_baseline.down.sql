@@ -0,0 +1,4 @@
+-- Drops everything; for resetting development databases.
+DROP TABLE IF EXISTS notification_cursors, notifications, push_subscriptions, notification_prefs, presence,
+	webhook_deliveries, webhooks, bot_commands, scheduled_messages, mutes, room_members, mentions, images,
+	outbox, dead_letters, messages, rooms, incoming_webhooks, users CASCADE;
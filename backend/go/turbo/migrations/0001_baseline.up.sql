@@ -0,0 +1,55 @@
+-- The schema as main() used to create it ad hoc, before conversations.
+-- Everything is IF NOT EXISTS so databases created that way adopt it as is.
+
+-- ensure tables exist: users, messages, images
+CREATE TABLE IF NOT EXISTS users (id BIGSERIAL PRIMARY KEY, email TEXT UNIQUE NOT NULL, password_hash BYTEA NOT NULL, display_name TEXT, avatar_url TEXT, bio TEXT);
+CREATE TABLE IF NOT EXISTS messages (id BIGSERIAL PRIMARY KEY, user_id BIGINT REFERENCES users(id) ON DELETE SET NULL, text TEXT, created_at TIMESTAMPTZ DEFAULT now(), recipient TEXT);
+CREATE TABLE IF NOT EXISTS images (id BIGSERIAL PRIMARY KEY, message_id BIGINT REFERENCES messages(id) ON DELETE CASCADE, url TEXT NOT NULL, filename TEXT, filesize BIGINT, created_at TIMESTAMPTZ DEFAULT now());
+-- @handles for mentions, unique regardless of case
+ALTER TABLE users ADD COLUMN IF NOT EXISTS handle TEXT;
+CREATE UNIQUE INDEX IF NOT EXISTS users_handle_uniq ON users (lower(handle));
+-- mentions holds resolved @mentions; user_id is NULL for @here/@room
+CREATE TABLE IF NOT EXISTS mentions (message_id BIGINT NOT NULL REFERENCES messages(id) ON DELETE CASCADE, user_id BIGINT REFERENCES users(id) ON DELETE CASCADE, kind TEXT NOT NULL, start_offset INT NOT NULL, end_offset INT NOT NULL, PRIMARY KEY (message_id, start_offset));
+CREATE INDEX IF NOT EXISTS mentions_user_idx ON mentions (user_id, message_id DESC);
+-- dead_letters keeps bus messages that exhausted their retries, for inspection and replay
+CREATE TABLE IF NOT EXISTS dead_letters (id BIGSERIAL PRIMARY KEY, topic TEXT NOT NULL, body BYTEA NOT NULL, body_hash TEXT NOT NULL, attempts INT NOT NULL, error TEXT, instance TEXT, created_at TIMESTAMPTZ NOT NULL DEFAULT now(), replayed_at TIMESTAMPTZ);
+-- every instance sees the same poison message on its own channel; keep one row per message
+CREATE UNIQUE INDEX IF NOT EXISTS dead_letters_pending_uniq ON dead_letters (topic, body_hash) WHERE replayed_at IS NULL;
+-- outbox holds bus events written in the same transaction as the rows they describe
+CREATE TABLE IF NOT EXISTS outbox (id BIGSERIAL PRIMARY KEY, event_id TEXT UNIQUE NOT NULL, topic TEXT NOT NULL, payload JSONB NOT NULL, created_at TIMESTAMPTZ NOT NULL DEFAULT now(), attempts INT NOT NULL DEFAULT 0, next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT now(), published_at TIMESTAMPTZ, last_error TEXT);
+CREATE INDEX IF NOT EXISTS outbox_pending_idx ON outbox (next_attempt_at) WHERE published_at IS NULL;
+-- incoming webhooks post into a conversation as their owner
+CREATE TABLE IF NOT EXISTS incoming_webhooks (id BIGSERIAL PRIMARY KEY, owner_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE, token_hash TEXT UNIQUE NOT NULL, recipient TEXT, name TEXT, avatar_url TEXT, created_at TIMESTAMPTZ NOT NULL DEFAULT now(), last_used_at TIMESTAMPTZ);
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS webhook_id BIGINT REFERENCES incoming_webhooks(id) ON DELETE SET NULL, ADD COLUMN IF NOT EXISTS author_name TEXT, ADD COLUMN IF NOT EXISTS author_avatar TEXT, ADD COLUMN IF NOT EXISTS attachments JSONB;
+-- rooms: named group conversations; messages and frames with "room" go to
+-- members only. mutes silence notifications per conversation key.
+CREATE TABLE IF NOT EXISTS rooms (id BIGSERIAL PRIMARY KEY, name TEXT NOT NULL, topic TEXT, created_by BIGINT REFERENCES users(id) ON DELETE SET NULL, created_at TIMESTAMPTZ NOT NULL DEFAULT now());
+CREATE UNIQUE INDEX IF NOT EXISTS rooms_name_uniq ON rooms (lower(name));
+CREATE TABLE IF NOT EXISTS room_members (room_id BIGINT NOT NULL REFERENCES rooms(id) ON DELETE CASCADE, user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE, joined_at TIMESTAMPTZ NOT NULL DEFAULT now(), PRIMARY KEY (room_id, user_id));
+CREATE TABLE IF NOT EXISTS mutes (user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE, conversation TEXT NOT NULL, created_at TIMESTAMPTZ NOT NULL DEFAULT now(), PRIMARY KEY (user_id, conversation));
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS recipient TEXT, ADD COLUMN IF NOT EXISTS room_id BIGINT REFERENCES rooms(id) ON DELETE CASCADE, ADD COLUMN IF NOT EXISTS subtype TEXT;
+-- history pages on (created_at, id), overall and per room
+CREATE INDEX IF NOT EXISTS messages_created_idx ON messages (created_at, id);
+CREATE INDEX IF NOT EXISTS messages_room_created_idx ON messages (room_id, created_at, id) WHERE room_id IS NOT NULL;
+-- full-text search over message text
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS search tsvector GENERATED ALWAYS AS (to_tsvector('english', COALESCE(text, ''))) STORED;
+CREATE INDEX IF NOT EXISTS messages_search_idx ON messages USING GIN (search);
+-- scheduled messages and reminders; frame is the message frame to send
+CREATE TABLE IF NOT EXISTS scheduled_messages (id BIGSERIAL PRIMARY KEY, user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE, kind TEXT NOT NULL, target_id BIGINT REFERENCES users(id) ON DELETE CASCADE, frame JSONB NOT NULL, send_at TIMESTAMPTZ NOT NULL, status TEXT NOT NULL DEFAULT 'pending', created_at TIMESTAMPTZ NOT NULL DEFAULT now(), sent_at TIMESTAMPTZ, message_id BIGINT REFERENCES messages(id) ON DELETE SET NULL, last_error TEXT);
+CREATE INDEX IF NOT EXISTS scheduled_messages_due_idx ON scheduled_messages (send_at) WHERE status = 'pending';
+-- slash commands answered by bots over HTTP
+CREATE TABLE IF NOT EXISTS bot_commands (id BIGSERIAL PRIMARY KEY, name TEXT UNIQUE NOT NULL, url TEXT NOT NULL, secret TEXT NOT NULL, owner_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE, description TEXT, display_name TEXT, created_at TIMESTAMPTZ NOT NULL DEFAULT now());
+-- roles gate webhooks and admin endpoints
+ALTER TABLE users ADD COLUMN IF NOT EXISTS role TEXT NOT NULL DEFAULT 'member';
+-- outgoing webhooks and their delivery log
+CREATE TABLE IF NOT EXISTS webhooks (id BIGSERIAL PRIMARY KEY, owner_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE, url TEXT NOT NULL, secret TEXT NOT NULL, events TEXT[] NOT NULL, room TEXT, active BOOLEAN NOT NULL DEFAULT true, failures INT NOT NULL DEFAULT 0, disabled_at TIMESTAMPTZ, created_at TIMESTAMPTZ NOT NULL DEFAULT now());
+CREATE TABLE IF NOT EXISTS webhook_deliveries (id BIGSERIAL PRIMARY KEY, webhook_id BIGINT NOT NULL REFERENCES webhooks(id) ON DELETE CASCADE, event_id TEXT NOT NULL, event_type TEXT NOT NULL, payload JSONB NOT NULL, status TEXT NOT NULL DEFAULT 'pending', attempts INT NOT NULL DEFAULT 0, next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT now(), response_code INT, last_error TEXT, created_at TIMESTAMPTZ NOT NULL DEFAULT now(), delivered_at TIMESTAMPTZ, UNIQUE (webhook_id, event_id));
+CREATE INDEX IF NOT EXISTS webhook_deliveries_pending_idx ON webhook_deliveries (next_attempt_at) WHERE status = 'pending';
+-- notifications for offline/idle users: presence, preferences, browser push
+-- subscriptions, the queue itself and a per-user, per-sink delivery cursor
+CREATE TABLE IF NOT EXISTS presence (user_id BIGINT PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE, last_seen_at TIMESTAMPTZ NOT NULL DEFAULT now(), last_active_at TIMESTAMPTZ NOT NULL DEFAULT now());
+CREATE TABLE IF NOT EXISTS notification_prefs (user_id BIGINT PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE, dms BOOLEAN NOT NULL DEFAULT true, mentions BOOLEAN NOT NULL DEFAULT true, web_push BOOLEAN NOT NULL DEFAULT true, email BOOLEAN NOT NULL DEFAULT false, webhook_url TEXT, quiet_start INT, quiet_end INT, timezone TEXT NOT NULL DEFAULT 'UTC', digest_minutes INT NOT NULL DEFAULT 60);
+CREATE TABLE IF NOT EXISTS push_subscriptions (id BIGSERIAL PRIMARY KEY, user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE, endpoint TEXT UNIQUE NOT NULL, p256dh TEXT NOT NULL, auth TEXT NOT NULL, created_at TIMESTAMPTZ NOT NULL DEFAULT now());
+CREATE TABLE IF NOT EXISTS notifications (id BIGSERIAL PRIMARY KEY, user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE, kind TEXT NOT NULL, message_id BIGINT REFERENCES messages(id) ON DELETE CASCADE, payload JSONB NOT NULL, created_at TIMESTAMPTZ NOT NULL DEFAULT now());
+CREATE INDEX IF NOT EXISTS notifications_user_idx ON notifications (user_id, id);
+CREATE TABLE IF NOT EXISTS notification_cursors (user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE, sink TEXT NOT NULL, last_id BIGINT NOT NULL DEFAULT 0, last_sent_at TIMESTAMPTZ, attempts INT NOT NULL DEFAULT 0, retry_at TIMESTAMPTZ, PRIMARY KEY (user_id, sink));
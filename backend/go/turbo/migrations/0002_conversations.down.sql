@@ -0,0 +1,37 @@
+-- groups have no equivalent before conversations; refuse rather than drop
+-- their messages
+DO $$
+BEGIN
+	IF EXISTS (SELECT 1 FROM conversations WHERE kind = 'group') THEN
+		RAISE EXCEPTION 'group conversations exist; delete them before reverting 0002';
+	END IF;
+END $$;
+
+CREATE TABLE rooms (id BIGSERIAL PRIMARY KEY, name TEXT NOT NULL, topic TEXT, created_by BIGINT REFERENCES users(id) ON DELETE SET NULL, created_at TIMESTAMPTZ NOT NULL DEFAULT now());
+CREATE UNIQUE INDEX rooms_name_uniq ON rooms (lower(name));
+CREATE TABLE room_members (room_id BIGINT NOT NULL REFERENCES rooms(id) ON DELETE CASCADE, user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE, joined_at TIMESTAMPTZ NOT NULL DEFAULT now(), PRIMARY KEY (room_id, user_id));
+CREATE TABLE mutes (user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE, conversation TEXT NOT NULL, created_at TIMESTAMPTZ NOT NULL DEFAULT now(), PRIMARY KEY (user_id, conversation));
+
+-- room conversations go back to rooms with the same ids
+INSERT INTO rooms (id, name, topic, created_by, created_at) SELECT id, COALESCE(name, 'room ' || id), topic, created_by, created_at FROM conversations WHERE kind = 'room';
+SELECT setval(pg_get_serial_sequence('rooms', 'id'), GREATEST((SELECT max(id) FROM rooms), 1));
+INSERT INTO room_members (room_id, user_id, joined_at) SELECT cp.conversation_id, cp.user_id, cp.joined_at FROM conversation_participants cp JOIN conversations c ON c.id = cp.conversation_id WHERE c.kind = 'room';
+INSERT INTO mutes (user_id, conversation) SELECT cp.user_id, CASE WHEN c.kind = 'direct' THEN 'dm:' || c.direct_key ELSE 'room:' || c.id END
+	FROM conversation_participants cp JOIN conversations c ON c.id = cp.conversation_id
+	WHERE cp.muted AND (c.kind = 'room' OR c.direct_key IS NOT NULL);
+
+ALTER TABLE messages ADD COLUMN recipient TEXT, ADD COLUMN room_id BIGINT REFERENCES rooms(id) ON DELETE CASCADE;
+UPDATE messages m SET room_id = c.id FROM conversations c WHERE c.id = m.conversation_id AND c.kind = 'room';
+-- a DM's recipient is the participant who isn't its author; notes to self
+-- name their author, and orphaned DMs keep a recipient that names nobody
+UPDATE messages m SET recipient = COALESCE(
+		(SELECT min(cp.user_id) FROM conversation_participants cp WHERE cp.conversation_id = m.conversation_id AND cp.user_id IS DISTINCT FROM m.user_id),
+		(SELECT min(cp.user_id) FROM conversation_participants cp WHERE cp.conversation_id = m.conversation_id),
+		0)::text
+	FROM conversations c WHERE c.id = m.conversation_id AND c.kind = 'direct';
+CREATE INDEX messages_room_created_idx ON messages (room_id, created_at, id) WHERE room_id IS NOT NULL;
+
+DROP INDEX messages_conversation_created_idx;
+ALTER TABLE messages DROP COLUMN conversation_id;
+DROP TABLE conversation_participants;
+DROP TABLE conversations;
@@ -0,0 +1,50 @@
+-- conversations: direct (direct_key is "<a>,<b>" by user id), group and
+-- named room conversations; messages without one are in the public room.
+-- participants see the messages and frames and may mute notifications.
+CREATE TABLE IF NOT EXISTS conversations (id BIGSERIAL PRIMARY KEY, kind TEXT NOT NULL, name TEXT, topic TEXT, direct_key TEXT UNIQUE, created_by BIGINT REFERENCES users(id) ON DELETE SET NULL, created_at TIMESTAMPTZ NOT NULL DEFAULT now());
+CREATE UNIQUE INDEX IF NOT EXISTS conversations_room_name_uniq ON conversations (lower(name)) WHERE kind = 'room';
+CREATE TABLE IF NOT EXISTS conversation_participants (conversation_id BIGINT NOT NULL REFERENCES conversations(id) ON DELETE CASCADE, user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE, joined_at TIMESTAMPTZ NOT NULL DEFAULT now(), muted BOOLEAN NOT NULL DEFAULT false, PRIMARY KEY (conversation_id, user_id));
+CREATE INDEX IF NOT EXISTS conversation_participants_user_idx ON conversation_participants (user_id);
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS conversation_id BIGINT REFERENCES conversations(id) ON DELETE CASCADE;
+CREATE INDEX IF NOT EXISTS messages_conversation_created_idx ON messages (conversation_id, created_at, id);
+
+-- rooms become room conversations with the same ids, so frames and
+-- scheduled messages addressing "room": N still work
+INSERT INTO conversations (id, kind, name, topic, created_by, created_at) SELECT id, 'room', name, topic, created_by, created_at FROM rooms ON CONFLICT (id) DO NOTHING;
+SELECT setval(pg_get_serial_sequence('conversations', 'id'), GREATEST((SELECT max(id) FROM conversations), 1));
+INSERT INTO conversation_participants (conversation_id, user_id, joined_at) SELECT room_id, user_id, joined_at FROM room_members ON CONFLICT DO NOTHING;
+UPDATE messages SET conversation_id = room_id WHERE room_id IS NOT NULL AND conversation_id IS NULL;
+
+-- each DM's two sides; a recipient that names nobody leaves the message
+-- with its author, as a note to self
+CREATE TEMP TABLE dm_migration ON COMMIT DROP AS
+	SELECT m.id, m.user_id AS a, COALESCE((SELECT u.id FROM users u WHERE u.id::text = m.recipient OR lower(u.email) = lower(m.recipient) ORDER BY u.id LIMIT 1), m.user_id) AS b, m.created_at
+	FROM messages m WHERE COALESCE(m.recipient, '') <> '' AND m.conversation_id IS NULL;
+UPDATE dm_migration SET a = b WHERE a IS NULL;
+ALTER TABLE dm_migration ADD COLUMN key TEXT;
+UPDATE dm_migration SET key = least(a, b) || ',' || greatest(a, b) WHERE a IS NOT NULL;
+INSERT INTO conversations (kind, direct_key, created_at) SELECT 'direct', key, min(created_at) FROM dm_migration WHERE key IS NOT NULL GROUP BY key ON CONFLICT (direct_key) DO NOTHING;
+INSERT INTO conversation_participants (conversation_id, user_id) SELECT DISTINCT c.id, p.uid FROM dm_migration d JOIN conversations c ON c.direct_key = d.key CROSS JOIN LATERAL (VALUES (d.a), (d.b)) p(uid) ON CONFLICT DO NOTHING;
+UPDATE messages m SET conversation_id = c.id FROM dm_migration d JOIN conversations c ON c.direct_key = d.key WHERE m.id = d.id;
+-- DMs whose author and recipient are both gone can't be shown to anyone,
+-- and without a recipient they would read as public; they are kept in one
+-- direct conversation with no key and no participants
+INSERT INTO conversations (kind, name, created_at) SELECT 'direct', 'orphaned direct messages', min(created_at) FROM dm_migration WHERE key IS NULL HAVING count(*) > 0;
+UPDATE messages m SET conversation_id = (SELECT max(id) FROM conversations WHERE kind = 'direct' AND direct_key IS NULL)
+	FROM dm_migration d WHERE m.id = d.id AND d.key IS NULL;
+
+-- mutes become a flag on the participant; DM keys named each side by id
+-- or by email
+UPDATE conversation_participants cp SET muted = true FROM mutes mu WHERE mu.user_id = cp.user_id AND mu.conversation = 'room:' || cp.conversation_id;
+UPDATE conversation_participants cp SET muted = true FROM mutes mu, conversations c
+	WHERE mu.conversation LIKE 'dm:%' AND mu.user_id = cp.user_id AND c.id = cp.conversation_id AND c.kind = 'direct'
+	AND c.direct_key = (SELECT least(x.id, y.id) || ',' || greatest(x.id, y.id) FROM users x, users y
+		WHERE (x.id::text = split_part(substr(mu.conversation, 4), ',', 1) OR lower(x.email) = lower(split_part(substr(mu.conversation, 4), ',', 1)))
+		AND (y.id::text = split_part(substr(mu.conversation, 4), ',', 2) OR lower(y.email) = lower(split_part(substr(mu.conversation, 4), ',', 2)))
+		LIMIT 1);
+
+DROP TABLE mutes;
+DROP INDEX IF EXISTS messages_room_created_idx;
+ALTER TABLE messages DROP COLUMN recipient, DROP COLUMN room_id;
+DROP TABLE room_members;
+DROP TABLE rooms;
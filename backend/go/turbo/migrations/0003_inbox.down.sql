@@ -0,0 +1,3 @@
+DROP INDEX messages_conversation_id_idx;
+ALTER TABLE conversation_participants DROP COLUMN pinned, DROP COLUMN last_read_id;
+ALTER TABLE conversations DROP COLUMN last_activity_at;
@@ -0,0 +1,10 @@
+-- the inbox: conversations order by last activity, participants pin them
+-- and have read up to last_read_id; both are filled in for existing rows
+ALTER TABLE conversations ADD COLUMN IF NOT EXISTS last_activity_at TIMESTAMPTZ;
+UPDATE conversations c SET last_activity_at = COALESCE((SELECT max(m.created_at) FROM messages m WHERE m.conversation_id = c.id), c.created_at) WHERE last_activity_at IS NULL;
+ALTER TABLE conversations ALTER COLUMN last_activity_at SET DEFAULT now(), ALTER COLUMN last_activity_at SET NOT NULL;
+ALTER TABLE conversation_participants ADD COLUMN IF NOT EXISTS pinned BOOLEAN NOT NULL DEFAULT false, ADD COLUMN IF NOT EXISTS last_read_id BIGINT;
+UPDATE conversation_participants cp SET last_read_id = COALESCE((SELECT max(m.id) FROM messages m WHERE m.conversation_id = cp.conversation_id), 0) WHERE last_read_id IS NULL;
+ALTER TABLE conversation_participants ALTER COLUMN last_read_id SET DEFAULT 0, ALTER COLUMN last_read_id SET NOT NULL;
+-- unread counts
+CREATE INDEX IF NOT EXISTS messages_conversation_id_idx ON messages (conversation_id, id);
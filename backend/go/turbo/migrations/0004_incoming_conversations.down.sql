@@ -0,0 +1,4 @@
+-- without the column a hook into a group or room would post publicly;
+-- drop those hooks instead
+DELETE FROM incoming_webhooks WHERE conversation_id IS NOT NULL;
+ALTER TABLE incoming_webhooks DROP COLUMN conversation_id;
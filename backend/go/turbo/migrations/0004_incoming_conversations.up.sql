@@ -0,0 +1,2 @@
+-- incoming webhooks can post into a group or room; the hook goes with it
+ALTER TABLE incoming_webhooks ADD COLUMN IF NOT EXISTS conversation_id BIGINT REFERENCES conversations(id) ON DELETE CASCADE;
@@ -0,0 +1,503 @@
+package turbo
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+	_ "time/tzdata" // quiet hours need zone data even on minimal images
+)
+
+const (
+	// presenceInterval is how often each instance records which users have
+	// an open connection; a user unseen for two intervals is offline.
+	presenceInterval = 30 * time.Second
+	// notifyPoll is how often the dispatcher looks for undelivered
+	// notifications.
+	notifyPoll = 5 * time.Second
+	// notifyBatch caps how many notifications one delivery carries.
+	notifyBatch = 50
+	// notifyRetention is how long notifications are kept after creation.
+	notifyRetention = 7 * 24 * time.Hour
+	// notifyLease is how long a pass holds the cursors it is delivering;
+	// if the instance dies mid-delivery they are retried after it.
+	notifyLease = 5 * time.Minute
+)
+
+// Notification kinds.
+const (
+	notifyDM       = "dm"
+	notifyMention  = "mention"
+	notifyReminder = "reminder"
+)
+
+// notification is one alert for a user who was offline or idle when a DM or
+// mention arrived.
+type notification struct {
+	ID        int64           `json:"id"`
+	Kind      string          `json:"kind"`
+	MessageID int64           `json:"message_id"`
+	Payload   json.RawMessage `json:"payload"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+// notifyPrefs are a user's notification preferences. Quiet hours are minutes
+// after local midnight in Timezone and may wrap past midnight.
+type notifyPrefs struct {
+	DMs           bool   `json:"dms"`
+	Mentions      bool   `json:"mentions"`
+	WebPush       bool   `json:"web_push"`
+	Email         bool   `json:"email"`
+	WebhookURL    string `json:"webhook_url,omitempty"`
+	QuietStart    *int   `json:"quiet_start,omitempty"`
+	QuietEnd      *int   `json:"quiet_end,omitempty"`
+	Timezone      string `json:"timezone"`
+	DigestMinutes int    `json:"digest_minutes"`
+}
+
+// defaultNotifyPrefs applies to users who never saved preferences.
+var defaultNotifyPrefs = notifyPrefs{DMs: true, Mentions: true, WebPush: true, Timezone: "UTC", DigestMinutes: 60}
+
+// quiet reports whether t falls inside the quiet hours.
+func (p notifyPrefs) quiet(t time.Time) bool {
+	if p.QuietStart == nil || p.QuietEnd == nil || *p.QuietStart == *p.QuietEnd {
+		return false
+	}
+	if loc, err := time.LoadLocation(p.Timezone); err == nil {
+		t = t.In(loc)
+	}
+	m := t.Hour()*60 + t.Minute()
+	start, end := *p.QuietStart, *p.QuietEnd
+	if start < end {
+		return m >= start && m < end
+	}
+	return m >= start || m < end
+}
+
+// notifyRecipient is who a sink delivers to.
+type notifyRecipient struct {
+	ID          int64
+	Email       string
+	DisplayName string
+	Prefs       notifyPrefs
+}
+
+// notifySink delivers batches of notifications through one channel.
+// Implementations live in notify_sinks.go.
+type notifySink interface {
+	// name identifies the sink in notification_cursors.
+	name() string
+	// enabled reports whether r wants (and can get) notifications here.
+	enabled(r *notifyRecipient) bool
+	// window is the minimum time between deliveries to one user; pending
+	// notifications accumulate into one batch meanwhile.
+	window(r *notifyRecipient) time.Duration
+	deliver(ctx context.Context, r *notifyRecipient, batch []notification) error
+}
+
+// enqueueNotifications records notifications for DM and group participants
+// and mentioned users who are offline or idle, in the message's
+// transaction. @here and @room never notify offline users. Outside the
+// public room (conv nil) only participants are notified, and nobody is
+// notified about a conversation they muted.
+func (s *Server) enqueueNotifications(ctx context.Context, tx Store, authorID int64, conv *conversation, mid int64, spans []mentionSpan, payload map[string]any) error {
+	kinds := map[int64]string{}
+	if conv != nil && conv.Kind != kindRoom {
+		for _, id := range conv.Members {
+			kinds[id] = notifyDM
+		}
+	}
+	for _, sp := range spans {
+		if sp.Kind == mentionUser && sp.UserID != 0 {
+			kinds[sp.UserID] = notifyMention
+		}
+	}
+	delete(kinds, authorID)
+	var convID int64
+	if conv != nil {
+		convID = conv.ID
+		for id := range kinds {
+			if !slices.Contains(conv.Members, id) {
+				delete(kinds, id)
+			}
+		}
+	}
+	return s.notifyAway(ctx, tx, kinds, convID, mid, payload)
+}
+
+// notifyAway queues a notification of the given kind for each user who is
+// offline or idle and hasn't muted conversation convID. mid and convID may
+// be 0 for notifications not about a message.
+func (s *Server) notifyAway(ctx context.Context, tx Store, kinds map[int64]string, convID int64, mid int64, payload map[string]any) error {
+	if len(kinds) == 0 {
+		return nil
+	}
+	ids := make([]int64, 0, len(kinds))
+	for id := range kinds {
+		ids = append(ids, id)
+	}
+	// anyone connected and recently active sees the message live, and muted
+	// conversations never notify
+	present, err := tx.Presence().Present(ctx, ids, s.now().Add(-2*presenceInterval), s.now().Add(-s.notifier.idleAfter))
+	if err != nil {
+		return err
+	}
+	muted, err := tx.Conversations().Muted(ctx, convID, ids)
+	if err != nil {
+		return err
+	}
+	for _, id := range append(present, muted...) {
+		delete(kinds, id)
+	}
+	body := mustJSON(payload)
+	for id, kind := range kinds {
+		if err := tx.Notifications().Add(ctx, id, kind, mid, body, s.notifier.sinkNames()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// notifier tracks presence and delivers queued notifications through its
+// sinks. Every user has a cursor per sink; a pass claims cursors with
+// undelivered notifications for the length of a transaction, so replicas
+// never deliver the same batch twice.
+type notifier struct {
+	store Store
+	hub   *hub
+	sinks []notifySink
+	log   *slog.Logger
+	now   func() time.Time
+	// idleAfter is how long without activity before a connected user is
+	// notified anyway
+	idleAfter time.Duration
+
+	mu     sync.Mutex
+	active map[int64]time.Time
+
+	quit chan struct{}
+	done chan struct{}
+	once sync.Once
+}
+
+func newNotifier(store Store, h *hub, idleAfter time.Duration, sinks []notifySink, logger *slog.Logger, now func() time.Time) *notifier {
+	return &notifier{
+		store:     store,
+		hub:       h,
+		sinks:     sinks,
+		log:       logger,
+		now:       now,
+		idleAfter: idleAfter,
+		active:    make(map[int64]time.Time),
+		quit:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+}
+
+func (n *notifier) sinkNames() []string {
+	names := make([]string, len(n.sinks))
+	for i, s := range n.sinks {
+		names[i] = s.name()
+	}
+	return names
+}
+
+func (n *notifier) sink(name string) notifySink {
+	for _, s := range n.sinks {
+		if s.name() == name {
+			return s
+		}
+	}
+	return nil
+}
+
+// touch marks u as active now; it is written out on the next presence flush.
+func (n *notifier) touch(u *user) {
+	if u == nil || u.ID == 0 {
+		return
+	}
+	n.mu.Lock()
+	n.active[u.ID] = n.now()
+	n.mu.Unlock()
+}
+
+// run flushes presence and dispatches notifications until stop is called.
+func (n *notifier) run() {
+	defer close(n.done)
+	presence := time.NewTicker(presenceInterval)
+	defer presence.Stop()
+	dispatch := time.NewTicker(notifyPoll)
+	defer dispatch.Stop()
+	ctx := context.Background()
+	lastCleanup := n.now()
+	for {
+		select {
+		case <-n.quit:
+			return
+		case <-presence.C:
+			if err := n.flushPresence(ctx); err != nil {
+				n.log.Error("presence", "err", err)
+			}
+			if n.now().Sub(lastCleanup) > time.Hour {
+				lastCleanup = n.now()
+				if err := n.store.Notifications().Cleanup(ctx, lastCleanup.Add(-notifyRetention)); err != nil {
+					n.log.Error("notify cleanup", "err", err)
+				}
+			}
+		case <-dispatch.C:
+			if err := n.dispatch(ctx); err != nil {
+				n.log.Error("notify", "err", err)
+			}
+		}
+	}
+}
+
+// stop ends the loop, waiting for the pass in progress.
+func (n *notifier) stop() {
+	n.once.Do(func() { close(n.quit) })
+	<-n.done
+}
+
+// flushPresence upserts last_seen_at for every locally connected user and
+// last_active_at for those who did something since the last flush.
+func (n *notifier) flushPresence(ctx context.Context) error {
+	n.mu.Lock()
+	active := n.active
+	n.active = make(map[int64]time.Time)
+	n.mu.Unlock()
+
+	if online := n.hub.onlineUsers(); len(online) > 0 {
+		if err := n.store.Presence().Seen(ctx, online); err != nil {
+			return err
+		}
+	}
+	for id, at := range active {
+		if err := n.store.Presence().Active(ctx, id, at); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// notifyJob is one batch a dispatch pass delivers.
+type notifyJob struct {
+	cursor notifyCursor
+	sink   notifySink
+	r      *notifyRecipient
+	batch  []notification
+	maxID  int64
+}
+
+// dispatch runs one pass over cursors with pending notifications. Batches
+// are picked and their cursors leased in a transaction and delivered after
+// it commits, so slow sinks hold neither a transaction nor the memory
+// store's write lock.
+func (n *notifier) dispatch(ctx context.Context) error {
+	var jobs []notifyJob
+	err := n.store.Tx(ctx, func(tx Store) error {
+		jobs = nil
+		cursors, err := tx.Notifications().Due(ctx, 100)
+		if err != nil {
+			return err
+		}
+
+		recipients := map[int64]*notifyRecipient{}
+		for _, c := range cursors {
+			sink := n.sink(c.Sink)
+			r, ok := recipients[c.UserID]
+			if !ok {
+				if r, err = loadRecipient(ctx, tx, c.UserID); err != nil {
+					return err
+				}
+				recipients[c.UserID] = r
+			}
+			if sink == nil || !sink.enabled(r) {
+				// nothing will ever go out here: skip what's queued
+				if err := tx.Notifications().Skip(ctx, c.UserID, c.Sink); err != nil {
+					return err
+				}
+				continue
+			}
+			now := n.now()
+			if r.Prefs.quiet(now) || (c.LastSent != nil && now.Sub(*c.LastSent) < sink.window(r)) {
+				continue
+			}
+			batch, maxID, err := pendingNotifications(ctx, tx, c.UserID, c.LastID, r.Prefs)
+			if err != nil {
+				return err
+			}
+			if len(batch) == 0 {
+				if err := tx.Notifications().Sent(ctx, c.UserID, c.Sink, maxID); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := tx.Notifications().Lease(ctx, c.UserID, c.Sink, now.Add(notifyLease)); err != nil {
+				return err
+			}
+			jobs = append(jobs, notifyJob{cursor: c, sink: sink, r: r, batch: batch, maxID: maxID})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, j := range jobs {
+		c := j.cursor
+		if err := j.sink.deliver(ctx, j.r, j.batch); err != nil {
+			n.log.Warn("notify: delivery failed", "sink", c.Sink, "user_id", c.UserID, "err", err)
+			backoff := time.Duration(1<<min(c.Attempts, 10)) * time.Second
+			errs = append(errs, n.store.Notifications().Retry(ctx, c.UserID, c.Sink, n.now().Add(backoff)))
+			continue
+		}
+		errs = append(errs, n.store.Notifications().Sent(ctx, c.UserID, c.Sink, j.maxID))
+	}
+	return errors.Join(errs...)
+}
+
+// pendingNotifications loads up to notifyBatch notifications after lastID
+// that the user's preferences allow. maxID is the last id examined, so
+// filtered-out rows are skipped for good.
+func pendingNotifications(ctx context.Context, tx Store, userID, lastID int64, prefs notifyPrefs) (batch []notification, maxID int64, err error) {
+	all, err := tx.Notifications().After(ctx, userID, lastID, notifyBatch)
+	if err != nil {
+		return nil, 0, err
+	}
+	maxID = lastID
+	for _, nt := range all {
+		maxID = nt.ID
+		if (nt.Kind == notifyDM && !prefs.DMs) || (nt.Kind == notifyMention && !prefs.Mentions) {
+			continue
+		}
+		batch = append(batch, nt)
+	}
+	return batch, maxID, nil
+}
+
+// loadRecipient reads a user and their preferences.
+func loadRecipient(ctx context.Context, tx Store, id int64) (*notifyRecipient, error) {
+	u, err := tx.Users().Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	r := &notifyRecipient{ID: id, Email: u.Email}
+	if u.DisplayName != nil {
+		r.DisplayName = *u.DisplayName
+	}
+	if r.Prefs, err = tx.Notifications().Prefs(ctx, id); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// handleNotifyPrefs reads (GET) or replaces (PUT) the caller's preferences.
+func (s *Server) handleNotifyPrefs(w http.ResponseWriter, r *http.Request) {
+	u := s.authenticate(r, r.Header.Get("Authorization"))
+	if u == nil || u.ID == 0 {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	ctx := r.Context()
+	switch r.Method {
+	case http.MethodGet:
+		p, err := s.store.Notifications().Prefs(ctx, u.ID)
+		if err != nil {
+			s.internalError(w, r, "db", err)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(p)
+	case http.MethodPut:
+		p := defaultNotifyPrefs
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			http.Error(w, "bad json", http.StatusBadRequest)
+			return
+		}
+		if _, err := time.LoadLocation(p.Timezone); err != nil {
+			http.Error(w, "bad timezone", http.StatusBadRequest)
+			return
+		}
+		for _, m := range []*int{p.QuietStart, p.QuietEnd} {
+			if m != nil && (*m < 0 || *m >= 24*60) {
+				http.Error(w, "bad quiet hours", http.StatusBadRequest)
+				return
+			}
+		}
+		if p.WebhookURL != "" {
+			if err := validUserURL(p.WebhookURL); err != nil {
+				http.Error(w, "bad webhook_url: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if p.DigestMinutes < 0 {
+			p.DigestMinutes = 0
+		}
+		if err := s.store.Notifications().SavePrefs(ctx, u.ID, p); err != nil {
+			s.internalError(w, r, "db", err)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(p)
+	default:
+		http.Error(w, "method", http.StatusMethodNotAllowed)
+	}
+}
+
+// handlePushSubscription registers (POST) or removes (DELETE) a browser
+// PushSubscription. GET returns the VAPID public key for subscribing.
+func (s *Server) handlePushSubscription(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		key := ""
+		if push, ok := s.notifier.sink("webpush").(*webPushSink); ok {
+			key = push.publicKey
+		}
+		_ = json.NewEncoder(w).Encode(map[string]any{"vapid_public_key": key})
+		return
+	}
+	u := s.authenticate(r, r.Header.Get("Authorization"))
+	if u == nil || u.ID == 0 {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	var sub struct {
+		Endpoint string `json:"endpoint"`
+		Keys     struct {
+			P256dh string `json:"p256dh"`
+			Auth   string `json:"auth"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&sub); err != nil || sub.Endpoint == "" {
+		http.Error(w, "bad json", http.StatusBadRequest)
+		return
+	}
+	ctx := r.Context()
+	switch r.Method {
+	case http.MethodPost:
+		if sub.Keys.P256dh == "" || sub.Keys.Auth == "" {
+			http.Error(w, "missing", http.StatusBadRequest)
+			return
+		}
+		if err := validUserURL(sub.Endpoint); err != nil {
+			http.Error(w, "bad endpoint: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		err := s.store.Push().Save(ctx, u.ID, pushSubscription{Endpoint: sub.Endpoint, P256dh: sub.Keys.P256dh, Auth: sub.Keys.Auth})
+		if err != nil {
+			s.internalError(w, r, "db", err)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	case http.MethodDelete:
+		if err := s.store.Push().Delete(ctx, u.ID, sub.Endpoint); err != nil {
+			s.internalError(w, r, "db", err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,225 @@
+package turbo
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"time"
+
+	webpush "github.com/SherClockHolmes/webpush-go"
+)
+
+// NotifyOptions configures notification delivery. The webhook sink is
+// always on; web push needs both VAPID keys and email needs SMTPAddr.
+type NotifyOptions struct {
+	// IdleAfter is how long a connected user can be inactive before they
+	// are notified anyway, 5m if zero.
+	IdleAfter time.Duration
+	// WebhookURL receives notifications for users without their own URL.
+	WebhookURL      string
+	VAPIDPublicKey  string
+	VAPIDPrivateKey string
+	VAPIDSubject    string
+	SMTPAddr        string
+	SMTPFrom        string
+	SMTPUsername    string
+	SMTPPassword    string
+}
+
+// notifySinks builds the sinks that are configured. Each sink takes its
+// endpoints and HTTP client as fields, so a local stand-in (a fake push
+// service, MailHog, a request bin) can be pointed at without code changes.
+func notifySinks(store Store, o NotifyOptions) []notifySink {
+	client := &http.Client{Timeout: 10 * time.Second}
+	sinks := []notifySink{
+		&webhookSink{client: client, userClient: publicClient(10 * time.Second), defaultURL: o.WebhookURL},
+	}
+	if o.VAPIDPublicKey != "" && o.VAPIDPrivateKey != "" {
+		sinks = append(sinks, &webPushSink{store: store, client: publicClient(10 * time.Second), publicKey: o.VAPIDPublicKey, privateKey: o.VAPIDPrivateKey, subject: cmp.Or(o.VAPIDSubject, "mailto:admin@localhost")})
+	}
+	if o.SMTPAddr != "" {
+		sinks = append(sinks, &emailSink{addr: o.SMTPAddr, from: cmp.Or(o.SMTPFrom, "turbo@localhost"), username: o.SMTPUsername, password: o.SMTPPassword})
+	}
+	return sinks
+}
+
+// notificationSummary is the one-line text shown for a notification.
+func notificationSummary(n notification) string {
+	var p struct {
+		Text   string `json:"text"`
+		Author struct {
+			Email       string `json:"email"`
+			DisplayName string `json:"display_name"`
+		} `json:"author"`
+	}
+	_ = json.Unmarshal(n.Payload, &p)
+	who := p.Author.DisplayName
+	if who == "" {
+		who = p.Author.Email
+	}
+	text := p.Text
+	if r := []rune(text); len(r) > 140 {
+		text = string(r[:140]) + "…"
+	}
+	switch n.Kind {
+	case notifyMention:
+		return fmt.Sprintf("%s mentioned you: %s", who, text)
+	case notifyReminder:
+		return "Reminder: " + text
+	}
+	return fmt.Sprintf("%s: %s", who, text)
+}
+
+// webPushSink sends Web Push notifications signed with the server's VAPID
+// keys to every browser subscription a user registered. Endpoints come from
+// users, so client only dials public addresses.
+type webPushSink struct {
+	store      Store
+	client     *http.Client
+	publicKey  string
+	privateKey string
+	subject    string
+}
+
+func (s *webPushSink) name() string { return "webpush" }
+
+func (s *webPushSink) enabled(r *notifyRecipient) bool { return r.Prefs.WebPush }
+
+func (s *webPushSink) window(*notifyRecipient) time.Duration { return 0 }
+
+func (s *webPushSink) deliver(ctx context.Context, r *notifyRecipient, batch []notification) error {
+	last := batch[len(batch)-1]
+	body := notificationSummary(last)
+	if len(batch) > 1 {
+		body = fmt.Sprintf("%s (+%d more)", body, len(batch)-1)
+	}
+	msg := []byte(mustJSON(map[string]any{"title": "Turbo", "body": body, "count": len(batch), "message_id": last.MessageID}))
+
+	saved, err := s.store.Push().List(ctx, r.ID)
+	if err != nil {
+		return err
+	}
+	subs := make([]webpush.Subscription, len(saved))
+	for i, sub := range saved {
+		subs[i].Endpoint, subs[i].Keys.P256dh, subs[i].Keys.Auth = sub.Endpoint, sub.P256dh, sub.Auth
+	}
+
+	var errs []error
+	for i := range subs {
+		resp, err := webpush.SendNotificationWithContext(ctx, msg, &subs[i], &webpush.Options{
+			HTTPClient:      s.client,
+			Subscriber:      s.subject,
+			TTL:             24 * 60 * 60,
+			Urgency:         webpush.UrgencyNormal,
+			Topic:           "turbo",
+			VAPIDPublicKey:  s.publicKey,
+			VAPIDPrivateKey: s.privateKey,
+		})
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		switch {
+		case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+			// the browser unsubscribed; stop sending to it
+			if err := s.store.Push().Drop(ctx, subs[i].Endpoint); err != nil {
+				errs = append(errs, err)
+			}
+		case resp.StatusCode >= 300:
+			errs = append(errs, fmt.Errorf("push %s: %s", subs[i].Endpoint, resp.Status))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// webhookSink POSTs batches as JSON to the user's webhook_url, or to
+// NotifyOptions.WebhookURL for users who didn't set one. Users' own URLs go
+// through userClient, which refuses internal addresses; the operator's may
+// point anywhere.
+type webhookSink struct {
+	client     *http.Client
+	userClient *http.Client
+	defaultURL string
+}
+
+func (s *webhookSink) name() string { return "webhook" }
+
+func (s *webhookSink) url(r *notifyRecipient) string {
+	if r.Prefs.WebhookURL != "" {
+		return r.Prefs.WebhookURL
+	}
+	return s.defaultURL
+}
+
+func (s *webhookSink) enabled(r *notifyRecipient) bool { return s.url(r) != "" }
+
+func (s *webhookSink) window(*notifyRecipient) time.Duration { return 0 }
+
+func (s *webhookSink) deliver(ctx context.Context, r *notifyRecipient, batch []notification) error {
+	body := mustJSON(map[string]any{"user_id": r.ID, "email": r.Email, "notifications": batch})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url(r), strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	client := s.client
+	if r.Prefs.WebhookURL != "" {
+		client = s.userClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook: %s", resp.Status)
+	}
+	return nil
+}
+
+// emailSink mails a digest of everything that accumulated since the last one,
+// at most every digest_minutes.
+type emailSink struct {
+	addr     string
+	from     string
+	username string
+	password string
+}
+
+func (s *emailSink) name() string { return "email" }
+
+func (s *emailSink) enabled(r *notifyRecipient) bool { return r.Prefs.Email && r.Email != "" }
+
+func (s *emailSink) window(r *notifyRecipient) time.Duration {
+	return time.Duration(r.Prefs.DigestMinutes) * time.Minute
+}
+
+func (s *emailSink) deliver(ctx context.Context, r *notifyRecipient, batch []notification) error {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\nTo: %s\r\n", s.from, r.Email)
+	fmt.Fprintf(&b, "Subject: %d new message(s) on Turbo\r\n", len(batch))
+	fmt.Fprintf(&b, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	for _, n := range batch {
+		fmt.Fprintf(&b, "[%s] %s\r\n", n.CreatedAt.UTC().Format("Jan 2 15:04 MST"), notificationSummary(n))
+	}
+	fmt.Fprintf(&b, "\r\nChange how you're notified in your Turbo settings.\r\n")
+
+	var auth smtp.Auth
+	if s.username != "" {
+		host, _, _ := net.SplitHostPort(s.addr)
+		auth = smtp.PlainAuth("", s.username, s.password, host)
+	}
+	// net/smtp has no context support; SendMail runs to completion
+	return smtp.SendMail(s.addr, auth, s.from, []string{r.Email}, b.Bytes())
+}
@@ -0,0 +1,204 @@
+package turbo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// internalURLs name the server's own network in the ways users have tried.
+var internalURLs = []string{
+	"http://127.0.0.1:8080/",
+	"http://localhost/",
+	"http://169.254.169.254/latest/meta-data",
+	"http://10.0.0.7/",
+	"http://[::ffff:10.0.0.1]/",
+	"ftp://example.com/",
+}
+
+func TestNotifyEgress(t *testing.T) {
+	ts := newTestServer(t, nil)
+	token, _ := ts.signup("alice@example.com")
+
+	for _, u := range internalURLs {
+		prefs := map[string]any{"timezone": "UTC", "webhook_url": u}
+		if code := ts.do(http.MethodPut, "/api/notifications/preferences", token, prefs, nil); code != http.StatusBadRequest {
+			t.Errorf("webhook_url %s: %d, want 400", u, code)
+		}
+		sub := map[string]any{"endpoint": u, "keys": map[string]string{"p256dh": "k", "auth": "a"}}
+		if code := ts.do(http.MethodPost, "/api/notifications/push", token, sub, nil); code != http.StatusBadRequest {
+			t.Errorf("push endpoint %s: %d, want 400", u, code)
+		}
+	}
+	prefs := map[string]any{"timezone": "UTC", "webhook_url": "https://hooks.example.com/notify"}
+	if code := ts.do(http.MethodPut, "/api/notifications/preferences", token, prefs, nil); code >= 300 {
+		t.Errorf("public webhook_url: %d", code)
+	}
+	sub := map[string]any{"endpoint": "https://fcm.googleapis.com/fcm/send/abc", "keys": map[string]string{"p256dh": "k", "auth": "a"}}
+	if code := ts.do(http.MethodPost, "/api/notifications/push", token, sub, nil); code != http.StatusCreated {
+		t.Errorf("public push endpoint: %d, want 201", code)
+	}
+}
+
+func TestQuietHours(t *testing.T) {
+	at := func(hh, mm int) time.Time { return time.Date(2024, 6, 1, hh, mm, 0, 0, time.UTC) }
+	for _, tc := range []struct {
+		name       string
+		start, end *int
+		tz         string
+		t          time.Time
+		want       bool
+	}{
+		{"unset", nil, nil, "UTC", at(23, 0), false},
+		{"start only", ptr(22 * 60), nil, "UTC", at(23, 0), false},
+		{"empty range", ptr(60), ptr(60), "UTC", at(1, 0), false},
+		{"inside", ptr(9 * 60), ptr(17 * 60), "UTC", at(12, 30), true},
+		{"start is inclusive", ptr(9 * 60), ptr(17 * 60), "UTC", at(9, 0), true},
+		{"end is exclusive", ptr(9 * 60), ptr(17 * 60), "UTC", at(17, 0), false},
+		{"past midnight, late", ptr(22 * 60), ptr(7 * 60), "UTC", at(23, 59), true},
+		{"past midnight, early", ptr(22 * 60), ptr(7 * 60), "UTC", at(6, 59), true},
+		{"past midnight, daytime", ptr(22 * 60), ptr(7 * 60), "UTC", at(12, 0), false},
+		// 21:00 UTC is 23:00 in Berlin in summer
+		{"local time", ptr(22 * 60), ptr(7 * 60), "Europe/Berlin", at(21, 0), true},
+		{"local time, daytime", ptr(22 * 60), ptr(7 * 60), "Europe/Berlin", at(5, 0), false},
+	} {
+		p := notifyPrefs{QuietStart: tc.start, QuietEnd: tc.end, Timezone: tc.tz}
+		if got := p.quiet(tc.t); got != tc.want {
+			t.Errorf("%s: quiet(%s) = %t, want %t", tc.name, tc.t.Format("15:04"), got, tc.want)
+		}
+	}
+}
+
+// recordingSink delivers every batch into got, or fails while fail is set.
+type recordingSink struct {
+	mu       sync.Mutex
+	fail     bool
+	got      []string
+	attempts int
+}
+
+func (s *recordingSink) name() string                          { return "recording" }
+func (s *recordingSink) enabled(*notifyRecipient) bool         { return true }
+func (s *recordingSink) window(*notifyRecipient) time.Duration { return 0 }
+func (s *recordingSink) deliver(_ context.Context, r *notifyRecipient, batch []notification) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attempts++
+	if s.fail {
+		return errors.New("sink down")
+	}
+	kinds := make([]string, len(batch))
+	for i, n := range batch {
+		kinds[i] = n.Kind
+	}
+	s.got = append(s.got, r.Email+":"+strings.Join(kinds, ","))
+	return nil
+}
+
+func (s *recordingSink) take() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	got := s.got
+	s.got = nil
+	slices.Sort(got)
+	return got
+}
+
+func TestNotifyDispatch(t *testing.T) {
+	var mu sync.Mutex
+	clock := time.Now()
+	now := func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return clock
+	}
+	ts := newTestServer(t, NewMemoryStore(now))
+	sink := &recordingSink{}
+	ts.notifier.sinks = []notifySink{sink}
+	ts.notifier.now = now
+	alice, _ := ts.signup("alice@example.com")
+	bob, _ := ts.signup("bob@example.com")
+	ts.signup("carol@example.com")
+
+	ctx := context.Background()
+	send := func(frame map[string]any) {
+		t.Helper()
+		if code := ts.do(http.MethodPost, "/api/send", alice, frame, nil); code >= 300 {
+			t.Fatalf("send %v: %d", frame, code)
+		}
+	}
+	dispatch := func() []string {
+		t.Helper()
+		if err := ts.notifier.dispatch(ctx); err != nil {
+			t.Fatal(err)
+		}
+		return sink.take()
+	}
+	prefs := func(dms bool) {
+		t.Helper()
+		p := map[string]any{"timezone": "UTC", "dms": dms, "mentions": true}
+		if code := ts.do(http.MethodPut, "/api/notifications/preferences", bob, p, nil); code != http.StatusOK {
+			t.Fatalf("prefs: %d", code)
+		}
+	}
+
+	// nobody is connected, so DMs and mentions notify but @here doesn't
+	send(map[string]any{"text": "psst", "to": "bob@example.com"})
+	send(map[string]any{"text": "hey @carol@example.com"})
+	send(map[string]any{"text": "@here anyone?"})
+	if got, want := dispatch(), []string{"bob@example.com:" + notifyDM, "carol@example.com:" + notifyMention}; !slices.Equal(got, want) {
+		t.Fatalf("delivered %q, want %q", got, want)
+	}
+	if got := dispatch(); len(got) != 0 {
+		t.Errorf("delivered %q twice", got)
+	}
+
+	// preferences filter what's delivered, and what they skip stays skipped
+	prefs(false)
+	send(map[string]any{"text": "psst again", "to": "bob@example.com"})
+	if got := dispatch(); len(got) != 0 {
+		t.Errorf("delivered %q with DMs off", got)
+	}
+	prefs(true)
+	if got := dispatch(); len(got) != 0 {
+		t.Errorf("delivered %q after turning DMs back on", got)
+	}
+
+	// muted conversations don't notify at all
+	var inbox struct {
+		Conversations []inboxEntry `json:"conversations"`
+	}
+	if code := ts.do(http.MethodGet, "/api/inbox", bob, nil, &inbox); code != http.StatusOK || len(inbox.Conversations) != 1 {
+		t.Fatalf("inbox: %d, %d conversations", code, len(inbox.Conversations))
+	}
+	if code := ts.do(http.MethodPatch, fmt.Sprintf("/api/conversations?id=%d", inbox.Conversations[0].ID), bob, map[string]any{"muted": true}, nil); code != http.StatusNoContent {
+		t.Fatalf("mute: %d", code)
+	}
+	send(map[string]any{"text": "muted", "to": "bob@example.com"})
+	if got := dispatch(); len(got) != 0 {
+		t.Errorf("delivered %q from a muted conversation", got)
+	}
+
+	// a failed delivery is retried after a backoff, not straight away
+	sink.fail = true
+	send(map[string]any{"text": "again @carol@example.com"})
+	attempts := sink.attempts
+	dispatch()
+	dispatch()
+	if sink.attempts != attempts+1 {
+		t.Fatalf("%d attempts before the backoff, want 1", sink.attempts-attempts)
+	}
+	sink.fail = false
+	mu.Lock()
+	clock = clock.Add(time.Minute)
+	mu.Unlock()
+	if got, want := dispatch(), []string{"carol@example.com:" + notifyMention}; !slices.Equal(got, want) {
+		t.Errorf("after the backoff delivered %q, want %q", got, want)
+	}
+}
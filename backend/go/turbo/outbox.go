@@ -0,0 +1,195 @@
+package turbo
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+const (
+	// outboxBatch is how many pending events one relay pass claims.
+	outboxBatch = 100
+	// outboxPoll is how often the relay looks for events when not kicked,
+	// which also picks up rows left behind by other instances.
+	outboxPoll = time.Second
+	// outboxMaxBackoff caps the retry delay after failed publishes.
+	outboxMaxBackoff = time.Minute
+	// outboxMaxAttempts is how often an event is published, about half an
+	// hour of retries, before it moves to the dead letters. An event the
+	// bus can never take, like a NOTIFY payload over 8000 bytes, would
+	// otherwise hold up every event behind it for good.
+	outboxMaxAttempts = 30
+	// outboxRetention is how long published rows are kept for inspection.
+	outboxRetention = 24 * time.Hour
+)
+
+// newEventID returns a random id that identifies one event across
+// redeliveries, so subscribers can drop duplicates.
+func newEventID() string {
+	var b [16]byte
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// enqueueOutbox records env for the relay to publish on topic once tx commits.
+func enqueueOutbox(ctx context.Context, tx Store, topic string, env *envelope) error {
+	return tx.Outbox().Enqueue(ctx, topic, env)
+}
+
+// outboxRelay publishes committed outbox rows to the bus. Rows are claimed
+// for the length of a transaction so any number of replicas can relay at
+// once; delivery is at-least-once and subscribers deduplicate by envelope id.
+type outboxRelay struct {
+	store   Store
+	bus     Bus
+	metrics *metrics
+	log     *slog.Logger
+	now     func() time.Time
+	kickc   chan struct{}
+	quit    chan struct{}
+	done    chan struct{}
+	once    sync.Once
+}
+
+func newOutboxRelay(store Store, bus Bus, metrics *metrics, logger *slog.Logger, now func() time.Time) *outboxRelay {
+	return &outboxRelay{
+		store:   store,
+		bus:     bus,
+		metrics: metrics,
+		log:     logger,
+		now:     now,
+		kickc:   make(chan struct{}, 1),
+		quit:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+}
+
+// kick wakes the relay after a commit instead of waiting for the next poll.
+func (o *outboxRelay) kick() {
+	select {
+	case o.kickc <- struct{}{}:
+	default:
+	}
+}
+
+// run relays events until stop is called.
+func (o *outboxRelay) run() {
+	defer close(o.done)
+	ticker := time.NewTicker(outboxPoll)
+	defer ticker.Stop()
+	lastCleanup := o.now()
+	for {
+		select {
+		case <-o.quit:
+			return
+		case <-o.kickc:
+		case <-ticker.C:
+		}
+		// keep going while full batches come back so a backlog drains quickly
+		for {
+			n, err := o.relayBatch(context.Background())
+			if err != nil {
+				o.log.Error("outbox relay", "err", err)
+			}
+			if n < outboxBatch {
+				break
+			}
+		}
+		if o.now().Sub(lastCleanup) > time.Hour {
+			lastCleanup = o.now()
+			if err := o.store.Outbox().Cleanup(context.Background(), lastCleanup.Add(-outboxRetention)); err != nil {
+				o.log.Error("outbox cleanup", "err", err)
+			}
+		}
+	}
+}
+
+// stop ends the relay loop, waiting for the batch in progress.
+func (o *outboxRelay) stop() {
+	o.once.Do(func() { close(o.quit) })
+	<-o.done
+}
+
+// relayBatch claims up to outboxBatch due rows and publishes them in order.
+// It stops at the first failure so later events aren't delivered ahead of
+// it; the failed row is rescheduled with exponential backoff, or after
+// outboxMaxAttempts moved to the dead letters so the rest can go.
+func (o *outboxRelay) relayBatch(ctx context.Context) (int, error) {
+	n := 0
+	err := o.store.Tx(ctx, func(tx Store) error {
+		batch, err := tx.Outbox().Due(ctx, outboxBatch)
+		if err != nil {
+			return err
+		}
+		for _, p := range batch {
+			if err := o.bus.Publish(ctx, p.Topic, p.Payload); err != nil {
+				if p.Attempts+1 >= outboxMaxAttempts {
+					if err := o.deadLetter(ctx, tx, &p, err); err != nil {
+						return err
+					}
+					continue
+				}
+				o.metrics.outboxFailed.Inc()
+				backoff := outboxMaxBackoff
+				if p.Attempts < 7 {
+					backoff = (500 * time.Millisecond) << p.Attempts
+				}
+				return tx.Outbox().Failed(ctx, p.ID, o.now().Add(backoff), err.Error())
+			}
+			if err := tx.Outbox().Published(ctx, p.ID); err != nil {
+				return err
+			}
+			o.metrics.outboxPublished.Inc()
+			o.metrics.outboxLag.Set(o.now().Sub(p.CreatedAt).Seconds())
+			n++
+		}
+		return nil
+	})
+	return n, err
+}
+
+// deadLetter moves p from the outbox to the dead letters. No instance saw
+// it, so a replay publishes it to all of them.
+func (o *outboxRelay) deadLetter(ctx context.Context, tx Store, p *outboxRow, cause error) error {
+	o.log.Warn("outbox: giving up on event", "id", p.ID, "topic", p.Topic, "attempts", p.Attempts+1, "err", cause)
+	m := &BusMessage{Topic: p.Topic, Body: p.Payload, Attempts: p.Attempts + 1}
+	if err := tx.DeadLetters().Record(ctx, "", m, cause); err != nil {
+		return err
+	}
+	if err := tx.Outbox().Drop(ctx, p.ID); err != nil {
+		return err
+	}
+	o.metrics.outboxDead.Inc()
+	return nil
+}
+
+// recentIDs remembers the last N ids seen, for duplicate suppression.
+type recentIDs struct {
+	mu   sync.Mutex
+	set  map[string]struct{}
+	ring []string
+	next int
+}
+
+func newRecentIDs(n int) *recentIDs {
+	return &recentIDs{set: make(map[string]struct{}, n), ring: make([]string, n)}
+}
+
+// add records id and reports whether it had already been seen.
+func (r *recentIDs) add(id string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.set[id]; ok {
+		return true
+	}
+	if old := r.ring[r.next]; old != "" {
+		delete(r.set, old)
+	}
+	r.ring[r.next] = id
+	r.set[id] = struct{}{}
+	r.next = (r.next + 1) % len(r.ring)
+	return false
+}
@@ -0,0 +1,84 @@
+package turbo
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// pickyBus refuses bodies containing "oversized", as Postgres refuses
+// NOTIFY payloads over its limit, and records what it publishes.
+type pickyBus struct {
+	Bus
+	mu        sync.Mutex
+	published [][]byte
+}
+
+func (b *pickyBus) Publish(ctx context.Context, topic string, body []byte) error {
+	if bytes.Contains(body, []byte("oversized")) {
+		return errors.New("payload string too long")
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.published = append(b.published, body)
+	return nil
+}
+
+func TestOutboxDeadLetters(t *testing.T) {
+	var mu sync.Mutex
+	clock := time.Now()
+	st := NewMemoryStore(func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return clock
+	})
+	ts := newTestServer(t, st)
+	bus := &pickyBus{Bus: ts.relay.bus}
+	ts.relay.bus = bus
+	token, _ := ts.signup("alice@example.com")
+	ts.do(http.MethodPost, "/api/send", token, map[string]any{"text": "oversized"}, nil)
+	ts.do(http.MethodPost, "/api/send", token, map[string]any{"text": "fine"}, nil)
+
+	ctx := context.Background()
+	for i := 0; i < outboxMaxAttempts; i++ {
+		if len(bus.published) != 0 {
+			t.Fatalf("published %d events behind the failing one after %d attempts", len(bus.published), i)
+		}
+		// every retry is due
+		mu.Lock()
+		clock = clock.Add(time.Hour)
+		mu.Unlock()
+		if _, err := ts.relay.relayBatch(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(bus.published) != 1 || !bytes.Contains(bus.published[0], []byte("fine")) {
+		t.Errorf("published %q, want the event after the dead one", bus.published)
+	}
+	letters, err := st.DeadLetters().List(ctx, true, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(letters) != 1 {
+		t.Fatalf("got %d dead letters, want 1", len(letters))
+	}
+	d := letters[0]
+	if d.Topic != topicChat || !bytes.Contains(d.Body, []byte("oversized")) || d.Attempts != outboxMaxAttempts {
+		t.Errorf("dead letter %s %s after %d attempts", d.Topic, d.Body, d.Attempts)
+	}
+	// no instance saw it, so a replay goes out to all of them as it was
+	if d.Instance != nil {
+		t.Errorf("dead letter names instance %q", *d.Instance)
+	}
+	if !bytes.Equal(ts.replayBody(&d), d.Body) {
+		t.Error("replay wraps the event for one instance")
+	}
+	if due, _ := st.Outbox().Due(ctx, outboxBatch); len(due) != 0 {
+		t.Errorf("%d events still due", len(due))
+	}
+}
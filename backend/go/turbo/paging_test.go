@@ -0,0 +1,79 @@
+package turbo
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"testing"
+)
+
+// historyPage is one /api/messages response.
+type historyPage struct {
+	Messages []struct {
+		Text string `json:"text"`
+	} `json:"messages"`
+	Prev string `json:"prev_cursor"`
+	Next string `json:"next_cursor"`
+}
+
+func (p historyPage) texts() []string {
+	var out []string
+	for _, m := range p.Messages {
+		out = append(out, m.Text)
+	}
+	return out
+}
+
+func TestHistoryPaging(t *testing.T) {
+	ts := newTestServer(t, nil)
+	token, _ := ts.signup("alice@example.com")
+	for i := 0; i < 7; i++ {
+		if code := ts.do(http.MethodPost, "/api/send", token, map[string]any{"text": fmt.Sprint("m", i)}, nil); code != http.StatusAccepted {
+			t.Fatalf("send: %d", code)
+		}
+	}
+	page := func(query string) historyPage {
+		t.Helper()
+		var p historyPage
+		if code := ts.do(http.MethodGet, "/api/messages?limit=3"+query, token, nil, &p); code != http.StatusOK {
+			t.Fatalf("%s: %d", query, code)
+		}
+		return p
+	}
+	check := func(name string, p historyPage, want []string, prev, next bool) {
+		t.Helper()
+		if got := p.texts(); !slices.Equal(got, want) {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+		if (p.Prev != "") != prev || (p.Next != "") != next {
+			t.Errorf("%s: prev_cursor %t, next_cursor %t; want %t, %t", name, p.Prev != "", p.Next != "", prev, next)
+		}
+	}
+
+	newest := page("")
+	check("newest page", newest, []string{"m4", "m5", "m6"}, true, false)
+	middle := page("&before=" + url.QueryEscape(newest.Prev))
+	check("before newest", middle, []string{"m1", "m2", "m3"}, true, true)
+	oldest := page("&before=" + url.QueryEscape(middle.Prev))
+	check("oldest page", oldest, []string{"m0"}, false, true)
+
+	// and forward again, without skipping or repeating a message
+	forward := page("&after=" + url.QueryEscape(oldest.Next))
+	check("after oldest", forward, []string{"m1", "m2", "m3"}, true, true)
+	last := page("&after=" + url.QueryEscape(forward.Next))
+	check("after middle", last, []string{"m4", "m5", "m6"}, true, false)
+
+	// nothing is newer than the newest message, or older than the oldest
+	var one historyPage
+	ts.do(http.MethodGet, "/api/messages?limit=1", token, nil, &one)
+	check("after newest", page("&after="+url.QueryEscape(one.Prev)), nil, false, false)
+	check("before oldest", page("&before="+url.QueryEscape(forward.Prev)), []string{"m0"}, false, true)
+	var all historyPage
+	ts.do(http.MethodGet, "/api/messages?limit=7", token, nil, &all)
+	check("whole history", all, []string{"m0", "m1", "m2", "m3", "m4", "m5", "m6"}, false, false)
+
+	if code := ts.do(http.MethodGet, "/api/messages?before=not-a-cursor", token, nil, nil); code != http.StatusBadRequest {
+		t.Errorf("bad cursor: %d, want 400", code)
+	}
+}
@@ -0,0 +1,88 @@
+package turbo
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// lookupUser finds a user by id, @handle or email, with or without the
+// "@", and returns how to name them in replies.
+func lookupUser(ctx context.Context, st Store, token string) (id int64, name string, err error) {
+	u, err := st.Users().Lookup(ctx, token)
+	if err != nil {
+		return 0, "", err
+	}
+	return u.ID, u.name(), nil
+}
+
+// handleRooms lists the caller's rooms (GET) or creates one with the caller
+// as its first member (POST {"name", "topic"}). Rooms are conversations of
+// kind room; their ids are conversation ids.
+//
+// A room is private to its members, who all read and post in it. Unlike a
+// group, which all its members run, only the room's creator (or an admin)
+// may /invite people or change its /topic; anyone in it can read the topic
+// or /mute it.
+func (s *Server) handleRooms(w http.ResponseWriter, r *http.Request) {
+	u := s.authenticate(r, r.Header.Get("Authorization"))
+	if u == nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	ctx := r.Context()
+	me, err := s.ownerID(ctx, u)
+	if err != nil {
+		http.Error(w, "unknown user", http.StatusForbidden)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		rooms, err := s.store.Conversations().Rooms(ctx, me)
+		if err != nil {
+			s.internalError(w, r, "db", err)
+			return
+		}
+		out := []map[string]any{}
+		for _, e := range rooms {
+			room := map[string]any{"id": e.ID, "name": e.Name, "created_at": e.CreatedAt, "members": e.Members, "muted": e.Muted, "conversation": conversationKey(kindRoom, e.ID, "")}
+			if e.Topic != nil {
+				room["topic"] = *e.Topic
+			}
+			out = append(out, room)
+		}
+		_ = json.NewEncoder(w).Encode(out)
+
+	case http.MethodPost:
+		var body struct {
+			Name  string `json:"name"`
+			Topic string `json:"topic"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "bad json", http.StatusBadRequest)
+			return
+		}
+		body.Name = strings.TrimPrefix(strings.TrimSpace(body.Name), "#")
+		if !handlePattern.MatchString(body.Name) {
+			http.Error(w, "bad name", http.StatusBadRequest)
+			return
+		}
+		c := &conversation{Kind: kindRoom, Name: &body.Name, Topic: &body.Topic, Members: []int64{me}}
+		err := s.store.Conversations().Create(ctx, c, me)
+		if errors.Is(err, errConflict) {
+			http.Error(w, "name taken", http.StatusConflict)
+			return
+		}
+		if err != nil {
+			s.internalError(w, r, "db", err)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(w).Encode(map[string]any{"id": c.ID, "name": body.Name, "topic": body.Topic, "conversation": c.key()})
+
+	default:
+		http.Error(w, "method", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,62 @@
+package turbo
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestRoomPermissions(t *testing.T) {
+	ts := newTestServer(t, nil)
+	alice, _ := ts.signup("alice@example.com")
+	bob, bobID := ts.signup("bob@example.com")
+	_, carolID := ts.signup("carol@example.com")
+
+	var room struct {
+		ID int64 `json:"id"`
+	}
+	if code := ts.do(http.MethodPost, "/api/rooms", alice, map[string]string{"name": "ops"}, &room); code != http.StatusCreated {
+		t.Fatalf("create room: %d", code)
+	}
+	command := func(token, text string) string {
+		t.Helper()
+		var reply struct {
+			Text string `json:"text"`
+		}
+		frame := map[string]any{"text": text, "conversation": room.ID}
+		if code := ts.do(http.MethodPost, "/api/send", token, frame, &reply); code != http.StatusOK && code != http.StatusAccepted {
+			t.Fatalf("%s: %d", text, code)
+		}
+		return reply.Text
+	}
+	members := func() []int64 {
+		t.Helper()
+		c, err := ts.store.Conversations().Get(context.Background(), room.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c.Members
+	}
+
+	if got := command(alice, "/invite bob@example.com"); !strings.HasPrefix(got, "Invited") {
+		t.Fatalf("creator /invite: %q", got)
+	}
+	if got := command(bob, "/invite carol@example.com"); !strings.Contains(got, "Only the room's creator") {
+		t.Errorf("member /invite: %q", got)
+	}
+	if slices.Contains(members(), carolID) {
+		t.Error("member's /invite added carol")
+	}
+	if got := command(bob, "/topic deploys"); !strings.Contains(got, "Only the room's creator") {
+		t.Errorf("member /topic: %q", got)
+	}
+	command(alice, "/topic deploys")
+	if got := command(bob, "/topic"); got != "Topic: deploys" {
+		t.Errorf("member reading the topic: %q", got)
+	}
+	if !slices.Contains(members(), bobID) {
+		t.Error("bob isn't in the room")
+	}
+}
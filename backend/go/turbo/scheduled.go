@@ -0,0 +1,418 @@
+package turbo
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Kinds of scheduled_messages rows.
+const (
+	scheduledMessage  = "message"
+	scheduledReminder = "reminder"
+)
+
+const (
+	// schedulePoll is how often the scheduler looks for due rows.
+	schedulePoll = time.Second
+	// maxScheduleAhead caps how far in the future anything may be scheduled.
+	maxScheduleAhead = 365 * 24 * time.Hour
+	// maxPendingReminders caps the reminders one user may have waiting.
+	maxPendingReminders = 100
+)
+
+var (
+	// errNotPending is returned when editing or cancelling a scheduled
+	// message that was already sent or cancelled.
+	errNotPending = errors.New("not pending")
+	// errNotReachable is returned for reminders to someone the setter
+	// shares no conversation with.
+	errNotReachable = errors.New("you can only remind people you share a conversation with")
+	// errTooManyReminders is returned once the setter has
+	// maxPendingReminders pending.
+	errTooManyReminders = fmt.Errorf("at most %d reminders can be pending", maxPendingReminders)
+)
+
+// checkReminder vets a reminder that setter wants to send target.
+func (s *Server) checkReminder(ctx context.Context, setter, target int64) error {
+	if target != setter {
+		ok, err := s.store.Conversations().Shared(ctx, setter, target)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return errNotReachable
+		}
+	}
+	n, err := s.store.Scheduled().Pending(ctx, setter, scheduledReminder)
+	if err != nil {
+		return err
+	}
+	if n >= maxPendingReminders {
+		return errTooManyReminders
+	}
+	return nil
+}
+
+// parseSendAt reads an RFC 3339 send_at or, failing that, a delay such as
+// "10m" or "2d" from now.
+func parseSendAt(sendAt, delay string, now time.Time) (time.Time, error) {
+	var t time.Time
+	switch {
+	case sendAt != "":
+		var err error
+		if t, err = time.Parse(time.RFC3339, sendAt); err != nil {
+			return t, err
+		}
+	case delay != "":
+		d, err := parseReminderDelay(delay)
+		if err != nil {
+			return t, err
+		}
+		t = now.Add(d)
+	default:
+		return t, errors.New("send_at or delay required")
+	}
+	if !t.After(now) || t.Sub(now) > maxScheduleAhead {
+		return t, errors.New("send time out of range")
+	}
+	return t, nil
+}
+
+// scheduleMessage stores frame to be sent as u at sendAt. For reminders
+// target is who gets reminded.
+func (s *Server) scheduleMessage(ctx context.Context, u *user, kind string, target int64, frame map[string]any, sendAt time.Time) (int64, error) {
+	owner, err := s.ownerID(ctx, u)
+	if err != nil {
+		return 0, err
+	}
+	return s.store.Scheduled().Add(ctx, owner, kind, target, frame, sendAt)
+}
+
+// scheduler sends scheduled messages and reminders when due. Each row is
+// claimed for the length of a transaction and marked sent in the same
+// transaction that stores the message, so with any number of replicas a row
+// is sent exactly once.
+type scheduler struct {
+	deps *Server
+	quit chan struct{}
+	done chan struct{}
+	once sync.Once
+}
+
+func newScheduler(deps *Server) *scheduler {
+	return &scheduler{deps: deps, quit: make(chan struct{}), done: make(chan struct{})}
+}
+
+// run sends due rows until stop is called.
+func (sc *scheduler) run() {
+	defer close(sc.done)
+	ticker := time.NewTicker(schedulePoll)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-sc.quit:
+			return
+		case <-ticker.C:
+		}
+		for {
+			sent, err := sc.sendOne(context.Background())
+			if err != nil {
+				sc.deps.log.Error("scheduler", "err", err)
+			}
+			if !sent {
+				break
+			}
+			select {
+			case <-sc.quit:
+				return
+			default:
+			}
+		}
+	}
+}
+
+// stop ends the loop, waiting for the row in progress.
+func (sc *scheduler) stop() {
+	sc.once.Do(func() { close(sc.quit) })
+	<-sc.done
+}
+
+// sendOne sends the oldest due row, reporting whether there was one.
+func (sc *scheduler) sendOne(ctx context.Context) (bool, error) {
+	s := sc.deps
+	var found bool
+	var events []*envelope
+	err := s.store.Tx(ctx, func(tx Store) error {
+		events = nil
+		due, err := tx.Scheduled().Due(ctx)
+		if errors.Is(err, errNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		found = true
+		u := &user{ID: due.UserID, Email: due.Email}
+		frame := due.Frame
+
+		// a savepoint lets a send that can never succeed (the author left
+		// the room, say) be recorded as failed instead of retried forever
+		sendErr := tx.Tx(ctx, func(sp Store) error {
+			var err error
+			switch due.Kind {
+			case scheduledMessage:
+				frame["type"] = "message"
+				events, err = s.storeMessageTx(ctx, sp, u, frame, nil)
+			case scheduledReminder:
+				to := due.UserID
+				if due.Target != nil {
+					to = *due.Target
+				}
+				events, err = s.remindTx(ctx, sp, u, to, frame)
+			default:
+				err = errors.New("unknown kind " + due.Kind)
+			}
+			return err
+		})
+		if sendErr != nil {
+			events = nil
+			s.log.Warn("scheduler: send failed", "kind", due.Kind, "id", due.ID, "err", sendErr)
+			return tx.Scheduled().Failed(ctx, due.ID, sendErr.Error())
+		}
+		var mid *int64
+		if v, ok := frame["id"].(int64); ok {
+			mid = &v
+		}
+		return tx.Scheduled().Sent(ctx, due.ID, mid)
+	})
+	if err != nil {
+		return found, err
+	}
+	s.published(events)
+	return found, nil
+}
+
+// remindTx delivers a reminder to target's connections through the outbox
+// and, if they're away, as a notification.
+func (s *Server) remindTx(ctx context.Context, tx Store, setBy *user, target int64, frame map[string]any) ([]*envelope, error) {
+	text, _ := frame["text"].(string)
+	conversation, _ := frame["conversation"].(string)
+	by, err := tx.Users().Get(ctx, setBy.ID)
+	if err != nil {
+		return nil, err
+	}
+	setter := map[string]any{"id": setBy.ID, "email": by.Email}
+	if by.DisplayName != nil {
+		setter["display_name"] = *by.DisplayName
+	}
+	payload := map[string]any{"type": "reminder", "text": text, "set_by": setter, "conversation": conversation, "ts": s.now().UnixMilli()}
+	env := s.newEnvelope(ctx, "reminder", conversation, payload)
+	env.To = []int64{target}
+	if err := enqueueOutbox(ctx, tx, topicChat, env); err != nil {
+		return nil, err
+	}
+	notice := map[string]any{"text": text, "author": setter, "conversation": conversation}
+	if err := s.notifyAway(ctx, tx, map[int64]string{target: notifyReminder}, 0, 0, notice); err != nil {
+		return nil, err
+	}
+	return []*envelope{env}, nil
+}
+
+type scheduledOut struct {
+	ID       int64          `json:"id"`
+	Kind     string         `json:"kind"`
+	TargetID *int64         `json:"target_id,omitempty"`
+	Frame    map[string]any `json:"frame"`
+	SendAt   time.Time      `json:"send_at"`
+	Status   string         `json:"status"`
+	SentAt   *time.Time     `json:"sent_at,omitempty"`
+	Error    *string        `json:"error,omitempty"`
+}
+
+// handleScheduled manages the caller's scheduled messages and reminders.
+//
+//	GET    /api/scheduled[?status=pending]
+//	POST   /api/scheduled         {"text", "conversation" | "room" | "to", "send_at" | "delay", "images"}
+//	POST   /api/scheduled         {"kind": "reminder", "text", "remind": "@user", "send_at" | "delay"}
+//	PATCH  /api/scheduled?id=N    {"text", "send_at" | "delay"}
+//	DELETE /api/scheduled?id=N    cancels
+//
+// Only pending rows can be edited or cancelled; 409 means it already went.
+// Reminders go to the caller or someone they share a conversation with,
+// and at most maxPendingReminders may wait at once.
+func (s *Server) handleScheduled(w http.ResponseWriter, r *http.Request) {
+	u := s.authenticate(r, r.Header.Get("Authorization"))
+	if u == nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	ctx := r.Context()
+	me, err := s.ownerID(ctx, u)
+	if err != nil {
+		http.Error(w, "unknown user", http.StatusForbidden)
+		return
+	}
+	u = &user{ID: me, Email: u.Email}
+	id, _ := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+
+	switch r.Method {
+	case http.MethodGet:
+		out, err := s.store.Scheduled().List(ctx, me, r.URL.Query().Get("status"))
+		if err != nil {
+			s.internalError(w, r, "db", err)
+			return
+		}
+		if out == nil {
+			out = []scheduledOut{}
+		}
+		_ = json.NewEncoder(w).Encode(out)
+
+	case http.MethodPost:
+		var body struct {
+			Kind   string `json:"kind"`
+			Text   string `json:"text"`
+			Room   any    `json:"room"`
+			Conv   any    `json:"conversation"`
+			To     string `json:"to"`
+			Images []any  `json:"images"`
+			Remind string `json:"remind"`
+			SendAt string `json:"send_at"`
+			Delay  string `json:"delay"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "bad json", http.StatusBadRequest)
+			return
+		}
+		if body.Text == "" {
+			http.Error(w, "missing text", http.StatusBadRequest)
+			return
+		}
+		sendAt, err := parseSendAt(body.SendAt, body.Delay, s.now())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		frame := map[string]any{"text": body.Text}
+		var target int64
+		switch body.Kind {
+		case "", scheduledMessage:
+			body.Kind = scheduledMessage
+			if body.Conv != nil {
+				frame["conversation"] = body.Conv
+			} else if body.Room != nil {
+				frame["room"] = body.Room
+			} else if body.To != "" {
+				frame["to"] = body.To
+			}
+			if len(body.Images) > 0 {
+				frame["images"] = body.Images
+			}
+			// fail now rather than at send time
+			if _, err := resolveConversation(ctx, s.store, u, frame); err != nil {
+				if clientError(err) {
+					http.Error(w, err.Error(), http.StatusForbidden)
+					return
+				}
+				s.internalError(w, r, "db", err)
+				return
+			}
+		case scheduledReminder:
+			target = me
+			if body.Remind != "" && body.Remind != "me" {
+				if target, _, err = lookupUser(ctx, s.store, body.Remind); err != nil {
+					http.Error(w, "unknown user", http.StatusBadRequest)
+					return
+				}
+			}
+			switch err := s.checkReminder(ctx, me, target); {
+			case errors.Is(err, errNotReachable):
+				http.Error(w, err.Error(), http.StatusForbidden)
+				return
+			case errors.Is(err, errTooManyReminders):
+				http.Error(w, err.Error(), http.StatusTooManyRequests)
+				return
+			case err != nil:
+				s.internalError(w, r, "db", err)
+				return
+			}
+		default:
+			http.Error(w, "bad kind", http.StatusBadRequest)
+			return
+		}
+		id, err := s.scheduleMessage(ctx, u, body.Kind, target, frame, sendAt)
+		if err != nil {
+			s.internalError(w, r, "db", err)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(w).Encode(scheduledOut{ID: id, Kind: body.Kind, Frame: frame, SendAt: sendAt, Status: "pending"})
+
+	case http.MethodPatch:
+		var body struct {
+			Text   *string `json:"text"`
+			SendAt string  `json:"send_at"`
+			Delay  string  `json:"delay"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "bad json", http.StatusBadRequest)
+			return
+		}
+		var sendAt *time.Time
+		if body.SendAt != "" || body.Delay != "" {
+			t, err := parseSendAt(body.SendAt, body.Delay, s.now())
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			sendAt = &t
+		}
+		if body.Text != nil && *body.Text == "" {
+			http.Error(w, "missing text", http.StatusBadRequest)
+			return
+		}
+		// this waits for a send in progress, after which status is no
+		// longer pending
+		o, err := s.store.Scheduled().Update(ctx, id, me, body.Text, sendAt)
+		if errors.Is(err, errNotFound) {
+			s.scheduledConflict(w, r, id, me)
+			return
+		}
+		if err != nil {
+			s.internalError(w, r, "db", err)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(o)
+
+	case http.MethodDelete:
+		err := s.store.Scheduled().Cancel(ctx, id, me)
+		if errors.Is(err, errNotFound) {
+			s.scheduledConflict(w, r, id, me)
+			return
+		}
+		if err != nil {
+			s.internalError(w, r, "db", err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "method", http.StatusMethodNotAllowed)
+	}
+}
+
+// scheduledConflict reports why a pending-only change didn't apply: 404 if
+// the row isn't the caller's, 409 if it already left the pending state.
+func (s *Server) scheduledConflict(w http.ResponseWriter, r *http.Request, id, owner int64) {
+	status, err := s.store.Scheduled().Status(r.Context(), id, owner)
+	if err != nil {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	http.Error(w, errNotPending.Error()+": "+status, http.StatusConflict)
+}
@@ -0,0 +1,90 @@
+package turbo
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSendAt(t *testing.T) {
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		sendAt, delay string
+		want          time.Time
+	}{
+		{"2026-03-01T13:00:00Z", "", now.Add(time.Hour)},
+		{"2026-03-01T14:30:00+02:00", "", now.Add(30 * time.Minute)},
+		// send_at wins over delay
+		{"2026-03-02T12:00:00Z", "10m", now.Add(24 * time.Hour)},
+		{"", "10m", now.Add(10 * time.Minute)},
+		{"", "2d", now.Add(48 * time.Hour)},
+		{"", "1s", now.Add(time.Second)},
+		{"", "365d", now.Add(maxScheduleAhead)},
+	} {
+		if got, err := parseSendAt(tc.sendAt, tc.delay, now); err != nil || !got.Equal(tc.want) {
+			t.Errorf("parseSendAt(%q, %q) = %s, %v; want %s", tc.sendAt, tc.delay, got, err, tc.want)
+		}
+	}
+	for _, tc := range []struct{ sendAt, delay string }{
+		{"", ""},
+		{"tomorrow", ""},
+		{"2026-03-01 13:00:00", ""},
+		{"", "soon"},
+		{"", "-5m"},
+		// now and the past are out of range, as is more than a year ahead
+		{"2026-03-01T12:00:00Z", ""},
+		{"2026-02-28T12:00:00Z", ""},
+		{"2027-03-02T12:00:00Z", ""},
+		{"", "366d"},
+	} {
+		if got, err := parseSendAt(tc.sendAt, tc.delay, now); err == nil {
+			t.Errorf("parseSendAt(%q, %q) = %s, want an error", tc.sendAt, tc.delay, got)
+		}
+	}
+}
+
+func TestReminderTargets(t *testing.T) {
+	ts := newTestServer(t, nil)
+	alice, _ := ts.signup("alice@example.com")
+	ts.signup("bob@example.com")
+
+	remind := map[string]string{"kind": scheduledReminder, "text": "lunch", "remind": "bob@example.com", "delay": "1h"}
+	if code := ts.do(http.MethodPost, "/api/scheduled", alice, remind, nil); code != http.StatusForbidden {
+		t.Errorf("reminding a stranger: %d, want 403", code)
+	}
+	var reply struct {
+		Text string `json:"text"`
+	}
+	ts.do(http.MethodPost, "/api/send", alice, map[string]string{"text": "/remind bob@example.com in 1h lunch"}, &reply)
+	if !strings.Contains(reply.Text, "share a conversation") {
+		t.Errorf("/remind a stranger: %q", reply.Text)
+	}
+
+	if code := ts.do(http.MethodPost, "/api/conversations", alice, map[string]string{"with": "bob@example.com"}, nil); code != http.StatusOK {
+		t.Fatalf("open DM: %d", code)
+	}
+	if code := ts.do(http.MethodPost, "/api/scheduled", alice, remind, nil); code != http.StatusCreated {
+		t.Errorf("reminding a DM peer: %d, want 201", code)
+	}
+}
+
+func TestReminderCap(t *testing.T) {
+	ts := newTestServer(t, nil)
+	alice, _ := ts.signup("alice@example.com")
+
+	remind := map[string]string{"kind": scheduledReminder, "text": "stretch", "delay": "1h"}
+	for i := 0; i < maxPendingReminders; i++ {
+		if code := ts.do(http.MethodPost, "/api/scheduled", alice, remind, nil); code != http.StatusCreated {
+			t.Fatalf("reminder %d: %d", i, code)
+		}
+	}
+	if code := ts.do(http.MethodPost, "/api/scheduled", alice, remind, nil); code != http.StatusTooManyRequests {
+		t.Errorf("reminder over the cap: %d, want 429", code)
+	}
+	// plain scheduled messages aren't reminders
+	msg := map[string]string{"text": "hello", "delay": "1h"}
+	if code := ts.do(http.MethodPost, "/api/scheduled", alice, msg, nil); code != http.StatusCreated {
+		t.Errorf("scheduled message: %d, want 201", code)
+	}
+}
@@ -0,0 +1,235 @@
+package turbo
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	searchDefaultLimit = 20
+	searchMaxLimit     = 100
+)
+
+// searchFilter is a parsed search request. Filters come from query
+// parameters or from operators typed into q, Slack style:
+//
+//	from:@alice in:#general in:@bob has:image after:2024-01-01 before:2024-02-01
+type searchFilter struct {
+	text     string
+	author   string
+	in       string
+	hasImage bool
+	after    *time.Time
+	before   *time.Time
+}
+
+// parseSearch splits the operators out of q; explicit query parameters win
+// over operators.
+func parseSearch(r *http.Request) (*searchFilter, error) {
+	q := r.URL.Query()
+	f := &searchFilter{}
+	var words []string
+	for _, tok := range strings.Fields(q.Get("q")) {
+		op, val, ok := strings.Cut(tok, ":")
+		if !ok || val == "" {
+			words = append(words, tok)
+			continue
+		}
+		switch strings.ToLower(op) {
+		case "from":
+			f.author = val
+		case "in":
+			f.in = val
+		case "has":
+			f.hasImage = strings.EqualFold(val, "image")
+		case "after", "before":
+			t, err := parseSearchTime(val)
+			if err != nil {
+				return nil, fmt.Errorf("bad %s date", op)
+			}
+			if op == "after" {
+				f.after = &t
+			} else {
+				f.before = &t
+			}
+		default:
+			words = append(words, tok)
+		}
+	}
+	f.text = strings.Join(words, " ")
+	if v := q.Get("author"); v != "" {
+		f.author = v
+	}
+	if v := q.Get("conversation"); v != "" {
+		f.in = v
+	}
+	if q.Get("has") == "image" {
+		f.hasImage = true
+	}
+	for _, k := range []string{"after", "before"} {
+		if v := q.Get(k); v != "" {
+			t, err := parseSearchTime(v)
+			if err != nil {
+				return nil, fmt.Errorf("bad %s date", k)
+			}
+			if k == "after" {
+				f.after = &t
+			} else {
+				f.before = &t
+			}
+		}
+	}
+	return f, nil
+}
+
+// parseSearchTime reads an RFC 3339 timestamp or a plain date.
+func parseSearchTime(v string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", v)
+}
+
+// encodeSearchCursor makes the opaque position after the last hit of a
+// page from its rank and id, which together order results.
+func encodeSearchCursor(rank float32, id int64) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatFloat(float64(rank), 'g', -1, 32) + ":" + strconv.FormatInt(id, 10)))
+}
+
+func decodeSearchCursor(c string) (*float32, *int64, error) {
+	if c == "" {
+		return nil, nil, nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(c)
+	if err != nil {
+		return nil, nil, err
+	}
+	rs, is, ok := strings.Cut(string(b), ":")
+	if !ok {
+		return nil, nil, errors.New("bad cursor")
+	}
+	r, err := strconv.ParseFloat(rs, 32)
+	if err != nil {
+		return nil, nil, err
+	}
+	id, err := strconv.ParseInt(is, 10, 64)
+	if err != nil {
+		return nil, nil, err
+	}
+	rank := float32(r)
+	return &rank, &id, nil
+}
+
+type searchHit struct {
+	ID   int64  `json:"id"`
+	Text string `json:"text"`
+	// Snippet is HTML-escaped text around the matches, which are wrapped in
+	// <mark>; absent when searching by filters alone
+	Snippet        *string        `json:"snippet,omitempty"`
+	Rank           float32        `json:"rank"`
+	Ts             int64          `json:"ts"`
+	Recipient      *string        `json:"to,omitempty"`
+	ConversationID *int64         `json:"conversation_id,omitempty"`
+	Conversation   string         `json:"conversation"`
+	Author         map[string]any `json:"author,omitempty"`
+	HasImage       bool           `json:"has_image"`
+}
+
+// handleSearch runs a full-text search over messages the caller can see.
+//
+//	GET /api/search?q=deploy from:@alice has:image&author=&conversation=&after=&before=&limit=&cursor=
+//
+// Results are ranked best first; pass next_cursor back as cursor for the
+// next page.
+func (s *Server) handleSearch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method", http.StatusMethodNotAllowed)
+		return
+	}
+	u := s.authenticate(r, r.Header.Get("Authorization"))
+	if u == nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	ctx := r.Context()
+	me, err := s.viewer(ctx, u)
+	if err != nil {
+		http.Error(w, "unknown user", http.StatusForbidden)
+		return
+	}
+	f, err := parseSearch(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if f.text == "" && f.author == "" && f.in == "" && !f.hasImage && f.after == nil && f.before == nil {
+		http.Error(w, "empty query", http.StatusBadRequest)
+		return
+	}
+	var author *int64
+	if f.author != "" {
+		a, err := s.lookupRef(ctx, f.author)
+		if err != nil {
+			http.Error(w, "unknown author", http.StatusBadRequest)
+			return
+		}
+		author = &a.ID
+	}
+	conv, err := s.parseConversation(ctx, me, f.in)
+	if err != nil {
+		http.Error(w, "unknown conversation", http.StatusBadRequest)
+		return
+	}
+	rank, after, err := decodeSearchCursor(r.URL.Query().Get("cursor"))
+	if err != nil {
+		http.Error(w, "bad cursor", http.StatusBadRequest)
+		return
+	}
+	limit := searchDefaultLimit
+	if n, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && n > 0 {
+		limit = min(n, searchMaxLimit)
+	}
+
+	// one extra row tells us whether there is a next page
+	rows, err := s.store.Messages().Search(ctx, searchQuery{Viewer: me.ID, Conversation: conv, Text: f.text, Author: author, HasImage: f.hasImage,
+		After: f.after, Before: f.before, Rank: rank, ID: after, Limit: limit + 1})
+	if err != nil {
+		s.internalError(w, r, "db", err)
+		return
+	}
+	hits := []searchHit{}
+	for _, row := range rows {
+		h := searchHit{ID: row.ID, Text: row.Text, Rank: row.Rank, Ts: row.CreatedAt.UnixMilli(), Recipient: row.Recipient, ConversationID: row.ConversationID,
+			Conversation: row.conversation(), HasImage: row.HasImage, Snippet: row.Snippet}
+		if row.AuthorID != nil {
+			h.Author = map[string]any{"id": *row.AuthorID}
+			if row.AuthorEmail != nil {
+				h.Author["email"] = *row.AuthorEmail
+			}
+			if row.AuthorName != nil {
+				h.Author["display_name"] = *row.AuthorName
+			}
+			if row.AuthorAvatar != nil {
+				h.Author["avatar_url"] = *row.AuthorAvatar
+			}
+			if row.WebhookID != nil {
+				h.Author["webhook_id"] = *row.WebhookID
+			}
+		}
+		hits = append(hits, h)
+	}
+	out := map[string]any{"results": hits}
+	if len(hits) > limit {
+		hits = hits[:limit]
+		last := hits[limit-1]
+		out["results"] = hits
+		out["next_cursor"] = encodeSearchCursor(last.Rank, last.ID)
+	}
+	_ = json.NewEncoder(w).Encode(out)
+}
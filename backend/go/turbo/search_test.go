@@ -0,0 +1,92 @@
+package turbo
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestParseSearch(t *testing.T) {
+	day := func(s string) *time.Time {
+		d, _ := time.Parse("2006-01-02", s)
+		return &d
+	}
+	for _, tc := range []struct {
+		query string
+		want  searchFilter
+	}{
+		{"q=deploy+failed", searchFilter{text: "deploy failed"}},
+		{"q=deploy+from:@alice+in:%23ops+has:image", searchFilter{text: "deploy", author: "@alice", in: "#ops", hasImage: true}},
+		{"q=FROM:bob+HAS:Image", searchFilter{author: "bob", hasImage: true}},
+		{"q=after:2024-01-01+before:2024-02-01T10:00:00Z", searchFilter{after: day("2024-01-01"), before: ptr(time.Date(2024, 2, 1, 10, 0, 0, 0, time.UTC))}},
+		// unknown operators, bare colons and has: other than image are text
+		{"q=ratio+is+16:9+url:+has:file", searchFilter{text: "ratio is 16:9 url:"}},
+		// parameters win over operators
+		{"q=from:alice+in:%23ops&author=bob&conversation=public&has=image&after=2024-03-01", searchFilter{author: "bob", in: "public", hasImage: true, after: day("2024-03-01")}},
+	} {
+		f, err := parseSearch(httptest.NewRequest(http.MethodGet, "/api/search?"+tc.query, nil))
+		if err != nil {
+			t.Errorf("%s: %v", tc.query, err)
+			continue
+		}
+		if f.text != tc.want.text || f.author != tc.want.author || f.in != tc.want.in || f.hasImage != tc.want.hasImage ||
+			!timeEqual(f.after, tc.want.after) || !timeEqual(f.before, tc.want.before) {
+			t.Errorf("%s = %+v, want %+v", tc.query, *f, tc.want)
+		}
+	}
+	for _, query := range []string{"q=after:yesterday", "q=x&before=2024-13-01"} {
+		if _, err := parseSearch(httptest.NewRequest(http.MethodGet, "/api/search?"+query, nil)); err == nil {
+			t.Errorf("%s: no error", query)
+		}
+	}
+}
+
+func ptr[T any](v T) *T { return &v }
+
+func timeEqual(a, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Equal(*b)
+}
+
+func TestSearchCursor(t *testing.T) {
+	rank, id, err := decodeSearchCursor(encodeSearchCursor(0.0607927, 42))
+	if err != nil || *rank != 0.0607927 || *id != 42 {
+		t.Errorf("round trip = %v, %v, %v", rank, id, err)
+	}
+	for _, c := range []string{"!!", "bm9jb2xvbg", "eDo0Mg"} {
+		if _, _, err := decodeSearchCursor(c); err == nil {
+			t.Errorf("decodeSearchCursor(%q): no error", c)
+		}
+	}
+}
+
+func TestSearchFilters(t *testing.T) {
+	w := newChatWorld(t)
+	w.send(w.bob, map[string]any{"text": "secret reply", "conversation": w.group})
+	for _, tc := range []struct {
+		q    string
+		want []string
+	}{
+		{"secret from:bob@example.com", []string{"secret reply"}},
+		{"secret from:alice@example.com", []string{"secret dm", "secret group", "secret room"}},
+		{fmt.Sprintf("secret in:group:%d", w.group), []string{"secret group", "secret reply"}},
+		{"in:dm:alice@example.com", []string{"secret dm"}},
+		{"hello in:public", []string{"public hello"}},
+		{"secret before:2000-01-01", nil},
+	} {
+		if got := w.search(w.bob, tc.q); !slices.Equal(got, tc.want) {
+			t.Errorf("bob searching %q = %q, want %q", tc.q, got, tc.want)
+		}
+	}
+	for _, q := range []string{"", "from:@nobody", "in:#nowhere", "after:soon"} {
+		if code := w.do(http.MethodGet, "/api/search?q="+url.QueryEscape(q), w.bob, nil, nil); code != http.StatusBadRequest {
+			t.Errorf("search %q: %d, want 400", q, code)
+		}
+	}
+}
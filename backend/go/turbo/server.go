@@ -0,0 +1,1291 @@
+package turbo
+
+import (
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/rs/cors"
+)
+
+// Options configures a Server. Only JWTSecret is required: without a Store
+// and Bus the server keeps everything in memory and reaches only its own
+// clients, which suits tests and single-node runs.
+type Options struct {
+	// Store holds all state; see NewPostgresStore and NewMemoryStore.
+	Store Store
+	// Bus carries events between instances; see NewBus.
+	Bus Bus
+	// Instance identifies this replica on the bus; see InstanceID.
+	Instance string
+	// Now is the clock, time.Now if nil.
+	Now func() time.Time
+	// Logger defaults to slog.Default(). Records logged while serving a
+	// request carry its request_id and, once authenticated, user_id.
+	Logger *slog.Logger
+
+	// Addr is where Start listens. Leave it empty to serve the Server as an
+	// http.Handler from your own http.Server instead.
+	Addr string
+	// JWTSecret signs the tokens issued by /api/login.
+	JWTSecret []byte
+	// Supabase, when URL is set, validates tokens against Supabase Auth and
+	// enables signed uploads.
+	Supabase SupabaseOptions
+	// UploadDir holds files posted to /api/upload, "./uploads" if empty;
+	// BaseURL is the public address their URLs are built on.
+	UploadDir string
+	BaseURL   string
+	// AdminEmails are granted the admin role on login.
+	AdminEmails []string
+	Notify      NotifyOptions
+	// ReconnectJitter spreads client reconnects over this window on shutdown.
+	ReconnectJitter time.Duration
+	// Metrics receives the server's collectors and is served on /metrics.
+	// If nil the server makes its own, with Go runtime and process metrics.
+	// Pass the registry given to NewBus to serve the bus's metrics too.
+	Metrics *prometheus.Registry
+}
+
+// SupabaseOptions points the server at a Supabase project.
+type SupabaseOptions struct {
+	URL            string
+	AnonKey        string
+	ServiceRoleKey string
+}
+
+// Server is one Turbo instance. It is an http.Handler; Start runs its
+// background workers (and listener, when Options.Addr is set) and Shutdown
+// drains them.
+type Server struct {
+	store  Store
+	bus    Bus
+	jwtKey []byte
+	hub    *hub
+	// instance is this replica's unique id
+	instance string
+	relay    *outboxRelay
+	notifier *notifier
+	webhooks *webhookDispatcher
+	sched    *scheduler
+	// bots calls slash command callbacks, which are URLs users register
+	bots *http.Client
+	// seen holds recent event ids for dropping bus duplicates and echoes
+	seen *recentIDs
+	// draining is set once shutdown starts; conns tracks open WebSocket
+	// handlers, which http.Server.Shutdown can't see after the hijack
+	draining atomic.Bool
+	conns    sync.WaitGroup
+
+	log      *slog.Logger
+	now      func() time.Time
+	upgrader websocket.Upgrader
+	supabase SupabaseOptions
+	uploads  string
+	baseURL  string
+	admins   []string
+	jitter   time.Duration
+	metrics  *metrics
+	handler  http.Handler
+
+	started  bool
+	addr     string
+	srv      *http.Server
+	listener net.Listener
+	serveErr chan error
+}
+
+type user struct {
+	ID    int64  `json:"id"`
+	Email string `json:"email"`
+}
+
+type authRequest struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
+// New builds a Server from opts. Nothing runs until Start.
+func New(opts Options) (*Server, error) {
+	if len(opts.JWTSecret) == 0 {
+		return nil, errors.New("turbo: JWTSecret is required")
+	}
+	now := opts.Now
+	if now == nil {
+		now = time.Now
+	}
+	base := opts.Logger
+	if base == nil {
+		base = slog.Default()
+	}
+	logger := slog.New(requestIDHandler{base.Handler()})
+	store := opts.Store
+	if store == nil {
+		store = NewMemoryStore(now)
+	}
+	bus := opts.Bus
+	if bus == nil {
+		bus = newMemBus(logger)
+	}
+	instance := opts.Instance
+	if instance == "" {
+		instance = InstanceID("")
+	}
+	uploads := cmp.Or(opts.UploadDir, "./uploads")
+	if err := os.MkdirAll(uploads, 0755); err != nil {
+		return nil, fmt.Errorf("turbo: uploads: %w", err)
+	}
+
+	reg := opts.Metrics
+	if reg == nil {
+		reg = prometheus.NewRegistry()
+		registerDefaultCollectors(reg)
+	}
+	if pg, ok := store.(*pgStore); ok {
+		if err := reg.Register(newPoolCollector(pg.pool)); err != nil {
+			return nil, fmt.Errorf("turbo: metrics: %w", err)
+		}
+	}
+	m, err := newMetrics(reg)
+	if err != nil {
+		return nil, err
+	}
+
+	h := newHub(instance)
+	s := &Server{
+		store:    store,
+		bus:      bus,
+		jwtKey:   opts.JWTSecret,
+		hub:      h,
+		instance: instance,
+		seen:     newRecentIDs(4096),
+		log:      logger,
+		now:      now,
+		upgrader: websocket.Upgrader{CheckOrigin: func(r *http.Request) bool { return true }},
+		supabase: opts.Supabase,
+		uploads:  uploads,
+		baseURL:  cmp.Or(opts.BaseURL, "http://localhost:8080"),
+		admins:   opts.AdminEmails,
+		jitter:   opts.ReconnectJitter,
+		metrics:  m,
+		addr:     opts.Addr,
+		serveErr: make(chan error, 1),
+	}
+	s.relay = newOutboxRelay(store, bus, s.metrics, logger, now)
+	idle := opts.Notify.IdleAfter
+	if idle <= 0 {
+		idle = 5 * time.Minute
+	}
+	s.notifier = newNotifier(store, h, idle, notifySinks(store, opts.Notify), logger, now)
+	s.webhooks = newWebhookDispatcher(store, logger, now)
+	s.sched = newScheduler(s)
+	s.bots = publicClient(5 * time.Second)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/health", func(w http.ResponseWriter, r *http.Request) {
+		// fail health checks while draining so load balancers stop routing here
+		if s.draining.Load() {
+			http.Error(w, "draining", http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("ok"))
+	})
+	mux.HandleFunc("/api/register", s.handleRegister)
+	mux.HandleFunc("/api/login", s.handleLogin)
+	mux.HandleFunc("/api/upload", s.handleUpload)
+	mux.HandleFunc("/api/messages", s.handleMessages)
+	mux.HandleFunc("/api/search", s.handleSearch)
+	mux.HandleFunc("/api/profile", s.handleProfile)
+	mux.HandleFunc("/api/sign-upload", s.handleSignUpload)
+	mux.HandleFunc("/api/friends", s.handleFriends)
+	mux.HandleFunc("/ws", s.handleWS)
+	// fallbacks for clients whose proxies break WebSockets
+	mux.HandleFunc("/api/events", s.handleSSE)
+	mux.HandleFunc("/api/poll", s.handlePoll)
+	mux.HandleFunc("/api/send", s.handleSend)
+	mux.HandleFunc("/api/notifications/preferences", s.handleNotifyPrefs)
+	mux.HandleFunc("/api/notifications/push", s.handlePushSubscription)
+	mux.HandleFunc("/api/webhooks", s.handleWebhooks)
+	mux.HandleFunc("/api/webhooks/deliveries", s.handleWebhookDeliveries)
+	mux.HandleFunc("/api/rooms", s.handleRooms)
+	mux.HandleFunc("/api/conversations", s.handleConversations)
+	mux.HandleFunc("/api/inbox", s.handleInbox)
+	mux.HandleFunc("/api/commands", s.handleCommands)
+	mux.HandleFunc("/api/scheduled", s.handleScheduled)
+	mux.HandleFunc("/api/incoming-webhooks", s.handleIncomingWebhooks)
+	mux.HandleFunc(incomingPath, s.handleIncomingHook)
+	mux.HandleFunc("/api/admin/users/role", s.handleUserRole)
+	mux.HandleFunc("/api/admin/dead-letters", s.handleDeadLetters)
+	mux.HandleFunc("/api/admin/dead-letters/replay", s.handleDeadLetterReplay)
+	mux.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{ErrorLog: slog.NewLogLogger(logger.Handler(), slog.LevelError)}))
+	// serve uploaded files
+	mux.Handle("/uploads/", http.StripPrefix("/uploads/", http.FileServer(http.Dir(uploads))))
+
+	s.handler = cors.AllowAll().Handler(s.accessLog(mux))
+	return s, nil
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.handler.ServeHTTP(w, r)
+}
+
+// Start subscribes to the bus and starts the background workers, then
+// listens on Options.Addr if set. It returns once the listener is bound;
+// serving errors after that are reported on Err.
+func (s *Server) Start() error {
+	// broadcast every chat event from any instance to this instance's clients
+	if err := s.bus.Subscribe(topicChat, s.handleChatEvent); err != nil {
+		return fmt.Errorf("bus subscribe: %w", err)
+	}
+	if s.addr != "" {
+		ln, err := net.Listen("tcp", s.addr)
+		if err != nil {
+			return err
+		}
+		s.listener = ln
+		s.srv = &http.Server{Handler: s}
+		// request contexts must outlive Shutdown's caller so in-flight
+		// requests can finish
+		s.srv.BaseContext = func(net.Listener) context.Context { return context.Background() }
+		go func() {
+			s.log.Info("backend listening", "addr", ln.Addr().String())
+			if err := s.srv.Serve(ln); !errors.Is(err, http.ErrServerClosed) {
+				s.serveErr <- err
+			}
+		}()
+	}
+	s.started = true
+	go s.relay.run()
+	go s.notifier.run()
+	go s.webhooks.run()
+	go s.sched.run()
+	return nil
+}
+
+// Addr is the address Start is listening on, or nil if it isn't.
+func (s *Server) Addr() net.Addr {
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Addr()
+}
+
+// Err receives the error that stopped the listener, other than Shutdown.
+func (s *Server) Err() <-chan error { return s.serveErr }
+
+func (s *Server) handleRegister(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method", http.StatusMethodNotAllowed)
+		return
+	}
+	var req authRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "bad json", http.StatusBadRequest)
+		return
+	}
+	if req.Email == "" || req.Password == "" {
+		http.Error(w, "missing", http.StatusBadRequest)
+		return
+	}
+	// Simplified: store password hash; for demo only.
+	pwHash := sha256.Sum256([]byte(req.Password))
+	// insert user record (display_name/avatar handled separately)
+	ctx := r.Context()
+	var id int64
+	err := s.store.Tx(ctx, func(tx Store) error {
+		var created bool
+		var err error
+		id, created, err = tx.Users().Create(ctx, req.Email, pwHash[:])
+		if err != nil || !created {
+			return err
+		}
+		return enqueueWebhooks(ctx, tx, s.newEnvelope(ctx, eventUserRegistered, "", map[string]any{"type": eventUserRegistered, "id": id, "email": req.Email}))
+	})
+	s.webhooks.kick()
+	if err != nil {
+		s.internalError(w, r, "db", err)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(map[string]any{"id": id, "email": req.Email})
+}
+
+func (s *Server) handleLogin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method", http.StatusMethodNotAllowed)
+		return
+	}
+	var req authRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "bad json", http.StatusBadRequest)
+		return
+	}
+	id, stored, err := s.store.Users().Password(r.Context(), req.Email)
+	if err != nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	pwHash := sha256.Sum256([]byte(req.Password))
+	if string(pwHash[:]) != string(stored) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"sub":   id,
+		"email": req.Email,
+		"exp":   s.now().Add(24 * time.Hour).Unix(),
+	})
+	sToken, err := token.SignedString(s.jwtKey)
+	if err != nil {
+		s.internalError(w, r, "token", err)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(map[string]any{"token": sToken, "user": map[string]any{"id": id, "email": req.Email}})
+}
+
+// validateToken parses a bearer token or raw token and returns a user (or nil)
+func (s *Server) validateToken(tokenStr string) *user {
+	if tokenStr == "" {
+		return nil
+	}
+	// strip "Bearer " if present
+	if len(tokenStr) > 7 && tokenStr[:7] == "Bearer " {
+		tokenStr = tokenStr[7:]
+	}
+	// If Supabase is configured, validate the token via Supabase Auth endpoint
+	if supa := s.supabase.URL; supa != "" {
+		req, _ := http.NewRequest("GET", supa+"/auth/v1/user", nil)
+		req.Header.Set("Authorization", "Bearer "+tokenStr)
+		// include anon key if available
+		if k := s.supabase.AnonKey; k != "" {
+			req.Header.Set("apikey", k)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err == nil {
+			defer resp.Body.Close()
+			if resp.StatusCode == 200 {
+				var u map[string]any
+				if err := json.NewDecoder(resp.Body).Decode(&u); err == nil {
+					// u may contain id and email
+					var uid int64
+					switch v := u["id"].(type) {
+					case float64:
+						uid = int64(v)
+					case int64:
+						uid = v
+					case string:
+						// Supabase user id is string (uuid) — we cannot map to int64; return email-only
+						uid = 0
+					}
+					email, _ := u["email"].(string)
+					return &user{ID: uid, Email: email}
+				}
+			}
+		}
+		// if Supabase validation failed, fall through to local JWT validation
+	}
+
+	tok, err := jwt.Parse(tokenStr, func(t *jwt.Token) (interface{}, error) { return s.jwtKey, nil })
+	if err != nil || !tok.Valid {
+		return nil
+	}
+	claims, ok := tok.Claims.(jwt.MapClaims)
+	if !ok {
+		return nil
+	}
+	var uid int64
+	switch v := claims["sub"].(type) {
+	case float64:
+		uid = int64(v)
+	case int64:
+		uid = v
+	default:
+		uid = 0
+	}
+	email, _ := claims["email"].(string)
+	return &user{ID: uid, Email: email}
+}
+
+func (s *Server) handleWS(w http.ResponseWriter, r *http.Request) {
+	// WebSocket handler: clients must send an initial {type:"auth", token: "..."} message to authenticate.
+	var connUser *user
+
+	if s.draining.Load() {
+		http.Error(w, "draining", http.StatusServiceUnavailable)
+		return
+	}
+	// the request id set by accessLog doesn't survive the hijack; hand it
+	// to the upgrade response ourselves
+	conn, err := s.upgrader.Upgrade(w, r, http.Header{requestIDHeader: {requestID(r.Context())}})
+	if err != nil {
+		http.Error(w, "upgrade", http.StatusBadRequest)
+		return
+	}
+	defer conn.Close()
+	s.conns.Add(1)
+	defer s.conns.Done()
+	s.metrics.wsConns.Inc()
+	defer s.metrics.wsConns.Dec()
+
+	ctx := withTrace(r.Context(), r)
+
+	// register connection for broadcasts
+	sub, _ := s.hub.subscribe(nil, "")
+	defer s.hub.unsubscribe(sub)
+
+	// gorilla allows one concurrent writer; the reader goroutine's replies and
+	// the broadcast loop below share this lock
+	var writeMu sync.Mutex
+	writeJSON := func(v map[string]any) error {
+		t, _ := v["type"].(string)
+		s.metrics.frames.WithLabelValues("out", frameLabel(t)).Inc()
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		return conn.WriteJSON(v)
+	}
+
+	// Reader goroutine: read messages from this websocket and publish to the bus
+	done := make(chan struct{})
+	// on the way out, close the socket to unblock the reader and wait for it
+	// so a frame being handled finishes before this connection counts as drained
+	defer func() {
+		conn.Close()
+		<-done
+	}()
+	go func() {
+		defer close(done)
+		for {
+			var msg map[string]any
+			if err := conn.ReadJSON(&msg); err != nil {
+				if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+					s.log.DebugContext(ctx, "ws: read", "err", err)
+				}
+				return
+			}
+			t, _ := msg["type"].(string)
+			s.metrics.frames.WithLabelValues("in", frameLabel(t)).Inc()
+			// Handle auth handshake
+			if t == "auth" {
+				tokenStr, _ := msg["token"].(string)
+				if u := s.validateToken(tokenStr); u != nil {
+					connUser = u
+					s.noteUser(ctx, u)
+					s.hub.identify(sub, u)
+					s.notifier.touch(u)
+					// send back a confirmation
+					_ = writeJSON(map[string]any{"type": "auth_ok", "user": map[string]any{"id": u.ID, "email": u.Email}, "request_id": requestID(ctx)})
+				} else {
+					_ = writeJSON(map[string]any{"type": "auth_fail"})
+				}
+				continue
+			}
+			reply, err := s.handleFrame(ctx, connUser, msg)
+			if err != nil {
+				_ = writeJSON(map[string]any{"type": "error", "reason": err.Error()})
+			} else if reply != nil {
+				_ = writeJSON(reply)
+			}
+		}
+	}()
+
+	// Broadcast loop: forward hub events until the client goes away or the
+	// hub drops this connection for falling behind.
+	for {
+		select {
+		case <-done:
+			return
+		case ev, ok := <-sub.ch:
+			if !ok {
+				// drained or dropped for falling behind: ask the client to come back
+				writeMu.Lock()
+				_ = conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "reconnect"), s.now().Add(time.Second))
+				writeMu.Unlock()
+				return
+			}
+			s.metrics.frames.WithLabelValues("out", frameLabel(ev.Type)).Inc()
+			writeMu.Lock()
+			err := conn.WriteMessage(websocket.TextMessage, ev.Data)
+			writeMu.Unlock()
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+// Errors handleFrame reports back to the sending client.
+var (
+	errUnauthenticated = errors.New("unauthenticated")
+	errStore           = errors.New("store failed")
+	errPublish         = errors.New("publish failed")
+)
+
+// clientError reports whether err is the client's mistake and is passed
+// back as is rather than as errStore or errPublish.
+func clientError(err error) bool {
+	return errors.Is(err, errNotMember) || errors.Is(err, errUnknownRecipient)
+}
+
+// handleFrame processes one client frame (anything but the auth handshake)
+// and publishes it for broadcast. It is shared by the WebSocket reader and
+// the REST send endpoint so both transports persist messages identically.
+// A non-nil reply is for the invoking connection only (slash command output).
+func (s *Server) handleFrame(ctx context.Context, connUser *user, msg map[string]any) (reply map[string]any, err error) {
+	s.notifier.touch(connUser)
+	// If this is a chat message, require auth
+	if t, _ := msg["type"].(string); t == "message" {
+		if connUser == nil {
+			// require authentication
+			return nil, errUnauthenticated
+		}
+		text, _ := msg["text"].(string)
+		if name, args, ok := parseCommand(text); ok {
+			reply, err := s.runCommand(ctx, connUser, msg, name, args)
+			if err != nil && !clientError(err) {
+				s.log.ErrorContext(ctx, "command failed", "command", name, "err", err)
+				err = errStore
+			}
+			return reply, err
+		}
+		// "//" escapes a leading slash
+		if strings.HasPrefix(text, "//") {
+			msg["text"] = text[1:]
+		}
+		if err := s.storeMessage(ctx, connUser, msg, nil); err != nil {
+			if clientError(err) {
+				return nil, err
+			}
+			s.log.ErrorContext(ctx, "store message", "err", err)
+			return nil, errStore
+		}
+		return nil, nil
+	}
+	// other frames (typing, reactions) aren't stored and go straight to the bus
+	t, _ := msg["type"].(string)
+	conv, err := resolveConversation(ctx, s.store, connUser, msg)
+	if err != nil {
+		if clientError(err) {
+			return nil, err
+		}
+		s.log.ErrorContext(ctx, "resolve conversation", "err", err)
+		return nil, errPublish
+	}
+	env := s.newEnvelope(ctx, frameEventType(t), conv.key(), msg)
+	if conv != nil {
+		env.To = conv.Members
+	}
+	s.deliverLocal(env)
+	if err := s.bus.Publish(ctx, topicChat, []byte(mustJSON(env))); err != nil {
+		s.log.ErrorContext(ctx, "publish frame", "type", t, "err", err)
+		return nil, errPublish
+	}
+	return nil, nil
+}
+
+// storeMessage inserts a chat message with its images and fills in id, ts
+// and author on msg. The broadcast is written to the outbox in the same
+// transaction, so a stored message is always delivered and a failed insert
+// never is. opts is nil for client frames.
+func (s *Server) storeMessage(ctx context.Context, connUser *user, msg map[string]any, opts *storeOpts) error {
+	var events []*envelope
+	err := s.store.Tx(ctx, func(tx Store) error {
+		var err error
+		events, err = s.storeMessageTx(ctx, tx, connUser, msg, opts)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	s.published(events)
+	return nil
+}
+
+// published hands committed events to local clients right away and wakes
+// the relays; other instances get them from the outbox.
+func (s *Server) published(events []*envelope) {
+	for _, env := range events {
+		s.deliverLocal(env)
+	}
+	s.relay.kick()
+	s.webhooks.kick()
+}
+
+// storeMessageTx is storeMessage inside the caller's transaction. The
+// returned events must be passed to published once tx commits.
+func (s *Server) storeMessageTx(ctx context.Context, tx Store, connUser *user, msg map[string]any, opts *storeOpts) ([]*envelope, error) {
+	text, _ := msg["text"].(string)
+	// members are who may see the message: the participants of its
+	// conversation, or nil for the public room
+	conv, err := resolveConversation(ctx, tx, connUser, msg)
+	if err != nil {
+		return nil, err
+	}
+	conversation := conv.key()
+	var members []int64
+	var convID int64
+	if conv != nil {
+		members, convID = conv.Members, conv.ID
+		msg["conversation_id"] = conv.ID
+	}
+	if opts == nil {
+		opts = &storeOpts{}
+	}
+	rec := &messageRecord{UserID: connUser.ID, Text: text, ConversationID: convID, Subtype: opts.Subtype, WebhookID: opts.WebhookID,
+		AuthorName: opts.DisplayName, AuthorAvatar: opts.AvatarURL, Attachments: opts.Attachments}
+	// images metadata if present
+	if imgs, ok := msg["images"].([]any); ok {
+		for _, im := range imgs {
+			if m, ok := im.(map[string]any); ok {
+				img := imageRecord{}
+				img.URL, _ = m["url"].(string)
+				img.Filename, _ = m["filename"].(string)
+				if fs, ok := m["filesize"].(float64); ok {
+					img.Filesize = int64(fs)
+				}
+				rec.Images = append(rec.Images, img)
+			}
+		}
+	}
+	if err := tx.Messages().Insert(ctx, rec); err != nil {
+		return nil, err
+	}
+	mid, created := rec.ID, rec.CreatedAt
+	// the conversation moves up everyone's inbox, and its author has read it
+	if convID != 0 {
+		if err := tx.Conversations().Posted(ctx, convID, connUser.ID, mid, created); err != nil {
+			return nil, err
+		}
+	}
+	var events []*envelope
+	msg["id"] = mid
+	msg["ts"] = created.UnixMilli()
+	if opts.Subtype != "" {
+		msg["subtype"] = opts.Subtype
+	}
+	// attach author metadata so consumers can show display name/avatar
+	authorObj := map[string]any{"id": int64(0)}
+	if a, err := tx.Users().Get(ctx, connUser.ID); err == nil {
+		authorObj["id"] = a.ID
+		authorObj["email"] = a.Email
+		if a.DisplayName != nil {
+			authorObj["display_name"] = *a.DisplayName
+		}
+		if a.AvatarURL != nil {
+			authorObj["avatar_url"] = *a.AvatarURL
+		}
+	}
+	// incoming webhooks post as their owner under their own name and icon
+	if opts.WebhookID != 0 {
+		authorObj["webhook_id"] = opts.WebhookID
+	}
+	if opts.DisplayName != "" {
+		authorObj["display_name"] = opts.DisplayName
+	}
+	if opts.AvatarURL != "" {
+		authorObj["avatar_url"] = opts.AvatarURL
+	}
+	if opts.Attachments != nil {
+		msg["attachments"] = opts.Attachments
+	}
+	msg["author"] = authorObj
+	spans, err := resolveMentions(ctx, tx, parseMentions(text))
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Messages().AddMentions(ctx, mid, spans); err != nil {
+		return nil, err
+	}
+	// DM and group participants and mentioned users hear about it later if away
+	preview := map[string]any{"text": text, "author": authorObj, "conversation": conversation}
+	if err := s.enqueueNotifications(ctx, tx, connUser.ID, conv, mid, spans, preview); err != nil {
+		return nil, err
+	}
+	if len(spans) > 0 {
+		msg["mentions"] = spans
+	}
+	env := s.newEnvelope(ctx, eventMessageCreated, conversation, msg)
+	env.To = members
+	events = append(events, env)
+
+	// mentioned users get a targeted event wherever they are in the app
+	to, all := mentionTargets(connUser.ID, members, spans)
+	if all || len(to) > 0 {
+		mention := s.newEnvelope(ctx, eventMention, conversation, map[string]any{
+			"type":         "mention",
+			"message_id":   mid,
+			"conversation": conversation,
+			"text":         text,
+			"author":       authorObj,
+			"mentions":     spans,
+			"ts":           created.UnixMilli(),
+		})
+		mention.To = to
+		events = append(events, mention)
+	}
+	for _, env := range events {
+		if err := enqueueOutbox(ctx, tx, topicChat, env); err != nil {
+			return nil, err
+		}
+	}
+	if err := enqueueWebhooks(ctx, tx, events[0]); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// handleDeleteMessage deletes one of the caller's messages (admins may delete
+// any). DELETE /api/messages?id=N. Clients get a message_deleted frame and
+// webhooks a message.deleted event, both written in the deleting transaction.
+func (s *Server) handleDeleteMessage(w http.ResponseWriter, r *http.Request) {
+	u := s.authenticate(r, r.Header.Get("Authorization"))
+	if u == nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "bad id", http.StatusBadRequest)
+		return
+	}
+	ctx := withTrace(r.Context(), r)
+	admin := s.userRole(ctx, u) == roleAdmin
+	// an unknown caller deletes nothing unless they are an admin
+	author, _ := s.ownerID(ctx, u)
+	var env *envelope
+	err = s.store.Tx(ctx, func(tx Store) error {
+		convID, err := tx.Messages().Delete(ctx, id, author, admin)
+		if err != nil {
+			return err
+		}
+		msg := map[string]any{"type": "message_deleted", "id": id}
+		var conv *conversation
+		if convID != nil {
+			if conv, err = tx.Conversations().Get(ctx, *convID); err != nil {
+				return err
+			}
+			msg["conversation_id"] = conv.ID
+		}
+		msg["conversation"] = conv.key()
+		env = s.newEnvelope(ctx, eventMessageDeleted, conv.key(), msg)
+		if conv != nil {
+			env.To = conv.Members
+		}
+		if err := enqueueOutbox(ctx, tx, topicChat, env); err != nil {
+			return err
+		}
+		return enqueueWebhooks(ctx, tx, env)
+	})
+	if errors.Is(err, errNotFound) {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		s.internalError(w, r, "db", err)
+		return
+	}
+	s.published([]*envelope{env})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func mustJSON(v any) string {
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+func (s *Server) handleUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// simple auth via Authorization header
+	token := r.Header.Get("Authorization")
+	u := s.authenticate(r, token)
+	if u == nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// limit to 50MB
+	err := r.ParseMultipartForm(50 << 20)
+	if err != nil {
+		http.Error(w, "bad form", http.StatusBadRequest)
+		return
+	}
+
+	file, handler, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, "bad file", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	// save file
+	fname := fmt.Sprintf("%d_%s", s.now().UnixNano(), filepath.Base(handler.Filename))
+	dstPath := filepath.Join(s.uploads, fname)
+	out, err := os.Create(dstPath)
+	if err != nil {
+		s.internalError(w, r, "server", err)
+		return
+	}
+	defer out.Close()
+	size, _ := io.Copy(out, file)
+	s.metrics.uploadBytes.Add(float64(size))
+
+	url := fmt.Sprintf("%s/uploads/%s", s.baseURL, fname)
+
+	_ = json.NewEncoder(w).Encode(map[string]any{"url": url, "filename": handler.Filename, "filesize": size})
+}
+
+// handleSignUpload issues a signed upload URL using the Supabase Storage REST API
+// Expects JSON body: { bucket: string, path: string, expiresIn?: int }
+func (s *Server) handleSignUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method", http.StatusMethodNotAllowed)
+		return
+	}
+	// require auth (optional) to avoid abuse
+	token := r.Header.Get("Authorization")
+	if s.authenticate(r, token) == nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	var body struct {
+		Bucket    string `json:"bucket"`
+		Path      string `json:"path"`
+		ExpiresIn int    `json:"expiresIn"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "bad json", http.StatusBadRequest)
+		return
+	}
+	if body.Bucket == "" || body.Path == "" {
+		http.Error(w, "missing", http.StatusBadRequest)
+		return
+	}
+	serviceKey, supa := s.supabase.ServiceRoleKey, s.supabase.URL
+	if serviceKey == "" || supa == "" {
+		http.Error(w, "server-misconfigured", http.StatusInternalServerError)
+		return
+	}
+	// call Supabase REST to sign an upload URL
+	signPath := fmt.Sprintf("%s/storage/v1/object/sign/%s/%s", supa, body.Bucket, body.Path)
+	req, _ := http.NewRequest(http.MethodPost, signPath, nil)
+	q := req.URL.Query()
+	if body.ExpiresIn > 0 {
+		q.Set("expiresIn", fmt.Sprintf("%d", body.ExpiresIn))
+	}
+	req.URL.RawQuery = q.Encode()
+	req.Header.Set("Authorization", "Bearer "+serviceKey)
+	req.Header.Set("apikey", serviceKey)
+	client := &http.Client{Timeout: 15 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		s.internalError(w, r, "sign-failed", err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		s.internalError(w, r, "sign-failed", fmt.Errorf("supabase sign: %s", resp.Status))
+		return
+	}
+	var out map[string]any
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		s.internalError(w, r, "bad response", err)
+		return
+	}
+	// build public URL (Supabase storage public URL pattern)
+	public := fmt.Sprintf("%s/storage/v1/object/public/%s/%s", supa, body.Bucket, body.Path)
+	out["publicUrl"] = public
+	_ = json.NewEncoder(w).Encode(out)
+}
+
+// handleFriends returns a lightweight list of users (id, email, display_name, avatar_url)
+func (s *Server) handleFriends(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method", http.StatusMethodNotAllowed)
+		return
+	}
+	ctx := r.Context()
+	users, err := s.store.Users().List(ctx, 100)
+	if err != nil {
+		s.internalError(w, r, "db", err)
+		return
+	}
+	out := []map[string]any{}
+	for _, u := range users {
+		m := map[string]any{"id": u.ID, "email": u.Email}
+		if u.Handle != nil {
+			m["handle"] = *u.Handle
+		}
+		if u.DisplayName != nil {
+			m["display_name"] = *u.DisplayName
+		}
+		if u.AvatarURL != nil {
+			m["avatar_url"] = *u.AvatarURL
+		}
+		out = append(out, m)
+	}
+	_ = json.NewEncoder(w).Encode(out)
+}
+
+// handleProfile updates the current user's profile (display_name, avatar_url, bio, handle)
+func (s *Server) handleProfile(w http.ResponseWriter, r *http.Request) {
+	// Support GET for profile lookup and POST for updates
+	switch r.Method {
+	case http.MethodGet:
+		// allow ?email= or use Authorization header to identify current user
+		qEmail := r.URL.Query().Get("email")
+		ctx := r.Context()
+		var email string
+		if qEmail != "" {
+			email = qEmail
+		} else {
+			token := r.Header.Get("Authorization")
+			u := s.authenticate(r, token)
+			if u == nil || u.Email == "" {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			email = u.Email
+		}
+		p, err := s.store.Users().ByEmail(ctx, email)
+		if err != nil {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		out := map[string]any{"id": p.ID, "email": email}
+		if p.DisplayName != nil {
+			out["display_name"] = *p.DisplayName
+		}
+		if p.AvatarURL != nil {
+			out["avatar_url"] = *p.AvatarURL
+		}
+		if p.Bio != nil {
+			out["bio"] = *p.Bio
+		}
+		if p.Handle != nil {
+			out["handle"] = *p.Handle
+		}
+		_ = json.NewEncoder(w).Encode(out)
+		return
+	case http.MethodPost:
+		token := r.Header.Get("Authorization")
+		u := s.authenticate(r, token)
+		if u == nil {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		// parse body
+		var body struct {
+			DisplayName string `json:"display_name"`
+			AvatarURL   string `json:"avatar_url"`
+			Bio         string `json:"bio"`
+			Handle      string `json:"handle"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "bad json", http.StatusBadRequest)
+			return
+		}
+		// an empty handle leaves the current one alone
+		if body.Handle != "" && !handlePattern.MatchString(body.Handle) {
+			http.Error(w, "bad handle", http.StatusBadRequest)
+			return
+		}
+
+		ctx := r.Context()
+		// find or create user record
+		var id int64
+		if u.ID != 0 {
+			id = u.ID
+		} else {
+			// lookup by email
+			if u.Email == "" {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			// create a user record if not exists (no password)
+			var err error
+			if id, _, err = s.store.Users().Create(ctx, u.Email, nil); err != nil {
+				s.internalError(w, r, "db", err)
+				return
+			}
+		}
+
+		// If avatar changed, attempt to remove the old avatar file from Supabase Storage (best-effort)
+		var oldAvatar, handle *string
+		if old, err := s.store.Users().Get(ctx, id); err == nil {
+			oldAvatar = old.AvatarURL
+		}
+		err := s.store.Users().UpdateProfile(ctx, id, body.DisplayName, body.AvatarURL, body.Bio, body.Handle)
+		if errors.Is(err, errConflict) {
+			http.Error(w, "handle taken", http.StatusConflict)
+			return
+		}
+		if err != nil {
+			s.internalError(w, r, "db", err)
+			return
+		}
+		if p, err := s.store.Users().Get(ctx, id); err == nil {
+			handle = p.Handle
+		}
+		profile := map[string]any{"type": eventProfileUpdated, "id": id, "display_name": body.DisplayName, "avatar_url": body.AvatarURL, "bio": body.Bio, "handle": handle}
+		if err := enqueueWebhooks(ctx, s.store, s.newEnvelope(ctx, eventProfileUpdated, "", profile)); err != nil {
+			s.log.ErrorContext(ctx, "profile webhooks", "err", err)
+		}
+		s.webhooks.kick()
+		if oldAvatar != nil && *oldAvatar != "" && body.AvatarURL != "" && *oldAvatar != body.AvatarURL {
+			// attempt deletion using service role key
+			go func(pubUrl string) {
+				serviceKey, supa := s.supabase.ServiceRoleKey, s.supabase.URL
+				if serviceKey == "" || supa == "" {
+					return
+				}
+				// parse expected pattern: {Supabase.URL}/storage/v1/object/public/{bucket}/{path}
+				prefix := supa + "/storage/v1/object/public/"
+				if !strings.HasPrefix(pubUrl, prefix) {
+					return
+				}
+				key := strings.TrimPrefix(pubUrl, prefix)
+				// key is "<bucket>/<path>" — split once
+				parts := strings.SplitN(key, "/", 2)
+				if len(parts) != 2 {
+					return
+				}
+				bucket := parts[0]
+				objPath := parts[1]
+				deleteURL := fmt.Sprintf("%s/storage/v1/object/%s/%s", supa, bucket, objPath)
+				req, _ := http.NewRequest(http.MethodDelete, deleteURL, nil)
+				req.Header.Set("Authorization", "Bearer "+serviceKey)
+				req.Header.Set("apikey", serviceKey)
+				client := &http.Client{Timeout: 10 * time.Second}
+				resp, err := client.Do(req)
+				if err != nil {
+					s.log.ErrorContext(ctx, "delete old avatar", "err", err)
+					return
+				}
+				resp.Body.Close()
+				if resp.StatusCode >= 400 {
+					s.log.ErrorContext(ctx, "delete old avatar", "status", resp.StatusCode)
+				}
+			}(*oldAvatar)
+		}
+		_ = json.NewEncoder(w).Encode(map[string]any{"ok": true, "id": id})
+		return
+	default:
+		http.Error(w, "method", http.StatusMethodNotAllowed)
+		return
+	}
+}
+
+const (
+	historyDefaultLimit = 50
+	historyMaxLimit     = 200
+)
+
+// encodeMessageCursor makes the opaque history position of a message from
+// its (created_at, id), which together order history.
+func encodeMessageCursor(created time.Time, id int64) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(created.UnixMicro(), 10) + ":" + strconv.FormatInt(id, 10)))
+}
+
+func decodeMessageCursor(c string) (*time.Time, *int64, error) {
+	if c == "" {
+		return nil, nil, nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(c)
+	if err != nil {
+		return nil, nil, err
+	}
+	ts, is, ok := strings.Cut(string(b), ":")
+	if !ok {
+		return nil, nil, errors.New("bad cursor")
+	}
+	us, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return nil, nil, err
+	}
+	id, err := strconv.ParseInt(is, 10, 64)
+	if err != nil {
+		return nil, nil, err
+	}
+	at := time.UnixMicro(us)
+	return &at, &id, nil
+}
+
+// handleMessages serves history.
+//
+//	GET /api/messages?limit=&before=|after=&conversation=|room=|peer=&author=
+//
+// The response is {"messages", "prev_cursor", "next_cursor"}, oldest
+// message first; pass a cursor back as before or after to keep paging.
+// Callers see public messages and their own conversations.
+func (s *Server) handleMessages(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodDelete {
+		s.handleDeleteMessage(w, r)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "method", http.StatusMethodNotAllowed)
+		return
+	}
+	u := s.authenticate(r, r.Header.Get("Authorization"))
+	if u == nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	ctx := r.Context()
+	q := r.URL.Query()
+	limit := historyDefaultLimit
+	if n, err := strconv.Atoi(q.Get("limit")); err == nil && n > 0 {
+		limit = min(n, historyMaxLimit)
+	}
+	// before pages back from a cursor, after forward; neither is the newest page
+	forward := q.Get("after") != ""
+	cursor := q.Get("before")
+	if forward {
+		cursor = q.Get("after")
+	}
+	at, afterID, err := decodeMessageCursor(cursor)
+	if err != nil {
+		http.Error(w, "bad cursor", http.StatusBadRequest)
+		return
+	}
+	me, err := s.viewer(ctx, u)
+	if err != nil {
+		http.Error(w, "unknown user", http.StatusForbidden)
+		return
+	}
+	in := q.Get("conversation")
+	if v := q.Get("room"); v != "" {
+		in = "room:" + v
+	}
+	if v := q.Get("peer"); v != "" {
+		in = "dm:" + v
+	}
+	conv, err := s.parseConversation(ctx, me, in)
+	if err != nil {
+		http.Error(w, "unknown conversation", http.StatusBadRequest)
+		return
+	}
+	var author *int64
+	if v := q.Get("author"); v != "" {
+		a, err := s.lookupRef(ctx, v)
+		if err != nil {
+			http.Error(w, "unknown author", http.StatusBadRequest)
+			return
+		}
+		author = &a.ID
+	}
+
+	// one extra row tells us whether there is more in the paging direction
+	rows, err := s.store.Messages().History(ctx, historyQuery{Viewer: me.ID, Conversation: conv, Author: author, At: at, ID: afterID, Forward: forward, Limit: limit + 1})
+	if err != nil {
+		s.internalError(w, r, "db", err)
+		return
+	}
+
+	type msgOut struct {
+		ID        int64           `json:"id"`
+		Text      string          `json:"text"`
+		Ts        int64           `json:"ts"`
+		Recipient *string         `json:"to,omitempty"`
+		Author    map[string]any  `json:"author"`
+		Images    json.RawMessage `json:"images"`
+		Mentions  []mentionSpan   `json:"mentions,omitempty"`
+		// Attachments are Slack-style attachments from incoming webhooks
+		Attachments json.RawMessage `json:"attachments,omitempty"`
+		Subtype     *string         `json:"subtype,omitempty"`
+		// ConversationID and Conversation are absent for the public room
+		ConversationID *int64 `json:"conversation_id,omitempty"`
+		Conversation   string `json:"conversation,omitempty"`
+
+		created time.Time
+	}
+
+	out := []msgOut{}
+	for _, row := range rows {
+		var author map[string]any
+		if row.AuthorID != nil || row.AuthorEmail != nil {
+			author = map[string]any{}
+			if row.AuthorID != nil {
+				author["id"] = *row.AuthorID
+			}
+			if row.AuthorEmail != nil {
+				author["email"] = *row.AuthorEmail
+			}
+			if row.AuthorName != nil {
+				author["display_name"] = *row.AuthorName
+			}
+			if row.AuthorAvatar != nil {
+				author["avatar_url"] = *row.AuthorAvatar
+			}
+			if row.WebhookID != nil {
+				author["webhook_id"] = *row.WebhookID
+			}
+		}
+		out = append(out, msgOut{ID: row.ID, Text: row.Text, Ts: row.CreatedAt.UnixMilli(), Recipient: row.Recipient, Author: author, Images: row.Images,
+			Attachments: row.Attachments, Subtype: row.Subtype, ConversationID: row.ConversationID, Conversation: row.conversation(), created: row.CreatedAt})
+	}
+
+	// attach mention spans for highlighting
+	ids := make([]int64, len(out))
+	for i := range out {
+		ids[i] = out[i].ID
+	}
+	mentions, err := s.store.Messages().Mentions(ctx, ids)
+	if err != nil {
+		s.internalError(w, r, "db", err)
+		return
+	}
+	for i := range out {
+		out[i].Mentions = mentions[out[i].ID]
+	}
+
+	more := len(out) > limit
+	if more {
+		out = out[:limit]
+	}
+	// return newest last
+	if !forward {
+		for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+			out[i], out[j] = out[j], out[i]
+		}
+	}
+	// prev_cursor pages to older messages and next_cursor to newer ones;
+	// each is absent when there was nothing more that way at query time
+	older, newer := more, at != nil
+	if forward {
+		older, newer = true, more
+	}
+	page := map[string]any{"messages": out}
+	if len(out) > 0 {
+		if older {
+			page["prev_cursor"] = encodeMessageCursor(out[0].created, out[0].ID)
+		}
+		if newer {
+			page["next_cursor"] = encodeMessageCursor(out[len(out)-1].created, out[len(out)-1].ID)
+		}
+	}
+	_ = json.NewEncoder(w).Encode(page)
+}
@@ -0,0 +1,57 @@
+package turbo
+
+import (
+	"context"
+)
+
+// Shutdown drains the server within ctx's deadline. The order matters:
+// realtime clients are told to reconnect elsewhere first, then HTTP requests
+// and WebSocket writers finish, and only then is the bus closed so nothing in
+// flight publishes to a closed producer. The store goes last. The returned
+// error is the first that stopped a step from finishing cleanly.
+func (s *Server) Shutdown(ctx context.Context) error {
+	var first error
+	fail := func(err error) {
+		if first == nil {
+			first = err
+		}
+	}
+	s.draining.Store(true)
+	s.hub.drain(s.jitter)
+
+	if s.srv != nil {
+		if err := s.srv.Shutdown(ctx); err != nil {
+			s.log.Error("shutdown: http", "err", err)
+			fail(err)
+		}
+	}
+
+	// hijacked WebSocket connections aren't tracked by http.Server
+	wsDone := make(chan struct{})
+	go func() {
+		s.conns.Wait()
+		close(wsDone)
+	}()
+	select {
+	case <-wsDone:
+	case <-ctx.Done():
+		s.log.Error("shutdown: websockets", "err", ctx.Err())
+		fail(ctx.Err())
+	}
+
+	// stop the relay before the bus; unpublished rows stay in the outbox for
+	// the next instance to pick up
+	if s.started {
+		s.sched.stop()
+		s.relay.stop()
+		s.notifier.stop()
+		s.webhooks.stop()
+	}
+	if err := s.bus.Close(ctx); err != nil {
+		s.log.Error("shutdown: bus", "err", err)
+		fail(err)
+	}
+	s.store.Close()
+	s.log.Info("shutdown complete")
+	return first
+}
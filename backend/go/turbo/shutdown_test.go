@@ -0,0 +1,45 @@
+package turbo
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestShutdownDrains(t *testing.T) {
+	ts := newTestServer(t, nil)
+	sub, _ := ts.hub.subscribe(nil, "")
+	// a WebSocket handler that doesn't finish in time
+	ts.conns.Add(1)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := ts.Shutdown(ctx)
+	ts.conns.Done()
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("shutdown past its deadline: %v, want context.Canceled", err)
+	}
+
+	// connected clients are told to reconnect elsewhere, then dropped
+	var frame struct {
+		Type string `json:"type"`
+	}
+	ev, ok := <-sub.ch
+	if !ok || json.Unmarshal(ev.Data, &frame) != nil || frame.Type != "reconnect" {
+		t.Errorf("subscriber got %s, %t; want a reconnect frame", ev.Data, ok)
+	}
+	if _, ok := <-sub.ch; ok {
+		t.Error("subscriber still open after the reconnect frame")
+	}
+	// and so are new ones
+	late, _ := ts.hub.subscribe(nil, "")
+	if ev := <-late.ch; ev.Type != "reconnect" {
+		t.Errorf("late subscriber got %s", ev.Data)
+	}
+	for _, path := range []string{"/api/health", "/ws"} {
+		if code := ts.do(http.MethodGet, path, "", nil, nil); code != http.StatusServiceUnavailable {
+			t.Errorf("%s while draining: %d, want 503", path, code)
+		}
+	}
+}
@@ -0,0 +1,529 @@
+package turbo
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// Errors repositories report in place of driver-specific ones.
+var (
+	// errNotFound means no row matched.
+	errNotFound = errors.New("not found")
+	// errConflict means a unique name, handle or key is already taken.
+	errConflict = errors.New("already exists")
+)
+
+// Store is everything the server persists, grouped into repositories by
+// what they hold. pgStore keeps it in Postgres; memStore keeps it in
+// process memory, for tests and single-node runs without a database.
+// Handlers and workers only ever see these interfaces.
+type Store interface {
+	// Tx runs fn with a Store whose writes commit together if fn returns
+	// nil and are rolled back otherwise. Tx on that Store nests as a
+	// savepoint.
+	Tx(ctx context.Context, fn func(tx Store) error) error
+
+	Users() UserRepo
+	Messages() MessageRepo
+	Conversations() ConversationRepo
+	Outbox() OutboxRepo
+	Webhooks() WebhookRepo
+	Notifications() NotificationRepo
+	Presence() PresenceRepo
+	Push() PushRepo
+	Scheduled() ScheduledRepo
+	Commands() CommandRepo
+	IncomingHooks() IncomingHookRepo
+	DeadLetters() DeadLetterRepo
+
+	Close()
+}
+
+// userRecord is a user as stored.
+type userRecord struct {
+	ID          int64
+	Email       string
+	Handle      *string
+	DisplayName *string
+	AvatarURL   *string
+	Bio         *string
+	Role        string
+}
+
+// name is how u is shown in replies: display name, @handle or email.
+func (u *userRecord) name() string {
+	switch {
+	case u.DisplayName != nil && *u.DisplayName != "":
+		return *u.DisplayName
+	case u.Handle != nil:
+		return "@" + *u.Handle
+	}
+	return u.Email
+}
+
+// UserRepo holds accounts and profiles.
+type UserRepo interface {
+	// Create adds a user unless the email is taken, returning the id either
+	// way. passwordHash is nil for users who sign in elsewhere.
+	Create(ctx context.Context, email string, passwordHash []byte) (id int64, created bool, err error)
+	// Password returns the id and password hash of the user with email.
+	Password(ctx context.Context, email string) (int64, []byte, error)
+	Get(ctx context.Context, id int64) (*userRecord, error)
+	// ByEmail finds a user by exact email.
+	ByEmail(ctx context.Context, email string) (*userRecord, error)
+	// Resolve finds u by id or, for tokens that only carry an email, by
+	// email.
+	Resolve(ctx context.Context, u *user) (*userRecord, error)
+	// Lookup finds a user by id, email or handle.
+	Lookup(ctx context.Context, ref string) (*userRecord, error)
+	// Mentioned returns the users whose lowercased handle or email is one
+	// of keys.
+	Mentioned(ctx context.Context, keys []string) ([]userRecord, error)
+	// List returns up to limit users, newest first.
+	List(ctx context.Context, limit int) ([]userRecord, error)
+	// ByIDs returns the given users in id order.
+	ByIDs(ctx context.Context, ids []int64) ([]userRecord, error)
+	// UpdateProfile sets display name, avatar and bio, and the handle unless
+	// it is empty; errConflict means the handle is taken.
+	UpdateProfile(ctx context.Context, id int64, display, avatar, bio, handle string) error
+	SetRole(ctx context.Context, id int64, role string) error
+}
+
+// messageRecord is a message to store. Insert sets ID and CreatedAt.
+type messageRecord struct {
+	UserID int64
+	Text   string
+	// ConversationID is 0 for the public room
+	ConversationID int64
+	Subtype        string
+	WebhookID      int64
+	AuthorName     string
+	AuthorAvatar   string
+	Attachments    json.RawMessage
+	Images         []imageRecord
+
+	ID        int64
+	CreatedAt time.Time
+}
+
+type imageRecord struct {
+	URL      string `json:"url"`
+	Filename string `json:"filename"`
+	Filesize int64  `json:"filesize"`
+}
+
+// historyQuery selects a page of history. Conversation is as returned by
+// parseConversation; At and ID are the cursor, after which Forward pages to
+// newer messages and otherwise to older ones.
+type historyQuery struct {
+	Viewer       int64
+	Conversation *int64
+	Author       *int64
+	At           *time.Time
+	ID           *int64
+	Forward      bool
+	Limit        int
+}
+
+// searchQuery selects a page of search results after the cursor (Rank, ID).
+type searchQuery struct {
+	Viewer       int64
+	Conversation *int64
+	Text         string
+	Author       *int64
+	HasImage     bool
+	After        *time.Time
+	Before       *time.Time
+	Rank         *float32
+	ID           *int64
+	Limit        int
+}
+
+// messageRow is a message as listed in history and search, with its author
+// and conversation.
+type messageRow struct {
+	ID        int64
+	Text      string
+	CreatedAt time.Time
+	// Recipient is the other participant's email in direct conversations
+	Recipient      *string
+	AuthorID       *int64
+	AuthorEmail    *string
+	AuthorName     *string
+	AuthorAvatar   *string
+	WebhookID      *int64
+	Attachments    json.RawMessage
+	Subtype        *string
+	ConversationID *int64
+	Kind           *string
+	DirectKey      string
+	// Images is a JSON array, filled in by History
+	Images json.RawMessage
+}
+
+// conversation returns the row's conversation key, "" for the public room.
+func (m *messageRow) conversation() string {
+	if m.ConversationID == nil || m.Kind == nil {
+		return ""
+	}
+	return conversationKey(*m.Kind, *m.ConversationID, m.DirectKey)
+}
+
+// searchRow is a search hit. Snippet is nil when searching by filters alone.
+type searchRow struct {
+	messageRow
+	Rank     float32
+	Snippet  *string
+	HasImage bool
+}
+
+// MessageRepo holds messages with their images and mentions.
+type MessageRepo interface {
+	// Insert stores m with its images.
+	Insert(ctx context.Context, m *messageRecord) error
+	// Delete removes message id if author wrote it or anyAuthor is set,
+	// returning its conversation.
+	Delete(ctx context.Context, id, author int64, anyAuthor bool) (convID *int64, err error)
+	AddMentions(ctx context.Context, mid int64, spans []mentionSpan) error
+	// Mentions returns the mention spans of the given messages.
+	Mentions(ctx context.Context, ids []int64) (map[int64][]mentionSpan, error)
+	// History returns a page of messages the viewer may see, in paging
+	// order.
+	History(ctx context.Context, q historyQuery) ([]messageRow, error)
+	// Search returns a page of messages the viewer may see, best first.
+	Search(ctx context.Context, q searchQuery) ([]searchRow, error)
+}
+
+// roomEntry is one of a user's rooms.
+type roomEntry struct {
+	ID        int64
+	Name      string
+	Topic     *string
+	CreatedAt time.Time
+	Members   int64
+	Muted     bool
+}
+
+// inboxQuery selects a page of a user's inbox after the cursor (Pinned,
+// At, ID), with unread counts capped at UnreadCap, up to Participants other
+// participants and previews PreviewLen characters long.
+type inboxQuery struct {
+	User         int64
+	Pinned       bool
+	At           *time.Time
+	ID           int64
+	Limit        int
+	UnreadCap    int
+	Participants int
+	PreviewLen   int
+}
+
+// ConversationRepo holds conversations and their participants.
+type ConversationRepo interface {
+	// Get returns conversation id with its participants.
+	Get(ctx context.Context, id int64) (*conversation, error)
+	// Direct returns the direct conversation between a and b, creating it
+	// on first use.
+	Direct(ctx context.Context, a, b int64) (*conversation, error)
+	// DirectID returns the id of the direct conversation with key.
+	DirectID(ctx context.Context, key string) (int64, error)
+	// RoomID finds a room by name, ignoring case.
+	RoomID(ctx context.Context, name string) (int64, error)
+	// Create starts a group or room with c's members, setting ID and
+	// CreatedAt; errConflict means a room name is taken.
+	Create(ctx context.Context, c *conversation, createdBy int64) error
+	// Join adds u, reporting false if they were already in it.
+	Join(ctx context.Context, id, u int64) (bool, error)
+	SetTopic(ctx context.Context, id int64, topic string) error
+	// Posted moves the conversation up inboxes for message mid and marks it
+	// read up to there for its author.
+	Posted(ctx context.Context, id, author, mid int64, at time.Time) error
+	// UpdateParticipant changes u's pinned, muted and read state where not
+	// nil; read 0 marks everything read.
+	UpdateParticipant(ctx context.Context, id, u int64, pinned, muted *bool, read *int64) error
+	// Muted returns which of ids muted conversation id.
+	Muted(ctx context.Context, id int64, ids []int64) ([]int64, error)
+	// Shared reports whether a and b are both in some conversation.
+	Shared(ctx context.Context, a, b int64) (bool, error)
+	// Rooms lists u's rooms by name.
+	Rooms(ctx context.Context, u int64) ([]roomEntry, error)
+	// Inbox lists a page of a user's conversations, pinned first and then
+	// by last activity.
+	Inbox(ctx context.Context, q inboxQuery) ([]inboxEntry, error)
+}
+
+// outboxRow is an event waiting to be published.
+type outboxRow struct {
+	ID        int64
+	Topic     string
+	Payload   json.RawMessage
+	Attempts  int
+	CreatedAt time.Time
+}
+
+// OutboxRepo holds events committed with the change that caused them until
+// the relay publishes them.
+type OutboxRepo interface {
+	Enqueue(ctx context.Context, topic string, env *envelope) error
+	// Due claims up to limit unpublished events whose next attempt is due,
+	// oldest first. Claims last until the transaction ends.
+	Due(ctx context.Context, limit int) ([]outboxRow, error)
+	Published(ctx context.Context, id int64) error
+	// Failed records a failed publish to retry at retryAt.
+	Failed(ctx context.Context, id int64, retryAt time.Time, cause string) error
+	// Drop removes an event that won't be published.
+	Drop(ctx context.Context, id int64) error
+	// Cleanup removes events published before t.
+	Cleanup(ctx context.Context, before time.Time) error
+}
+
+// webhookDelivery is a claimed delivery with its webhook's endpoint.
+type webhookDelivery struct {
+	ID        int64
+	WebhookID int64
+	EventID   string
+	Type      string
+	Payload   []byte
+	Attempts  int
+	URL       string
+	Secret    string
+}
+
+// deliveryLog is a delivery as shown in a webhook's log.
+type deliveryLog struct {
+	ID            int64
+	EventID       string
+	Type          string
+	Status        string
+	Attempts      int
+	ResponseCode  *int
+	Error         *string
+	CreatedAt     time.Time
+	DeliveredAt   *time.Time
+	NextAttemptAt time.Time
+}
+
+// WebhookRepo holds outgoing webhooks and their delivery queue.
+type WebhookRepo interface {
+	// Enqueue queues env for every active webhook subscribed to its type and
+	// conversation. Events outside the public room only go to webhooks
+	// whose owner takes part in the conversation or is an admin.
+	Enqueue(ctx context.Context, env *envelope) error
+	// Claim leases up to limit due deliveries of active webhooks until
+	// leaseUntil, so other replicas pass them over meanwhile.
+	Claim(ctx context.Context, limit int, leaseUntil time.Time) ([]webhookDelivery, error)
+	// Succeeded records a delivery and resets its webhook's failure count.
+	Succeeded(ctx context.Context, d *webhookDelivery, code *int) error
+	// Failed records a failed attempt with status pending, to retry at
+	// retryAt, or failed. It disables the webhook after disableAfter
+	// consecutive failures, reporting whether it did.
+	Failed(ctx context.Context, d *webhookDelivery, status string, code *int, cause string, retryAt time.Time, disableAfter int) (disabled bool, err error)
+	// Cleanup removes finished deliveries created before t.
+	Cleanup(ctx context.Context, before time.Time) error
+
+	// List returns owner's webhooks, or everyone's if all is set.
+	List(ctx context.Context, owner int64, all bool) ([]webhookOut, error)
+	// Get returns webhook id if owner has it or anyOwner is set.
+	Get(ctx context.Context, id, owner int64, anyOwner bool) (*webhookOut, error)
+	// Create stores h, setting ID and CreatedAt.
+	Create(ctx context.Context, h *webhookOut) error
+	// Update saves h's settings. A non-empty Secret replaces the secret and
+	// re-enabling clears the failure count; Failures, DisabledAt and
+	// CreatedAt are filled in.
+	Update(ctx context.Context, h *webhookOut) error
+	Delete(ctx context.Context, id, owner int64, anyOwner bool) error
+	// Deliveries is a webhook's delivery log, newest first; status "" is
+	// any.
+	Deliveries(ctx context.Context, webhookID int64, status string, limit int) ([]deliveryLog, error)
+}
+
+// notifyCursor is how far a user's notifications went out through a sink.
+type notifyCursor struct {
+	UserID   int64
+	Sink     string
+	LastID   int64
+	LastSent *time.Time
+	Attempts int
+}
+
+// NotificationRepo holds queued notifications, per-sink delivery cursors
+// and preferences.
+type NotificationRepo interface {
+	// Add queues a notification and gives the user a cursor on each sink.
+	// mid is 0 for notifications not about a message.
+	Add(ctx context.Context, userID int64, kind string, mid int64, payload string, sinks []string) error
+	// Due claims up to limit cursors, not backing off, with notifications
+	// after them. Claims last until the transaction ends.
+	Due(ctx context.Context, limit int) ([]notifyCursor, error)
+	// After returns up to limit of a user's notifications after id.
+	After(ctx context.Context, userID, id int64, limit int) ([]notification, error)
+	// Sent moves a cursor to lastID after a delivery.
+	Sent(ctx context.Context, userID int64, sink string, lastID int64) error
+	// Lease holds a cursor until until while its batch is delivered outside
+	// the claiming transaction, so other passes skip it meanwhile.
+	Lease(ctx context.Context, userID int64, sink string, until time.Time) error
+	// Retry backs a cursor off until at after a failed delivery.
+	Retry(ctx context.Context, userID int64, sink string, at time.Time) error
+	// Skip moves a cursor past everything queued for a sink that will never
+	// deliver it.
+	Skip(ctx context.Context, userID int64, sink string) error
+	// Cleanup removes notifications created before t.
+	Cleanup(ctx context.Context, before time.Time) error
+
+	// Prefs returns a user's saved preferences or the defaults.
+	Prefs(ctx context.Context, userID int64) (notifyPrefs, error)
+	SavePrefs(ctx context.Context, userID int64, p notifyPrefs) error
+}
+
+// PresenceRepo records when users were last connected and active, across
+// instances.
+type PresenceRepo interface {
+	// Seen marks users as connected now.
+	Seen(ctx context.Context, ids []int64) error
+	// Active marks a user as connected now and active at at.
+	Active(ctx context.Context, id int64, at time.Time) error
+	// Present returns which of ids were seen after seenAfter and active
+	// after activeAfter.
+	Present(ctx context.Context, ids []int64, seenAfter, activeAfter time.Time) ([]int64, error)
+}
+
+// pushSubscription is a browser's Web Push subscription.
+type pushSubscription struct {
+	Endpoint string
+	P256dh   string
+	Auth     string
+}
+
+// PushRepo holds Web Push subscriptions.
+type PushRepo interface {
+	List(ctx context.Context, userID int64) ([]pushSubscription, error)
+	// Save registers sub for a user, taking it over from whoever had it.
+	Save(ctx context.Context, userID int64, sub pushSubscription) error
+	Delete(ctx context.Context, userID int64, endpoint string) error
+	// Drop removes an endpoint the push service says is gone.
+	Drop(ctx context.Context, endpoint string) error
+}
+
+// scheduledDue is a claimed scheduled message with its author.
+type scheduledDue struct {
+	ID     int64
+	UserID int64
+	Email  string
+	Kind   string
+	Target *int64
+	Frame  map[string]any
+}
+
+// ScheduledRepo holds scheduled messages and reminders.
+type ScheduledRepo interface {
+	Add(ctx context.Context, owner int64, kind string, target int64, frame map[string]any, sendAt time.Time) (int64, error)
+	// Due claims the oldest pending row whose time has come. The claim
+	// lasts until the transaction ends.
+	Due(ctx context.Context) (*scheduledDue, error)
+	Sent(ctx context.Context, id int64, mid *int64) error
+	Failed(ctx context.Context, id int64, cause string) error
+	// List returns owner's rows by send time; status "" is any.
+	List(ctx context.Context, owner int64, status string) ([]scheduledOut, error)
+	// Pending counts owner's pending rows of kind.
+	Pending(ctx context.Context, owner int64, kind string) (int, error)
+	// Update changes the text and send time, where not nil, of a pending
+	// row of owner's.
+	Update(ctx context.Context, id, owner int64, text *string, sendAt *time.Time) (*scheduledOut, error)
+	// Cancel cancels a pending row of owner's.
+	Cancel(ctx context.Context, id, owner int64) error
+	// Status returns the state of a row of owner's.
+	Status(ctx context.Context, id, owner int64) (string, error)
+}
+
+// botCommand is a slash command served by a bot's callback URL.
+type botCommand struct {
+	Name        string
+	URL         string
+	Secret      string
+	OwnerID     int64
+	Description *string
+	DisplayName *string
+}
+
+// CommandRepo holds bot commands.
+type CommandRepo interface {
+	// List returns every bot command by name.
+	List(ctx context.Context) ([]botCommand, error)
+	Get(ctx context.Context, name string) (*botCommand, error)
+	// Create stores c; errConflict means the name is taken.
+	Create(ctx context.Context, c *botCommand) error
+	// Delete removes command name if owner has it or anyOwner is set.
+	Delete(ctx context.Context, name string, owner int64, anyOwner bool) error
+}
+
+// incomingHook is an incoming webhook with its owner's email.
+type incomingHook struct {
+	ID         int64
+	OwnerID    int64
+	OwnerEmail string
+	Recipient  *string
+	// ConversationID is the group or room the hook posts into; nil for a
+	// DM to Recipient or the public room
+	ConversationID *int64
+	Name           *string
+	AvatarURL      *string
+	CreatedAt      time.Time
+	LastUsedAt     *time.Time
+}
+
+// IncomingHookRepo holds incoming webhooks, found by the hash of their
+// token.
+type IncomingHookRepo interface {
+	ByToken(ctx context.Context, tokenHash string) (*incomingHook, error)
+	// Used records that a hook just posted.
+	Used(ctx context.Context, id int64) error
+	List(ctx context.Context, owner int64) ([]incomingHook, error)
+	// Create stores h, setting ID and CreatedAt.
+	Create(ctx context.Context, h *incomingHook, tokenHash string) error
+	Delete(ctx context.Context, id, owner int64) error
+}
+
+// deadLetter is a bus message that won't be retried.
+type deadLetter struct {
+	ID         int64
+	Topic      string
+	Body       []byte
+	Attempts   int
+	Error      *string
+	Instance   *string
+	CreatedAt  time.Time
+	ReplayedAt *time.Time
+}
+
+// DeadLetterRepo holds dead-lettered bus messages.
+type DeadLetterRepo interface {
+	// Record stores m unless the same message is already pending, so copies
+	// consumed by several replicas collapse into one. instance is the
+	// replica that failed to handle m, or "" if m never reached the bus.
+	Record(ctx context.Context, instance string, m *BusMessage, cause error) error
+	// List returns pending messages, or all if all is set, newest first.
+	List(ctx context.Context, all bool, limit int) ([]deadLetter, error)
+	// Claim marks a pending message replayed and returns its topic, body
+	// and instance.
+	Claim(ctx context.Context, id int64) (*deadLetter, error)
+	// Unclaim makes a claimed message pending again after a failed replay.
+	Unclaim(ctx context.Context, id int64) error
+}
+
+// nonEmpty is s, or nil for a column left NULL when empty.
+func nonEmpty(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
+
+// deref is *p, or "" for nil.
+func deref(p *string) string {
+	if p == nil {
+		return ""
+	}
+	return *p
+}
@@ -0,0 +1,1576 @@
+package turbo
+
+import (
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"html"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memStore is the Store in process memory, for running and testing the API
+// without Postgres. It keeps the constraints the schema enforces (unique
+// emails, handles, room names and so on) and its cascades.
+//
+// Transactions are serialized: a top-level Tx holds txMu until it ends and
+// undoes its writes on error. Statements outside a transaction don't wait
+// for it and may see its uncommitted writes; a Tx must not start another
+// top-level Tx. Search matches substrings, ignoring case, rather than
+// stemmed words as on Postgres.
+type memStore struct {
+	db *memDB
+	// tx is the transaction this store runs in, nil outside one
+	tx *memTx
+}
+
+type memTx struct {
+	undo []func()
+}
+
+type memDB struct {
+	txMu sync.Mutex
+	mu   sync.Mutex
+	seq  int64
+	// now stamps created_at and friends, to the microsecond as Postgres
+	// does, so history cursors name rows exactly
+	now func() time.Time
+
+	users         map[int64]memUser
+	messages      map[int64]messageRecord
+	mentions      map[int64][]mentionSpan
+	conversations map[int64]memConversation
+	participants  map[memMember]memParticipant
+	outbox        map[int64]memOutbox
+	webhooks      map[int64]webhookOut
+	deliveries    map[int64]memDelivery
+	notifications map[int64]memNotification
+	cursors       map[memCursorKey]memCursor
+	prefs         map[int64]notifyPrefs
+	presence      map[int64]memPresence
+	push          map[string]memPush
+	scheduled     map[int64]memScheduled
+	commands      map[string]botCommand
+	incoming      map[int64]memIncoming
+	deadLetters   map[int64]memDeadLetter
+}
+
+type memUser struct {
+	userRecord
+	password []byte
+}
+
+type memConversation struct {
+	conversation
+	lastActivity time.Time
+}
+
+type memMember struct{ conv, user int64 }
+
+type memParticipant struct {
+	pinned, muted bool
+	lastRead      int64
+	joined        time.Time
+}
+
+type memOutbox struct {
+	outboxRow
+	nextAttempt time.Time
+	published   *time.Time
+	lastError   *string
+}
+
+type memDelivery struct {
+	deliveryLog
+	webhookID int64
+	payload   []byte
+}
+
+type memNotification struct {
+	notification
+	userID int64
+}
+
+type memCursorKey struct {
+	user int64
+	sink string
+}
+
+type memCursor struct {
+	notifyCursor
+	retryAt *time.Time
+}
+
+type memPresence struct{ seen, active time.Time }
+
+type memPush struct {
+	pushSubscription
+	userID int64
+}
+
+type memScheduled struct {
+	scheduledOut
+	userID    int64
+	frame     []byte
+	messageID *int64
+}
+
+type memIncoming struct {
+	incomingHook
+	tokenHash string
+}
+
+type memDeadLetter struct {
+	deadLetter
+	hash string
+}
+
+// NewMemoryStore returns an empty Store kept in process memory and lost on
+// exit. now is its clock, time.Now if nil.
+func NewMemoryStore(now func() time.Time) Store {
+	if now == nil {
+		now = time.Now
+	}
+	return &memStore{db: &memDB{
+		now:           func() time.Time { return now().Truncate(time.Microsecond) },
+		users:         map[int64]memUser{},
+		messages:      map[int64]messageRecord{},
+		mentions:      map[int64][]mentionSpan{},
+		conversations: map[int64]memConversation{},
+		participants:  map[memMember]memParticipant{},
+		outbox:        map[int64]memOutbox{},
+		webhooks:      map[int64]webhookOut{},
+		deliveries:    map[int64]memDelivery{},
+		notifications: map[int64]memNotification{},
+		cursors:       map[memCursorKey]memCursor{},
+		prefs:         map[int64]notifyPrefs{},
+		presence:      map[int64]memPresence{},
+		push:          map[string]memPush{},
+		scheduled:     map[int64]memScheduled{},
+		commands:      map[string]botCommand{},
+		incoming:      map[int64]memIncoming{},
+		deadLetters:   map[int64]memDeadLetter{},
+	}}
+}
+
+func (s *memStore) Tx(ctx context.Context, fn func(tx Store) error) error {
+	tx := s
+	if s.tx == nil {
+		s.db.txMu.Lock()
+		defer s.db.txMu.Unlock()
+		tx = &memStore{db: s.db, tx: &memTx{}}
+	}
+	// a nested Tx is a savepoint: on error only its own writes are undone
+	mark := len(tx.tx.undo)
+	committed := false
+	defer func() {
+		if !committed {
+			tx.rollback(mark)
+		}
+	}()
+	if err := fn(tx); err != nil {
+		return err
+	}
+	committed = true
+	return nil
+}
+
+// rollback undoes the writes made since the undo log was mark long.
+func (s *memStore) rollback(mark int) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	for i := len(s.tx.undo) - 1; i >= mark; i-- {
+		s.tx.undo[i]()
+	}
+	s.tx.undo = s.tx.undo[:mark]
+}
+
+// lock takes the table lock for one statement.
+func (s *memStore) lock() func() {
+	s.db.mu.Lock()
+	return s.db.mu.Unlock
+}
+
+// nextID is the next value of the sequence shared by every table.
+func (s *memStore) nextID() int64 {
+	s.db.seq++
+	return s.db.seq
+}
+
+// memPut sets m[k] to v, remembering how to undo it in a transaction.
+func memPut[K comparable, V any](s *memStore, m map[K]V, k K, v V) {
+	old, had := m[k]
+	m[k] = v
+	if s.tx != nil {
+		s.tx.undo = append(s.tx.undo, func() {
+			if had {
+				m[k] = old
+			} else {
+				delete(m, k)
+			}
+		})
+	}
+}
+
+// memDelete removes m[k], remembering how to undo it in a transaction.
+func memDelete[K comparable, V any](s *memStore, m map[K]V, k K) {
+	old, had := m[k]
+	if !had {
+		return
+	}
+	delete(m, k)
+	if s.tx != nil {
+		s.tx.undo = append(s.tx.undo, func() { m[k] = old })
+	}
+}
+
+// memSorted returns m's values ordered by less.
+func memSorted[K comparable, V any](m map[K]V, keep func(V) bool, less func(a, b V) int) []V {
+	var out []V
+	for _, v := range m {
+		if keep(v) {
+			out = append(out, v)
+		}
+	}
+	slices.SortFunc(out, less)
+	return out
+}
+
+// limited cuts rows to n.
+func limited[T any](rows []T, n int) []T {
+	if n >= 0 && len(rows) > n {
+		return rows[:n]
+	}
+	return rows
+}
+
+func (s *memStore) Users() UserRepo                 { return memUsers{s} }
+func (s *memStore) Messages() MessageRepo           { return memMessages{s} }
+func (s *memStore) Conversations() ConversationRepo { return memConversations{s} }
+func (s *memStore) Outbox() OutboxRepo              { return memOutboxRepo{s} }
+func (s *memStore) Webhooks() WebhookRepo           { return memWebhooks{s} }
+func (s *memStore) Notifications() NotificationRepo { return memNotifications{s} }
+func (s *memStore) Presence() PresenceRepo          { return memPresenceRepo{s} }
+func (s *memStore) Push() PushRepo                  { return memPushRepo{s} }
+func (s *memStore) Scheduled() ScheduledRepo        { return memScheduledRepo{s} }
+func (s *memStore) Commands() CommandRepo           { return memCommands{s} }
+func (s *memStore) IncomingHooks() IncomingHookRepo { return memIncomingHooks{s} }
+func (s *memStore) DeadLetters() DeadLetterRepo     { return memDeadLetters{s} }
+
+func (s *memStore) Close() {}
+
+type memUsers struct{ s *memStore }
+
+// find returns the lowest-id user matching keep.
+func (r memUsers) find(keep func(u *userRecord) bool) (*userRecord, error) {
+	var found *userRecord
+	for _, u := range r.s.db.users {
+		if keep(&u.userRecord) && (found == nil || u.ID < found.ID) {
+			rec := u.userRecord
+			found = &rec
+		}
+	}
+	if found == nil {
+		return nil, errNotFound
+	}
+	return found, nil
+}
+
+func (r memUsers) Create(ctx context.Context, email string, passwordHash []byte) (int64, bool, error) {
+	defer r.s.lock()()
+	if u, err := r.find(func(u *userRecord) bool { return u.Email == email }); err == nil {
+		return u.ID, false, nil
+	}
+	id := r.s.nextID()
+	if passwordHash == nil {
+		passwordHash = []byte{}
+	}
+	memPut(r.s, r.s.db.users, id, memUser{userRecord: userRecord{ID: id, Email: email, DisplayName: &email, Role: roleMember}, password: passwordHash})
+	return id, true, nil
+}
+
+func (r memUsers) Password(ctx context.Context, email string) (int64, []byte, error) {
+	defer r.s.lock()()
+	for _, u := range r.s.db.users {
+		if u.Email == email {
+			return u.ID, u.password, nil
+		}
+	}
+	return 0, nil, errNotFound
+}
+
+func (r memUsers) Get(ctx context.Context, id int64) (*userRecord, error) {
+	defer r.s.lock()()
+	return r.find(func(u *userRecord) bool { return u.ID == id })
+}
+
+func (r memUsers) ByEmail(ctx context.Context, email string) (*userRecord, error) {
+	defer r.s.lock()()
+	return r.find(func(u *userRecord) bool { return u.Email == email })
+}
+
+func (r memUsers) Resolve(ctx context.Context, ref *user) (*userRecord, error) {
+	defer r.s.lock()()
+	return r.find(func(u *userRecord) bool {
+		return u.ID == ref.ID || (ref.ID == 0 && strings.EqualFold(u.Email, ref.Email))
+	})
+}
+
+func (r memUsers) Lookup(ctx context.Context, ref string) (*userRecord, error) {
+	defer r.s.lock()()
+	ref = strings.TrimPrefix(ref, "@")
+	return r.find(func(u *userRecord) bool {
+		return strconv.FormatInt(u.ID, 10) == ref || strings.EqualFold(u.Email, ref) || (u.Handle != nil && strings.EqualFold(*u.Handle, ref))
+	})
+}
+
+func (r memUsers) list(keep func(u *userRecord) bool, less func(a, b memUser) int) []userRecord {
+	rows := memSorted(r.s.db.users, func(u memUser) bool { return keep(&u.userRecord) }, less)
+	out := make([]userRecord, 0, len(rows))
+	for _, u := range rows {
+		out = append(out, u.userRecord)
+	}
+	return out
+}
+
+func byUserID(a, b memUser) int { return cmp.Compare(a.ID, b.ID) }
+
+func (r memUsers) Mentioned(ctx context.Context, keys []string) ([]userRecord, error) {
+	defer r.s.lock()()
+	return r.list(func(u *userRecord) bool {
+		return slices.Contains(keys, strings.ToLower(u.Email)) || (u.Handle != nil && slices.Contains(keys, strings.ToLower(*u.Handle)))
+	}, byUserID), nil
+}
+
+func (r memUsers) List(ctx context.Context, limit int) ([]userRecord, error) {
+	defer r.s.lock()()
+	all := r.list(func(*userRecord) bool { return true }, func(a, b memUser) int { return cmp.Compare(b.ID, a.ID) })
+	return limited(all, limit), nil
+}
+
+func (r memUsers) ByIDs(ctx context.Context, ids []int64) ([]userRecord, error) {
+	defer r.s.lock()()
+	return r.list(func(u *userRecord) bool { return slices.Contains(ids, u.ID) }, byUserID), nil
+}
+
+func (r memUsers) UpdateProfile(ctx context.Context, id int64, display, avatar, bio, handle string) error {
+	defer r.s.lock()()
+	u, ok := r.s.db.users[id]
+	if !ok {
+		return nil
+	}
+	if handle != "" {
+		for _, o := range r.s.db.users {
+			if o.ID != id && o.Handle != nil && strings.EqualFold(*o.Handle, handle) {
+				return errConflict
+			}
+		}
+		u.Handle = &handle
+	}
+	u.DisplayName, u.AvatarURL, u.Bio = &display, &avatar, &bio
+	memPut(r.s, r.s.db.users, id, u)
+	return nil
+}
+
+func (r memUsers) SetRole(ctx context.Context, id int64, role string) error {
+	defer r.s.lock()()
+	u, ok := r.s.db.users[id]
+	if !ok {
+		return errNotFound
+	}
+	u.Role = role
+	memPut(r.s, r.s.db.users, id, u)
+	return nil
+}
+
+type memMessages struct{ s *memStore }
+
+func (r memMessages) Insert(ctx context.Context, m *messageRecord) error {
+	defer r.s.lock()()
+	m.ID, m.CreatedAt = r.s.nextID(), r.s.db.now()
+	rec := *m
+	rec.Images = slices.Clone(m.Images)
+	memPut(r.s, r.s.db.messages, m.ID, rec)
+	return nil
+}
+
+func (r memMessages) Delete(ctx context.Context, id, author int64, anyAuthor bool) (*int64, error) {
+	defer r.s.lock()()
+	m, ok := r.s.db.messages[id]
+	if !ok || !(anyAuthor || m.UserID == author) {
+		return nil, errNotFound
+	}
+	memDelete(r.s, r.s.db.messages, id)
+	memDelete(r.s, r.s.db.mentions, id)
+	for nid, n := range r.s.db.notifications {
+		if n.MessageID == id {
+			memDelete(r.s, r.s.db.notifications, nid)
+		}
+	}
+	for sid, sm := range r.s.db.scheduled {
+		if sm.messageID != nil && *sm.messageID == id {
+			sm.messageID = nil
+			memPut(r.s, r.s.db.scheduled, sid, sm)
+		}
+	}
+	if m.ConversationID == 0 {
+		return nil, nil
+	}
+	return &m.ConversationID, nil
+}
+
+func (r memMessages) AddMentions(ctx context.Context, mid int64, spans []mentionSpan) error {
+	defer r.s.lock()()
+	stored := slices.Clone(r.s.db.mentions[mid])
+	for _, sp := range spans {
+		stored = append(stored, mentionSpan{Start: sp.Start, End: sp.End, Kind: sp.Kind, UserID: sp.UserID})
+	}
+	memPut(r.s, r.s.db.mentions, mid, stored)
+	return nil
+}
+
+func (r memMessages) Mentions(ctx context.Context, ids []int64) (map[int64][]mentionSpan, error) {
+	defer r.s.lock()()
+	out := map[int64][]mentionSpan{}
+	for _, mid := range ids {
+		for _, sp := range r.s.db.mentions[mid] {
+			if u, ok := r.s.db.users[sp.UserID]; ok {
+				sp.Handle, sp.DisplayName = deref(u.Handle), deref(u.DisplayName)
+			}
+			out[mid] = append(out[mid], sp)
+		}
+		slices.SortFunc(out[mid], func(a, b mentionSpan) int { return cmp.Compare(a.Start, b.Start) })
+	}
+	return out, nil
+}
+
+// visible is whether viewer may read m and it is in the conversation
+// selected as by parseConversation.
+func (r memMessages) visible(m *messageRecord, viewer int64, conv *int64) bool {
+	if m.ConversationID != 0 {
+		if _, ok := r.s.db.participants[memMember{m.ConversationID, viewer}]; !ok {
+			return false
+		}
+	}
+	return conv == nil || *conv == m.ConversationID
+}
+
+// row is m as history and search list it.
+func (r memMessages) row(m *messageRecord) messageRow {
+	row := messageRow{ID: m.ID, Text: m.Text, CreatedAt: m.CreatedAt, Attachments: m.Attachments}
+	author, hasAuthor := r.s.db.users[m.UserID]
+	if hasAuthor {
+		row.AuthorID, row.AuthorEmail = &author.ID, &author.Email
+		row.AuthorName, row.AuthorAvatar = author.DisplayName, author.AvatarURL
+	}
+	if m.AuthorName != "" {
+		row.AuthorName = &m.AuthorName
+	}
+	if m.AuthorAvatar != "" {
+		row.AuthorAvatar = &m.AuthorAvatar
+	}
+	if m.WebhookID != 0 {
+		row.WebhookID = &m.WebhookID
+	}
+	row.Subtype = nonEmpty(m.Subtype)
+	if c, ok := r.s.db.conversations[m.ConversationID]; ok {
+		row.ConversationID, row.Kind, row.DirectKey = &c.ID, &c.Kind, c.DirectKey
+		if c.Kind == kindDirect {
+			row.Recipient = row.AuthorEmail
+			for _, id := range memberIDs(r.s.db, c.ID) {
+				if id != m.UserID {
+					if peer, ok := r.s.db.users[id]; ok {
+						row.Recipient = &peer.Email
+					}
+					break
+				}
+			}
+		}
+	}
+	return row
+}
+
+func (r memMessages) History(ctx context.Context, q historyQuery) ([]messageRow, error) {
+	defer r.s.lock()()
+	rows := memSorted(r.s.db.messages, func(m messageRecord) bool {
+		if !r.visible(&m, q.Viewer, q.Conversation) || (q.Author != nil && m.UserID != *q.Author) {
+			return false
+		}
+		if q.At == nil {
+			return true
+		}
+		c := cmp.Or(m.CreatedAt.Compare(*q.At), cmp.Compare(m.ID, *q.ID))
+		return (q.Forward && c > 0) || (!q.Forward && c < 0)
+	}, func(a, b messageRecord) int {
+		c := cmp.Or(a.CreatedAt.Compare(b.CreatedAt), cmp.Compare(a.ID, b.ID))
+		if q.Forward {
+			return c
+		}
+		return -c
+	})
+	var out []messageRow
+	for _, m := range limited(rows, q.Limit) {
+		row := r.row(&m)
+		images := m.Images
+		if images == nil {
+			images = []imageRecord{}
+		}
+		row.Images = json.RawMessage(mustJSON(images))
+		out = append(out, row)
+	}
+	return out, nil
+}
+
+func (r memMessages) Search(ctx context.Context, q searchQuery) ([]searchRow, error) {
+	defer r.s.lock()()
+	terms := strings.Fields(q.Text)
+	var hits []searchRow
+	for _, m := range r.s.db.messages {
+		if !r.visible(&m, q.Viewer, q.Conversation) || (q.Author != nil && m.UserID != *q.Author) || (q.HasImage && len(m.Images) == 0) ||
+			(q.After != nil && !m.CreatedAt.After(*q.After)) || (q.Before != nil && !m.CreatedAt.Before(*q.Before)) {
+			continue
+		}
+		var rank float32
+		matched := true
+		for _, t := range terms {
+			n := strings.Count(strings.ToLower(m.Text), strings.ToLower(t))
+			matched = matched && n > 0
+			rank += float32(n)
+		}
+		if !matched {
+			continue
+		}
+		if q.Rank != nil && cmp.Or(cmp.Compare(rank, *q.Rank), cmp.Compare(m.ID, *q.ID)) >= 0 {
+			continue
+		}
+		h := searchRow{messageRow: r.row(&m), Rank: rank, HasImage: len(m.Images) > 0}
+		h.Attachments, h.Subtype = nil, nil
+		if len(terms) > 0 {
+			snippet := highlight(m.Text, terms)
+			h.Snippet = &snippet
+		}
+		hits = append(hits, h)
+	}
+	slices.SortFunc(hits, func(a, b searchRow) int { return cmp.Or(cmp.Compare(b.Rank, a.Rank), cmp.Compare(b.ID, a.ID)) })
+	return limited(hits, q.Limit), nil
+}
+
+// highlight HTML-escapes text and wraps each occurrence of terms in <mark>.
+func highlight(text string, terms []string) string {
+	var b strings.Builder
+	start := 0
+	for i := 0; i < len(text); {
+		n := 0
+		for _, t := range terms {
+			if len(t) > n && i+len(t) <= len(text) && strings.EqualFold(text[i:i+len(t)], t) {
+				n = len(t)
+			}
+		}
+		if n == 0 {
+			i++
+			continue
+		}
+		b.WriteString(html.EscapeString(text[start:i]))
+		b.WriteString("<mark>" + html.EscapeString(text[i:i+n]) + "</mark>")
+		i += n
+		start = i
+	}
+	b.WriteString(html.EscapeString(text[start:]))
+	return b.String()
+}
+
+// memberIDs lists a conversation's participants by id.
+func memberIDs(db *memDB, conv int64) []int64 {
+	var ids []int64
+	for k := range db.participants {
+		if k.conv == conv {
+			ids = append(ids, k.user)
+		}
+	}
+	slices.Sort(ids)
+	return ids
+}
+
+// mayWatch reports whether a webhook owned by uid gets the events of the
+// conversation with key conv: everyone gets the public room's, otherwise
+// the owner has to be a participant or an admin.
+func (db *memDB) mayWatch(uid int64, conv string) bool {
+	if conv == "" || db.users[uid].Role == roleAdmin {
+		return true
+	}
+	for _, c := range db.conversations {
+		if c.key() == conv {
+			_, ok := db.participants[memMember{c.ID, uid}]
+			return ok
+		}
+	}
+	return false
+}
+
+type memConversations struct{ s *memStore }
+
+func (r memConversations) get(id int64) (*conversation, error) {
+	c, ok := r.s.db.conversations[id]
+	if !ok {
+		return nil, errNotFound
+	}
+	out := c.conversation
+	out.Members = memberIDs(r.s.db, id)
+	return &out, nil
+}
+
+func (r memConversations) Get(ctx context.Context, id int64) (*conversation, error) {
+	defer r.s.lock()()
+	return r.get(id)
+}
+
+// join adds u to conversation id, reporting false if they were already in
+// it.
+func (r memConversations) join(id, u int64) bool {
+	k := memMember{id, u}
+	if _, ok := r.s.db.participants[k]; ok {
+		return false
+	}
+	memPut(r.s, r.s.db.participants, k, memParticipant{joined: r.s.db.now()})
+	return true
+}
+
+func (r memConversations) directID(key string) (int64, error) {
+	for _, c := range r.s.db.conversations {
+		if c.DirectKey == key {
+			return c.ID, nil
+		}
+	}
+	return 0, errNotFound
+}
+
+func (r memConversations) Direct(ctx context.Context, a, b int64) (*conversation, error) {
+	defer r.s.lock()()
+	key := directKey(a, b)
+	id, err := r.directID(key)
+	if err != nil {
+		now := r.s.db.now()
+		id = r.s.nextID()
+		memPut(r.s, r.s.db.conversations, id, memConversation{conversation: conversation{ID: id, Kind: kindDirect, DirectKey: key, CreatedBy: &a, CreatedAt: now}, lastActivity: now})
+	}
+	r.join(id, a)
+	r.join(id, b)
+	return r.get(id)
+}
+
+func (r memConversations) DirectID(ctx context.Context, key string) (int64, error) {
+	defer r.s.lock()()
+	return r.directID(key)
+}
+
+func (r memConversations) roomID(name string) (int64, error) {
+	for _, c := range r.s.db.conversations {
+		if c.Kind == kindRoom && c.Name != nil && strings.EqualFold(*c.Name, name) {
+			return c.ID, nil
+		}
+	}
+	return 0, errNotFound
+}
+
+func (r memConversations) RoomID(ctx context.Context, name string) (int64, error) {
+	defer r.s.lock()()
+	return r.roomID(name)
+}
+
+func (r memConversations) Create(ctx context.Context, c *conversation, createdBy int64) error {
+	defer r.s.lock()()
+	if c.Kind == kindRoom {
+		if _, err := r.roomID(deref(c.Name)); err == nil {
+			return errConflict
+		}
+	}
+	c.ID, c.CreatedBy, c.CreatedAt = r.s.nextID(), &createdBy, r.s.db.now()
+	stored := memConversation{conversation: *c, lastActivity: c.CreatedAt}
+	stored.Name, stored.Topic, stored.Members = nonEmpty(deref(c.Name)), nonEmpty(deref(c.Topic)), nil
+	memPut(r.s, r.s.db.conversations, c.ID, stored)
+	for _, u := range c.Members {
+		r.join(c.ID, u)
+	}
+	return nil
+}
+
+func (r memConversations) Join(ctx context.Context, id, u int64) (bool, error) {
+	defer r.s.lock()()
+	return r.join(id, u), nil
+}
+
+func (r memConversations) SetTopic(ctx context.Context, id int64, topic string) error {
+	defer r.s.lock()()
+	if c, ok := r.s.db.conversations[id]; ok {
+		c.Topic = &topic
+		memPut(r.s, r.s.db.conversations, id, c)
+	}
+	return nil
+}
+
+func (r memConversations) Posted(ctx context.Context, id, author, mid int64, at time.Time) error {
+	defer r.s.lock()()
+	if c, ok := r.s.db.conversations[id]; ok && at.After(c.lastActivity) {
+		c.lastActivity = at
+		memPut(r.s, r.s.db.conversations, id, c)
+	}
+	k := memMember{id, author}
+	if p, ok := r.s.db.participants[k]; ok && mid > p.lastRead {
+		p.lastRead = mid
+		memPut(r.s, r.s.db.participants, k, p)
+	}
+	return nil
+}
+
+func (r memConversations) UpdateParticipant(ctx context.Context, id, u int64, pinned, muted *bool, read *int64) error {
+	defer r.s.lock()()
+	k := memMember{id, u}
+	p, ok := r.s.db.participants[k]
+	if !ok {
+		return errNotFound
+	}
+	if pinned != nil {
+		p.pinned = *pinned
+	}
+	if muted != nil {
+		p.muted = *muted
+	}
+	if read != nil {
+		to := *read
+		if to == 0 {
+			for _, m := range r.s.db.messages {
+				if m.ConversationID == id {
+					to = max(to, m.ID)
+				}
+			}
+		}
+		p.lastRead = max(p.lastRead, to)
+	}
+	memPut(r.s, r.s.db.participants, k, p)
+	return nil
+}
+
+func (r memConversations) Muted(ctx context.Context, id int64, ids []int64) ([]int64, error) {
+	defer r.s.lock()()
+	var out []int64
+	for _, u := range ids {
+		if p, ok := r.s.db.participants[memMember{id, u}]; ok && p.muted {
+			out = append(out, u)
+		}
+	}
+	return out, nil
+}
+
+func (r memConversations) Shared(ctx context.Context, a, b int64) (bool, error) {
+	defer r.s.lock()()
+	for k := range r.s.db.participants {
+		if k.user == a {
+			if _, ok := r.s.db.participants[memMember{k.conv, b}]; ok {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+func (r memConversations) Rooms(ctx context.Context, u int64) ([]roomEntry, error) {
+	defer r.s.lock()()
+	var out []roomEntry
+	for _, c := range r.s.db.conversations {
+		p, ok := r.s.db.participants[memMember{c.ID, u}]
+		if c.Kind != kindRoom || !ok {
+			continue
+		}
+		out = append(out, roomEntry{ID: c.ID, Name: deref(c.Name), Topic: c.Topic, CreatedAt: c.CreatedAt, Members: int64(len(memberIDs(r.s.db, c.ID))), Muted: p.muted})
+	}
+	slices.SortFunc(out, func(a, b roomEntry) int { return strings.Compare(a.Name, b.Name) })
+	return out, nil
+}
+
+// memInboxUser is a participant as the inbox previews them.
+type memInboxUser struct {
+	ID          int64   `json:"id"`
+	Email       string  `json:"email"`
+	Handle      *string `json:"handle"`
+	DisplayName *string `json:"display_name"`
+	AvatarURL   *string `json:"avatar_url"`
+}
+
+func (r memConversations) Inbox(ctx context.Context, q inboxQuery) ([]inboxEntry, error) {
+	defer r.s.lock()()
+	type entry struct {
+		c memConversation
+		p memParticipant
+	}
+	var page []entry
+	for k, p := range r.s.db.participants {
+		if k.user != q.User {
+			continue
+		}
+		c := r.s.db.conversations[k.conv]
+		if q.At != nil && inboxOrder(p.pinned, c.lastActivity, c.ID, q.Pinned, *q.At, q.ID) >= 0 {
+			continue
+		}
+		page = append(page, entry{c, p})
+	}
+	slices.SortFunc(page, func(a, b entry) int {
+		return -inboxOrder(a.p.pinned, a.c.lastActivity, a.c.ID, b.p.pinned, b.c.lastActivity, b.c.ID)
+	})
+	var entries []inboxEntry
+	for _, en := range limited(page, q.Limit) {
+		c, p := en.c, en.p
+		e := inboxEntry{ID: c.ID, Kind: c.Kind, Name: c.Name, Topic: c.Topic, LastActivity: c.lastActivity, Pinned: p.pinned, Muted: p.muted,
+			Conversation: conversationKey(c.Kind, c.ID, c.DirectKey)}
+		var last *messageRecord
+		for _, m := range r.s.db.messages {
+			if m.ConversationID != c.ID {
+				continue
+			}
+			if m.ID > p.lastRead && m.UserID != q.User && e.Unread < int64(q.UnreadCap) {
+				e.Unread++
+			}
+			if last == nil || cmp.Or(m.CreatedAt.Compare(last.CreatedAt), cmp.Compare(m.ID, last.ID)) > 0 {
+				last = &m
+			}
+		}
+		others := []memInboxUser{}
+		var joined []memMember
+		for k := range r.s.db.participants {
+			if k.conv == c.ID {
+				e.ParticipantCount++
+				if k.user != q.User {
+					joined = append(joined, k)
+				}
+			}
+		}
+		slices.SortFunc(joined, func(a, b memMember) int {
+			return cmp.Or(r.s.db.participants[a].joined.Compare(r.s.db.participants[b].joined), cmp.Compare(a.user, b.user))
+		})
+		for _, k := range limited(joined, q.Participants) {
+			if u, ok := r.s.db.users[k.user]; ok {
+				others = append(others, memInboxUser{u.ID, u.Email, u.Handle, u.DisplayName, u.AvatarURL})
+			}
+		}
+		e.Participants = json.RawMessage(mustJSON(others))
+		if last != nil {
+			text := []rune(last.Text)
+			pv := &inboxPreview{ID: last.ID, Text: string(limited(text, q.PreviewLen)), Ts: last.CreatedAt.UnixMilli(), AuthorID: &last.UserID, HasImage: len(last.Images) > 0}
+			if last.AuthorName != "" {
+				pv.Author = &last.AuthorName
+			} else if u, ok := r.s.db.users[last.UserID]; ok {
+				pv.Author = &u.Email
+				if u.DisplayName != nil {
+					pv.Author = u.DisplayName
+				}
+			}
+			e.LastMessage = pv
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// inboxOrder compares inbox positions (pinned, last activity, id), the
+// greatest first in the inbox.
+func inboxOrder(pinnedA bool, atA time.Time, idA int64, pinnedB bool, atB time.Time, idB int64) int {
+	b2i := func(b bool) int {
+		if b {
+			return 1
+		}
+		return 0
+	}
+	return cmp.Or(cmp.Compare(b2i(pinnedA), b2i(pinnedB)), atA.Compare(atB), cmp.Compare(idA, idB))
+}
+
+type memOutboxRepo struct{ s *memStore }
+
+func (r memOutboxRepo) Enqueue(ctx context.Context, topic string, env *envelope) error {
+	defer r.s.lock()()
+	now := r.s.db.now()
+	id := r.s.nextID()
+	memPut(r.s, r.s.db.outbox, id, memOutbox{outboxRow: outboxRow{ID: id, Topic: topic, Payload: json.RawMessage(mustJSON(env)), CreatedAt: now}, nextAttempt: now})
+	return nil
+}
+
+func (r memOutboxRepo) Due(ctx context.Context, limit int) ([]outboxRow, error) {
+	defer r.s.lock()()
+	now := r.s.db.now()
+	rows := memSorted(r.s.db.outbox, func(o memOutbox) bool { return o.published == nil && !o.nextAttempt.After(now) },
+		func(a, b memOutbox) int { return cmp.Compare(a.ID, b.ID) })
+	var out []outboxRow
+	for _, o := range limited(rows, limit) {
+		out = append(out, o.outboxRow)
+	}
+	return out, nil
+}
+
+func (r memOutboxRepo) update(id int64, fn func(o *memOutbox)) {
+	if o, ok := r.s.db.outbox[id]; ok {
+		fn(&o)
+		memPut(r.s, r.s.db.outbox, id, o)
+	}
+}
+
+func (r memOutboxRepo) Published(ctx context.Context, id int64) error {
+	defer r.s.lock()()
+	r.update(id, func(o *memOutbox) {
+		now := r.s.db.now()
+		o.Attempts++
+		o.published, o.lastError = &now, nil
+	})
+	return nil
+}
+
+func (r memOutboxRepo) Failed(ctx context.Context, id int64, retryAt time.Time, cause string) error {
+	defer r.s.lock()()
+	r.update(id, func(o *memOutbox) {
+		o.Attempts++
+		o.nextAttempt, o.lastError = retryAt, &cause
+	})
+	return nil
+}
+
+func (r memOutboxRepo) Drop(ctx context.Context, id int64) error {
+	defer r.s.lock()()
+	memDelete(r.s, r.s.db.outbox, id)
+	return nil
+}
+
+func (r memOutboxRepo) Cleanup(ctx context.Context, before time.Time) error {
+	defer r.s.lock()()
+	for id, o := range r.s.db.outbox {
+		if o.published != nil && o.published.Before(before) {
+			memDelete(r.s, r.s.db.outbox, id)
+		}
+	}
+	return nil
+}
+
+type memWebhooks struct{ s *memStore }
+
+func (r memWebhooks) Enqueue(ctx context.Context, env *envelope) error {
+	defer r.s.lock()()
+	now := r.s.db.now()
+	for _, h := range r.s.db.webhooks {
+		if !h.Active || !slices.Contains(h.Events, env.Type) || (h.Room != nil && *h.Room != env.Conversation) ||
+			!r.s.db.mayWatch(h.OwnerID, env.Conversation) {
+			continue
+		}
+		dup := false
+		for _, d := range r.s.db.deliveries {
+			dup = dup || (d.webhookID == h.ID && d.EventID == env.ID)
+		}
+		if dup {
+			continue
+		}
+		id := r.s.nextID()
+		memPut(r.s, r.s.db.deliveries, id, memDelivery{deliveryLog: deliveryLog{ID: id, EventID: env.ID, Type: env.Type, Status: "pending", CreatedAt: now, NextAttemptAt: now},
+			webhookID: h.ID, payload: []byte(mustJSON(env))})
+	}
+	return nil
+}
+
+func (r memWebhooks) Claim(ctx context.Context, limit int, leaseUntil time.Time) ([]webhookDelivery, error) {
+	defer r.s.lock()()
+	now := r.s.db.now()
+	due := memSorted(r.s.db.deliveries, func(d memDelivery) bool {
+		return d.Status == "pending" && !d.NextAttemptAt.After(now) && r.s.db.webhooks[d.webhookID].Active
+	}, func(a, b memDelivery) int { return cmp.Compare(a.ID, b.ID) })
+	var out []webhookDelivery
+	for _, d := range limited(due, limit) {
+		d.NextAttemptAt = leaseUntil
+		memPut(r.s, r.s.db.deliveries, d.ID, d)
+		h := r.s.db.webhooks[d.webhookID]
+		out = append(out, webhookDelivery{ID: d.ID, WebhookID: d.webhookID, EventID: d.EventID, Type: d.Type, Payload: d.payload, Attempts: d.Attempts, URL: h.URL, Secret: h.Secret})
+	}
+	return out, nil
+}
+
+func (r memWebhooks) Succeeded(ctx context.Context, d *webhookDelivery, code *int) error {
+	defer r.s.lock()()
+	if del, ok := r.s.db.deliveries[d.ID]; ok {
+		now := r.s.db.now()
+		del.Status, del.ResponseCode, del.Error, del.DeliveredAt = "succeeded", code, nil, &now
+		del.Attempts++
+		memPut(r.s, r.s.db.deliveries, d.ID, del)
+	}
+	if h, ok := r.s.db.webhooks[d.WebhookID]; ok {
+		h.Failures = 0
+		memPut(r.s, r.s.db.webhooks, h.ID, h)
+	}
+	return nil
+}
+
+func (r memWebhooks) Failed(ctx context.Context, d *webhookDelivery, status string, code *int, cause string, retryAt time.Time, disableAfter int) (bool, error) {
+	defer r.s.lock()()
+	if del, ok := r.s.db.deliveries[d.ID]; ok {
+		del.Status, del.ResponseCode, del.Error, del.NextAttemptAt = status, code, &cause, retryAt
+		del.Attempts++
+		memPut(r.s, r.s.db.deliveries, d.ID, del)
+	}
+	h, ok := r.s.db.webhooks[d.WebhookID]
+	if !ok {
+		return false, errNotFound
+	}
+	h.Failures++
+	if h.Failures >= disableAfter && h.Active {
+		now := r.s.db.now()
+		h.Active, h.DisabledAt = false, &now
+	}
+	memPut(r.s, r.s.db.webhooks, h.ID, h)
+	return !h.Active, nil
+}
+
+func (r memWebhooks) Cleanup(ctx context.Context, before time.Time) error {
+	defer r.s.lock()()
+	for id, d := range r.s.db.deliveries {
+		if d.Status != "pending" && d.CreatedAt.Before(before) {
+			memDelete(r.s, r.s.db.deliveries, id)
+		}
+	}
+	return nil
+}
+
+func (r memWebhooks) List(ctx context.Context, owner int64, all bool) ([]webhookOut, error) {
+	defer r.s.lock()()
+	out := memSorted(r.s.db.webhooks, func(h webhookOut) bool { return all || h.OwnerID == owner },
+		func(a, b webhookOut) int { return cmp.Compare(a.ID, b.ID) })
+	for i := range out {
+		out[i].Secret = ""
+	}
+	return out, nil
+}
+
+func (r memWebhooks) Get(ctx context.Context, id, owner int64, anyOwner bool) (*webhookOut, error) {
+	defer r.s.lock()()
+	h, ok := r.s.db.webhooks[id]
+	if !ok || !(anyOwner || h.OwnerID == owner) {
+		return nil, errNotFound
+	}
+	h.Secret = ""
+	return &h, nil
+}
+
+func (r memWebhooks) Create(ctx context.Context, h *webhookOut) error {
+	defer r.s.lock()()
+	h.ID, h.CreatedAt = r.s.nextID(), r.s.db.now()
+	stored := *h
+	stored.Events, stored.Active, stored.Failures, stored.DisabledAt = slices.Clone(h.Events), true, 0, nil
+	memPut(r.s, r.s.db.webhooks, h.ID, stored)
+	return nil
+}
+
+func (r memWebhooks) Update(ctx context.Context, h *webhookOut) error {
+	defer r.s.lock()()
+	old, ok := r.s.db.webhooks[h.ID]
+	if !ok {
+		return errNotFound
+	}
+	stored := old
+	stored.URL, stored.Events, stored.Room, stored.Active = h.URL, slices.Clone(h.Events), h.Room, h.Active
+	if h.Secret != "" {
+		stored.Secret = h.Secret
+	}
+	if h.Active && !old.Active {
+		stored.Failures = 0
+	}
+	if h.Active {
+		stored.DisabledAt = nil
+	}
+	memPut(r.s, r.s.db.webhooks, h.ID, stored)
+	h.Failures, h.DisabledAt, h.CreatedAt = stored.Failures, stored.DisabledAt, stored.CreatedAt
+	return nil
+}
+
+func (r memWebhooks) Delete(ctx context.Context, id, owner int64, anyOwner bool) error {
+	defer r.s.lock()()
+	h, ok := r.s.db.webhooks[id]
+	if !ok || !(anyOwner || h.OwnerID == owner) {
+		return errNotFound
+	}
+	memDelete(r.s, r.s.db.webhooks, id)
+	for did, d := range r.s.db.deliveries {
+		if d.webhookID == id {
+			memDelete(r.s, r.s.db.deliveries, did)
+		}
+	}
+	return nil
+}
+
+func (r memWebhooks) Deliveries(ctx context.Context, webhookID int64, status string, limit int) ([]deliveryLog, error) {
+	defer r.s.lock()()
+	rows := memSorted(r.s.db.deliveries, func(d memDelivery) bool { return d.webhookID == webhookID && (status == "" || d.Status == status) },
+		func(a, b memDelivery) int { return cmp.Compare(b.ID, a.ID) })
+	var out []deliveryLog
+	for _, d := range limited(rows, limit) {
+		out = append(out, d.deliveryLog)
+	}
+	return out, nil
+}
+
+type memNotifications struct{ s *memStore }
+
+func (r memNotifications) Add(ctx context.Context, userID int64, kind string, mid int64, payload string, sinks []string) error {
+	defer r.s.lock()()
+	id := r.s.nextID()
+	memPut(r.s, r.s.db.notifications, id, memNotification{notification: notification{ID: id, Kind: kind, MessageID: mid, Payload: json.RawMessage(payload), CreatedAt: r.s.db.now()}, userID: userID})
+	for _, sink := range sinks {
+		k := memCursorKey{userID, sink}
+		if _, ok := r.s.db.cursors[k]; !ok {
+			memPut(r.s, r.s.db.cursors, k, memCursor{notifyCursor: notifyCursor{UserID: userID, Sink: sink}})
+		}
+	}
+	return nil
+}
+
+// latest is the id of a user's newest notification, 0 if none.
+func (r memNotifications) latest(userID int64) int64 {
+	var id int64
+	for _, n := range r.s.db.notifications {
+		if n.userID == userID {
+			id = max(id, n.ID)
+		}
+	}
+	return id
+}
+
+func (r memNotifications) Due(ctx context.Context, limit int) ([]notifyCursor, error) {
+	defer r.s.lock()()
+	now := r.s.db.now()
+	rows := memSorted(r.s.db.cursors, func(c memCursor) bool {
+		return (c.retryAt == nil || !c.retryAt.After(now)) && r.latest(c.UserID) > c.LastID
+	}, func(a, b memCursor) int {
+		return cmp.Or(cmp.Compare(a.UserID, b.UserID), strings.Compare(a.Sink, b.Sink))
+	})
+	var out []notifyCursor
+	for _, c := range limited(rows, limit) {
+		out = append(out, c.notifyCursor)
+	}
+	return out, nil
+}
+
+func (r memNotifications) After(ctx context.Context, userID, id int64, limit int) ([]notification, error) {
+	defer r.s.lock()()
+	rows := memSorted(r.s.db.notifications, func(n memNotification) bool { return n.userID == userID && n.ID > id },
+		func(a, b memNotification) int { return cmp.Compare(a.ID, b.ID) })
+	var out []notification
+	for _, n := range limited(rows, limit) {
+		out = append(out, n.notification)
+	}
+	return out, nil
+}
+
+func (r memNotifications) update(userID int64, sink string, fn func(c *memCursor)) {
+	k := memCursorKey{userID, sink}
+	if c, ok := r.s.db.cursors[k]; ok {
+		fn(&c)
+		memPut(r.s, r.s.db.cursors, k, c)
+	}
+}
+
+func (r memNotifications) Sent(ctx context.Context, userID int64, sink string, lastID int64) error {
+	defer r.s.lock()()
+	r.update(userID, sink, func(c *memCursor) {
+		now := r.s.db.now()
+		c.LastID, c.LastSent, c.Attempts, c.retryAt = lastID, &now, 0, nil
+	})
+	return nil
+}
+
+func (r memNotifications) Lease(ctx context.Context, userID int64, sink string, until time.Time) error {
+	defer r.s.lock()()
+	r.update(userID, sink, func(c *memCursor) { c.retryAt = &until })
+	return nil
+}
+
+func (r memNotifications) Retry(ctx context.Context, userID int64, sink string, at time.Time) error {
+	defer r.s.lock()()
+	r.update(userID, sink, func(c *memCursor) {
+		c.Attempts++
+		c.retryAt = &at
+	})
+	return nil
+}
+
+func (r memNotifications) Skip(ctx context.Context, userID int64, sink string) error {
+	defer r.s.lock()()
+	r.update(userID, sink, func(c *memCursor) {
+		if latest := r.latest(userID); latest != 0 {
+			c.LastID = latest
+		}
+	})
+	return nil
+}
+
+func (r memNotifications) Cleanup(ctx context.Context, before time.Time) error {
+	defer r.s.lock()()
+	for id, n := range r.s.db.notifications {
+		if n.CreatedAt.Before(before) {
+			memDelete(r.s, r.s.db.notifications, id)
+		}
+	}
+	return nil
+}
+
+func (r memNotifications) Prefs(ctx context.Context, userID int64) (notifyPrefs, error) {
+	defer r.s.lock()()
+	if p, ok := r.s.db.prefs[userID]; ok {
+		return p, nil
+	}
+	return defaultNotifyPrefs, nil
+}
+
+func (r memNotifications) SavePrefs(ctx context.Context, userID int64, p notifyPrefs) error {
+	defer r.s.lock()()
+	memPut(r.s, r.s.db.prefs, userID, p)
+	return nil
+}
+
+type memPresenceRepo struct{ s *memStore }
+
+func (r memPresenceRepo) Seen(ctx context.Context, ids []int64) error {
+	defer r.s.lock()()
+	now := r.s.db.now()
+	for _, id := range ids {
+		p, ok := r.s.db.presence[id]
+		if !ok {
+			p.active = now
+		}
+		p.seen = now
+		memPut(r.s, r.s.db.presence, id, p)
+	}
+	return nil
+}
+
+func (r memPresenceRepo) Active(ctx context.Context, id int64, at time.Time) error {
+	defer r.s.lock()()
+	p, ok := r.s.db.presence[id]
+	if !ok || at.After(p.active) {
+		p.active = at
+	}
+	p.seen = r.s.db.now()
+	memPut(r.s, r.s.db.presence, id, p)
+	return nil
+}
+
+func (r memPresenceRepo) Present(ctx context.Context, ids []int64, seenAfter, activeAfter time.Time) ([]int64, error) {
+	defer r.s.lock()()
+	var out []int64
+	for _, id := range ids {
+		if p, ok := r.s.db.presence[id]; ok && p.seen.After(seenAfter) && p.active.After(activeAfter) {
+			out = append(out, id)
+		}
+	}
+	return out, nil
+}
+
+type memPushRepo struct{ s *memStore }
+
+func (r memPushRepo) List(ctx context.Context, userID int64) ([]pushSubscription, error) {
+	defer r.s.lock()()
+	var out []pushSubscription
+	for _, p := range r.s.db.push {
+		if p.userID == userID {
+			out = append(out, p.pushSubscription)
+		}
+	}
+	return out, nil
+}
+
+func (r memPushRepo) Save(ctx context.Context, userID int64, sub pushSubscription) error {
+	defer r.s.lock()()
+	memPut(r.s, r.s.db.push, sub.Endpoint, memPush{sub, userID})
+	return nil
+}
+
+func (r memPushRepo) Delete(ctx context.Context, userID int64, endpoint string) error {
+	defer r.s.lock()()
+	if p, ok := r.s.db.push[endpoint]; ok && p.userID == userID {
+		memDelete(r.s, r.s.db.push, endpoint)
+	}
+	return nil
+}
+
+func (r memPushRepo) Drop(ctx context.Context, endpoint string) error {
+	defer r.s.lock()()
+	memDelete(r.s, r.s.db.push, endpoint)
+	return nil
+}
+
+type memScheduledRepo struct{ s *memStore }
+
+// out is sm as listed, its frame decoded afresh so callers may change it.
+func (sm memScheduled) out() scheduledOut {
+	o := sm.scheduledOut
+	o.Frame = nil
+	_ = json.Unmarshal(sm.frame, &o.Frame)
+	return o
+}
+
+func (r memScheduledRepo) Add(ctx context.Context, owner int64, kind string, target int64, frame map[string]any, sendAt time.Time) (int64, error) {
+	defer r.s.lock()()
+	id := r.s.nextID()
+	sm := memScheduled{scheduledOut: scheduledOut{ID: id, Kind: kind, SendAt: sendAt, Status: "pending"}, userID: owner, frame: []byte(mustJSON(frame))}
+	if target != 0 {
+		sm.TargetID = &target
+	}
+	memPut(r.s, r.s.db.scheduled, id, sm)
+	return id, nil
+}
+
+func (r memScheduledRepo) Due(ctx context.Context) (*scheduledDue, error) {
+	defer r.s.lock()()
+	now := r.s.db.now()
+	due := memSorted(r.s.db.scheduled, func(sm memScheduled) bool { return sm.Status == "pending" && !sm.SendAt.After(now) },
+		func(a, b memScheduled) int { return cmp.Or(a.SendAt.Compare(b.SendAt), cmp.Compare(a.ID, b.ID)) })
+	for _, sm := range due {
+		u, ok := r.s.db.users[sm.userID]
+		if !ok {
+			continue
+		}
+		return &scheduledDue{ID: sm.ID, UserID: sm.userID, Email: u.Email, Kind: sm.Kind, Target: sm.TargetID, Frame: sm.out().Frame}, nil
+	}
+	return nil, errNotFound
+}
+
+func (r memScheduledRepo) update(id int64, fn func(sm *memScheduled)) {
+	if sm, ok := r.s.db.scheduled[id]; ok {
+		fn(&sm)
+		memPut(r.s, r.s.db.scheduled, id, sm)
+	}
+}
+
+func (r memScheduledRepo) Sent(ctx context.Context, id int64, mid *int64) error {
+	defer r.s.lock()()
+	r.update(id, func(sm *memScheduled) {
+		now := r.s.db.now()
+		sm.Status, sm.SentAt, sm.messageID = "sent", &now, mid
+	})
+	return nil
+}
+
+func (r memScheduledRepo) Failed(ctx context.Context, id int64, cause string) error {
+	defer r.s.lock()()
+	r.update(id, func(sm *memScheduled) { sm.Status, sm.Error = "failed", &cause })
+	return nil
+}
+
+func (r memScheduledRepo) List(ctx context.Context, owner int64, status string) ([]scheduledOut, error) {
+	defer r.s.lock()()
+	rows := memSorted(r.s.db.scheduled, func(sm memScheduled) bool { return sm.userID == owner && (status == "" || sm.Status == status) },
+		func(a, b memScheduled) int { return cmp.Or(a.SendAt.Compare(b.SendAt), cmp.Compare(a.ID, b.ID)) })
+	var out []scheduledOut
+	for _, sm := range limited(rows, 500) {
+		out = append(out, sm.out())
+	}
+	return out, nil
+}
+
+func (r memScheduledRepo) Pending(ctx context.Context, owner int64, kind string) (int, error) {
+	defer r.s.lock()()
+	n := 0
+	for _, sm := range r.s.db.scheduled {
+		if sm.userID == owner && sm.Kind == kind && sm.Status == "pending" {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (r memScheduledRepo) pending(id, owner int64) (memScheduled, error) {
+	sm, ok := r.s.db.scheduled[id]
+	if !ok || sm.userID != owner || sm.Status != "pending" {
+		return sm, errNotFound
+	}
+	return sm, nil
+}
+
+// Update waits for a send in progress, as the sender holds its transaction
+// until the row is no longer pending.
+func (r memScheduledRepo) Update(ctx context.Context, id, owner int64, text *string, sendAt *time.Time) (*scheduledOut, error) {
+	if r.s.tx == nil {
+		r.s.db.txMu.Lock()
+		defer r.s.db.txMu.Unlock()
+	}
+	defer r.s.lock()()
+	sm, err := r.pending(id, owner)
+	if err != nil {
+		return nil, err
+	}
+	if text != nil {
+		frame := sm.out().Frame
+		frame["text"] = *text
+		sm.frame = []byte(mustJSON(frame))
+	}
+	if sendAt != nil {
+		sm.SendAt = *sendAt
+	}
+	memPut(r.s, r.s.db.scheduled, id, sm)
+	o := sm.out()
+	o.SentAt, o.Error = nil, nil
+	return &o, nil
+}
+
+func (r memScheduledRepo) Cancel(ctx context.Context, id, owner int64) error {
+	defer r.s.lock()()
+	sm, err := r.pending(id, owner)
+	if err != nil {
+		return err
+	}
+	sm.Status = "cancelled"
+	memPut(r.s, r.s.db.scheduled, id, sm)
+	return nil
+}
+
+func (r memScheduledRepo) Status(ctx context.Context, id, owner int64) (string, error) {
+	defer r.s.lock()()
+	sm, ok := r.s.db.scheduled[id]
+	if !ok || sm.userID != owner {
+		return "", errNotFound
+	}
+	return sm.Status, nil
+}
+
+type memCommands struct{ s *memStore }
+
+func (r memCommands) List(ctx context.Context) ([]botCommand, error) {
+	defer r.s.lock()()
+	return memSorted(r.s.db.commands, func(botCommand) bool { return true },
+		func(a, b botCommand) int { return strings.Compare(a.Name, b.Name) }), nil
+}
+
+func (r memCommands) Get(ctx context.Context, name string) (*botCommand, error) {
+	defer r.s.lock()()
+	c, ok := r.s.db.commands[name]
+	if !ok {
+		return nil, errNotFound
+	}
+	return &c, nil
+}
+
+func (r memCommands) Create(ctx context.Context, c *botCommand) error {
+	defer r.s.lock()()
+	if _, ok := r.s.db.commands[c.Name]; ok {
+		return errConflict
+	}
+	memPut(r.s, r.s.db.commands, c.Name, *c)
+	return nil
+}
+
+func (r memCommands) Delete(ctx context.Context, name string, owner int64, anyOwner bool) error {
+	defer r.s.lock()()
+	c, ok := r.s.db.commands[name]
+	if !ok || !(anyOwner || c.OwnerID == owner) {
+		return errNotFound
+	}
+	memDelete(r.s, r.s.db.commands, name)
+	return nil
+}
+
+type memIncomingHooks struct{ s *memStore }
+
+func (r memIncomingHooks) ByToken(ctx context.Context, tokenHash string) (*incomingHook, error) {
+	defer r.s.lock()()
+	for _, h := range r.s.db.incoming {
+		if h.tokenHash == tokenHash {
+			out := h.incomingHook
+			out.OwnerEmail = r.s.db.users[h.OwnerID].Email
+			return &out, nil
+		}
+	}
+	return nil, errNotFound
+}
+
+func (r memIncomingHooks) Used(ctx context.Context, id int64) error {
+	defer r.s.lock()()
+	if h, ok := r.s.db.incoming[id]; ok {
+		now := r.s.db.now()
+		h.LastUsedAt = &now
+		memPut(r.s, r.s.db.incoming, id, h)
+	}
+	return nil
+}
+
+func (r memIncomingHooks) List(ctx context.Context, owner int64) ([]incomingHook, error) {
+	defer r.s.lock()()
+	rows := memSorted(r.s.db.incoming, func(h memIncoming) bool { return h.OwnerID == owner },
+		func(a, b memIncoming) int { return cmp.Compare(a.ID, b.ID) })
+	var out []incomingHook
+	for _, h := range rows {
+		out = append(out, h.incomingHook)
+	}
+	return out, nil
+}
+
+func (r memIncomingHooks) Create(ctx context.Context, h *incomingHook, tokenHash string) error {
+	defer r.s.lock()()
+	h.ID, h.CreatedAt = r.s.nextID(), r.s.db.now()
+	stored := *h
+	stored.OwnerEmail, stored.LastUsedAt = "", nil
+	memPut(r.s, r.s.db.incoming, h.ID, memIncoming{stored, tokenHash})
+	return nil
+}
+
+func (r memIncomingHooks) Delete(ctx context.Context, id, owner int64) error {
+	defer r.s.lock()()
+	h, ok := r.s.db.incoming[id]
+	if !ok || h.OwnerID != owner {
+		return errNotFound
+	}
+	memDelete(r.s, r.s.db.incoming, id)
+	return nil
+}
+
+type memDeadLetters struct{ s *memStore }
+
+func (r memDeadLetters) Record(ctx context.Context, instance string, m *BusMessage, cause error) error {
+	defer r.s.lock()()
+	sum := sha256.Sum256(m.Body)
+	hash := hex.EncodeToString(sum[:])
+	for _, d := range r.s.db.deadLetters {
+		if d.ReplayedAt == nil && d.Topic == m.Topic && d.hash == hash {
+			return nil
+		}
+	}
+	id := r.s.nextID()
+	msg := cause.Error()
+	memPut(r.s, r.s.db.deadLetters, id, memDeadLetter{deadLetter{ID: id, Topic: m.Topic, Body: slices.Clone(m.Body), Attempts: m.Attempts, Error: &msg, Instance: nonEmpty(instance), CreatedAt: r.s.db.now()}, hash})
+	return nil
+}
+
+func (r memDeadLetters) List(ctx context.Context, all bool, limit int) ([]deadLetter, error) {
+	defer r.s.lock()()
+	rows := memSorted(r.s.db.deadLetters, func(d memDeadLetter) bool { return all || d.ReplayedAt == nil },
+		func(a, b memDeadLetter) int { return cmp.Compare(b.ID, a.ID) })
+	var out []deadLetter
+	for _, d := range limited(rows, limit) {
+		out = append(out, d.deadLetter)
+	}
+	return out, nil
+}
+
+func (r memDeadLetters) Claim(ctx context.Context, id int64) (*deadLetter, error) {
+	defer r.s.lock()()
+	d, ok := r.s.db.deadLetters[id]
+	if !ok || d.ReplayedAt != nil {
+		return nil, errNotFound
+	}
+	now := r.s.db.now()
+	d.ReplayedAt = &now
+	memPut(r.s, r.s.db.deadLetters, id, d)
+	return &deadLetter{ID: id, Topic: d.Topic, Body: d.Body, Instance: d.Instance}, nil
+}
+
+func (r memDeadLetters) Unclaim(ctx context.Context, id int64) error {
+	defer r.s.lock()()
+	if d, ok := r.s.db.deadLetters[id]; ok {
+		d.ReplayedAt = nil
+		memPut(r.s, r.s.db.deadLetters, id, d)
+	}
+	return nil
+}
@@ -0,0 +1,1050 @@
+package turbo
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// pgDB is satisfied by both *pgxpool.Pool and pgx.Tx, so repositories run
+// the same statements in and out of transactions.
+type pgDB interface {
+	Begin(ctx context.Context) (pgx.Tx, error)
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+// NewPostgresStore connects to the database at url. Run Migrate or
+// MigrateOnStartup before serving from it.
+func NewPostgresStore(ctx context.Context, url string) (Store, error) {
+	db, err := pgxpool.New(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(ctx); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return newPGStore(db), nil
+}
+
+// pgErr maps pgx's no-rows and unique-violation errors to errNotFound and
+// errConflict.
+func pgErr(err error) error {
+	var pe *pgconn.PgError
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+		return errNotFound
+	case errors.As(err, &pe) && pe.Code == "23505":
+		return errConflict
+	}
+	return err
+}
+
+// pgAffected is errNotFound for statements that matched no row.
+func pgAffected(tag pgconn.CommandTag, err error) error {
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return errNotFound
+	}
+	return nil
+}
+
+// pgStore is the Store on Postgres. Claims made by Due and Claim methods
+// use FOR UPDATE SKIP LOCKED, so any number of replicas share the queues.
+type pgStore struct {
+	pool *pgxpool.Pool
+	// db is the pool, or the transaction this store runs in
+	db pgDB
+}
+
+func newPGStore(pool *pgxpool.Pool) *pgStore {
+	return &pgStore{pool: pool, db: pool}
+}
+
+func (s *pgStore) Tx(ctx context.Context, fn func(tx Store) error) error {
+	return pgx.BeginFunc(ctx, s.db, func(tx pgx.Tx) error {
+		return fn(&pgStore{pool: s.pool, db: tx})
+	})
+}
+
+func (s *pgStore) Users() UserRepo                 { return pgUsers{s.db} }
+func (s *pgStore) Messages() MessageRepo           { return pgMessages{s.db} }
+func (s *pgStore) Conversations() ConversationRepo { return pgConversations{s.db} }
+func (s *pgStore) Outbox() OutboxRepo              { return pgOutbox{s.db} }
+func (s *pgStore) Webhooks() WebhookRepo           { return pgWebhooks{s.db} }
+func (s *pgStore) Notifications() NotificationRepo { return pgNotifications{s.db} }
+func (s *pgStore) Presence() PresenceRepo          { return pgPresence{s.db} }
+func (s *pgStore) Push() PushRepo                  { return pgPush{s.db} }
+func (s *pgStore) Scheduled() ScheduledRepo        { return pgScheduled{s.db} }
+func (s *pgStore) Commands() CommandRepo           { return pgCommands{s.db} }
+func (s *pgStore) IncomingHooks() IncomingHookRepo { return pgIncomingHooks{s.db} }
+func (s *pgStore) DeadLetters() DeadLetterRepo     { return pgDeadLetters{s.db} }
+
+func (s *pgStore) Close() { s.pool.Close() }
+
+type pgUsers struct{ db pgDB }
+
+const pgUserColumns = `id, email, handle, display_name, avatar_url, bio, role`
+
+func scanUser(row pgx.Row) (*userRecord, error) {
+	u := &userRecord{}
+	if err := row.Scan(&u.ID, &u.Email, &u.Handle, &u.DisplayName, &u.AvatarURL, &u.Bio, &u.Role); err != nil {
+		return nil, pgErr(err)
+	}
+	return u, nil
+}
+
+func (r pgUsers) queryUsers(ctx context.Context, sql string, args ...any) ([]userRecord, error) {
+	rows, err := r.db.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []userRecord
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, *u)
+	}
+	return out, rows.Err()
+}
+
+func (r pgUsers) Create(ctx context.Context, email string, passwordHash []byte) (int64, bool, error) {
+	var id int64
+	err := r.db.QueryRow(ctx, `INSERT INTO users (email, password_hash, display_name) VALUES ($1, COALESCE($2, ''::bytea), $1) ON CONFLICT (email) DO NOTHING RETURNING id`, email, passwordHash).Scan(&id)
+	if err == nil {
+		return id, true, nil
+	}
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return 0, false, err
+	}
+	// already registered
+	err = r.db.QueryRow(ctx, `SELECT id FROM users WHERE email = $1`, email).Scan(&id)
+	return id, false, pgErr(err)
+}
+
+func (r pgUsers) Password(ctx context.Context, email string) (int64, []byte, error) {
+	var id int64
+	var hash []byte
+	err := r.db.QueryRow(ctx, `SELECT id, password_hash FROM users WHERE email = $1`, email).Scan(&id, &hash)
+	return id, hash, pgErr(err)
+}
+
+func (r pgUsers) Get(ctx context.Context, id int64) (*userRecord, error) {
+	return scanUser(r.db.QueryRow(ctx, `SELECT `+pgUserColumns+` FROM users WHERE id = $1`, id))
+}
+
+func (r pgUsers) ByEmail(ctx context.Context, email string) (*userRecord, error) {
+	return scanUser(r.db.QueryRow(ctx, `SELECT `+pgUserColumns+` FROM users WHERE email = $1`, email))
+}
+
+func (r pgUsers) Resolve(ctx context.Context, u *user) (*userRecord, error) {
+	return scanUser(r.db.QueryRow(ctx, `SELECT `+pgUserColumns+` FROM users WHERE id = $1 OR ($1 = 0 AND lower(email) = lower($2))`, u.ID, u.Email))
+}
+
+func (r pgUsers) Lookup(ctx context.Context, ref string) (*userRecord, error) {
+	ref = strings.TrimPrefix(ref, "@")
+	return scanUser(r.db.QueryRow(ctx, `SELECT `+pgUserColumns+` FROM users WHERE id::text = $1 OR lower(email) = lower($1) OR lower(handle) = lower($1) ORDER BY id LIMIT 1`, ref))
+}
+
+func (r pgUsers) Mentioned(ctx context.Context, keys []string) ([]userRecord, error) {
+	return r.queryUsers(ctx, `SELECT `+pgUserColumns+` FROM users WHERE lower(handle) = ANY($1) OR lower(email) = ANY($1)`, keys)
+}
+
+func (r pgUsers) List(ctx context.Context, limit int) ([]userRecord, error) {
+	return r.queryUsers(ctx, `SELECT `+pgUserColumns+` FROM users ORDER BY id DESC LIMIT $1`, limit)
+}
+
+func (r pgUsers) ByIDs(ctx context.Context, ids []int64) ([]userRecord, error) {
+	return r.queryUsers(ctx, `SELECT `+pgUserColumns+` FROM users WHERE id = ANY($1) ORDER BY id`, ids)
+}
+
+func (r pgUsers) UpdateProfile(ctx context.Context, id int64, display, avatar, bio, handle string) error {
+	_, err := r.db.Exec(ctx, `UPDATE users SET display_name=$1, avatar_url=$2, bio=$3, handle=COALESCE(NULLIF($5, ''), handle) WHERE id=$4`, display, avatar, bio, id, handle)
+	return pgErr(err)
+}
+
+func (r pgUsers) SetRole(ctx context.Context, id int64, role string) error {
+	return pgAffected(r.db.Exec(ctx, `UPDATE users SET role = $2 WHERE id = $1`, id, role))
+}
+
+type pgMessages struct{ db pgDB }
+
+// visibleMessage is the SQL condition limiting messages m to those the
+// viewer may read: public messages and messages in conversations they take
+// part in. The viewer's id must be bound to $1.
+const visibleMessage = `(m.conversation_id IS NULL
+	OR m.conversation_id IN (SELECT cp.conversation_id FROM conversation_participants cp WHERE cp.user_id = $1))`
+
+// inConversation narrows messages m to the conversation bound to $2 as
+// returned by parseConversation: NULL for any, 0 for the public room.
+const inConversation = `($2::bigint IS NULL
+	OR ($2 = 0 AND m.conversation_id IS NULL)
+	OR m.conversation_id = $2)`
+
+// directPeerEmail is the SQL for a message's "to" in history and search:
+// for direct conversations, the email of the participant who isn't the
+// author, as clients address DMs by email. It expects the message as m,
+// its conversation as c and its author as u.
+const directPeerEmail = `CASE WHEN c.kind = 'direct' THEN COALESCE((SELECT pu.email FROM conversation_participants cp JOIN users pu ON pu.id = cp.user_id
+	WHERE cp.conversation_id = c.id AND cp.user_id IS DISTINCT FROM m.user_id ORDER BY cp.user_id LIMIT 1), u.email) END`
+
+func (r pgMessages) Insert(ctx context.Context, m *messageRecord) error {
+	err := r.db.QueryRow(ctx, `INSERT INTO messages (user_id, text, created_at, conversation_id, subtype, webhook_id, author_name, author_avatar, attachments) VALUES ($1, $2, now(), NULLIF($3, 0), NULLIF($4, ''), NULLIF($5, 0), NULLIF($6, ''), NULLIF($7, ''), $8) RETURNING id, created_at`,
+		m.UserID, m.Text, m.ConversationID, m.Subtype, m.WebhookID, m.AuthorName, m.AuthorAvatar, m.Attachments).Scan(&m.ID, &m.CreatedAt)
+	if err != nil {
+		return err
+	}
+	for _, im := range m.Images {
+		if _, err := r.db.Exec(ctx, `INSERT INTO images (message_id, url, filename, filesize) VALUES ($1,$2,$3,$4)`, m.ID, im.URL, im.Filename, im.Filesize); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r pgMessages) Delete(ctx context.Context, id, author int64, anyAuthor bool) (*int64, error) {
+	var convID *int64
+	err := r.db.QueryRow(ctx, `DELETE FROM messages m WHERE m.id = $1 AND ($2 OR m.user_id = $3) RETURNING m.conversation_id`, id, anyAuthor, author).Scan(&convID)
+	return convID, pgErr(err)
+}
+
+func (r pgMessages) AddMentions(ctx context.Context, mid int64, spans []mentionSpan) error {
+	for _, sp := range spans {
+		var uid *int64
+		if sp.UserID != 0 {
+			uid = &sp.UserID
+		}
+		if _, err := r.db.Exec(ctx, `INSERT INTO mentions (message_id, user_id, kind, start_offset, end_offset) VALUES ($1,$2,$3,$4,$5)`, mid, uid, sp.Kind, sp.Start, sp.End); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r pgMessages) Mentions(ctx context.Context, ids []int64) (map[int64][]mentionSpan, error) {
+	out := map[int64][]mentionSpan{}
+	if len(ids) == 0 {
+		return out, nil
+	}
+	rows, err := r.db.Query(ctx, `SELECT mn.message_id, mn.kind, mn.start_offset, mn.end_offset, u.id, u.handle, u.display_name FROM mentions mn LEFT JOIN users u ON u.id = mn.user_id WHERE mn.message_id = ANY($1) ORDER BY mn.message_id, mn.start_offset`, ids)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var mid int64
+		var sp mentionSpan
+		var uid *int64
+		var handle, display *string
+		if err := rows.Scan(&mid, &sp.Kind, &sp.Start, &sp.End, &uid, &handle, &display); err != nil {
+			return nil, err
+		}
+		if uid != nil {
+			sp.UserID = *uid
+		}
+		if handle != nil {
+			sp.Handle = *handle
+		}
+		if display != nil {
+			sp.DisplayName = *display
+		}
+		out[mid] = append(out[mid], sp)
+	}
+	return out, rows.Err()
+}
+
+// historySQL selects a page of history, newest first when paging back and
+// oldest first when paging forward from the cursor ($4, $5). Authors and
+// images come back on each row so a page costs one query, plus one for
+// mentions, whatever its size. Only what the viewer may see is listed.
+func historySQL(forward bool) string {
+	cmp, order := "<", "DESC"
+	if forward {
+		cmp, order = ">", "ASC"
+	}
+	return `SELECT m.id, COALESCE(m.text, ''), m.created_at, ` + directPeerEmail + `, u.id, u.email, COALESCE(m.author_name, u.display_name), COALESCE(m.author_avatar, u.avatar_url), m.webhook_id, m.attachments, m.subtype,
+			m.conversation_id, c.kind, COALESCE(c.direct_key, ''),
+			COALESCE((SELECT json_agg(json_build_object('url', i.url, 'filename', i.filename, 'filesize', i.filesize) ORDER BY i.id) FROM images i WHERE i.message_id = m.id), '[]')
+		FROM messages m LEFT JOIN users u ON m.user_id = u.id LEFT JOIN conversations c ON c.id = m.conversation_id
+		WHERE ` + visibleMessage + ` AND ` + inConversation + `
+		AND ($3::bigint IS NULL OR m.user_id = $3)
+		AND ($4::timestamptz IS NULL OR (m.created_at, m.id) ` + cmp + ` ($4, $5))
+		ORDER BY m.created_at ` + order + `, m.id ` + order + ` LIMIT $6`
+}
+
+func (r pgMessages) History(ctx context.Context, q historyQuery) ([]messageRow, error) {
+	rows, err := r.db.Query(ctx, historySQL(q.Forward), q.Viewer, q.Conversation, q.Author, q.At, q.ID, q.Limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []messageRow
+	for rows.Next() {
+		var m messageRow
+		if err := rows.Scan(&m.ID, &m.Text, &m.CreatedAt, &m.Recipient, &m.AuthorID, &m.AuthorEmail, &m.AuthorName, &m.AuthorAvatar, &m.WebhookID, &m.Attachments, &m.Subtype,
+			&m.ConversationID, &m.Kind, &m.DirectKey, &m.Images); err != nil {
+			return nil, err
+		}
+		out = append(out, m)
+	}
+	return out, rows.Err()
+}
+
+// searchSQL ranks the caller's visible messages against the query, filters
+// them and builds highlighted snippets for one page. Snippets are computed
+// only for the page, as ts_headline is the expensive part.
+const searchSQL = `WITH q AS (SELECT websearch_to_tsquery('english', $3) AS query),
+page AS (
+	SELECT * FROM (
+		SELECT m.id, COALESCE(m.text, '') AS text, m.created_at, m.conversation_id, m.user_id, m.author_name, m.author_avatar, m.webhook_id,
+			CASE WHEN $3 = '' THEN 0 ELSE ts_rank_cd(m.search, q.query) END::real AS rank,
+			EXISTS (SELECT 1 FROM images i WHERE i.message_id = m.id) AS has_image
+		FROM messages m, q
+		WHERE ` + visibleMessage + `
+		AND ` + inConversation + `
+		AND ($3 = '' OR m.search @@ q.query)
+		AND ($4::bigint IS NULL OR m.user_id = $4)
+		AND (NOT $5 OR EXISTS (SELECT 1 FROM images i WHERE i.message_id = m.id))
+		AND ($6::timestamptz IS NULL OR m.created_at > $6)
+		AND ($7::timestamptz IS NULL OR m.created_at < $7)
+	) hits
+	WHERE $8::real IS NULL OR (hits.rank, hits.id) < ($8, $9)
+	ORDER BY hits.rank DESC, hits.id DESC
+	LIMIT $10
+)
+SELECT m.id, m.text, m.rank, m.created_at, ` + directPeerEmail + `, m.conversation_id, c.kind, COALESCE(c.direct_key, ''), m.has_image,
+	CASE WHEN $3 = '' THEN NULL ELSE ts_headline('english', replace(replace(replace(m.text, '&', '&amp;'), '<', '&lt;'), '>', '&gt;'), q.query,
+		'StartSel=<mark>, StopSel=</mark>, MaxWords=30, MinWords=10, MaxFragments=2') END,
+	u.id, u.email, COALESCE(m.author_name, u.display_name), COALESCE(m.author_avatar, u.avatar_url), m.webhook_id
+FROM page m CROSS JOIN q LEFT JOIN users u ON u.id = m.user_id LEFT JOIN conversations c ON c.id = m.conversation_id
+ORDER BY m.rank DESC, m.id DESC`
+
+func (r pgMessages) Search(ctx context.Context, q searchQuery) ([]searchRow, error) {
+	rows, err := r.db.Query(ctx, searchSQL, q.Viewer, q.Conversation, q.Text, q.Author, q.HasImage, q.After, q.Before, q.Rank, q.ID, q.Limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []searchRow
+	for rows.Next() {
+		var h searchRow
+		if err := rows.Scan(&h.ID, &h.Text, &h.Rank, &h.CreatedAt, &h.Recipient, &h.ConversationID, &h.Kind, &h.DirectKey, &h.HasImage, &h.Snippet,
+			&h.AuthorID, &h.AuthorEmail, &h.AuthorName, &h.AuthorAvatar, &h.WebhookID); err != nil {
+			return nil, err
+		}
+		out = append(out, h)
+	}
+	return out, rows.Err()
+}
+
+type pgConversations struct{ db pgDB }
+
+func (r pgConversations) Get(ctx context.Context, id int64) (*conversation, error) {
+	c := &conversation{ID: id}
+	err := r.db.QueryRow(ctx, `SELECT kind, name, topic, COALESCE(direct_key, ''), created_by, created_at, ARRAY(SELECT user_id FROM conversation_participants WHERE conversation_id = c.id ORDER BY user_id)
+		FROM conversations c WHERE id = $1`, id).Scan(&c.Kind, &c.Name, &c.Topic, &c.DirectKey, &c.CreatedBy, &c.CreatedAt, &c.Members)
+	if err != nil {
+		return nil, pgErr(err)
+	}
+	return c, nil
+}
+
+// Direct is safe to race: the insert waits on the unique direct_key and
+// the select then sees the winner.
+func (r pgConversations) Direct(ctx context.Context, a, b int64) (*conversation, error) {
+	key := directKey(a, b)
+	if _, err := r.db.Exec(ctx, `INSERT INTO conversations (kind, direct_key, created_by) VALUES ('direct', $1, $2) ON CONFLICT (direct_key) DO NOTHING`, key, a); err != nil {
+		return nil, err
+	}
+	id, err := r.DirectID(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	members := []int64{min(a, b), max(a, b)}
+	if a == b {
+		members = members[:1]
+	}
+	if _, err := r.db.Exec(ctx, `INSERT INTO conversation_participants (conversation_id, user_id) SELECT $1, unnest($2::bigint[]) ON CONFLICT DO NOTHING`, id, members); err != nil {
+		return nil, err
+	}
+	return r.Get(ctx, id)
+}
+
+func (r pgConversations) DirectID(ctx context.Context, key string) (int64, error) {
+	var id int64
+	err := r.db.QueryRow(ctx, `SELECT id FROM conversations WHERE direct_key = $1`, key).Scan(&id)
+	return id, pgErr(err)
+}
+
+func (r pgConversations) RoomID(ctx context.Context, name string) (int64, error) {
+	var id int64
+	err := r.db.QueryRow(ctx, `SELECT id FROM conversations WHERE kind = 'room' AND lower(name) = lower($1)`, name).Scan(&id)
+	return id, pgErr(err)
+}
+
+func (r pgConversations) Create(ctx context.Context, c *conversation, createdBy int64) error {
+	err := pgx.BeginFunc(ctx, r.db, func(tx pgx.Tx) error {
+		if err := tx.QueryRow(ctx, `INSERT INTO conversations (kind, name, topic, created_by) VALUES ($1, NULLIF($2, ''), NULLIF($3, ''), $4) RETURNING id, created_at`,
+			c.Kind, deref(c.Name), deref(c.Topic), createdBy).Scan(&c.ID, &c.CreatedAt); err != nil {
+			return err
+		}
+		c.CreatedBy = &createdBy
+		_, err := tx.Exec(ctx, `INSERT INTO conversation_participants (conversation_id, user_id) SELECT $1, unnest($2::bigint[])`, c.ID, c.Members)
+		return err
+	})
+	return pgErr(err)
+}
+
+func (r pgConversations) Join(ctx context.Context, id, u int64) (bool, error) {
+	tag, err := r.db.Exec(ctx, `INSERT INTO conversation_participants (conversation_id, user_id) VALUES ($1, $2) ON CONFLICT DO NOTHING`, id, u)
+	return err == nil && tag.RowsAffected() > 0, err
+}
+
+func (r pgConversations) SetTopic(ctx context.Context, id int64, topic string) error {
+	_, err := r.db.Exec(ctx, `UPDATE conversations SET topic = $2 WHERE id = $1`, id, topic)
+	return err
+}
+
+func (r pgConversations) Posted(ctx context.Context, id, author, mid int64, at time.Time) error {
+	if _, err := r.db.Exec(ctx, `UPDATE conversations SET last_activity_at = GREATEST(last_activity_at, $2) WHERE id = $1`, id, at); err != nil {
+		return err
+	}
+	_, err := r.db.Exec(ctx, `UPDATE conversation_participants SET last_read_id = GREATEST(last_read_id, $3) WHERE conversation_id = $1 AND user_id = $2`, id, author, mid)
+	return err
+}
+
+func (r pgConversations) UpdateParticipant(ctx context.Context, id, u int64, pinned, muted *bool, read *int64) error {
+	return pgAffected(r.db.Exec(ctx, `UPDATE conversation_participants cp SET pinned = COALESCE($3, pinned), muted = COALESCE($4, muted),
+		last_read_id = CASE WHEN $5::bigint IS NULL THEN last_read_id
+			WHEN $5 = 0 THEN GREATEST(last_read_id, COALESCE((SELECT max(m.id) FROM messages m WHERE m.conversation_id = cp.conversation_id), 0))
+			ELSE GREATEST(last_read_id, $5) END
+		WHERE conversation_id = $1 AND user_id = $2`, id, u, pinned, muted, read))
+}
+
+func (r pgConversations) Shared(ctx context.Context, a, b int64) (bool, error) {
+	var ok bool
+	err := r.db.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM conversation_participants x JOIN conversation_participants y USING (conversation_id) WHERE x.user_id = $1 AND y.user_id = $2)`, a, b).Scan(&ok)
+	return ok, err
+}
+
+func (r pgConversations) Muted(ctx context.Context, id int64, ids []int64) ([]int64, error) {
+	rows, err := r.db.Query(ctx, `SELECT user_id FROM conversation_participants WHERE user_id = ANY($1) AND conversation_id = $2 AND muted`, ids, id)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowTo[int64])
+}
+
+func (r pgConversations) Rooms(ctx context.Context, u int64) ([]roomEntry, error) {
+	rows, err := r.db.Query(ctx, `SELECT r.id, r.name, r.topic, r.created_at, (SELECT count(*) FROM conversation_participants m2 WHERE m2.conversation_id = r.id), m.muted
+		FROM conversations r JOIN conversation_participants m ON m.conversation_id = r.id WHERE r.kind = 'room' AND m.user_id = $1 ORDER BY r.name`, u)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []roomEntry
+	for rows.Next() {
+		var e roomEntry
+		if err := rows.Scan(&e.ID, &e.Name, &e.Topic, &e.CreatedAt, &e.Members, &e.Muted); err != nil {
+			return nil, err
+		}
+		out = append(out, e)
+	}
+	return out, rows.Err()
+}
+
+// inboxSQL lists a page of the caller's ($1) conversations, pinned ones
+// first and then by last activity, after the cursor ($2, $3, $4). The last
+// message, unread count and participant preview are looked up only for the
+// page, each through an index on messages or participants.
+const inboxSQL = `SELECT c.id, c.kind, c.name, c.topic, COALESCE(c.direct_key, ''), c.last_activity_at, cp.pinned, cp.muted,
+	(SELECT count(*) FROM (SELECT 1 FROM messages um WHERE um.conversation_id = c.id AND um.id > cp.last_read_id AND um.user_id IS DISTINCT FROM cp.user_id LIMIT $6) unread),
+	(SELECT count(*) FROM conversation_participants pc WHERE pc.conversation_id = c.id),
+	COALESCE((SELECT json_agg(json_build_object('id', u.id, 'email', u.email, 'handle', u.handle, 'display_name', u.display_name, 'avatar_url', u.avatar_url) ORDER BY o.joined_at, o.user_id)
+		FROM (SELECT op.user_id, op.joined_at FROM conversation_participants op WHERE op.conversation_id = c.id AND op.user_id <> cp.user_id ORDER BY op.joined_at, op.user_id LIMIT $7) o
+		JOIN users u ON u.id = o.user_id), '[]'),
+	lm.id, lm.text, lm.created_at, lm.user_id, lm.author, lm.has_image
+FROM conversation_participants cp
+JOIN conversations c ON c.id = cp.conversation_id
+LEFT JOIN LATERAL (
+	SELECT m.id, left(COALESCE(m.text, ''), $8) AS text, m.created_at, m.user_id, COALESCE(m.author_name, au.display_name, au.email) AS author,
+		EXISTS (SELECT 1 FROM images i WHERE i.message_id = m.id) AS has_image
+	FROM messages m LEFT JOIN users au ON au.id = m.user_id
+	WHERE m.conversation_id = c.id
+	ORDER BY m.created_at DESC, m.id DESC LIMIT 1
+) lm ON true
+WHERE cp.user_id = $1
+AND ($3::timestamptz IS NULL OR (cp.pinned, c.last_activity_at, c.id) < ($2::boolean, $3, $4::bigint))
+ORDER BY cp.pinned DESC, c.last_activity_at DESC, c.id DESC
+LIMIT $5`
+
+func (r pgConversations) Inbox(ctx context.Context, q inboxQuery) ([]inboxEntry, error) {
+	rows, err := r.db.Query(ctx, inboxSQL, q.User, q.Pinned, q.At, q.ID, q.Limit, q.UnreadCap, q.Participants, q.PreviewLen)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var entries []inboxEntry
+	for rows.Next() {
+		var e inboxEntry
+		var direct string
+		var lastID *int64
+		var lastText *string
+		var lastAt *time.Time
+		var lastAuthorID *int64
+		var lastAuthor *string
+		var lastImage *bool
+		if err := rows.Scan(&e.ID, &e.Kind, &e.Name, &e.Topic, &direct, &e.LastActivity, &e.Pinned, &e.Muted,
+			&e.Unread, &e.ParticipantCount, &e.Participants,
+			&lastID, &lastText, &lastAt, &lastAuthorID, &lastAuthor, &lastImage); err != nil {
+			return nil, err
+		}
+		e.Conversation = conversationKey(e.Kind, e.ID, direct)
+		if lastID != nil {
+			e.LastMessage = &inboxPreview{ID: *lastID, Text: *lastText, Ts: lastAt.UnixMilli(), AuthorID: lastAuthorID, Author: lastAuthor, HasImage: *lastImage}
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+type pgOutbox struct{ db pgDB }
+
+func (r pgOutbox) Enqueue(ctx context.Context, topic string, env *envelope) error {
+	_, err := r.db.Exec(ctx, `INSERT INTO outbox (event_id, topic, payload) VALUES ($1, $2, $3)`, env.ID, topic, mustJSON(env))
+	return err
+}
+
+func (r pgOutbox) Due(ctx context.Context, limit int) ([]outboxRow, error) {
+	rows, err := r.db.Query(ctx, `SELECT id, topic, payload, attempts, created_at FROM outbox WHERE published_at IS NULL AND next_attempt_at <= now() ORDER BY id LIMIT $1 FOR UPDATE SKIP LOCKED`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []outboxRow
+	for rows.Next() {
+		var p outboxRow
+		if err := rows.Scan(&p.ID, &p.Topic, &p.Payload, &p.Attempts, &p.CreatedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, p)
+	}
+	return out, rows.Err()
+}
+
+func (r pgOutbox) Published(ctx context.Context, id int64) error {
+	_, err := r.db.Exec(ctx, `UPDATE outbox SET attempts = attempts + 1, published_at = now(), last_error = NULL WHERE id = $1`, id)
+	return err
+}
+
+func (r pgOutbox) Failed(ctx context.Context, id int64, retryAt time.Time, cause string) error {
+	_, err := r.db.Exec(ctx, `UPDATE outbox SET attempts = attempts + 1, next_attempt_at = $2, last_error = $3 WHERE id = $1`, id, retryAt, cause)
+	return err
+}
+
+func (r pgOutbox) Drop(ctx context.Context, id int64) error {
+	_, err := r.db.Exec(ctx, `DELETE FROM outbox WHERE id = $1`, id)
+	return err
+}
+
+func (r pgOutbox) Cleanup(ctx context.Context, before time.Time) error {
+	_, err := r.db.Exec(ctx, `DELETE FROM outbox WHERE published_at < $1`, before)
+	return err
+}
+
+type pgWebhooks struct{ db pgDB }
+
+func (r pgWebhooks) Enqueue(ctx context.Context, env *envelope) error {
+	_, err := r.db.Exec(ctx, `INSERT INTO webhook_deliveries (webhook_id, event_id, event_type, payload)
+		SELECT w.id, $1, $2, $3 FROM webhooks w JOIN users u ON u.id = w.owner_id
+		WHERE w.active AND $2 = ANY(w.events) AND (w.room IS NULL OR w.room = $4)
+		AND ($4 = '' OR u.role = 'admin' OR EXISTS (SELECT 1 FROM conversation_participants cp JOIN conversations c ON c.id = cp.conversation_id
+			WHERE cp.user_id = w.owner_id AND $4 = CASE WHEN c.kind = 'direct' THEN 'dm:' || c.direct_key ELSE c.kind || ':' || c.id END))
+		ON CONFLICT (webhook_id, event_id) DO NOTHING`,
+		env.ID, env.Type, mustJSON(env), env.Conversation)
+	return err
+}
+
+func (r pgWebhooks) Claim(ctx context.Context, limit int, leaseUntil time.Time) ([]webhookDelivery, error) {
+	rows, err := r.db.Query(ctx, `UPDATE webhook_deliveries d SET next_attempt_at = $2
+		FROM webhooks w
+		WHERE d.id IN (SELECT d2.id FROM webhook_deliveries d2 JOIN webhooks w2 ON w2.id = d2.webhook_id
+			WHERE d2.status = 'pending' AND d2.next_attempt_at <= now() AND w2.active
+			ORDER BY d2.id LIMIT $1 FOR UPDATE OF d2 SKIP LOCKED)
+		AND w.id = d.webhook_id
+		RETURNING d.id, d.webhook_id, d.event_id, d.event_type, d.payload, d.attempts, w.url, w.secret`,
+		limit, leaseUntil)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []webhookDelivery
+	for rows.Next() {
+		var d webhookDelivery
+		if err := rows.Scan(&d.ID, &d.WebhookID, &d.EventID, &d.Type, &d.Payload, &d.Attempts, &d.URL, &d.Secret); err != nil {
+			return nil, err
+		}
+		out = append(out, d)
+	}
+	return out, rows.Err()
+}
+
+func (r pgWebhooks) Succeeded(ctx context.Context, d *webhookDelivery, code *int) error {
+	if _, err := r.db.Exec(ctx, `UPDATE webhook_deliveries SET status = 'succeeded', attempts = attempts + 1, response_code = $2, last_error = NULL, delivered_at = now() WHERE id = $1`, d.ID, code); err != nil {
+		return err
+	}
+	_, err := r.db.Exec(ctx, `UPDATE webhooks SET failures = 0 WHERE id = $1`, d.WebhookID)
+	return err
+}
+
+func (r pgWebhooks) Failed(ctx context.Context, d *webhookDelivery, status string, code *int, cause string, retryAt time.Time, disableAfter int) (bool, error) {
+	if _, err := r.db.Exec(ctx, `UPDATE webhook_deliveries SET status = $2, attempts = attempts + 1, response_code = $3, last_error = $4, next_attempt_at = $5 WHERE id = $1`,
+		d.ID, status, code, cause, retryAt); err != nil {
+		return false, err
+	}
+	var disabled bool
+	err := r.db.QueryRow(ctx, `UPDATE webhooks SET failures = failures + 1,
+		active = active AND failures + 1 < $2,
+		disabled_at = CASE WHEN failures + 1 >= $2 AND active THEN now() ELSE disabled_at END
+		WHERE id = $1 RETURNING NOT active`, d.WebhookID, disableAfter).Scan(&disabled)
+	return disabled, err
+}
+
+func (r pgWebhooks) Cleanup(ctx context.Context, before time.Time) error {
+	_, err := r.db.Exec(ctx, `DELETE FROM webhook_deliveries WHERE status <> 'pending' AND created_at < $1`, before)
+	return err
+}
+
+func (r pgWebhooks) List(ctx context.Context, owner int64, all bool) ([]webhookOut, error) {
+	rows, err := r.db.Query(ctx, `SELECT id, owner_id, url, events, room, active, failures, disabled_at, created_at FROM webhooks WHERE $1 OR owner_id = $2 ORDER BY id`, all, owner)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []webhookOut
+	for rows.Next() {
+		var h webhookOut
+		if err := rows.Scan(&h.ID, &h.OwnerID, &h.URL, &h.Events, &h.Room, &h.Active, &h.Failures, &h.DisabledAt, &h.CreatedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, h)
+	}
+	return out, rows.Err()
+}
+
+func (r pgWebhooks) Get(ctx context.Context, id, owner int64, anyOwner bool) (*webhookOut, error) {
+	var h webhookOut
+	err := r.db.QueryRow(ctx, `SELECT id, owner_id, url, events, room, active, failures, disabled_at, created_at FROM webhooks WHERE id = $1 AND ($2 OR owner_id = $3)`, id, anyOwner, owner).
+		Scan(&h.ID, &h.OwnerID, &h.URL, &h.Events, &h.Room, &h.Active, &h.Failures, &h.DisabledAt, &h.CreatedAt)
+	if err != nil {
+		return nil, pgErr(err)
+	}
+	return &h, nil
+}
+
+func (r pgWebhooks) Create(ctx context.Context, h *webhookOut) error {
+	return r.db.QueryRow(ctx, `INSERT INTO webhooks (owner_id, url, secret, events, room) VALUES ($1,$2,$3,$4,$5) RETURNING id, created_at`,
+		h.OwnerID, h.URL, h.Secret, h.Events, h.Room).Scan(&h.ID, &h.CreatedAt)
+}
+
+func (r pgWebhooks) Update(ctx context.Context, h *webhookOut) error {
+	err := r.db.QueryRow(ctx, `UPDATE webhooks SET url=$2, events=$3, room=$4, active=$5, secret=COALESCE(NULLIF($6,''), secret),
+		failures = CASE WHEN $5 AND NOT active THEN 0 ELSE failures END,
+		disabled_at = CASE WHEN $5 THEN NULL ELSE disabled_at END
+		WHERE id=$1 RETURNING failures, disabled_at, created_at`,
+		h.ID, h.URL, h.Events, h.Room, h.Active, h.Secret).Scan(&h.Failures, &h.DisabledAt, &h.CreatedAt)
+	return pgErr(err)
+}
+
+func (r pgWebhooks) Delete(ctx context.Context, id, owner int64, anyOwner bool) error {
+	return pgAffected(r.db.Exec(ctx, `DELETE FROM webhooks WHERE id = $1 AND ($2 OR owner_id = $3)`, id, anyOwner, owner))
+}
+
+func (r pgWebhooks) Deliveries(ctx context.Context, webhookID int64, status string, limit int) ([]deliveryLog, error) {
+	rows, err := r.db.Query(ctx, `SELECT id, event_id, event_type, status, attempts, response_code, last_error, created_at, delivered_at, next_attempt_at FROM webhook_deliveries
+		WHERE webhook_id = $1 AND ($2 = '' OR status = $2) ORDER BY id DESC LIMIT $3`, webhookID, status, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []deliveryLog
+	for rows.Next() {
+		var d deliveryLog
+		if err := rows.Scan(&d.ID, &d.EventID, &d.Type, &d.Status, &d.Attempts, &d.ResponseCode, &d.Error, &d.CreatedAt, &d.DeliveredAt, &d.NextAttemptAt); err != nil {
+			return nil, err
+		}
+		out = append(out, d)
+	}
+	return out, rows.Err()
+}
+
+type pgNotifications struct{ db pgDB }
+
+func (r pgNotifications) Add(ctx context.Context, userID int64, kind string, mid int64, payload string, sinks []string) error {
+	if _, err := r.db.Exec(ctx, `INSERT INTO notifications (user_id, kind, message_id, payload) VALUES ($1,$2,NULLIF($3,0),$4)`, userID, kind, mid, payload); err != nil {
+		return err
+	}
+	_, err := r.db.Exec(ctx, `INSERT INTO notification_cursors (user_id, sink) SELECT $1, unnest($2::text[]) ON CONFLICT DO NOTHING`, userID, sinks)
+	return err
+}
+
+func (r pgNotifications) Due(ctx context.Context, limit int) ([]notifyCursor, error) {
+	rows, err := r.db.Query(ctx, `SELECT c.user_id, c.sink, c.last_id, c.last_sent_at, c.attempts FROM notification_cursors c
+		WHERE (c.retry_at IS NULL OR c.retry_at <= now())
+		AND EXISTS (SELECT 1 FROM notifications n WHERE n.user_id = c.user_id AND n.id > c.last_id)
+		ORDER BY c.user_id LIMIT $1 FOR UPDATE SKIP LOCKED`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []notifyCursor
+	for rows.Next() {
+		var c notifyCursor
+		if err := rows.Scan(&c.UserID, &c.Sink, &c.LastID, &c.LastSent, &c.Attempts); err != nil {
+			return nil, err
+		}
+		out = append(out, c)
+	}
+	return out, rows.Err()
+}
+
+func (r pgNotifications) After(ctx context.Context, userID, id int64, limit int) ([]notification, error) {
+	rows, err := r.db.Query(ctx, `SELECT id, kind, message_id, payload, created_at FROM notifications WHERE user_id = $1 AND id > $2 ORDER BY id LIMIT $3`, userID, id, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []notification
+	for rows.Next() {
+		var nt notification
+		var mid *int64
+		if err := rows.Scan(&nt.ID, &nt.Kind, &mid, &nt.Payload, &nt.CreatedAt); err != nil {
+			return nil, err
+		}
+		if mid != nil {
+			nt.MessageID = *mid
+		}
+		out = append(out, nt)
+	}
+	return out, rows.Err()
+}
+
+func (r pgNotifications) Sent(ctx context.Context, userID int64, sink string, lastID int64) error {
+	_, err := r.db.Exec(ctx, `UPDATE notification_cursors SET last_id = $3, last_sent_at = now(), attempts = 0, retry_at = NULL WHERE user_id = $1 AND sink = $2`, userID, sink, lastID)
+	return err
+}
+
+func (r pgNotifications) Lease(ctx context.Context, userID int64, sink string, until time.Time) error {
+	_, err := r.db.Exec(ctx, `UPDATE notification_cursors SET retry_at = $3 WHERE user_id = $1 AND sink = $2`, userID, sink, until)
+	return err
+}
+
+func (r pgNotifications) Retry(ctx context.Context, userID int64, sink string, at time.Time) error {
+	_, err := r.db.Exec(ctx, `UPDATE notification_cursors SET attempts = attempts + 1, retry_at = $3 WHERE user_id = $1 AND sink = $2`, userID, sink, at)
+	return err
+}
+
+func (r pgNotifications) Skip(ctx context.Context, userID int64, sink string) error {
+	_, err := r.db.Exec(ctx, `UPDATE notification_cursors SET last_id = COALESCE((SELECT max(id) FROM notifications WHERE user_id = $1), last_id) WHERE user_id = $1 AND sink = $2`, userID, sink)
+	return err
+}
+
+func (r pgNotifications) Cleanup(ctx context.Context, before time.Time) error {
+	_, err := r.db.Exec(ctx, `DELETE FROM notifications WHERE created_at < $1`, before)
+	return err
+}
+
+func (r pgNotifications) Prefs(ctx context.Context, userID int64) (notifyPrefs, error) {
+	p := defaultNotifyPrefs
+	var webhook *string
+	err := r.db.QueryRow(ctx, `SELECT dms, mentions, web_push, email, webhook_url, quiet_start, quiet_end, timezone, digest_minutes FROM notification_prefs WHERE user_id = $1`, userID).
+		Scan(&p.DMs, &p.Mentions, &p.WebPush, &p.Email, &webhook, &p.QuietStart, &p.QuietEnd, &p.Timezone, &p.DigestMinutes)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return defaultNotifyPrefs, nil
+	}
+	if webhook != nil {
+		p.WebhookURL = *webhook
+	}
+	return p, err
+}
+
+func (r pgNotifications) SavePrefs(ctx context.Context, userID int64, p notifyPrefs) error {
+	var webhook *string
+	if p.WebhookURL != "" {
+		webhook = &p.WebhookURL
+	}
+	_, err := r.db.Exec(ctx, `INSERT INTO notification_prefs (user_id, dms, mentions, web_push, email, webhook_url, quiet_start, quiet_end, timezone, digest_minutes) VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10)
+		ON CONFLICT (user_id) DO UPDATE SET dms=$2, mentions=$3, web_push=$4, email=$5, webhook_url=$6, quiet_start=$7, quiet_end=$8, timezone=$9, digest_minutes=$10`,
+		userID, p.DMs, p.Mentions, p.WebPush, p.Email, webhook, p.QuietStart, p.QuietEnd, p.Timezone, p.DigestMinutes)
+	return err
+}
+
+type pgPresence struct{ db pgDB }
+
+func (r pgPresence) Seen(ctx context.Context, ids []int64) error {
+	_, err := r.db.Exec(ctx, `INSERT INTO presence (user_id, last_seen_at) SELECT unnest($1::bigint[]), now() ON CONFLICT (user_id) DO UPDATE SET last_seen_at = now()`, ids)
+	return err
+}
+
+func (r pgPresence) Active(ctx context.Context, id int64, at time.Time) error {
+	_, err := r.db.Exec(ctx, `INSERT INTO presence (user_id, last_seen_at, last_active_at) VALUES ($1, now(), $2) ON CONFLICT (user_id) DO UPDATE SET last_seen_at = now(), last_active_at = GREATEST(presence.last_active_at, $2)`, id, at)
+	return err
+}
+
+func (r pgPresence) Present(ctx context.Context, ids []int64, seenAfter, activeAfter time.Time) ([]int64, error) {
+	rows, err := r.db.Query(ctx, `SELECT user_id FROM presence WHERE user_id = ANY($1) AND last_seen_at > $2 AND last_active_at > $3`, ids, seenAfter, activeAfter)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowTo[int64])
+}
+
+type pgPush struct{ db pgDB }
+
+func (r pgPush) List(ctx context.Context, userID int64) ([]pushSubscription, error) {
+	rows, err := r.db.Query(ctx, `SELECT endpoint, p256dh, auth FROM push_subscriptions WHERE user_id = $1`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []pushSubscription
+	for rows.Next() {
+		var sub pushSubscription
+		if err := rows.Scan(&sub.Endpoint, &sub.P256dh, &sub.Auth); err != nil {
+			return nil, err
+		}
+		out = append(out, sub)
+	}
+	return out, rows.Err()
+}
+
+func (r pgPush) Save(ctx context.Context, userID int64, sub pushSubscription) error {
+	_, err := r.db.Exec(ctx, `INSERT INTO push_subscriptions (user_id, endpoint, p256dh, auth) VALUES ($1,$2,$3,$4) ON CONFLICT (endpoint) DO UPDATE SET user_id=$1, p256dh=$3, auth=$4`, userID, sub.Endpoint, sub.P256dh, sub.Auth)
+	return err
+}
+
+func (r pgPush) Delete(ctx context.Context, userID int64, endpoint string) error {
+	_, err := r.db.Exec(ctx, `DELETE FROM push_subscriptions WHERE user_id=$1 AND endpoint=$2`, userID, endpoint)
+	return err
+}
+
+func (r pgPush) Drop(ctx context.Context, endpoint string) error {
+	_, err := r.db.Exec(ctx, `DELETE FROM push_subscriptions WHERE endpoint = $1`, endpoint)
+	return err
+}
+
+type pgScheduled struct{ db pgDB }
+
+func (r pgScheduled) Add(ctx context.Context, owner int64, kind string, target int64, frame map[string]any, sendAt time.Time) (int64, error) {
+	var id int64
+	err := r.db.QueryRow(ctx, `INSERT INTO scheduled_messages (user_id, kind, target_id, frame, send_at) VALUES ($1,$2,NULLIF($3,0),$4,$5) RETURNING id`,
+		owner, kind, target, mustJSON(frame), sendAt).Scan(&id)
+	return id, err
+}
+
+func (r pgScheduled) Due(ctx context.Context) (*scheduledDue, error) {
+	d := &scheduledDue{}
+	err := r.db.QueryRow(ctx, `SELECT sm.id, sm.user_id, u.email, sm.kind, sm.target_id, sm.frame FROM scheduled_messages sm JOIN users u ON u.id = sm.user_id
+		WHERE sm.status = 'pending' AND sm.send_at <= now() ORDER BY sm.send_at, sm.id LIMIT 1 FOR UPDATE OF sm SKIP LOCKED`).
+		Scan(&d.ID, &d.UserID, &d.Email, &d.Kind, &d.Target, &d.Frame)
+	if err != nil {
+		return nil, pgErr(err)
+	}
+	return d, nil
+}
+
+func (r pgScheduled) Sent(ctx context.Context, id int64, mid *int64) error {
+	_, err := r.db.Exec(ctx, `UPDATE scheduled_messages SET status = 'sent', sent_at = now(), message_id = $2 WHERE id = $1`, id, mid)
+	return err
+}
+
+func (r pgScheduled) Failed(ctx context.Context, id int64, cause string) error {
+	_, err := r.db.Exec(ctx, `UPDATE scheduled_messages SET status = 'failed', last_error = $2 WHERE id = $1`, id, cause)
+	return err
+}
+
+func (r pgScheduled) List(ctx context.Context, owner int64, status string) ([]scheduledOut, error) {
+	rows, err := r.db.Query(ctx, `SELECT id, kind, target_id, frame, send_at, status, sent_at, last_error FROM scheduled_messages
+		WHERE user_id = $1 AND ($2 = '' OR status = $2) ORDER BY send_at LIMIT 500`, owner, status)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []scheduledOut
+	for rows.Next() {
+		var o scheduledOut
+		if err := rows.Scan(&o.ID, &o.Kind, &o.TargetID, &o.Frame, &o.SendAt, &o.Status, &o.SentAt, &o.Error); err != nil {
+			return nil, err
+		}
+		out = append(out, o)
+	}
+	return out, rows.Err()
+}
+
+func (r pgScheduled) Pending(ctx context.Context, owner int64, kind string) (int, error) {
+	var n int
+	err := r.db.QueryRow(ctx, `SELECT count(*) FROM scheduled_messages WHERE user_id = $1 AND kind = $2 AND status = 'pending'`, owner, kind).Scan(&n)
+	return n, err
+}
+
+// Update takes the row lock, so it waits for a send in progress, after
+// which the row is no longer pending.
+func (r pgScheduled) Update(ctx context.Context, id, owner int64, text *string, sendAt *time.Time) (*scheduledOut, error) {
+	var o scheduledOut
+	err := r.db.QueryRow(ctx, `UPDATE scheduled_messages SET
+		frame = CASE WHEN $3::text IS NULL THEN frame ELSE jsonb_set(frame, '{text}', to_jsonb($3::text)) END,
+		send_at = COALESCE($4, send_at)
+		WHERE id = $1 AND user_id = $2 AND status = 'pending'
+		RETURNING id, kind, target_id, frame, send_at, status`, id, owner, text, sendAt).
+		Scan(&o.ID, &o.Kind, &o.TargetID, &o.Frame, &o.SendAt, &o.Status)
+	if err != nil {
+		return nil, pgErr(err)
+	}
+	return &o, nil
+}
+
+func (r pgScheduled) Cancel(ctx context.Context, id, owner int64) error {
+	return pgAffected(r.db.Exec(ctx, `UPDATE scheduled_messages SET status = 'cancelled' WHERE id = $1 AND user_id = $2 AND status = 'pending'`, id, owner))
+}
+
+func (r pgScheduled) Status(ctx context.Context, id, owner int64) (string, error) {
+	var status string
+	err := r.db.QueryRow(ctx, `SELECT status FROM scheduled_messages WHERE id = $1 AND user_id = $2`, id, owner).Scan(&status)
+	return status, pgErr(err)
+}
+
+type pgCommands struct{ db pgDB }
+
+func (r pgCommands) List(ctx context.Context) ([]botCommand, error) {
+	rows, err := r.db.Query(ctx, `SELECT name, url, secret, owner_id, description, display_name FROM bot_commands ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []botCommand
+	for rows.Next() {
+		var c botCommand
+		if err := rows.Scan(&c.Name, &c.URL, &c.Secret, &c.OwnerID, &c.Description, &c.DisplayName); err != nil {
+			return nil, err
+		}
+		out = append(out, c)
+	}
+	return out, rows.Err()
+}
+
+func (r pgCommands) Get(ctx context.Context, name string) (*botCommand, error) {
+	var c botCommand
+	err := r.db.QueryRow(ctx, `SELECT name, url, secret, owner_id, description, display_name FROM bot_commands WHERE name = $1`, name).
+		Scan(&c.Name, &c.URL, &c.Secret, &c.OwnerID, &c.Description, &c.DisplayName)
+	if err != nil {
+		return nil, pgErr(err)
+	}
+	return &c, nil
+}
+
+func (r pgCommands) Create(ctx context.Context, c *botCommand) error {
+	_, err := r.db.Exec(ctx, `INSERT INTO bot_commands (name, url, secret, owner_id, description, display_name) VALUES ($1,$2,$3,$4,$5,$6)`,
+		c.Name, c.URL, c.Secret, c.OwnerID, c.Description, c.DisplayName)
+	return pgErr(err)
+}
+
+func (r pgCommands) Delete(ctx context.Context, name string, owner int64, anyOwner bool) error {
+	return pgAffected(r.db.Exec(ctx, `DELETE FROM bot_commands WHERE name = $1 AND ($2 OR owner_id = $3)`, name, anyOwner, owner))
+}
+
+type pgIncomingHooks struct{ db pgDB }
+
+func (r pgIncomingHooks) ByToken(ctx context.Context, tokenHash string) (*incomingHook, error) {
+	var h incomingHook
+	err := r.db.QueryRow(ctx, `SELECT h.id, h.owner_id, u.email, h.recipient, h.conversation_id, h.name, h.avatar_url, h.created_at, h.last_used_at FROM incoming_webhooks h JOIN users u ON u.id = h.owner_id WHERE h.token_hash = $1`, tokenHash).
+		Scan(&h.ID, &h.OwnerID, &h.OwnerEmail, &h.Recipient, &h.ConversationID, &h.Name, &h.AvatarURL, &h.CreatedAt, &h.LastUsedAt)
+	if err != nil {
+		return nil, pgErr(err)
+	}
+	return &h, nil
+}
+
+func (r pgIncomingHooks) Used(ctx context.Context, id int64) error {
+	_, err := r.db.Exec(ctx, `UPDATE incoming_webhooks SET last_used_at = now() WHERE id = $1`, id)
+	return err
+}
+
+func (r pgIncomingHooks) List(ctx context.Context, owner int64) ([]incomingHook, error) {
+	rows, err := r.db.Query(ctx, `SELECT id, owner_id, recipient, conversation_id, name, avatar_url, created_at, last_used_at FROM incoming_webhooks WHERE owner_id = $1 ORDER BY id`, owner)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []incomingHook
+	for rows.Next() {
+		var h incomingHook
+		if err := rows.Scan(&h.ID, &h.OwnerID, &h.Recipient, &h.ConversationID, &h.Name, &h.AvatarURL, &h.CreatedAt, &h.LastUsedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, h)
+	}
+	return out, rows.Err()
+}
+
+func (r pgIncomingHooks) Create(ctx context.Context, h *incomingHook, tokenHash string) error {
+	return r.db.QueryRow(ctx, `INSERT INTO incoming_webhooks (owner_id, token_hash, recipient, conversation_id, name, avatar_url) VALUES ($1,$2,$3,$4,$5,$6) RETURNING id, created_at`,
+		h.OwnerID, tokenHash, h.Recipient, h.ConversationID, h.Name, h.AvatarURL).Scan(&h.ID, &h.CreatedAt)
+}
+
+func (r pgIncomingHooks) Delete(ctx context.Context, id, owner int64) error {
+	return pgAffected(r.db.Exec(ctx, `DELETE FROM incoming_webhooks WHERE id = $1 AND owner_id = $2`, id, owner))
+}
+
+type pgDeadLetters struct{ db pgDB }
+
+func (r pgDeadLetters) Record(ctx context.Context, instance string, m *BusMessage, cause error) error {
+	sum := sha256.Sum256(m.Body)
+	_, err := r.db.Exec(ctx, `INSERT INTO dead_letters (topic, body, body_hash, attempts, error, instance) VALUES ($1,$2,$3,$4,$5,$6) ON CONFLICT (topic, body_hash) WHERE replayed_at IS NULL DO NOTHING`,
+		m.Topic, m.Body, hex.EncodeToString(sum[:]), m.Attempts, cause.Error(), nonEmpty(instance))
+	return err
+}
+
+func (r pgDeadLetters) List(ctx context.Context, all bool, limit int) ([]deadLetter, error) {
+	rows, err := r.db.Query(ctx, `SELECT id, topic, body, attempts, error, instance, created_at, replayed_at FROM dead_letters WHERE $1 OR replayed_at IS NULL ORDER BY id DESC LIMIT $2`, all, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []deadLetter
+	for rows.Next() {
+		var d deadLetter
+		if err := rows.Scan(&d.ID, &d.Topic, &d.Body, &d.Attempts, &d.Error, &d.Instance, &d.CreatedAt, &d.ReplayedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, d)
+	}
+	return out, rows.Err()
+}
+
+func (r pgDeadLetters) Claim(ctx context.Context, id int64) (*deadLetter, error) {
+	d := &deadLetter{ID: id}
+	err := r.db.QueryRow(ctx, `UPDATE dead_letters SET replayed_at = now() WHERE id = $1 AND replayed_at IS NULL RETURNING topic, body, instance`, id).Scan(&d.Topic, &d.Body, &d.Instance)
+	if err != nil {
+		return nil, pgErr(err)
+	}
+	return d, nil
+}
+
+func (r pgDeadLetters) Unclaim(ctx context.Context, id int64) error {
+	_, err := r.db.Exec(ctx, `UPDATE dead_letters SET replayed_at = NULL WHERE id = $1`, id)
+	return err
+}
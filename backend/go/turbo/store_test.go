@@ -0,0 +1,158 @@
+package turbo
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// TestStores holds both stores to the contract the Store interface
+// documents, so the memory store stays a faithful stand-in.
+func TestStores(t *testing.T) {
+	for name, open := range map[string]func(*testing.T) Store{
+		"memory":   func(*testing.T) Store { return NewMemoryStore(nil) },
+		"postgres": func(t *testing.T) Store { st, _ := testPostgres(t); return st },
+	} {
+		t.Run(name, func(t *testing.T) {
+			st := open(t)
+			t.Run("users", func(t *testing.T) { testUserRepo(t, st) })
+			t.Run("tx", func(t *testing.T) { testStoreTx(t, st) })
+			t.Run("conversations", func(t *testing.T) { testConversationRepo(t, st) })
+		})
+	}
+}
+
+func testUserRepo(t *testing.T, st Store) {
+	ctx := context.Background()
+	email := uniqueEmail("store")
+	id, created, err := st.Users().Create(ctx, email, []byte("hash"))
+	if err != nil || !created {
+		t.Fatalf("create: %v, created %t", err, created)
+	}
+	if again, created, err := st.Users().Create(ctx, email, nil); err != nil || created || again != id {
+		t.Errorf("create a taken email: id %d (want %d), created %t, %v", again, id, created, err)
+	}
+	if got, hash, err := st.Users().Password(ctx, email); err != nil || got != id || string(hash) != "hash" {
+		t.Errorf("password: %d %q %v", got, hash, err)
+	}
+	for _, find := range []func() (*userRecord, error){
+		func() (*userRecord, error) { return st.Users().Get(ctx, id) },
+		func() (*userRecord, error) { return st.Users().ByEmail(ctx, email) },
+		func() (*userRecord, error) { return st.Users().Lookup(ctx, email) },
+		func() (*userRecord, error) { return st.Users().Resolve(ctx, &user{Email: email}) },
+	} {
+		if u, err := find(); err != nil || u.ID != id || u.Email != email {
+			t.Errorf("found %+v, %v; want user %d", u, err, id)
+		}
+	}
+	if _, err := st.Users().Get(ctx, -1); !errors.Is(err, errNotFound) {
+		t.Errorf("get an unknown user: %v, want errNotFound", err)
+	}
+	if _, err := st.Users().ByEmail(ctx, "nobody-"+email); !errors.Is(err, errNotFound) {
+		t.Errorf("an unknown email: %v, want errNotFound", err)
+	}
+}
+
+func testStoreTx(t *testing.T, st Store) {
+	ctx := context.Background()
+	kept, dropped, inner := uniqueEmail("kept"), uniqueEmail("dropped"), uniqueEmail("inner")
+	cause := errors.New("roll back")
+	err := st.Tx(ctx, func(tx Store) error {
+		if _, _, err := tx.Users().Create(ctx, kept, nil); err != nil {
+			return err
+		}
+		// a failed nested Tx only undoes its own writes
+		if err := tx.Tx(ctx, func(tx Store) error {
+			if _, _, err := tx.Users().Create(ctx, inner, nil); err != nil {
+				return err
+			}
+			return cause
+		}); !errors.Is(err, cause) {
+			t.Errorf("nested tx: %v, want %v", err, cause)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := st.Tx(ctx, func(tx Store) error {
+		if _, _, err := tx.Users().Create(ctx, dropped, nil); err != nil {
+			return err
+		}
+		return cause
+	}); !errors.Is(err, cause) {
+		t.Errorf("tx: %v, want %v", err, cause)
+	}
+	for email, want := range map[string]bool{kept: true, inner: false, dropped: false} {
+		_, err := st.Users().ByEmail(ctx, email)
+		if got := err == nil; got != want || err != nil && !errors.Is(err, errNotFound) {
+			t.Errorf("%s: stored %t (%v), want %t", email, got, err, want)
+		}
+	}
+}
+
+func testConversationRepo(t *testing.T, st Store) {
+	ctx := context.Background()
+	var ids []int64
+	for _, name := range []string{"a", "b", "c"} {
+		id, _, err := st.Users().Create(ctx, uniqueEmail(name), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	a, b, c := ids[0], ids[1], ids[2]
+
+	dm, err := st.Conversations().Direct(ctx, a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, err := st.Conversations().Direct(ctx, b, a); err != nil || again.ID != dm.ID {
+		t.Errorf("direct the other way: %+v, %v; want conversation %d", again, err, dm.ID)
+	}
+	if id, err := st.Conversations().DirectID(ctx, dm.DirectKey); err != nil || id != dm.ID {
+		t.Errorf("direct id: %d, %v; want %d", id, err, dm.ID)
+	}
+	if got := sortedIDs(dm.Members); !slices.Equal(got, []int64{a, b}) || dm.Kind != kindDirect {
+		t.Errorf("direct %s with %v, want %v", dm.Kind, got, []int64{a, b})
+	}
+
+	name := "store-" + newEventID()[:8]
+	room := &conversation{Kind: kindRoom, Name: &name, Members: []int64{a}}
+	if err := st.Conversations().Create(ctx, room, a); err != nil || room.ID == 0 || room.CreatedAt.IsZero() {
+		t.Fatalf("create room: %v, %+v", err, room)
+	}
+	if id, err := st.Conversations().RoomID(ctx, strings.ToUpper(name)); err != nil || id != room.ID {
+		t.Errorf("room by name: %d, %v; want %d", id, err, room.ID)
+	}
+	upper := strings.ToUpper(name)
+	if err := st.Conversations().Create(ctx, &conversation{Kind: kindRoom, Name: &upper, Members: []int64{b}}, b); !errors.Is(err, errConflict) {
+		t.Errorf("a taken room name: %v, want errConflict", err)
+	}
+	for _, tc := range []struct {
+		user   int64
+		joined bool
+	}{{c, true}, {c, false}, {a, false}} {
+		if joined, err := st.Conversations().Join(ctx, room.ID, tc.user); err != nil || joined != tc.joined {
+			t.Errorf("user %d joining: %t, %v; want %t", tc.user, joined, err, tc.joined)
+		}
+	}
+	got, err := st.Conversations().Get(ctx, room.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if members := sortedIDs(got.Members); !slices.Equal(members, []int64{a, c}) || got.CreatedBy == nil || *got.CreatedBy != a {
+		t.Errorf("room members %v, created by %v", members, got.CreatedBy)
+	}
+	if _, err := st.Conversations().Get(ctx, -1); !errors.Is(err, errNotFound) {
+		t.Errorf("get an unknown conversation: %v, want errNotFound", err)
+	}
+}
+
+func sortedIDs(ids []int64) []int64 {
+	ids = slices.Clone(ids)
+	slices.Sort(ids)
+	return ids
+}
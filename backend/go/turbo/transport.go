@@ -0,0 +1,199 @@
+package turbo
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// pollTimeout bounds how long a long-poll request is held open waiting for
+// events; it stays under common proxy idle timeouts.
+const pollTimeout = 25 * time.Second
+
+// sseHeartbeat is how often an idle SSE stream gets a comment line so
+// intermediaries don't close it.
+const sseHeartbeat = 15 * time.Second
+
+// requestToken returns the auth token from the Authorization header, falling
+// back to ?token= because EventSource cannot set request headers.
+func requestToken(r *http.Request) string {
+	if t := r.Header.Get("Authorization"); t != "" {
+		return t
+	}
+	return r.URL.Query().Get("token")
+}
+
+// lastEventID reads the resume cursor from the Last-Event-ID header (sent by
+// EventSource on reconnect) or the ?lastEventId= / ?since= query parameters.
+func lastEventID(r *http.Request) string {
+	v := r.Header.Get("Last-Event-ID")
+	if v == "" {
+		v = r.URL.Query().Get("lastEventId")
+	}
+	if v == "" {
+		v = r.URL.Query().Get("since")
+	}
+	return v
+}
+
+// handleSSE streams the same events as /ws using Server-Sent Events.
+func (s *Server) handleSSE(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method", http.StatusMethodNotAllowed)
+		return
+	}
+	u := s.authenticate(r, requestToken(r))
+	if u == nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	sub, complete := s.hub.subscribe(u, lastEventID(r))
+	defer s.hub.unsubscribe(sub)
+	s.notifier.touch(u)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	// disable response buffering in nginx-style proxies
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	// tell the client to refetch history when the backlog can't cover the
+	// gap or the cursor came from another replica
+	if !complete {
+		fmt.Fprint(w, "event: resync\ndata: {}\n\n")
+	}
+	flusher.Flush()
+
+	ticker := time.NewTicker(sseHeartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case ev, ok := <-sub.ch:
+			if !ok {
+				// dropped for falling behind; EventSource reconnects with Last-Event-ID
+				return
+			}
+			if ev.ID == "" {
+				// control frame: no id so the client's resume cursor is kept
+				fmt.Fprintf(w, "event: reconnect\nretry: %d\ndata: %s\n\n", ev.Retry.Milliseconds(), ev.Data)
+				flusher.Flush()
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "id: %s\ndata: %s\n\n", ev.ID, ev.Data); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// handlePoll is the long-poll transport. It returns immediately if events
+// after the cursor are buffered, otherwise waits up to pollTimeout for one.
+// The response carries the cursor to pass as ?since= on the next request.
+func (s *Server) handlePoll(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method", http.StatusMethodNotAllowed)
+		return
+	}
+	u := s.authenticate(r, requestToken(r))
+	if u == nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	sub, complete := s.hub.subscribe(u, lastEventID(r))
+	defer s.hub.unsubscribe(sub)
+	s.notifier.touch(u)
+
+	events := []hubEvent{}
+	timer := time.NewTimer(pollTimeout)
+	defer timer.Stop()
+	// a client that has to resync is answered right away
+wait:
+	for complete || len(sub.ch) > 0 {
+		select {
+		case ev, ok := <-sub.ch:
+			if !ok {
+				break wait
+			}
+			events = append(events, ev)
+			// drain whatever else is already queued, then answer
+			if len(sub.ch) == 0 {
+				break wait
+			}
+		case <-timer.C:
+			break wait
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	// the hub's position at subscribe time covers an empty answer, so the
+	// next poll resumes from there rather than from "now"
+	cursor := sub.head
+	for _, ev := range events {
+		if ev.ID != "" {
+			cursor = ev.ID
+		}
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	_ = json.NewEncoder(w).Encode(map[string]any{"events": events, "cursor": cursor, "resync": !complete})
+}
+
+// handleSend accepts a chat frame over REST for clients without a WebSocket.
+// The body is the same JSON as a WebSocket `message` frame.
+func (s *Server) handleSend(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method", http.StatusMethodNotAllowed)
+		return
+	}
+	u := s.authenticate(r, r.Header.Get("Authorization"))
+	if u == nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	var msg map[string]any
+	if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+		http.Error(w, "bad json", http.StatusBadRequest)
+		return
+	}
+	if _, ok := msg["type"]; !ok {
+		msg["type"] = "message"
+	}
+	if t, _ := msg["type"].(string); t == "auth" {
+		http.Error(w, "bad type", http.StatusBadRequest)
+		return
+	}
+	reply, err := s.handleFrame(withTrace(r.Context(), r), u, msg)
+	// our failures are 5xx so clients retry them; anything else is the
+	// frame's fault
+	if errors.Is(err, errStore) || errors.Is(err, errPublish) {
+		s.internalError(w, r, err.Error(), err)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// slash command output goes back to this caller only
+	if reply != nil {
+		_ = json.NewEncoder(w).Encode(reply)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+	_ = json.NewEncoder(w).Encode(msg)
+}
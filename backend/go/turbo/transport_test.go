@@ -0,0 +1,37 @@
+package turbo
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"testing"
+)
+
+// brokenTxStore fails every transaction once broken, like a database that
+// went away mid-request.
+type brokenTxStore struct {
+	Store
+	broken atomic.Bool
+}
+
+func (s *brokenTxStore) Tx(ctx context.Context, fn func(Store) error) error {
+	if s.broken.Load() {
+		return errors.New("connection reset")
+	}
+	return s.Store.Tx(ctx, fn)
+}
+
+func TestSendStatus(t *testing.T) {
+	st := &brokenTxStore{Store: NewMemoryStore(nil)}
+	ts := newTestServer(t, st)
+	alice, _ := ts.signup("alice@example.com")
+	st.broken.Store(true)
+
+	if code := ts.do(http.MethodPost, "/api/send", alice, map[string]any{"type": "typing", "conversation": 999}, nil); code != http.StatusBadRequest {
+		t.Errorf("typing in a conversation alice isn't in: %d, want 400", code)
+	}
+	if code := ts.do(http.MethodPost, "/api/send", alice, map[string]any{"text": "hi"}, nil); code != http.StatusInternalServerError {
+		t.Errorf("store failure: %d, want 500", code)
+	}
+}
@@ -0,0 +1,176 @@
+package turbo
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"testing"
+)
+
+// chatWorld is three users where alice and bob share a DM, a group and a
+// room, and carol shares nothing with them.
+type chatWorld struct {
+	*testServer
+	alice, bob, carol string
+	group, room       int64
+	// since is a poll cursor from before anything was said
+	since string
+}
+
+func newChatWorld(t *testing.T) *chatWorld {
+	t.Helper()
+	w := &chatWorld{testServer: newTestServer(t, nil)}
+	w.alice, _ = w.signup("alice@example.com")
+	w.bob, _ = w.signup("bob@example.com")
+	w.carol, _ = w.signup("carol@example.com")
+
+	var c struct {
+		ID int64 `json:"id"`
+	}
+	if code := w.do(http.MethodPost, "/api/conversations", w.alice, map[string]any{"members": []string{"bob@example.com"}, "name": "pair"}, &c); code != http.StatusOK {
+		t.Fatalf("create group: %d", code)
+	}
+	w.group = c.ID
+	if code := w.do(http.MethodPost, "/api/rooms", w.alice, map[string]string{"name": "ops"}, &c); code != http.StatusCreated {
+		t.Fatalf("create room: %d", code)
+	}
+	w.room = c.ID
+	w.since = w.hub.cursor(0)
+
+	w.send(w.alice, map[string]any{"text": "/invite bob@example.com", "conversation": w.room})
+	w.send(w.alice, map[string]any{"text": "public hello"})
+	w.send(w.alice, map[string]any{"text": "secret dm", "to": "bob@example.com"})
+	w.send(w.alice, map[string]any{"text": "secret group", "conversation": w.group})
+	w.send(w.alice, map[string]any{"text": "secret room", "conversation": w.room})
+	return w
+}
+
+func (w *chatWorld) send(token string, frame map[string]any) {
+	w.tb.Helper()
+	if code := w.do(http.MethodPost, "/api/send", token, frame, nil); code != http.StatusOK && code != http.StatusAccepted {
+		w.tb.Fatalf("send %v: %d", frame, code)
+	}
+}
+
+// history returns the texts token sees on /api/messages with query.
+func (w *chatWorld) history(token, query string) []string {
+	w.tb.Helper()
+	var page struct {
+		Messages []struct {
+			Text string `json:"text"`
+		} `json:"messages"`
+	}
+	if code := w.do(http.MethodGet, "/api/messages?limit=100&"+query, token, nil, &page); code != http.StatusOK {
+		return nil
+	}
+	var out []string
+	for _, m := range page.Messages {
+		out = append(out, m.Text)
+	}
+	return out
+}
+
+// search returns the texts token finds for q.
+func (w *chatWorld) search(token, q string) []string {
+	w.tb.Helper()
+	var res struct {
+		Results []struct {
+			Text string `json:"text"`
+		} `json:"results"`
+	}
+	if code := w.do(http.MethodGet, "/api/search?q="+url.QueryEscape(q), token, nil, &res); code != http.StatusOK {
+		w.tb.Fatalf("search %q: %d", q, code)
+	}
+	var out []string
+	for _, r := range res.Results {
+		out = append(out, r.Text)
+	}
+	slices.Sort(out)
+	return out
+}
+
+// replay returns the message texts token gets replayed by a long poll from
+// before anything was said.
+func (w *chatWorld) replay(token string) []string {
+	w.tb.Helper()
+	var res struct {
+		Events []struct {
+			Data json.RawMessage `json:"data"`
+		} `json:"events"`
+	}
+	if code := w.do(http.MethodGet, "/api/poll?since="+url.QueryEscape(w.since), token, nil, &res); code != http.StatusOK {
+		w.tb.Fatalf("poll: %d", code)
+	}
+	var out []string
+	for _, ev := range res.Events {
+		var m struct {
+			Type string `json:"type"`
+			Text string `json:"text"`
+		}
+		_ = json.Unmarshal(ev.Data, &m)
+		if m.Type == "message" {
+			out = append(out, m.Text)
+		}
+	}
+	return out
+}
+
+func TestVisibility(t *testing.T) {
+	w := newChatWorld(t)
+	everything := []string{"public hello", "secret dm", "secret group", "secret room"}
+	secrets := everything[1:]
+
+	for _, tc := range []struct {
+		who   string
+		token string
+		want  []string
+	}{
+		{"alice", w.alice, everything},
+		{"bob", w.bob, everything},
+		{"carol", w.carol, []string{"public hello"}},
+	} {
+		if got := w.history(tc.token, ""); !slices.Equal(got, tc.want) {
+			t.Errorf("%s's history = %q, want %q", tc.who, got, tc.want)
+		}
+		wantSecrets := secrets
+		if tc.who == "carol" {
+			wantSecrets = nil
+		}
+		if got := w.search(tc.token, "secret"); !slices.Equal(got, wantSecrets) {
+			t.Errorf("%s's search = %q, want %q", tc.who, got, wantSecrets)
+		}
+		if got := w.replay(tc.token); !slices.Equal(got, tc.want) {
+			t.Errorf("%s's replay = %q, want %q", tc.who, got, tc.want)
+		}
+	}
+}
+
+func TestVisibilityByConversation(t *testing.T) {
+	w := newChatWorld(t)
+	for _, tc := range []struct {
+		query string
+		want  string
+	}{
+		{"peer=alice@example.com", "secret dm"},
+		{fmt.Sprintf("conversation=group:%d", w.group), "secret group"},
+		{fmt.Sprintf("room=%d", w.room), "secret room"},
+		{"conversation=public", "public hello"},
+	} {
+		if got := w.history(w.bob, tc.query); !slices.Equal(got, []string{tc.want}) {
+			t.Errorf("bob's history for %s = %q, want %q", tc.query, got, tc.want)
+		}
+	}
+	// naming someone else's conversation doesn't let carol in
+	for _, query := range []string{
+		fmt.Sprintf("conversation=group:%d", w.group),
+		fmt.Sprintf("room=%d", w.room),
+		"peer=alice@example.com",
+		"conversation=dm:alice@example.com,bob@example.com",
+	} {
+		if got := w.history(w.carol, query); len(got) != 0 {
+			t.Errorf("carol's history for %s = %q", query, got)
+		}
+	}
+}
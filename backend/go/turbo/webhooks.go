@@ -0,0 +1,504 @@
+package turbo
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Event types outgoing webhooks can subscribe to, besides
+// eventMessageCreated.
+const (
+	eventMessageDeleted = "message.deleted"
+	eventUserRegistered = "user.registered"
+	eventProfileUpdated = "profile.updated"
+)
+
+// webhookEvents is every event type a webhook may filter on.
+var webhookEvents = []string{eventMessageCreated, eventMessageDeleted, eventUserRegistered, eventProfileUpdated}
+
+// User roles. Integrators and admins may register webhooks.
+const (
+	roleMember     = "member"
+	roleIntegrator = "integrator"
+	roleAdmin      = "admin"
+)
+
+const (
+	// webhookBatch is how many due deliveries one dispatcher pass claims.
+	webhookBatch = 20
+	// webhookLease is how long a claimed delivery is hidden from other
+	// replicas while its request is in flight.
+	webhookLease = time.Minute
+	// webhookMaxAttempts is how often one delivery is tried before it is
+	// marked failed.
+	webhookMaxAttempts = 8
+	// webhookMaxBackoff caps the delay between attempts.
+	webhookMaxBackoff = time.Hour
+	// webhookDisableAfter consecutive failed attempts disable the endpoint.
+	webhookDisableAfter = 15
+	// webhookRetention is how long the delivery log is kept.
+	webhookRetention = 7 * 24 * time.Hour
+)
+
+// enqueueWebhooks queues env for every active webhook subscribed to its type
+// and conversation, in st's transaction if it has one.
+func enqueueWebhooks(ctx context.Context, st Store, env *envelope) error {
+	return st.Webhooks().Enqueue(ctx, env)
+}
+
+// signWebhook returns the X-Turbo-Signature value for body sent at ts:
+// "sha256=" and the hex HMAC of "<ts>.<body>" keyed with the secret.
+// Receivers recompute it and reject stale timestamps to stop replays.
+func signWebhook(secret string, ts int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", ts)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookDispatcher POSTs queued deliveries. Deliveries are claimed by
+// pushing their next attempt out by webhookLease, so replicas share the
+// queue and a crashed sender's claims expire.
+type webhookDispatcher struct {
+	store  Store
+	client *http.Client
+	log    *slog.Logger
+	now    func() time.Time
+	kickc  chan struct{}
+	quit   chan struct{}
+	done   chan struct{}
+	once   sync.Once
+}
+
+func newWebhookDispatcher(store Store, logger *slog.Logger, now func() time.Time) *webhookDispatcher {
+	return &webhookDispatcher{
+		store:  store,
+		client: publicClient(10 * time.Second),
+		log:    logger,
+		now:    now,
+		kickc:  make(chan struct{}, 1),
+		quit:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+}
+
+// kick wakes the dispatcher after events were queued.
+func (d *webhookDispatcher) kick() {
+	select {
+	case d.kickc <- struct{}{}:
+	default:
+	}
+}
+
+// run delivers until stop is called.
+func (d *webhookDispatcher) run() {
+	defer close(d.done)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	lastCleanup := d.now()
+	for {
+		select {
+		case <-d.quit:
+			return
+		case <-d.kickc:
+		case <-ticker.C:
+		}
+		for {
+			n, err := d.deliverBatch(context.Background())
+			if err != nil {
+				d.log.Error("webhooks", "err", err)
+			}
+			if n < webhookBatch {
+				break
+			}
+		}
+		if d.now().Sub(lastCleanup) > time.Hour {
+			lastCleanup = d.now()
+			if err := d.store.Webhooks().Cleanup(context.Background(), lastCleanup.Add(-webhookRetention)); err != nil {
+				d.log.Error("webhooks cleanup", "err", err)
+			}
+		}
+	}
+}
+
+// stop ends the loop, waiting for the batch in progress.
+func (d *webhookDispatcher) stop() {
+	d.once.Do(func() { close(d.quit) })
+	<-d.done
+}
+
+// deliverBatch claims and sends up to webhookBatch due deliveries.
+func (d *webhookDispatcher) deliverBatch(ctx context.Context) (int, error) {
+	batch, err := d.store.Webhooks().Claim(ctx, webhookBatch, d.now().Add(webhookLease))
+	if err != nil {
+		return 0, err
+	}
+
+	for i := range batch {
+		c := &batch[i]
+		code, err := d.post(ctx, c.URL, c.Secret, c.EventID, c.Type, c.Payload)
+		var codePtr *int
+		if code != 0 {
+			codePtr = &code
+		}
+		if err == nil {
+			if err := d.store.Webhooks().Succeeded(ctx, c, codePtr); err != nil {
+				return len(batch), err
+			}
+			continue
+		}
+		status := "pending"
+		if c.Attempts+1 >= webhookMaxAttempts {
+			status = "failed"
+		}
+		backoff := webhookMaxBackoff
+		if c.Attempts < 12 {
+			backoff = min((10*time.Second)<<c.Attempts, webhookMaxBackoff)
+		}
+		disabled, err := d.store.Webhooks().Failed(ctx, c, status, codePtr, err.Error(), d.now().Add(backoff), webhookDisableAfter)
+		if err != nil {
+			return len(batch), err
+		}
+		if disabled {
+			d.log.Warn("webhooks: disabled after consecutive failures", "webhook_id", c.WebhookID, "failures", webhookDisableAfter)
+		}
+	}
+	return len(batch), nil
+}
+
+// post sends one signed delivery, returning the response code if any.
+func (d *webhookDispatcher) post(ctx context.Context, endpoint, secret, eventID, typ string, payload []byte) (int, error) {
+	ts := d.now().Unix()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(string(payload)))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Turbo-Webhooks/1")
+	req.Header.Set("X-Turbo-Event", typ)
+	req.Header.Set("X-Turbo-Delivery", eventID)
+	req.Header.Set("X-Turbo-Timestamp", strconv.FormatInt(ts, 10))
+	req.Header.Set("X-Turbo-Signature", signWebhook(secret, ts, payload))
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("status %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// userRole returns u's role, looked up by id or, for tokens without one, by
+// email. Options.AdminEmails are always admins.
+func (s *Server) userRole(ctx context.Context, u *user) string {
+	for _, e := range s.admins {
+		if u.Email != "" && strings.EqualFold(e, u.Email) {
+			return roleAdmin
+		}
+	}
+	rec, err := s.store.Users().Resolve(ctx, u)
+	if err != nil {
+		if !errors.Is(err, errNotFound) {
+			s.log.ErrorContext(ctx, "role lookup", "err", err)
+		}
+		return roleMember
+	}
+	return rec.Role
+}
+
+// requireRole returns the caller if they hold one of roles, writing 401/403
+// and returning nil otherwise.
+func (s *Server) requireRole(w http.ResponseWriter, r *http.Request, roles ...string) *user {
+	u := s.authenticate(r, r.Header.Get("Authorization"))
+	if u == nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return nil
+	}
+	role := s.userRole(r.Context(), u)
+	for _, want := range roles {
+		if role == want {
+			return u
+		}
+	}
+	http.Error(w, "forbidden", http.StatusForbidden)
+	return nil
+}
+
+// ownerID resolves the caller's user id for tokens that only carry an email.
+func (s *Server) ownerID(ctx context.Context, u *user) (int64, error) {
+	if u.ID != 0 {
+		return u.ID, nil
+	}
+	rec, err := s.store.Users().Resolve(ctx, u)
+	if err != nil {
+		return 0, err
+	}
+	return rec.ID, nil
+}
+
+type webhookOut struct {
+	ID         int64      `json:"id"`
+	OwnerID    int64      `json:"owner_id"`
+	URL        string     `json:"url"`
+	Events     []string   `json:"events"`
+	Room       *string    `json:"room,omitempty"`
+	Active     bool       `json:"active"`
+	Failures   int        `json:"failures"`
+	DisabledAt *time.Time `json:"disabled_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	// Secret is only returned when created or rotated
+	Secret string `json:"secret,omitempty"`
+}
+
+// validWebhookRequest checks the endpoint URL and event filter. Endpoints
+// must be public; the dispatcher's client refuses internal addresses that a
+// name resolves to.
+func validWebhookRequest(endpoint string, events []string) error {
+	if err := validUserURL(endpoint); err != nil {
+		return err
+	}
+	if len(events) == 0 {
+		return errors.New("no events")
+	}
+	for _, e := range events {
+		ok := false
+		for _, known := range webhookEvents {
+			ok = ok || e == known
+		}
+		if !ok {
+			return fmt.Errorf("unknown event %q", e)
+		}
+	}
+	return nil
+}
+
+func newWebhookSecret() string {
+	var b [32]byte
+	_, _ = rand.Read(b[:])
+	return "whsec_" + hex.EncodeToString(b[:])
+}
+
+// handleWebhooks manages the caller's outgoing webhooks.
+//
+//	GET    /api/webhooks            list (admins: ?all=1 for everyone's)
+//	POST   /api/webhooks            {"url", "events": [...], "room"} -> includes secret
+//	PATCH  /api/webhooks?id=N       {"url", "events", "room", "active", "rotate_secret"}
+//	DELETE /api/webhooks?id=N
+func (s *Server) handleWebhooks(w http.ResponseWriter, r *http.Request) {
+	u := s.requireRole(w, r, roleIntegrator, roleAdmin)
+	if u == nil {
+		return
+	}
+	ctx := r.Context()
+	owner, err := s.ownerID(ctx, u)
+	if err != nil {
+		http.Error(w, "unknown user", http.StatusForbidden)
+		return
+	}
+	// admins may manage anyone's webhooks
+	anyOwner := s.userRole(ctx, u) == roleAdmin
+	id, _ := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+
+	switch r.Method {
+	case http.MethodGet:
+		all := anyOwner && r.URL.Query().Get("all") == "1"
+		out, err := s.store.Webhooks().List(ctx, owner, all)
+		if err != nil {
+			s.internalError(w, r, "db", err)
+			return
+		}
+		if out == nil {
+			out = []webhookOut{}
+		}
+		_ = json.NewEncoder(w).Encode(out)
+
+	case http.MethodPost:
+		var body struct {
+			URL    string   `json:"url"`
+			Events []string `json:"events"`
+			Room   *string  `json:"room"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "bad json", http.StatusBadRequest)
+			return
+		}
+		if err := validWebhookRequest(body.URL, body.Events); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		h := webhookOut{OwnerID: owner, URL: body.URL, Events: body.Events, Room: body.Room, Active: true, Secret: newWebhookSecret()}
+		if err := s.store.Webhooks().Create(ctx, &h); err != nil {
+			s.internalError(w, r, "db", err)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(w).Encode(h)
+
+	case http.MethodPatch:
+		var body struct {
+			URL          *string  `json:"url"`
+			Events       []string `json:"events"`
+			Room         *string  `json:"room"`
+			Active       *bool    `json:"active"`
+			RotateSecret bool     `json:"rotate_secret"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "bad json", http.StatusBadRequest)
+			return
+		}
+		h, err := s.store.Webhooks().Get(ctx, id, owner, anyOwner)
+		if err != nil {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		if body.URL != nil {
+			h.URL = *body.URL
+		}
+		if body.Events != nil {
+			h.Events = body.Events
+		}
+		if body.Room != nil {
+			// an empty room clears the filter
+			h.Room = body.Room
+			if *body.Room == "" {
+				h.Room = nil
+			}
+		}
+		if err := validWebhookRequest(h.URL, h.Events); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if body.Active != nil {
+			h.Active = *body.Active
+		}
+		if body.RotateSecret {
+			h.Secret = newWebhookSecret()
+		}
+		// re-enabling starts the failure count over
+		if err := s.store.Webhooks().Update(ctx, h); err != nil {
+			s.internalError(w, r, "db", err)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(h)
+
+	case http.MethodDelete:
+		err := s.store.Webhooks().Delete(ctx, id, owner, anyOwner)
+		if errors.Is(err, errNotFound) {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			s.internalError(w, r, "db", err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "method", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleWebhookDeliveries is the delivery log of one webhook, newest first.
+// GET /api/webhooks/deliveries?webhook_id=N[&status=failed][&limit=100]
+func (s *Server) handleWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method", http.StatusMethodNotAllowed)
+		return
+	}
+	u := s.requireRole(w, r, roleIntegrator, roleAdmin)
+	if u == nil {
+		return
+	}
+	ctx := r.Context()
+	owner, err := s.ownerID(ctx, u)
+	if err != nil {
+		http.Error(w, "unknown user", http.StatusForbidden)
+		return
+	}
+	anyOwner := s.userRole(ctx, u) == roleAdmin
+	q := r.URL.Query()
+	hookID, _ := strconv.ParseInt(q.Get("webhook_id"), 10, 64)
+	limit := 100
+	if l, err := strconv.Atoi(q.Get("limit")); err == nil && l > 0 && l <= 1000 {
+		limit = l
+	}
+	if _, err := s.store.Webhooks().Get(ctx, hookID, owner, anyOwner); err != nil {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	deliveries, err := s.store.Webhooks().Deliveries(ctx, hookID, q.Get("status"), limit)
+	if err != nil {
+		s.internalError(w, r, "db", err)
+		return
+	}
+	out := []map[string]any{}
+	for _, e := range deliveries {
+		d := map[string]any{"id": e.ID, "event_id": e.EventID, "event": e.Type, "status": e.Status, "attempts": e.Attempts, "created_at": e.CreatedAt}
+		if e.ResponseCode != nil {
+			d["response_code"] = *e.ResponseCode
+		}
+		if e.Error != nil {
+			d["error"] = *e.Error
+		}
+		if e.DeliveredAt != nil {
+			d["delivered_at"] = *e.DeliveredAt
+		}
+		if e.Status == "pending" {
+			d["next_attempt_at"] = e.NextAttemptAt
+		}
+		out = append(out, d)
+	}
+	_ = json.NewEncoder(w).Encode(out)
+}
+
+// handleUserRole lets admins change a user's role.
+// POST /api/admin/users/role {"user_id": 1, "role": "integrator"}
+func (s *Server) handleUserRole(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.requireAdmin(w, r) == nil {
+		return
+	}
+	var body struct {
+		UserID int64  `json:"user_id"`
+		Role   string `json:"role"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "bad json", http.StatusBadRequest)
+		return
+	}
+	switch body.Role {
+	case roleMember, roleIntegrator, roleAdmin:
+	default:
+		http.Error(w, "bad role", http.StatusBadRequest)
+		return
+	}
+	err := s.store.Users().SetRole(r.Context(), body.UserID, body.Role)
+	if errors.Is(err, errNotFound) {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		s.internalError(w, r, "db", err)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(map[string]any{"ok": true, "user_id": body.UserID, "role": body.Role})
+}
@@ -0,0 +1,125 @@
+package turbo
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// verifySignature is what a receiver does with a delivery: recompute the
+// HMAC of "<timestamp>.<body>" and compare in constant time.
+func verifySignature(secret string, h http.Header, body []byte) bool {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(h.Get("X-Turbo-Timestamp") + "."))
+	mac.Write(body)
+	want := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	return hmac.Equal([]byte(want), []byte(h.Get("X-Turbo-Signature")))
+}
+
+func TestSignWebhook(t *testing.T) {
+	body := []byte(`{"type":"message.created"}`)
+	sig := signWebhook("whsec_test", 1700000000, body)
+	h := http.Header{"X-Turbo-Timestamp": {"1700000000"}, "X-Turbo-Signature": {sig}}
+	if !verifySignature("whsec_test", h, body) {
+		t.Fatalf("signature %s doesn't verify", sig)
+	}
+	if verifySignature("whsec_other", h, body) {
+		t.Error("verified with the wrong secret")
+	}
+	if verifySignature("whsec_test", h, []byte(`{"type":"message.deleted"}`)) {
+		t.Error("verified a tampered body")
+	}
+	h.Set("X-Turbo-Timestamp", "1700000001")
+	if verifySignature("whsec_test", h, body) {
+		t.Error("verified a changed timestamp")
+	}
+}
+
+// delivery is one request a test receiver got.
+type delivery struct {
+	header http.Header
+	body   []byte
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	var mu sync.Mutex
+	var got []delivery
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		got = append(got, delivery{r.Header.Clone(), b})
+		mu.Unlock()
+	}))
+	defer receiver.Close()
+
+	ts := newTestServer(t, nil)
+	_, id := ts.signup("integrator@example.com")
+	alice, _ := ts.signup("alice@example.com")
+	ts.signup("bob@example.com")
+	// the receiver listens on loopback, which the API and the dispatcher's
+	// own client refuse
+	hook := webhookOut{OwnerID: id, URL: receiver.URL, Events: []string{eventMessageCreated}, Active: true, Secret: newWebhookSecret()}
+	if err := ts.store.Webhooks().Create(context.Background(), &hook); err != nil {
+		t.Fatal(err)
+	}
+	ts.webhooks.client = receiver.Client()
+
+	ts.do(http.MethodPost, "/api/send", alice, map[string]any{"text": "public hello"}, nil)
+	// the integrator isn't in alice and bob's DM, so it isn't delivered
+	ts.do(http.MethodPost, "/api/send", alice, map[string]any{"text": "secret dm", "to": "bob@example.com"}, nil)
+	if _, err := ts.webhooks.deliverBatch(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(got) != 1 {
+		t.Fatalf("got %d deliveries, want 1", len(got))
+	}
+	d := got[0]
+	if !verifySignature(hook.Secret, d.header, d.body) {
+		t.Errorf("delivery signature %s doesn't verify", d.header.Get("X-Turbo-Signature"))
+	}
+	if _, err := strconv.ParseInt(d.header.Get("X-Turbo-Timestamp"), 10, 64); err != nil {
+		t.Errorf("timestamp %q", d.header.Get("X-Turbo-Timestamp"))
+	}
+	if e := d.header.Get("X-Turbo-Event"); e != eventMessageCreated || !bytes.Contains(d.body, []byte("public hello")) {
+		t.Errorf("delivered %s %s", e, d.body)
+	}
+}
+
+func TestWebhookEgress(t *testing.T) {
+	receiver := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	defer receiver.Close()
+
+	ts := newTestServer(t, nil)
+	token, id := ts.signup("integrator@example.com")
+	if err := ts.store.Users().SetRole(context.Background(), id, roleIntegrator); err != nil {
+		t.Fatal(err)
+	}
+	for _, u := range []string{receiver.URL, "http://localhost:6379/", "http://169.254.169.254/latest/meta-data", "http://10.0.0.7/", "http://[::1]:8080/", "ftp://example.com/"} {
+		req := map[string]any{"url": u, "events": []string{eventMessageCreated}}
+		if code := ts.do(http.MethodPost, "/api/webhooks", token, req, nil); code != http.StatusBadRequest {
+			t.Errorf("webhook to %s: %d, want 400", u, code)
+		}
+	}
+	req := map[string]any{"url": "https://hooks.example.com/turbo", "events": []string{eventMessageCreated}}
+	if code := ts.do(http.MethodPost, "/api/webhooks", token, req, nil); code != http.StatusCreated {
+		t.Errorf("public webhook: %d, want 201", code)
+	}
+
+	// a public name can still resolve to an internal address; the
+	// dispatcher refuses to dial it
+	if _, err := ts.webhooks.post(context.Background(), receiver.URL, "whsec_test", "ev-1", eventMessageCreated, []byte("{}")); !errors.Is(err, errPrivateAddress) {
+		t.Errorf("post to loopback: %v, want errPrivateAddress", err)
+	}
+}
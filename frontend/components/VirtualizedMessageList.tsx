@@ -1,13 +1,16 @@
-import React, { useRef } from 'react';
+import React, { useEffect, useRef } from 'react';
 import { useVirtualizer } from '@tanstack/react-virtual';
 import MessageItem, { MessageType } from './MessageItem';
 
 export default function VirtualizedMessageList({
   messages,
   currentUser,
+  onReachTop,
 }: {
   messages: MessageType[];
   currentUser: string | null;
+  // called when the first message scrolls into view, to load older history
+  onReachTop?: () => void;
 }) {
   const parentRef = useRef<HTMLDivElement | null>(null);
 
@@ -18,10 +21,19 @@ export default function VirtualizedMessageList({
     overscan: 6,
   });
 
+  // fire once each time the top comes into view, not on every render there
+  const reachTop = useRef(onReachTop);
+  reachTop.current = onReachTop;
+  const items = rowVirtualizer.getVirtualItems();
+  const firstIndex = items.length > 0 ? items[0].index : -1;
+  useEffect(() => {
+    if (firstIndex === 0) reachTop.current?.();
+  }, [firstIndex]);
+
   return (
     <div ref={parentRef} className="turbo-message-list">
       <div style={{ height: rowVirtualizer.getTotalSize(), position: 'relative' }}>
-        {rowVirtualizer.getVirtualItems().map((virtualRow) => {
+        {items.map((virtualRow) => {
           const message = messages[virtualRow.index];
           return (
             <div
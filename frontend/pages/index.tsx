@@ -21,6 +21,33 @@ type Message = {
   authorEmail?: string | null;
 };
 
+const apiBase = process.env.NEXT_PUBLIC_API_URL || 'http://localhost:8080';
+
+// historyHeaders authenticates history requests, which only return what the
+// signed-in user may see
+async function historyHeaders(): Promise<Record<string, string>> {
+  let token: string | null = localStorage.getItem('auth_token');
+  try {
+    const s = await supabase.auth.getSession();
+    if (s?.data?.session?.access_token) token = s.data.session.access_token;
+  } catch {}
+  return token ? { Authorization: 'Bearer ' + token } : {};
+}
+
+// mapHistory converts /api/messages rows to the list's message shape
+function mapHistory(rows: any[]): Message[] {
+  return rows.map((m) => ({
+    id: String(m.id),
+    author: (m.author && (m.author.display_name || m.author.email)) || (m.author && String(m.author)) || 'anon',
+    authorEmail: m.author && m.author.email ? m.author.email : null,
+    text: m.text || '',
+    ts: m.ts || Date.now(),
+    to: m.to || m.recipient || null,
+    reactions: m.reactions || {},
+    images: m.images || [],
+  })) as unknown as Message[];
+}
+
 export default function Home() {
   const [messages, setMessages] = useState<Message[]>([]);
   const [selectedFriend, setSelectedFriend] = useState<string | null>(null);
@@ -29,6 +56,9 @@ export default function Home() {
   const [connected, setConnected] = useState(false);
   const [isHydrated, setIsHydrated] = useState(false);
   const wsRef = useRef<ReconnectingWebSocket | null>(null);
+  // prev_cursor of the oldest page loaded; null once history is exhausted
+  const olderCursor = useRef<string | null>(null);
+  const loadingOlder = useRef(false);
   const [currentUser, setCurrentUser] = useState<string | null>(() => {
     try {
       if (typeof window === 'undefined') return null;
@@ -58,6 +88,26 @@ export default function Home() {
 
   const router = useRouter();
 
+  // page back through history when the list is scrolled to the top
+  const loadOlder = async () => {
+    if (!olderCursor.current || loadingOlder.current) return;
+    loadingOlder.current = true;
+    try {
+      const res = await axios.get(apiBase + '/api/messages?limit=100&before=' + encodeURIComponent(olderCursor.current), { headers: await historyHeaders() });
+      if (res.data && Array.isArray(res.data.messages)) {
+        olderCursor.current = res.data.prev_cursor || null;
+        const older = mapHistory(res.data.messages);
+        setMessages((prev) => {
+          const seen = new Set(prev.map((m) => m.id));
+          return [...older.filter((m) => !seen.has(m.id)), ...prev];
+        });
+      }
+    } catch (e) {
+    } finally {
+      loadingOlder.current = false;
+    }
+  };
+
   useEffect(() => {
     setIsHydrated(true);
   }, []);
@@ -121,19 +171,10 @@ export default function Home() {
     // fetch recent messages history
     (async () => {
       try {
-        const res = await axios.get((process.env.NEXT_PUBLIC_API_URL || 'http://localhost:8080') + '/api/messages?limit=100');
-        if (res.data && Array.isArray(res.data)) {
-          const mapped = (res.data as any[]).map((m) => ({
-            id: String(m.id),
-            author: (m.author && (m.author.display_name || m.author.email)) || (m.author && String(m.author)) || 'anon',
-            authorEmail: m.author && m.author.email ? m.author.email : null,
-            text: m.text || '',
-            ts: m.ts || Date.now(),
-            to: m.to || m.recipient || null,
-            reactions: m.reactions || {},
-            images: m.images || [],
-          }));
-          setMessages(mapped as unknown as Message[]);
+        const res = await axios.get(apiBase + '/api/messages?limit=100', { headers: await historyHeaders() });
+        if (res.data && Array.isArray(res.data.messages)) {
+          olderCursor.current = res.data.prev_cursor || null;
+          setMessages(mapHistory(res.data.messages));
         }
       } catch (e) {}
     })();
@@ -208,6 +249,15 @@ export default function Home() {
               }));
               break;
             }
+            case 'ephemeral': {
+              // slash command output, only shown to this tab
+              setMessages((prev) => [...prev, { id: nanoid(), author: data.command || 'Turbo', authorEmail: null, text: data.text || '', ts: Date.now(), to: null, reactions: {} }]);
+              break;
+            }
+            case 'message_deleted': {
+              setMessages((prev) => prev.filter((m) => m.id !== data.id));
+              break;
+            }
             case 'typing': {
               const who = data.author;
               setTypingUsers((prev) => Array.from(new Set([...prev, who])));
@@ -327,6 +377,7 @@ export default function Home() {
                   (m.to === currentUser && (m.authorEmail === selectedFriend || m.author === selectedFriend))
               ) as any}
               currentUser={currentUser}
+              onReachTop={loadOlder}
             />
           ) : (
             <div className="turbo-messages-empty">Select a friend to begin a direct conversation</div>